@@ -0,0 +1,80 @@
+//go:build otel
+
+// Package otel traces gobits handlers with OpenTelemetry. It depends on go.opentelemetry.io/otel,
+// and is only built with the otel tag so gobits itself doesn't.
+package otel
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"gitlab.com/magan/gobits"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracer is a gobits.Tracer starting OpenTelemetry spans
+type Tracer struct {
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+// New creates a Tracer with the tracer provider, continuing the traces of requests found by the
+// propagator, e.g. otel.GetTracerProvider() and otel.GetTextMapPropagator()
+func New(tp trace.TracerProvider, propagator propagation.TextMapPropagator) *Tracer {
+	return &Tracer{tracer: tp.Tracer("gitlab.com/magan/gobits"), propagator: propagator}
+}
+
+// Extract implements gobits.Tracer
+func (t *Tracer) Extract(ctx context.Context, header http.Header) context.Context {
+	return t.propagator.Extract(ctx, propagation.HeaderCarrier(header))
+}
+
+// StartSpan implements gobits.Tracer
+func (t *Tracer) StartSpan(ctx context.Context, name string, attrs ...gobits.Attribute) (context.Context, gobits.Span) {
+	ctx, s := t.tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(convert(attrs)...))
+	return ctx, span{s}
+}
+
+// span is a gobits.Span of an OpenTelemetry span
+type span struct {
+	trace.Span
+}
+
+func (s span) SetAttributes(attrs ...gobits.Attribute) {
+	s.Span.SetAttributes(convert(attrs)...)
+}
+
+func (s span) SetError(err error) {
+	s.RecordError(err)
+	s.SetStatus(codes.Error, err.Error())
+}
+
+func (s span) End() {
+	s.Span.End()
+}
+
+// convert attributes to OpenTelemetry attributes
+func convert(attrs []gobits.Attribute) []attribute.KeyValue {
+	kvs := make([]attribute.KeyValue, 0, len(attrs))
+	for _, a := range attrs {
+		switch v := a.Value.(type) {
+		case string:
+			kvs = append(kvs, attribute.String(a.Key, v))
+		case int:
+			kvs = append(kvs, attribute.Int(a.Key, v))
+		case int64:
+			kvs = append(kvs, attribute.Int64(a.Key, v))
+		case uint64:
+			kvs = append(kvs, attribute.Int64(a.Key, int64(v)))
+		case bool:
+			kvs = append(kvs, attribute.Bool(a.Key, v))
+		default:
+			kvs = append(kvs, attribute.String(a.Key, fmt.Sprint(v)))
+		}
+	}
+	return kvs
+}
@@ -0,0 +1,53 @@
+//go:build otel
+
+package otel
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"gitlab.com/magan/gobits"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracer(t *testing.T) {
+
+	recorder := tracetest.NewSpanRecorder()
+	tracer := New(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)), propagation.TraceContext{})
+
+	header := http.Header{}
+	header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx := tracer.Extract(context.Background(), header)
+	_, span := tracer.StartSpan(ctx, "gobits.fragment", gobits.Attribute{Key: gobits.AttributeFilename, Value: "file.txt"})
+	span.SetAttributes(gobits.Attribute{Key: gobits.AttributeBytesWritten, Value: 4})
+	span.SetError(errors.New("failed"))
+	span.End()
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("expected 1 span, got %v", len(spans))
+	}
+	s := spans[0]
+	if s.Name() != "gobits.fragment" || s.Parent().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("unexpected span %v with parent %v", s.Name(), s.Parent().TraceID())
+	}
+	expected := map[attribute.Key]attribute.Value{
+		gobits.AttributeFilename:     attribute.StringValue("file.txt"),
+		gobits.AttributeBytesWritten: attribute.IntValue(4),
+	}
+	for _, kv := range s.Attributes() {
+		if expected[kv.Key] != kv.Value {
+			t.Errorf("unexpected attribute %v=%v", kv.Key, kv.Value.Emit())
+		}
+	}
+	if s.Status().Code != codes.Error {
+		t.Errorf("expected the span to fail, got %v", s.Status())
+	}
+
+}
@@ -0,0 +1,103 @@
+//go:build prometheus
+
+// Package prometheus exports the metrics of gobits handlers with the Prometheus client library.
+// It depends on github.com/prometheus/client_golang, and is only built with the prometheus tag
+// so gobits itself doesn't.
+package prometheus
+
+import (
+	"time"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+	"gitlab.com/magan/gobits"
+)
+
+// Collector is a gobits.MetricsCollector keeping the metrics in Prometheus collectors
+type Collector struct {
+	sessions       *prom.CounterVec
+	fragments      *prom.CounterVec
+	receivedBytes  prom.Counter
+	filesCompleted prom.Counter
+	activeSessions prom.Gauge
+	fragmentTime   prom.Histogram
+	webhooksLost   prom.Counter
+}
+
+// New creates a Collector and registers its collectors with reg. The constant labels are added
+// to every metric, e.g. to tell handlers in the same process apart
+func New(reg prom.Registerer, labels prom.Labels) (*Collector, error) {
+	c := &Collector{
+		sessions: prom.NewCounterVec(prom.CounterOpts{
+			Name:        gobits.MetricSessions,
+			Help:        "Sessions created, closed, canceled or expired.",
+			ConstLabels: labels,
+		}, []string{"event"}),
+		fragments: prom.NewCounterVec(prom.CounterOpts{
+			Name:        gobits.MetricFragments,
+			Help:        "Fragments accepted, or rejected by reason.",
+			ConstLabels: labels,
+		}, []string{"result"}),
+		receivedBytes: prom.NewCounter(prom.CounterOpts{
+			Name:        gobits.MetricReceivedBytes,
+			Help:        "Bytes received, not counting fragments sent again.",
+			ConstLabels: labels,
+		}),
+		filesCompleted: prom.NewCounter(prom.CounterOpts{
+			Name:        gobits.MetricFilesCompleted,
+			Help:        "Files received completely.",
+			ConstLabels: labels,
+		}),
+		activeSessions: prom.NewGauge(prom.GaugeOpts{
+			Name:        gobits.MetricActiveSessions,
+			Help:        "Sessions created since the handler started that are still active.",
+			ConstLabels: labels,
+		}),
+		fragmentTime: prom.NewHistogram(prom.HistogramOpts{
+			Name:        gobits.MetricFragmentDuration,
+			Help:        "Time to read and write accepted fragments.",
+			ConstLabels: labels,
+			Buckets:     prom.DefBuckets,
+		}),
+		webhooksLost: prom.NewCounter(prom.CounterOpts{
+			Name:        gobits.MetricWebhooksDropped,
+			Help:        "Events that couldn't be delivered to the webhook.",
+			ConstLabels: labels,
+		}),
+	}
+	for _, collector := range []prom.Collector{c.sessions, c.fragments, c.receivedBytes, c.filesCompleted, c.activeSessions, c.fragmentTime, c.webhooksLost} {
+		if err := reg.Register(collector); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// IncCounter implements gobits.MetricsCollector
+func (c *Collector) IncCounter(name string, labels map[string]string, delta float64) {
+	switch name {
+	case gobits.MetricSessions:
+		c.sessions.WithLabelValues(labels["event"]).Add(delta)
+	case gobits.MetricFragments:
+		c.fragments.WithLabelValues(labels["result"]).Add(delta)
+	case gobits.MetricReceivedBytes:
+		c.receivedBytes.Add(delta)
+	case gobits.MetricFilesCompleted:
+		c.filesCompleted.Add(delta)
+	case gobits.MetricWebhooksDropped:
+		c.webhooksLost.Add(delta)
+	}
+}
+
+// SetGauge implements gobits.MetricsCollector
+func (c *Collector) SetGauge(name string, value float64) {
+	if name == gobits.MetricActiveSessions {
+		c.activeSessions.Set(value)
+	}
+}
+
+// ObserveDuration implements gobits.MetricsCollector
+func (c *Collector) ObserveDuration(name string, d time.Duration) {
+	if name == gobits.MetricFragmentDuration {
+		c.fragmentTime.Observe(d.Seconds())
+	}
+}
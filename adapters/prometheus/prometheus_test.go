@@ -0,0 +1,46 @@
+//go:build prometheus
+
+package prometheus
+
+import (
+	"testing"
+	"time"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gitlab.com/magan/gobits"
+)
+
+func TestCollector(t *testing.T) {
+
+	reg := prom.NewRegistry()
+	c, err := New(reg, prom.Labels{"handler": "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.IncCounter(gobits.MetricSessions, map[string]string{"event": "created"}, 1)
+	c.IncCounter(gobits.MetricFragments, map[string]string{"result": gobits.FragmentRejected}, 2)
+	c.IncCounter(gobits.MetricReceivedBytes, nil, 10)
+	c.SetGauge(gobits.MetricActiveSessions, 1)
+	c.ObserveDuration(gobits.MetricFragmentDuration, time.Millisecond)
+
+	if v := testutil.ToFloat64(c.sessions.WithLabelValues("created")); v != 1 {
+		t.Errorf("expected 1 created session, got %v", v)
+	}
+	if v := testutil.ToFloat64(c.fragments.WithLabelValues(gobits.FragmentRejected)); v != 2 {
+		t.Errorf("expected 2 rejected fragments, got %v", v)
+	}
+	if v := testutil.ToFloat64(c.receivedBytes); v != 10 {
+		t.Errorf("expected 10 bytes received, got %v", v)
+	}
+	if v := testutil.ToFloat64(c.activeSessions); v != 1 {
+		t.Errorf("expected 1 active session, got %v", v)
+	}
+
+	// collectors can't be registered twice
+	if _, err := New(reg, prom.Labels{"handler": "test"}); err == nil {
+		t.Error("expected registering the collectors again to fail")
+	}
+
+}
@@ -0,0 +1,143 @@
+package gobits
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+)
+
+// auditBufferSize is the number of audit records that can be queued before new ones are dropped
+const auditBufferSize = 1024
+
+// auditRecord is a single line in the audit log
+type auditRecord struct {
+	Time        time.Time   `json:"time"`
+	Event       string      `json:"event"`
+	Session     string      `json:"session"`
+	Filename    string      `json:"filename,omitempty"`
+	Bytes       uint64      `json:"bytes"`
+	ContentType string      `json:"content_type,omitempty"`
+	Hash        string      `json:"hash,omitempty"`
+	Remote      string      `json:"remote,omitempty"`
+	UserAgent   string      `json:"user_agent,omitempty"`
+	Principal   string      `json:"principal,omitempty"`
+	ClientCert  *ClientCert `json:"client_cert,omitempty"`
+	Reason      string      `json:"reason,omitempty"`
+
+	Incomplete []string `json:"incomplete,omitempty"`
+}
+
+// write queued audit records, one JSON object per line. Failed writes are counted, the upload
+// has already succeeded
+func (b *Handler) writeAudit(w io.Writer, records <-chan []byte) {
+	defer b.workers.Done()
+	for record := range records {
+		if _, err := w.Write(record); err != nil {
+			b.auditErrors.Add(1)
+		}
+	}
+}
+
+// eventInfo is what is known about an event besides its type and session
+type eventInfo struct {
+	path        string   // the path passed to the callback
+	filename    string   // a received file relative to the session directory
+	bytes       uint64   // the size of a received file, or the bytes received in a closed session
+	contentType string   // the MIME type of a received file
+	hash        string   // the hex digest of a received file
+	reason      error    // why a file is rejected
+	incomplete  []string // files that weren't completed when the session was closed
+}
+
+// send an event to the callback, the audit log and the webhook. r is nil if the event isn't caused by a request
+func (b *Handler) event(r *http.Request, event Event, uuid string, info eventInfo) {
+	origin := b.sessionOrigin(event, uuid)
+	b.countEvent(event, uuid, r == nil)
+	b.countTenant(event, uuid)
+	b.logEvent(r, event, uuid, info)
+	if b.callback != nil {
+		b.callback(event, uuid, info.path)
+	}
+	if b.cfg.SessionCallback != nil {
+		var files []FileStatus
+		if event != EventCreateSession {
+			// a new session has no files yet
+			files = b.sessionFiles(uuid)
+		}
+		b.cfg.SessionCallback(event, Session{
+			ID:          uuid,
+			Path:        info.path,
+			Filename:    info.filename,
+			Bytes:       info.bytes,
+			ContentType: info.contentType,
+			Hash:        info.hash,
+			Reason:      info.reason,
+			Incomplete:  info.incomplete,
+			Principal:   origin.principal,
+			Headers:     origin.headers,
+			ClientCert:  origin.cert,
+			Files:       files,
+			Request:     r,
+		})
+	}
+	if b.audit == nil && b.webhooks == nil {
+		return
+	}
+
+	// the queues are closed with the handler
+	b.queueMu.RLock()
+	defer b.queueMu.RUnlock()
+	select {
+	case <-b.closed:
+		return
+	default:
+	}
+
+	record := auditRecord{
+		Time:       time.Now().UTC(),
+		Event:      event.String(),
+		Session:    uuid,
+		Bytes:      info.bytes,
+		Principal:  origin.principal,
+		ClientCert: origin.cert,
+		Incomplete: info.incomplete,
+	}
+	switch event {
+	case EventRecieveFile:
+		record.Filename = info.filename
+		record.ContentType = info.contentType
+		record.Hash = info.hash
+	case EventRejectFile:
+		record.Filename = info.path
+	}
+	if info.reason != nil {
+		record.Reason = info.reason.Error()
+	}
+	if event == EventCancelSession && r == nil {
+		// terminated by the server
+		record.Event = "expire-session"
+	}
+	if r != nil {
+		record.Remote = b.cfg.ClientIP(r)
+		record.UserAgent = r.UserAgent()
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	if b.webhooks != nil {
+		b.notify(record, line)
+	}
+	if b.audit == nil {
+		return
+	}
+
+	// Never hold up the request, drop the record if the writer can't keep up
+	select {
+	case b.audit <- append(line, '\n'):
+	default:
+		b.auditDropped.Add(1)
+	}
+}
@@ -0,0 +1,155 @@
+package gobits
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer that is safe for concurrent use
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.Write(p)
+}
+
+func (s *syncBuffer) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.String()
+}
+
+func TestAuditWriter(t *testing.T) {
+
+	audit := &syncBuffer{}
+	h := newTestHandler(t, Config{AuditWriter: audit}, nil)
+	uuid := createSession(t, h)
+
+	for _, f := range []struct {
+		data  string
+		start uint64
+	}{{"01234", 0}, {"56789", 5}} {
+		res := sendFragment(h, uuid, "file.txt", []byte(f.data), f.start, 10)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("fragment %v failed: %v", f.start, res.Status)
+		}
+	}
+	res := doPacket(h, "Close-Session", uuid, "/BITS/", nil, nil)
+	res.Body.Close()
+
+	// the records are written in the background
+	deadline := time.Now().Add(time.Second)
+	for strings.Count(audit.String(), "\n") < 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	var records []auditRecord
+	scanner := bufio.NewScanner(strings.NewReader(audit.String()))
+	for scanner.Scan() {
+		var record auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("invalid audit record %q: %v", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+
+	expected := []auditRecord{
+		{Event: "create-session", Session: uuid, Remote: "192.0.2.1"},
+		{Event: "receive-file", Session: uuid, Filename: "file.txt", Bytes: 10, ContentType: "text/plain; charset=utf-8", Remote: "192.0.2.1"},
+		{Event: "close-session", Session: uuid, Bytes: 10, Remote: "192.0.2.1"},
+	}
+	if len(records) != len(expected) {
+		t.Fatalf("expected %v audit records, got %v: %v", len(expected), len(records), audit.String())
+	}
+	for i, e := range expected {
+		record := records[i]
+		if record.Time.IsZero() {
+			t.Errorf("record %v has no time", i)
+		}
+		record.Time = time.Time{}
+		if !reflect.DeepEqual(record, e) {
+			t.Errorf("invalid record %v: %+v, expected %+v", i, record, e)
+		}
+	}
+
+}
+
+// failingWriter fails every write
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestAuditSchema(t *testing.T) {
+
+	audit := &syncBuffer{}
+	h := newTestHandler(t, Config{AuditWriter: audit, Disallowed: []string{`.*\.exe`}}, nil)
+	res := doPacket(h, "Create-Session", "", "/BITS/", map[string]string{
+		"BITS-Supported-Protocols": h.cfg.Protocol,
+		"User-Agent":               "Microsoft BITS/7.8",
+	}, nil)
+	res.Body.Close()
+	uuid := res.Header.Get("BITS-Session-Id")
+	res = sendFragment(h, uuid, "virus.exe", []byte("MZ"), 0, 2)
+	res.Body.Close()
+	if err := h.TerminateSession(uuid); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for strings.Count(audit.String(), "\n") < 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	// every line is an object with the documented fields
+	var records []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(audit.String()), "\n") {
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("invalid audit record %q: %v", line, err)
+		}
+		if _, err := time.Parse(time.RFC3339, record["time"].(string)); err != nil {
+			t.Errorf("invalid time in %q: %v", line, err)
+		}
+		delete(record, "time")
+		records = append(records, record)
+	}
+	expected := []map[string]interface{}{
+		{"event": "create-session", "session": uuid, "bytes": 0.0, "remote": "192.0.2.1", "user_agent": "Microsoft BITS/7.8"},
+		{"event": "reject-file", "session": uuid, "filename": "virus.exe", "bytes": 0.0, "remote": "192.0.2.1", "reason": ErrFileDisallowed.Error()},
+		{"event": "expire-session", "session": uuid, "bytes": 0.0},
+	}
+	if !reflect.DeepEqual(records, expected) {
+		t.Errorf("unexpected records:\n%v\nexpected:\n%v", records, expected)
+	}
+
+	// a failing writer doesn't fail the upload, the failures are counted
+	h = newTestHandler(t, Config{AuditWriter: failingWriter{}}, nil)
+	uuid = createSession(t, h)
+	res = sendFragment(h, uuid, "file.txt", []byte("data"), 0, 4)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("fragment failed: %v", res.Status)
+	}
+	for h.Stats().AuditErrors < 2 && time.Now().Before(deadline.Add(time.Second)) {
+		time.Sleep(time.Millisecond)
+	}
+	if stats := h.Stats(); stats.AuditErrors != 2 || stats.AuditDropped != 0 {
+		t.Errorf("expected 2 failed writes, got %+v", stats)
+	}
+
+}
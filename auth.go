@@ -0,0 +1,60 @@
+package gobits
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// AuthenticatorFunc authenticates the client sending a request, and returns who it is. The
+// principal is kept with the session it creates, and passed to the events of the session.
+// Return an *AuthError to challenge the client
+type AuthenticatorFunc func(r *http.Request) (principal string, err error)
+
+// AuthError is returned by an AuthenticatorFunc to refuse a request with challenges. Any other
+// error refuses it without a challenge
+type AuthError struct {
+	Challenges []string // values of the WWW-Authenticate headers, like `Basic realm="uploads"`
+	Reason     string   // why the request is refused, for the log
+}
+
+func (e *AuthError) Error() string {
+	if e.Reason == "" {
+		return "unauthorized"
+	}
+	return e.Reason
+}
+
+// principalKey is the context key of the principal of an authenticated request
+type principalKey struct{}
+
+// authenticate the request if the packet needs it. Returns false if the request is refused,
+// with a 401 and the challenges of the authenticator
+func (b *Handler) authenticate(w http.ResponseWriter, r *http.Request, packetType, sessionID string) (*http.Request, bool) {
+	if b.cfg.Authenticator == nil {
+		return r, true
+	}
+	if packetType != "ping" && packetType != "create-session" && !b.cfg.AuthenticateAll && !b.cfg.BindSessions {
+		return r, true
+	}
+
+	principal, err := b.cfg.Authenticator(r)
+	if err != nil {
+		var authErr *AuthError
+		if errors.As(err, &authErr) {
+			for _, challenge := range authErr.Challenges {
+				w.Header().Add("WWW-Authenticate", challenge)
+			}
+		}
+		refusedBecause(r, err)
+		bitsError(w, sessionID, http.StatusUnauthorized, codeAccessDenied, ErrorContextRemoteFile)
+		return r, false
+	}
+	return r.WithContext(context.WithValue(r.Context(), principalKey{}, principal)), true
+}
+
+// the principal of an authenticated request, empty if it isn't authenticated
+func requestPrincipal(r *http.Request) string {
+	principal, _ := r.Context().Value(principalKey{}).(string)
+	return principal
+}
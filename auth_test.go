@@ -0,0 +1,109 @@
+package gobits
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+)
+
+// authenticate clients with basic auth, alice is the only user
+func basicAuthenticator(r *http.Request) (string, error) {
+	user, password, ok := r.BasicAuth()
+	if !ok || user != "alice" || password != "secret" {
+		return "", &AuthError{Challenges: []string{`Basic realm="uploads"`}, Reason: "bad credentials"}
+	}
+	return user, nil
+}
+
+func TestAuthenticator(t *testing.T) {
+
+	var mu sync.Mutex
+	principals := make(map[Event]string)
+	cfg := Config{
+		StrictClose:   true,
+		Authenticator: basicAuthenticator,
+		SessionCallback: func(event Event, s Session) {
+			mu.Lock()
+			defer mu.Unlock()
+			principals[event] = s.Principal
+		},
+	}
+	h := newTestHandler(t, cfg, nil)
+
+	// unauthenticated clients are challenged
+	for _, packetType := range []string{"Ping", "Create-Session"} {
+		res := doPacket(h, packetType, "", "/BITS/", map[string]string{"BITS-Supported-Protocols": h.cfg.Protocol}, nil)
+		res.Body.Close()
+		if res.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("%v: expected status %v, got %v", packetType, http.StatusUnauthorized, res.StatusCode)
+		}
+		if got := res.Header.Get("WWW-Authenticate"); got != `Basic realm="uploads"` {
+			t.Errorf("%v: unexpected challenge %q", packetType, got)
+		}
+		if got := res.Header.Get("BITS-Error-Code"); got != "80070005" {
+			t.Errorf("%v: unexpected error code %q", packetType, got)
+		}
+	}
+
+	// the challenge is answered
+	res := doPacket(h, "Create-Session", "", "/BITS/", map[string]string{
+		"BITS-Supported-Protocols": h.cfg.Protocol,
+		"Authorization":            "Basic YWxpY2U6c2VjcmV0", // alice:secret
+	}, nil)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("failed to create session: %v", res.Status)
+	}
+	uuid := res.Header.Get("BITS-Session-Id")
+
+	// fragments aren't authenticated, but are attributed to whoever created the session
+	res = sendFragment(h, uuid, "file.txt", []byte("data"), 0, 4)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("failed to send fragment: %v", res.Status)
+	}
+
+	// the principal is kept with the session
+	h = restartHandler(t, h, nil)
+	res = doPacket(h, "Close-Session", uuid, "/BITS/", nil, nil)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("failed to close session: %v", res.Status)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, event := range []Event{EventCreateSession, EventRecieveFile, EventCloseSession} {
+		if principals[event] != "alice" {
+			t.Errorf("%v: expected principal alice, got %q", event, principals[event])
+		}
+	}
+}
+
+func TestAuthenticateAll(t *testing.T) {
+
+	authorization := map[string]string{
+		"BITS-Supported-Protocols": ProtocolUpload15,
+		"Authorization":            "Basic YWxpY2U6c2VjcmV0",
+	}
+	h := newTestHandler(t, Config{Authenticator: basicAuthenticator, AuthenticateAll: true}, nil)
+
+	res := doPacket(h, "Create-Session", "", "/BITS/", authorization, nil)
+	res.Body.Close()
+	uuid := res.Header.Get("BITS-Session-Id")
+
+	res = sendFragment(h, uuid, "file.txt", []byte("data"), 0, 4)
+	res.Body.Close()
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected status %v, got %v", http.StatusUnauthorized, res.StatusCode)
+	}
+	if got := res.Header.Get("BITS-Session-Id"); got != uuid {
+		t.Errorf("expected session %v, got %q", uuid, got)
+	}
+
+	res = doPacket(h, "Cancel-Session", uuid, "/BITS/", authorization, nil)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("failed to cancel session: %v", res.Status)
+	}
+}
@@ -0,0 +1,39 @@
+package gobits
+
+import (
+	"errors"
+	"net/http"
+)
+
+// authorize a fragment with the BeforeFragment hook, before its body is read. A refused
+// fragment gets a 403 with the code of the RejectError, or access denied
+func (b *Handler) authorizeFragment(w http.ResponseWriter, r *http.Request, sessionID, uuid, filename, src string, rangeStart, rangeEnd, total uint64) bool {
+	if b.cfg.BeforeFragment == nil {
+		return true
+	}
+
+	// the origin is only forgotten when the session is closed or canceled
+	origin := b.sessionOrigin(EventRecieveFile, uuid)
+	err := b.cfg.BeforeFragment(Session{
+		ID:         uuid,
+		Path:       src,
+		Filename:   filename,
+		Principal:  origin.principal,
+		Headers:    origin.headers,
+		ClientCert: origin.cert,
+		Files:      b.sessionFiles(uuid),
+		Request:    r,
+	}, rangeStart, rangeEnd, total)
+	if err == nil {
+		return true
+	}
+
+	code := codeAccessDenied
+	var rejectErr *RejectError
+	if errors.As(err, &rejectErr) {
+		code = rejectErr.Code
+	}
+	refusedBecause(r, err)
+	bitsError(w, sessionID, http.StatusForbidden, code, ErrorContextRemoteApplication)
+	return false
+}
@@ -0,0 +1,106 @@
+package gobits
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestBeforeFragment(t *testing.T) {
+
+	// a budget of 10 bytes per principal, counted when the fragments are authorized
+	errBudget := errors.New("budget exceeded")
+	var mu sync.Mutex
+	spent := make(map[string]uint64)
+	var ranges [][3]uint64
+	cfg := Config{
+		Authenticator: func(r *http.Request) (string, error) {
+			return r.Header.Get("X-User"), nil
+		},
+		BeforeFragment: func(s Session, rangeStart, rangeEnd, total uint64) error {
+			mu.Lock()
+			defer mu.Unlock()
+			ranges = append(ranges, [3]uint64{rangeStart, rangeEnd, total})
+			size := rangeEnd - rangeStart + 1
+			if spent[s.Principal]+size > 10 {
+				return errBudget
+			}
+			spent[s.Principal] += size
+			return nil
+		},
+	}
+	h := newTestHandler(t, cfg, nil)
+	res := doPacket(h, "Create-Session", "", "/BITS/", map[string]string{
+		"BITS-Supported-Protocols": h.cfg.Protocol,
+		"X-User":                   "alice",
+	}, nil)
+	res.Body.Close()
+	uuid := res.Header.Get("BITS-Session-Id")
+
+	content := []byte("0123456789ab")
+	for _, start := range []uint64{0, 4} {
+		res = sendFragment(h, uuid, "file.txt", content[start:start+4], start, 12)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("failed to send fragment at %v: %v", start, res.Status)
+		}
+	}
+
+	// the fragment over the budget is refused before it is written
+	res = sendFragment(h, uuid, "file.txt", content[8:], 8, 12)
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected status %v, got %v", http.StatusForbidden, res.Status)
+	}
+	if code, context := res.Header.Get("BITS-Error-Code"), res.Header.Get("BITS-Error-Context"); code != "80070005" || context != "7" {
+		t.Errorf("unexpected error code %v in context %v", code, context)
+	}
+	data, err := os.ReadFile(filepath.Join(h.cfg.TempDir, uuid, "file.txt"+h.cfg.PartSuffix))
+	if err != nil || string(data) != "01234567" {
+		t.Errorf("expected only the authorized fragments to be written, got %q, %v", data, err)
+	}
+
+	// the file isn't rejected, a larger budget lets the client send the fragment again
+	mu.Lock()
+	spent["alice"] = 0
+	mu.Unlock()
+	res = sendFragment(h, uuid, "file.txt", content[8:], 8, 12)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || res.Header.Get("BITS-Received-Content-Range") != "12" {
+		t.Errorf("expected the fragment to be received, got %v", res.Status)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := [][3]uint64{{0, 3, 12}, {4, 7, 12}, {8, 11, 12}, {8, 11, 12}}
+	if len(ranges) != len(want) {
+		t.Fatalf("expected ranges %v, got %v", want, ranges)
+	}
+	for i := range want {
+		if ranges[i] != want[i] {
+			t.Errorf("expected ranges %v, got %v", want, ranges)
+		}
+	}
+}
+
+func TestBeforeFragmentRejectError(t *testing.T) {
+
+	h := newTestHandler(t, Config{
+		BeforeFragment: func(s Session, rangeStart, rangeEnd, total uint64) error {
+			if s.Filename != "file.txt" || s.ID == "" || s.Request == nil {
+				t.Errorf("unexpected session %+v", s)
+			}
+			return &RejectError{Code: codeInvalidData, Reason: "scanner unavailable"}
+		},
+	}, nil)
+	uuid := createSession(t, h)
+
+	res := sendFragment(h, uuid, "file.txt", []byte("data"), 0, 4)
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden || res.Header.Get("BITS-Error-Code") != "8007000d" {
+		t.Errorf("unexpected reply %v, code %v", res.Status, res.Header.Get("BITS-Error-Code"))
+	}
+}
@@ -0,0 +1,42 @@
+package gobits
+
+import (
+	"errors"
+	"net/http"
+)
+
+// errSessionBound is why a packet sent to a session by another client is refused
+var errSessionBound = errors.New("session belongs to another client")
+
+// check that a packet of a session comes from the client that created it, with BindSessions.
+// Sessions created by an authenticated client are bound to the principal, the others to the
+// address of the client unless BindIgnoreAddress is set. Returns false if the packet is refused
+// with a 403. Unknown sessions are left to the packet handlers
+func (b *Handler) checkBinding(w http.ResponseWriter, r *http.Request, sessionID string) bool {
+	if !b.cfg.BindSessions {
+		return true
+	}
+	uuid, ok := b.verifySessionID(sessionID)
+	if !ok {
+		return true
+	}
+	if _, err := b.cfg.SessionStore.Get(uuid); err != nil {
+		return true
+	}
+
+	s := b.lockSession(uuid)
+	o := s.origin
+	s.mu.Unlock()
+
+	switch {
+	case o.principal != "":
+		ok = requestPrincipal(r) == o.principal
+	case o.remote != "" && !b.cfg.BindIgnoreAddress:
+		ok = b.cfg.ClientIP(r) == o.remote
+	}
+	if !ok {
+		refusedBecause(r, errSessionBound)
+		bitsError(w, sessionID, http.StatusForbidden, codeInvalidOwner, ErrorContextRemoteFile)
+	}
+	return ok
+}
@@ -0,0 +1,141 @@
+package gobits
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// send a BITS packet to the handler from a client at the given address
+func doPacketFrom(h *Handler, remoteAddr, packetType, uuid, target string, headers map[string]string, body []byte) *http.Response {
+	r := httptest.NewRequest(h.cfg.AllowedMethod, target, bytes.NewReader(body))
+	r.RemoteAddr = remoteAddr
+	r.Header.Set("BITS-Packet-Type", packetType)
+	if uuid != "" {
+		r.Header.Set("BITS-Session-Id", uuid)
+	}
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	return rec.Result()
+}
+
+func TestBindSessions(t *testing.T) {
+
+	const owner, intruder = "192.0.2.1:1234", "198.51.100.7:4321"
+	h := newTestHandler(t, Config{BindSessions: true}, nil)
+
+	res := doPacketFrom(h, owner, "Create-Session", "", "/BITS/", map[string]string{"BITS-Supported-Protocols": h.cfg.Protocol}, nil)
+	res.Body.Close()
+	uuid := res.Header.Get("BITS-Session-Id")
+
+	// both clients send fragments of their own files at the same time
+	const fragments = 20
+	var wg sync.WaitGroup
+	statuses := make(map[string][]int)
+	var mu sync.Mutex
+	for _, client := range []string{owner, intruder} {
+		wg.Add(1)
+		go func(client string) {
+			defer wg.Done()
+			filename := "file" + client[:3] + ".txt"
+			for i := uint64(0); i < fragments; i++ {
+				res := doPacketFrom(h, client, "Fragment", uuid, "/BITS/"+filename, map[string]string{
+					"Content-Range":  fmt.Sprintf("bytes %d-%d/%d", i, i, fragments),
+					"Content-Length": strconv.Itoa(1),
+				}, []byte{'x'})
+				res.Body.Close()
+				mu.Lock()
+				statuses[client] = append(statuses[client], res.StatusCode)
+				mu.Unlock()
+				if res.StatusCode == http.StatusForbidden && res.Header.Get("BITS-Error-Code") != "8007051b" {
+					t.Errorf("unexpected error code %q", res.Header.Get("BITS-Error-Code"))
+				}
+			}
+		}(client)
+	}
+	wg.Wait()
+
+	for client, expected := range map[string]int{owner: http.StatusOK, intruder: http.StatusForbidden} {
+		for i, status := range statuses[client] {
+			if status != expected {
+				t.Errorf("%v: fragment %v: expected status %v, got %v", client, i, expected, status)
+			}
+		}
+	}
+
+	// the intruder can't end the session either
+	for _, packetType := range []string{"Close-Session", "Cancel-Session"} {
+		res = doPacketFrom(h, intruder, packetType, uuid, "/BITS/", nil, nil)
+		res.Body.Close()
+		if res.StatusCode != http.StatusForbidden {
+			t.Errorf("%v: expected status %v, got %v", packetType, http.StatusForbidden, res.StatusCode)
+		}
+	}
+	res = doPacketFrom(h, owner, "Close-Session", uuid, "/BITS/", nil, nil)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("failed to close session: %v", res.Status)
+	}
+}
+
+func TestBindSessionsPrincipal(t *testing.T) {
+
+	const home, roaming = "192.0.2.1:1234", "198.51.100.7:4321"
+	cfg := Config{
+		BindSessions:      true,
+		BindIgnoreAddress: true,
+		Authenticator: func(r *http.Request) (string, error) {
+			return r.Header.Get("X-User"), nil
+		},
+	}
+	h := newTestHandler(t, cfg, nil)
+
+	res := doPacketFrom(h, home, "Create-Session", "", "/BITS/", map[string]string{
+		"BITS-Supported-Protocols": h.cfg.Protocol,
+		"X-User":                   "alice",
+	}, nil)
+	res.Body.Close()
+	uuid := res.Header.Get("BITS-Session-Id")
+
+	testcases := []struct {
+		name       string
+		remoteAddr string
+		user       string
+		status     int
+	}{
+		{"same principal", home, "alice", http.StatusOK},
+		{"new address", roaming, "alice", http.StatusOK},
+		{"other principal", home, "mallory", http.StatusForbidden},
+	}
+	for i, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			res := doPacketFrom(h, tc.remoteAddr, "Fragment", uuid, "/BITS/file.txt", map[string]string{
+				"Content-Range":  fmt.Sprintf("bytes %d-%d/10", i, i),
+				"Content-Length": "1",
+				"X-User":         tc.user,
+			}, []byte{'x'})
+			res.Body.Close()
+			if res.StatusCode != tc.status {
+				t.Errorf("expected status %v, got %v", tc.status, res.StatusCode)
+			}
+		})
+	}
+
+	// without a principal, sessions aren't bound to addresses
+	res = doPacketFrom(h, home, "Create-Session", "", "/BITS/", map[string]string{"BITS-Supported-Protocols": h.cfg.Protocol}, nil)
+	res.Body.Close()
+	uuid = res.Header.Get("BITS-Session-Id")
+	res = doPacketFrom(h, roaming, "Cancel-Session", uuid, "/BITS/", nil, nil)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("failed to cancel session: %v", res.Status)
+	}
+}
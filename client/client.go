@@ -0,0 +1,452 @@
+// Package client uploads files to BITS servers, like gobits or IIS, with the BITS 1.5 upload
+// protocol.
+//
+// A session is created at the URL of a file, the file is sent in fragments with their range
+// of the file, and the session is closed to have the server finish it:
+//
+//	c := &client.Client{FragmentSize: 4 << 20}
+//	result, err := c.Upload(ctx, "https://example.com/BITS/file.zip", f, size)
+//
+// Error replies of the server are returned as an *Error, with the BITS error code. A file that
+// failed, e.g. when the connection was lost, is sent again from where the server is with
+// Session.ResumeFile. Requests that fail with a network error or a server error are retried
+// with Client.Retry.
+//
+// Client.MaxBytesPerSecond limits the bandwidth used, like BITS keeping to the idle bandwidth,
+// Client.FragmentTuning adapts the fragment size to the network and Client.Progress reports
+// the progress of the files.
+//
+// The package doesn't depend on gobits, so the tests of gobits can use it.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProtocolUpload15 is the BITS 1.5 upload protocol, the only protocol offered by default
+const ProtocolUpload15 = "{7df0354d-249b-430f-820d-3d2a9bef4931}"
+
+// DefaultFragmentSize is the size of fragments if Client.FragmentSize isn't set
+const DefaultFragmentSize = 1 << 20
+
+// maxErrorMessage is how much of the body of an error reply is kept in the Error
+const maxErrorMessage = 4096
+
+// maxRewinds is how many times a file is sent again from where the server is without getting
+// further than before, until giving up on a server that keeps losing it
+const maxRewinds = 3
+
+// Client sends files to BITS servers. The zero value is ready to use
+type Client struct {
+	HTTPClient   *http.Client // Sends the requests, http.DefaultClient if nil
+	Method       string       // Method of the requests, BITS_POST by default
+	Protocols    []string     // Protocols offered when creating a session, ProtocolUpload15 by default
+	FragmentSize int64        // Max bytes sent in a fragment, DefaultFragmentSize by default
+	Header       http.Header  // Added to every request, e.g. for authentication
+	Retry        *RetryPolicy // Retries requests that failed, nil never retries
+
+	// MaxBytesPerSecond limits the bytes of fragments sent by the client, over all its sessions,
+	// zero means no limit. Fragments sent again by Retry aren't counted
+	MaxBytesPerSecond int64
+
+	// FragmentTuning, if set, adapts the fragment size of each session to how long fragments take
+	FragmentTuning *FragmentTuning
+
+	// Progress, if set, is called when a fragment is acknowledged, with how much of the file at
+	// url the server has and the size of the file, -1 while it isn't known
+	Progress func(url string, sent, total int64)
+
+	mu     sync.Mutex // guards the bucket of MaxBytesPerSecond
+	tokens float64    // bytes that can be sent without waiting, negative when a fragment waits
+	filled time.Time  // when the bucket was last refilled
+}
+
+// Session is an upload session created on a server
+type Session struct {
+	ID       string // The id of the session given by the server
+	Protocol string // The protocol the server chose
+	URL      string // The URL the session was created at, where it is closed
+
+	client       *Client
+	files        []File
+	fragmentSize int64 // size of the next fragment, tuned by FragmentTuning
+}
+
+// File is a file sent in a session, with how much of it the server reports it received
+type File struct {
+	URL      string
+	Size     int64 // The size of the file
+	Received int64 // The bytes the server acknowledged, from BITS-Received-Content-Range
+}
+
+// Result is what a closed session received
+type Result struct {
+	SessionID string
+	Files     []File
+}
+
+// Error is an error reply of a BITS server
+type Error struct {
+	StatusCode int           // The HTTP status of the reply
+	Code       uint32        // The BITS-Error-Code, a HRESULT, zero if the reply had none
+	Context    int           // The BITS-Error-Context, like 5 for the remote file
+	SessionID  string        // The session of the reply, if the server sent it
+	Message    string        // The body of the reply, if it was text
+	Received   int64         // How much of the file the server has, sent with a 416, -1 if it sent none
+	RetryAfter time.Duration // How long the server asked to wait with Retry-After, zero if it didn't
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("bits: server replied %d", e.StatusCode)
+	if e.Code != 0 {
+		msg += fmt.Sprintf(", error code 0x%08x in context %d", e.Code, e.Context)
+	}
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+// ErrUnexpectedReply is returned when the server replies with something that isn't BITS
+var ErrUnexpectedReply = errors.New("bits: unexpected reply")
+
+// Ping checks that the server at url speaks BITS
+func (c *Client) Ping(ctx context.Context, url string) error {
+	res, err := c.do(ctx, "Ping", "", url, nil, nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// CreateSession creates an upload session at url, usually the URL of the first file sent
+func (c *Client) CreateSession(ctx context.Context, url string) (*Session, error) {
+	protocols := c.Protocols
+	if len(protocols) == 0 {
+		protocols = []string{ProtocolUpload15}
+	}
+	header := http.Header{"BITS-Supported-Protocols": {strings.Join(protocols, " ")}}
+	if c.Retry != nil {
+		header.Set("Idempotency-Key", idempotencyKey())
+	}
+	res, err := c.do(ctx, "Create-Session", "", url, header, nil)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+
+	s := &Session{
+		ID:       res.Header.Get("BITS-Session-Id"),
+		Protocol: res.Header.Get("BITS-Protocol"),
+		URL:      url,
+		client:   c,
+	}
+	if s.ID == "" {
+		return nil, fmt.Errorf("%w: no session id", ErrUnexpectedReply)
+	}
+	return s, nil
+}
+
+// Upload sends a file to url in a session of its own, see Session.SendFile. The session is
+// canceled if the file can't be sent
+func (c *Client) Upload(ctx context.Context, url string, r io.Reader, size int64) (*Result, error) {
+	s, err := c.CreateSession(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = s.SendFile(ctx, url, r, size); err != nil {
+		s.Cancel(ctx)
+		return nil, err
+	}
+	return s.Close(ctx)
+}
+
+// SendFile sends a file of size bytes read from r to url in fragments. The size is -1 if it
+// isn't known, then the total size is only sent with the last fragment. Returns how much of
+// the file the server acknowledged. Ranges the server already has are skipped, and if the
+// server replies 416 because it has less than was sent, the file is sent again from there if
+// r is an io.Seeker
+func (s *Session) SendFile(ctx context.Context, url string, r io.Reader, size int64) (int64, error) {
+	return s.sendFrom(ctx, url, r, 0, size)
+}
+
+// ResumeFile sends the rest of a file that was partly sent to url, e.g. by a SendFile that
+// failed when the connection was lost. The server is asked how much of the file it has, and
+// the file is sent from there. The size is taken from r if it is -1
+func (s *Session) ResumeFile(ctx context.Context, url string, r io.ReadSeeker, size int64) (int64, error) {
+	if size < 0 {
+		var err error
+		if size, err = r.Seek(0, io.SeekEnd); err != nil {
+			return 0, err
+		}
+	}
+	received, err := s.Received(ctx, url, size)
+	if err != nil {
+		return 0, err
+	}
+	if received > size {
+		return 0, fmt.Errorf("%w: received %d bytes of a file of %d", ErrUnexpectedReply, received, size)
+	}
+	if _, err = r.Seek(received, io.SeekStart); err != nil {
+		return received, err
+	}
+	return s.sendFrom(ctx, url, r, received, size)
+}
+
+// Received asks the server how much it has of the file of size bytes at url
+func (s *Session) Received(ctx context.Context, url string, size int64) (int64, error) {
+	return s.sendFragment(ctx, url, fmt.Sprintf("bytes */%d", size), nil)
+}
+
+// send a file from offset, r is read from there
+func (s *Session) sendFrom(ctx context.Context, url string, r io.Reader, offset, size int64) (int64, error) {
+	// An empty file is a single fragment without data
+	br := bufio.NewReader(r)
+	if size == 0 || size < 0 && offset == 0 && isEOF(br) {
+		received, err := s.sendFragment(ctx, url, "bytes 0-0/0", nil)
+		if err == nil {
+			s.files = append(s.files, File{URL: url, Received: received})
+			s.progress(url, received, 0)
+		}
+		return received, err
+	}
+
+	var buf []byte
+	rewinds, furthest := 0, offset
+	for size < 0 || offset < size {
+		// the server had the rest of a file of unknown size
+		if size < 0 && isEOF(br) {
+			size = offset
+			break
+		}
+
+		n := s.nextFragmentSize()
+		if size >= 0 && size-offset < n {
+			n = size - offset
+		}
+		if int64(len(buf)) < n {
+			buf = make([]byte, n)
+		}
+		n64, err := io.ReadFull(br, buf[:n])
+		if err == io.ErrUnexpectedEOF && size < 0 {
+			err = nil
+		}
+		if err != nil {
+			return offset, fmt.Errorf("failed to read the file at %d: %w", offset, err)
+		}
+		fragment := buf[:n64]
+
+		// the last fragment of a file of unknown size has the size
+		total := "*"
+		if size >= 0 {
+			total = strconv.FormatInt(size, 10)
+		} else if isEOF(br) {
+			size = offset + int64(len(fragment))
+			total = strconv.FormatInt(size, 10)
+		}
+
+		end := offset + int64(len(fragment))
+		if err = s.client.throttle(ctx, int64(len(fragment))); err != nil {
+			return offset, err
+		}
+		start := now()
+		received, err := s.sendFragment(ctx, url, fmt.Sprintf("bytes %d-%d/%s", offset, end-1, total), fragment)
+		var bitsErr *Error
+		if errors.As(err, &bitsErr) && bitsErr.StatusCode == http.StatusRequestedRangeNotSatisfiable && bitsErr.Received >= 0 {
+			// the server has another range than was sent, continue from what it has
+			received, err = bitsErr.Received, nil
+		}
+		if err != nil && isTimeout(err) && ctx.Err() == nil {
+			// send the fragment again in smaller ones, if the file can be read again
+			if seeker, ok := r.(io.Seeker); ok && s.shrink() {
+				if _, err = seeker.Seek(offset, io.SeekStart); err != nil {
+					return offset, err
+				}
+				br.Reset(r)
+				continue
+			}
+		}
+		if err != nil {
+			return offset, err
+		}
+		s.tune(int64(len(fragment)), now().Sub(start))
+
+		switch {
+		case size >= 0 && received > size:
+			return offset, fmt.Errorf("%w: received %d bytes of a file of %d", ErrUnexpectedReply, received, size)
+		case received > end:
+			// the server has more of the file, e.g. from an earlier attempt
+			if _, err = io.CopyN(io.Discard, br, received-end); err != nil {
+				return offset, fmt.Errorf("failed to skip to %d: %w", received, err)
+			}
+		case received < end:
+			// the server lost some of the file, send it again if the file can be read again
+			seeker, ok := r.(io.Seeker)
+			if !ok || rewinds >= maxRewinds {
+				return offset, fmt.Errorf("%w: received %d bytes, sent %d", ErrUnexpectedReply, received, end)
+			}
+			if _, err = seeker.Seek(received, io.SeekStart); err != nil {
+				return offset, err
+			}
+			br.Reset(r)
+			rewinds++
+		}
+		if received > furthest {
+			rewinds, furthest = 0, received
+		}
+		offset = received
+		s.progress(url, offset, size)
+	}
+
+	s.files = append(s.files, File{URL: url, Size: size, Received: offset})
+	return offset, nil
+}
+
+// report the progress of a file to the Progress of the client
+func (s *Session) progress(url string, sent, total int64) {
+	if s.client.Progress != nil {
+		s.client.Progress(url, sent, total)
+	}
+}
+
+// Close closes the session, so the server finishes the files
+func (s *Session) Close(ctx context.Context) (*Result, error) {
+	res, err := s.client.do(ctx, "Close-Session", s.ID, s.URL, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	return &Result{SessionID: s.ID, Files: s.files}, nil
+}
+
+// Cancel cancels the session, so the server removes what it received
+func (s *Session) Cancel(ctx context.Context) error {
+	res, err := s.client.do(ctx, "Cancel-Session", s.ID, s.URL, nil, nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// send a fragment, and return how much of the file the server has
+func (s *Session) sendFragment(ctx context.Context, url, contentRange string, data []byte) (int64, error) {
+	res, err := s.client.do(ctx, "Fragment", s.ID, url, http.Header{"Content-Range": {contentRange}}, data)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+
+	received := receivedRange(res.Header)
+	if received < 0 {
+		return 0, fmt.Errorf("%w: invalid BITS-Received-Content-Range '%s'", ErrUnexpectedReply, res.Header.Get("BITS-Received-Content-Range"))
+	}
+	return received, nil
+}
+
+// send a packet, and return the Ack of the server. Error replies are returned as an *Error
+func (c *Client) do(ctx context.Context, packetType, sessionID, url string, header http.Header, body []byte) (*http.Response, error) {
+	return c.retry(ctx, func() (*http.Response, error) {
+		return c.send(ctx, packetType, sessionID, url, header, body)
+	})
+}
+
+// send a packet once
+func (c *Client) send(ctx context.Context, packetType, sessionID, url string, header http.Header, body []byte) (*http.Response, error) {
+	method := c.Method
+	if method == "" {
+		method = "BITS_POST"
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range c.Header {
+		req.Header[k] = append([]string(nil), v...)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("BITS-Packet-Type", packetType)
+	if sessionID != "" {
+		req.Header.Set("BITS-Session-Id", sessionID)
+	}
+
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, &transportError{err}
+	}
+
+	if res.StatusCode != http.StatusOK {
+		defer res.Body.Close()
+		return nil, replyError(res)
+	}
+	if !strings.EqualFold(res.Header.Get("BITS-Packet-Type"), "Ack") {
+		res.Body.Close()
+		return nil, fmt.Errorf("%w: packet type '%s'", ErrUnexpectedReply, res.Header.Get("BITS-Packet-Type"))
+	}
+	return res, nil
+}
+
+// get the error of an error reply
+func replyError(res *http.Response) *Error {
+	e := &Error{
+		StatusCode: res.StatusCode,
+		SessionID:  res.Header.Get("BITS-Session-Id"),
+		Received:   receivedRange(res.Header),
+		RetryAfter: parseRetryAfter(res.Header.Get("Retry-After"), now()),
+	}
+	if code, err := parseHex(res.Header.Get("BITS-Error-Code")); err == nil {
+		e.Code = uint32(code)
+	}
+	if errorContext, err := parseHex(res.Header.Get("BITS-Error-Context")); err == nil {
+		e.Context = int(errorContext)
+	}
+	if strings.HasPrefix(res.Header.Get("Content-Type"), "text/plain") {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, maxErrorMessage))
+		e.Message = strings.TrimSpace(string(msg))
+	}
+	return e
+}
+
+// get the BITS-Received-Content-Range of a reply, -1 if it is missing or invalid. Some servers
+// misspell it in error replies
+func receivedRange(header http.Header) int64 {
+	value := header.Get("BITS-Received-Content-Range")
+	if value == "" {
+		value = header.Get("BITS-Recieved-Content-Range")
+	}
+	received, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || received < 0 {
+		return -1
+	}
+	return received
+}
+
+// parse a hex number of a BITS header, with or without 0x
+func parseHex(s string) (uint64, error) {
+	s = strings.TrimSpace(s)
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "0x"), "0X")
+	return strconv.ParseUint(s, 16, 32)
+}
+
+// check if there is nothing more to read
+func isEOF(r *bufio.Reader) bool {
+	_, err := r.Peek(1)
+	return err != nil
+}
@@ -0,0 +1,336 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"gitlab.com/magan/gobits"
+)
+
+// serve a gobits handler, and record the Content-Range of the fragments it gets
+func newTestServer(t *testing.T, cfg gobits.Config) (*httptest.Server, *[]string) {
+	t.Helper()
+
+	cfg.TempDir = t.TempDir()
+	h, err := gobits.NewHandler(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("BITS-Packet-Type") == "Fragment" {
+			mu.Lock()
+			ranges = append(ranges, r.Header.Get("Content-Range"))
+			mu.Unlock()
+		}
+		h.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server, &ranges
+}
+
+func TestUpload(t *testing.T) {
+
+	testcases := []struct {
+		name   string
+		data   string
+		size   int64
+		ranges []string
+	}{
+		{"known size", "0123456789", 10, []string{"bytes 0-3/10", "bytes 4-7/10", "bytes 8-9/10"}},
+		{"unknown size", "0123456789", -1, []string{"bytes 0-3/*", "bytes 4-7/*", "bytes 8-9/10"}},
+		{"unknown size of whole fragments", "01234567", -1, []string{"bytes 0-3/*", "bytes 4-7/8"}},
+		{"single fragment", "012", 3, []string{"bytes 0-2/3"}},
+		{"empty", "", 0, []string{"bytes 0-0/0"}},
+		{"empty of unknown size", "", -1, []string{"bytes 0-0/0"}},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			destDir := t.TempDir()
+			server, ranges := newTestServer(t, gobits.Config{DestDir: destDir})
+			c := &Client{FragmentSize: 4}
+
+			if err := c.Ping(context.Background(), server.URL+"/BITS/"); err != nil {
+				t.Fatalf("failed to ping: %v", err)
+			}
+			result, err := c.Upload(context.Background(), server.URL+"/BITS/file.txt", strings.NewReader(tc.data), tc.size)
+			if err != nil {
+				t.Fatalf("failed to upload: %v", err)
+			}
+
+			if !reflect.DeepEqual(*ranges, tc.ranges) {
+				t.Errorf("expected fragments %q, got %q", tc.ranges, *ranges)
+			}
+			want := []File{{URL: server.URL + "/BITS/file.txt", Size: int64(len(tc.data)), Received: int64(len(tc.data))}}
+			if result.SessionID == "" || !reflect.DeepEqual(result.Files, want) {
+				t.Errorf("unexpected result %+v", result)
+			}
+			data, err := os.ReadFile(filepath.Join(destDir, "file.txt"))
+			if err != nil || string(data) != tc.data {
+				t.Errorf("expected the file to be received, got %q, %v", data, err)
+			}
+		})
+	}
+}
+
+func TestSessionFiles(t *testing.T) {
+
+	destDir := t.TempDir()
+	server, _ := newTestServer(t, gobits.Config{DestDir: destDir})
+	c := &Client{}
+	ctx := context.Background()
+
+	s, err := c.CreateSession(ctx, server.URL+"/BITS/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Protocol != ProtocolUpload15 {
+		t.Errorf("expected protocol %v, got %v", ProtocolUpload15, s.Protocol)
+	}
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if received, err := s.SendFile(ctx, server.URL+"/BITS/"+name, strings.NewReader(name), -1); err != nil || received != 5 {
+			t.Fatalf("failed to send %v: %v %v", name, received, err)
+		}
+	}
+	result, err := s.Close(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Files) != 2 || result.Files[1].URL != server.URL+"/BITS/b.txt" {
+		t.Errorf("unexpected files %+v", result.Files)
+	}
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if data, err := os.ReadFile(filepath.Join(destDir, name)); err != nil || string(data) != name {
+			t.Errorf("expected %v to be received, got %q, %v", name, data, err)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+
+	server, _ := newTestServer(t, gobits.Config{
+		Disallowed:    []string{`\.exe$`},
+		VerboseErrors: true,
+		Authenticator: func(r *http.Request) (string, error) {
+			if r.Header.Get("Authorization") != "Bearer token" {
+				return "", &gobits.AuthError{Challenges: []string{"Bearer"}}
+			}
+			return "agent", nil
+		},
+	})
+	ctx := context.Background()
+
+	// the BITS error headers are parsed
+	_, err := (&Client{}).CreateSession(ctx, server.URL+"/BITS/")
+	var bitsErr *Error
+	if !errors.As(err, &bitsErr) {
+		t.Fatalf("expected an *Error, got %v", err)
+	}
+	if bitsErr.StatusCode != http.StatusUnauthorized || bitsErr.Code != 0x80070005 || bitsErr.Context != 5 || bitsErr.Message == "" {
+		t.Errorf("unexpected error %+v", bitsErr)
+	}
+
+	// the headers of the client are sent, and the session is canceled when the file fails
+	c := &Client{Header: http.Header{"Authorization": {"Bearer token"}}}
+	_, err = c.Upload(ctx, server.URL+"/BITS/file.exe", strings.NewReader("x"), 1)
+	if !errors.As(err, &bitsErr) || bitsErr.StatusCode != http.StatusBadRequest || bitsErr.SessionID == "" {
+		t.Fatalf("expected the file to be refused, got %v", err)
+	}
+	s := &Session{ID: bitsErr.SessionID, URL: server.URL + "/BITS/", client: c}
+	if err = s.Cancel(ctx); !errors.As(err, &bitsErr) || bitsErr.StatusCode != http.StatusNotFound {
+		t.Errorf("expected the session to be canceled, got %v", err)
+	}
+
+	// servers that aren't BITS
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+		}
+	}))
+	defer plain.Close()
+	if err = c.Ping(ctx, plain.URL+"/missing"); !errors.As(err, &bitsErr) || bitsErr.StatusCode != http.StatusNotFound || bitsErr.Code != 0 {
+		t.Errorf("expected a 404 error, got %v", err)
+	}
+	if err = c.Ping(ctx, plain.URL); !errors.Is(err, ErrUnexpectedReply) {
+		t.Errorf("expected an unexpected reply, got %v", err)
+	}
+}
+
+func TestSkipReceived(t *testing.T) {
+
+	// a server that already has the start of the file
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Content-Range"))
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("BITS-Packet-Type", "Ack")
+		received := "8"
+		if len(ranges) > 1 {
+			received = "10"
+		}
+		w.Header().Set("BITS-Received-Content-Range", received)
+	}))
+	defer server.Close()
+
+	s := &Session{ID: "session", URL: server.URL, client: &Client{FragmentSize: 4}}
+	received, err := s.SendFile(context.Background(), server.URL, bytes.NewReader([]byte("0123456789")), 10)
+	if err != nil || received != 10 {
+		t.Fatalf("failed to send the file: %v %v", received, err)
+	}
+	if want := []string{"bytes 0-3/10", "bytes 8-9/10"}; !reflect.DeepEqual(ranges, want) {
+		t.Errorf("expected fragments %q, got %q", want, ranges)
+	}
+
+	// a reader shorter than the size
+	if _, err = s.SendFile(context.Background(), server.URL, strings.NewReader("01"), 10); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("expected the short file to fail, got %v", err)
+	}
+}
+
+func TestResumeAfterDisconnect(t *testing.T) {
+
+	destDir := t.TempDir()
+	h, err := gobits.NewHandler(gobits.Config{TempDir: t.TempDir(), DestDir: destDir}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the third fragment is written, but the connection is dropped before the client gets the Ack
+	var mu sync.Mutex
+	var fragments int
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("BITS-Packet-Type") != "Fragment" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		mu.Lock()
+		fragments++
+		drop := fragments == 3
+		ranges = append(ranges, r.Header.Get("Content-Range"))
+		mu.Unlock()
+		if !drop {
+			h.ServeHTTP(w, r)
+			return
+		}
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		conn, _, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn.Close()
+	}))
+	defer server.Close()
+
+	data := make([]byte, 10000)
+	for i := range data {
+		data[i] = byte(i * 7 % 251)
+	}
+	ctx := context.Background()
+	c := &Client{FragmentSize: 1000}
+	s, err := c.CreateSession(ctx, server.URL+"/BITS/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := server.URL + "/BITS/data.bin"
+	if _, err = s.SendFile(ctx, url, bytes.NewReader(data), int64(len(data))); err == nil {
+		t.Fatal("expected the dropped connection to fail the file")
+	}
+
+	// the file is resumed after the fragment the server got
+	if received, err := s.ResumeFile(ctx, url, bytes.NewReader(data), -1); err != nil || received != int64(len(data)) {
+		t.Fatalf("failed to resume: %v %v", received, err)
+	}
+	result, err := s.Close(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Files) != 1 || result.Files[0].Received != int64(len(data)) {
+		t.Errorf("unexpected result %+v", result)
+	}
+	received, err := os.ReadFile(filepath.Join(destDir, "data.bin"))
+	if err != nil || !bytes.Equal(received, data) {
+		t.Errorf("expected the file to be identical, got %v bytes, %v", len(received), err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(ranges) != 11 || ranges[2] != "bytes 2000-2999/10000" || ranges[3] != "bytes */10000" || ranges[4] != "bytes 3000-3999/10000" {
+		t.Errorf("unexpected fragments %q", ranges)
+	}
+}
+
+func TestRewind(t *testing.T) {
+
+	// a server that loses the second fragment, and replies 416 to the third
+	newServer := func(lost func(start string) bool) (*httptest.Server, *[]string) {
+		var ranges []string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			contentRange := r.Header.Get("Content-Range")
+			ranges = append(ranges, contentRange)
+			io.Copy(io.Discard, r.Body)
+			var start, end, total int
+			fmt.Sscanf(contentRange, "bytes %d-%d/%d", &start, &end, &total)
+			if lost(strconv.Itoa(start)) {
+				w.Header().Set("BITS-Recieved-Content-Range", "4")
+				w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+			w.Header().Set("BITS-Packet-Type", "Ack")
+			w.Header().Set("BITS-Received-Content-Range", strconv.Itoa(end+1))
+		}))
+		t.Cleanup(server.Close)
+		return server, &ranges
+	}
+	ctx := context.Background()
+
+	var once sync.Once
+	server, ranges := newServer(func(start string) (lost bool) {
+		if start == "8" {
+			once.Do(func() { lost = true })
+		}
+		return
+	})
+	s := &Session{ID: "session", URL: server.URL, client: &Client{FragmentSize: 4}}
+	if received, err := s.SendFile(ctx, server.URL, bytes.NewReader([]byte("0123456789")), 10); err != nil || received != 10 {
+		t.Fatalf("failed to send the file: %v %v", received, err)
+	}
+	want := []string{"bytes 0-3/10", "bytes 4-7/10", "bytes 8-9/10", "bytes 4-7/10", "bytes 8-9/10"}
+	if !reflect.DeepEqual(*ranges, want) {
+		t.Errorf("expected fragments %q, got %q", want, *ranges)
+	}
+
+	// a file that can't be read again fails
+	if _, err := s.SendFile(ctx, server.URL, io.MultiReader(strings.NewReader("0123456789")), 10); err != nil {
+		t.Errorf("expected the file to be sent, got %v", err)
+	}
+	once = sync.Once{}
+	if _, err := s.SendFile(ctx, server.URL, io.MultiReader(strings.NewReader("0123456789")), 10); !errors.Is(err, ErrUnexpectedReply) {
+		t.Errorf("expected the lost fragment to fail the file, got %v", err)
+	}
+
+	// a server that keeps losing the file is given up on
+	server, ranges = newServer(func(start string) bool { return start == "8" })
+	s = &Session{ID: "session", URL: server.URL, client: &Client{FragmentSize: 4}}
+	if _, err := s.SendFile(ctx, server.URL, bytes.NewReader([]byte("0123456789")), 10); !errors.Is(err, ErrUnexpectedReply) {
+		t.Errorf("expected the file to fail, got %v", err)
+	}
+	if len(*ranges) != 3+2*maxRewinds {
+		t.Errorf("expected %v rewinds, got fragments %q", maxRewinds, *ranges)
+	}
+}
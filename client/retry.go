@@ -0,0 +1,160 @@
+package client
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Defaults of the RetryPolicy
+const (
+	DefaultInitialInterval = 500 * time.Millisecond
+	DefaultMaxInterval     = 30 * time.Second
+	DefaultMaxElapsedTime  = 5 * time.Minute
+	DefaultMaxRetries      = 10
+)
+
+// RetryPolicy retries requests that fail with a network error or a 408, 429 or 5xx reply, with
+// jittered exponential backoff. A Retry-After of the reply is waited instead of the backoff.
+// Fields that are zero get the defaults.
+//
+// Fragments are safe to send again, a server acknowledges what it already has. Sessions are
+// created with an Idempotency-Key, so a server deduplicating them doesn't create two
+type RetryPolicy struct {
+	InitialInterval time.Duration // Wait before the first retry, doubled for each retry after it
+	MaxInterval     time.Duration // Max wait between two attempts
+	MaxElapsedTime  time.Duration // Max time from the first attempt of a request until it is given up
+	MaxRetries      int           // Max retries of a request
+}
+
+// the clock, and functions used to wait between attempts and to jitter the waits, replaced by
+// tests
+var (
+	now    = time.Now
+	sleep  = sleepContext
+	jitter = rand.Float64
+)
+
+// wait for d, or until ctx is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// transportError is a request that failed without a reply
+type transportError struct {
+	err error
+}
+
+func (e *transportError) Error() string { return e.err.Error() }
+func (e *transportError) Unwrap() error { return e.err }
+
+// get the policy with the defaults
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.InitialInterval <= 0 {
+		p.InitialInterval = DefaultInitialInterval
+	}
+	if p.MaxInterval <= 0 {
+		p.MaxInterval = DefaultMaxInterval
+	}
+	if p.MaxElapsedTime <= 0 {
+		p.MaxElapsedTime = DefaultMaxElapsedTime
+	}
+	if p.MaxRetries <= 0 {
+		p.MaxRetries = DefaultMaxRetries
+	}
+	return p
+}
+
+// get the wait before a retry, the interval doubled for each retry before it, randomized by
+// up to half of it either way
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	interval := p.InitialInterval
+	for i := 0; i < retry && interval < p.MaxInterval; i++ {
+		interval *= 2
+	}
+	interval = time.Duration(float64(interval) * (0.5 + jitter()))
+	if interval > p.MaxInterval {
+		interval = p.MaxInterval
+	}
+	return interval
+}
+
+// send a packet, retrying it by the policy of the client
+func (c *Client) retry(ctx context.Context, send func() (*http.Response, error)) (*http.Response, error) {
+	res, err := send()
+	if c.Retry == nil {
+		return res, err
+	}
+
+	p := c.Retry.withDefaults()
+	start := now()
+	for retry := 0; err != nil && retry < p.MaxRetries && ctx.Err() == nil; retry++ {
+		wait, ok := retryable(err)
+		if !ok {
+			break
+		}
+		if wait == 0 {
+			wait = p.backoff(retry)
+		}
+		if now().Sub(start)+wait > p.MaxElapsedTime {
+			break
+		}
+		if serr := sleep(ctx, wait); serr != nil {
+			return nil, serr
+		}
+		res, err = send()
+	}
+	return res, err
+}
+
+// check if a failed request can be retried, and how long the server asked to wait
+func retryable(err error) (time.Duration, bool) {
+	var bitsErr *Error
+	if errors.As(err, &bitsErr) {
+		switch code := bitsErr.StatusCode; {
+		case code == http.StatusRequestTimeout, code == http.StatusTooManyRequests:
+		case code >= 500 && code != http.StatusNotImplemented:
+		default:
+			return 0, false
+		}
+		return bitsErr.RetryAfter, true
+	}
+	var transportErr *transportError
+	return 0, errors.As(err, &transportErr)
+}
+
+// parse a Retry-After header, in seconds or a date, zero if it is missing or invalid
+func parseRetryAfter(value string, at time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(at) {
+		return date.Sub(at)
+	}
+	return 0
+}
+
+// create a random key identifying a request over its retries
+func idempotencyKey() string {
+	key := make([]byte, 16)
+	crand.Read(key)
+	return hex.EncodeToString(key)
+}
@@ -0,0 +1,257 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"gitlab.com/magan/gobits"
+)
+
+// fakeClock replaces the clock and the waits of the client, the waits are recorded and advance
+// the clock
+type fakeClock struct {
+	mu    sync.Mutex
+	now   time.Time
+	waits []time.Duration
+}
+
+func newFakeClock(t *testing.T) *fakeClock {
+	t.Helper()
+
+	c := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	oldNow, oldSleep, oldJitter := now, sleep, jitter
+	now = func() time.Time {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.now
+	}
+	sleep = func(ctx context.Context, d time.Duration) error {
+		c.mu.Lock()
+		c.waits = append(c.waits, d)
+		c.mu.Unlock()
+		c.advance(d)
+		return ctx.Err()
+	}
+	jitter = func() float64 { return 0.5 }
+	t.Cleanup(func() { now, sleep, jitter = oldNow, oldSleep, oldJitter })
+	return c
+}
+
+// move the clock forward, like a request taking d
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// get the waits so far
+func (c *fakeClock) slept() []time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]time.Duration(nil), c.waits...)
+}
+
+func TestRetryFlakyServer(t *testing.T) {
+
+	clock := newFakeClock(t)
+	destDir := t.TempDir()
+	h, err := gobits.NewHandler(gobits.Config{TempDir: t.TempDir(), DestDir: destDir, DeduplicateCreate: true}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the server fails the same requests every time: the first create and close, the first
+	// attempt of two fragments and the first two attempts of another
+	var mu sync.Mutex
+	attempts := map[string]int{}
+	var ranges []string
+	var created string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		packetType := r.Header.Get("BITS-Packet-Type")
+		key := packetType + " " + r.Header.Get("Content-Range")
+		mu.Lock()
+		attempts[key]++
+		attempt := attempts[key]
+		if packetType == "Fragment" {
+			ranges = append(ranges, r.Header.Get("Content-Range"))
+		}
+		mu.Unlock()
+
+		switch {
+		case key == "Create-Session " && attempt == 1:
+			// the session is created, but the reply is lost
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, r)
+			mu.Lock()
+			created = rec.Header().Get("BITS-Session-Id")
+			mu.Unlock()
+			w.Header().Set("Retry-After", "2")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case key == "Fragment bytes 2000-2999/10000" && attempt == 1:
+			w.WriteHeader(http.StatusInternalServerError)
+		case key == "Fragment bytes 5000-5999/10000" && attempt == 1:
+			// the fragment is written, but the connection is dropped before the Ack
+			h.ServeHTTP(httptest.NewRecorder(), r)
+			conn, _, err := http.NewResponseController(w).Hijack()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			conn.Close()
+		case key == "Fragment bytes 7000-7999/10000" && attempt <= 2:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case key == "Close-Session " && attempt == 1:
+			w.WriteHeader(http.StatusBadGateway)
+		default:
+			h.ServeHTTP(w, r)
+		}
+	}))
+	defer server.Close()
+
+	data := make([]byte, 10000)
+	for i := range data {
+		data[i] = byte(i * 7 % 251)
+	}
+	c := &Client{FragmentSize: 1000, Retry: &RetryPolicy{InitialInterval: 10 * time.Millisecond, MaxInterval: 15 * time.Millisecond}}
+	result, err := c.Upload(context.Background(), server.URL+"/BITS/data.bin", bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("failed to upload: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if result.SessionID != created {
+		t.Errorf("expected the retried create to get session %v, got %v", created, result.SessionID)
+	}
+	received, err := os.ReadFile(filepath.Join(destDir, "data.bin"))
+	if err != nil || !bytes.Equal(received, data) {
+		t.Errorf("expected the file to be identical, got %v bytes, %v", len(received), err)
+	}
+
+	// Retry-After is waited as it is, the backoff is capped by MaxInterval
+	ms := time.Millisecond
+	want := []time.Duration{2 * time.Second, 10 * ms, 10 * ms, 10 * ms, 15 * ms, 10 * ms}
+	if !reflect.DeepEqual(clock.slept(), want) {
+		t.Errorf("expected waits %v, got %v", want, clock.slept())
+	}
+	if len(ranges) != 14 {
+		t.Errorf("expected 4 fragments to be sent again, got %q", ranges)
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+
+	ms := time.Millisecond
+	testcases := []struct {
+		name     string
+		status   int
+		policy   *RetryPolicy
+		attempts int
+		waits    []time.Duration
+	}{
+		{"no policy", http.StatusServiceUnavailable, nil, 1, nil},
+		{"max retries", http.StatusServiceUnavailable, &RetryPolicy{InitialInterval: 10 * ms, MaxRetries: 3}, 4, []time.Duration{10 * ms, 20 * ms, 40 * ms}},
+		{"max elapsed time", http.StatusBadGateway, &RetryPolicy{InitialInterval: 10 * ms, MaxElapsedTime: 70 * ms}, 4, []time.Duration{10 * ms, 20 * ms, 40 * ms}},
+		{"defaults", http.StatusGatewayTimeout, &RetryPolicy{}, 11, []time.Duration{
+			500 * ms, time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second,
+			30 * time.Second, 30 * time.Second, 30 * time.Second, 30 * time.Second,
+		}},
+		{"too many requests", http.StatusTooManyRequests, &RetryPolicy{InitialInterval: ms, MaxRetries: 1}, 2, []time.Duration{ms}},
+		{"request timeout", http.StatusRequestTimeout, &RetryPolicy{InitialInterval: ms, MaxRetries: 1}, 2, []time.Duration{ms}},
+		{"client error", http.StatusBadRequest, &RetryPolicy{}, 1, nil},
+		{"not found", http.StatusNotFound, &RetryPolicy{}, 1, nil},
+		{"not implemented", http.StatusNotImplemented, &RetryPolicy{}, 1, nil},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			clock := newFakeClock(t)
+			var attempts int
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				attempts++
+				w.WriteHeader(tc.status)
+			}))
+			defer server.Close()
+
+			c := &Client{Retry: tc.policy}
+			var bitsErr *Error
+			if err := c.Ping(context.Background(), server.URL); !errors.As(err, &bitsErr) || bitsErr.StatusCode != tc.status {
+				t.Errorf("expected the reply as the error, got %v", err)
+			}
+			if attempts != tc.attempts || !reflect.DeepEqual(clock.slept(), tc.waits) {
+				t.Errorf("expected %v attempts with waits %v, got %v with %v", tc.attempts, tc.waits, attempts, clock.slept())
+			}
+		})
+	}
+
+	// the jitter randomizes the waits by half either way
+	p := RetryPolicy{InitialInterval: 100 * ms}.withDefaults()
+	for i := 0; i < 100; i++ {
+		if wait := p.backoff(2); wait < 200*ms || wait >= 600*ms {
+			t.Fatalf("expected a wait around 400ms, got %v", wait)
+		}
+	}
+}
+
+func TestRetryCanceled(t *testing.T) {
+
+	var attempts int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	// the wait for the retry ends when the context is canceled
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	c := &Client{Retry: &RetryPolicy{MaxElapsedTime: 2 * time.Hour}}
+	if err := c.Ping(ctx, server.URL); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the ping to be canceled, got %v", err)
+	}
+	if attempts != 1 {
+		t.Errorf("expected a single attempt, got %v", attempts)
+	}
+
+	// a context that is done isn't retried
+	if err := c.Ping(ctx, server.URL); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the ping to be canceled, got %v", err)
+	}
+	if attempts != 1 {
+		t.Errorf("expected no more attempts, got %v", attempts)
+	}
+
+	// a Retry-After longer than the time left gives up at once
+	c.Retry.MaxElapsedTime = time.Minute
+	if err := c.Ping(context.Background(), server.URL); err == nil || attempts != 2 {
+		t.Errorf("expected the ping to fail after an attempt, got %v after %v", err, attempts)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+
+	at := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := map[string]time.Duration{
+		"":                              0,
+		"120":                           2 * time.Minute,
+		"-1":                            0,
+		"soon":                          0,
+		"Mon, 01 Jan 2024 12:00:30 GMT": 30 * time.Second,
+		"Mon, 01 Jan 2024 11:00:00 GMT": 0,
+	}
+	for value, want := range tests {
+		if got := parseRetryAfter(value, at); got != want {
+			t.Errorf("%q: expected %v, got %v", value, want, got)
+		}
+	}
+}
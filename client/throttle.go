@@ -0,0 +1,130 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Defaults of the FragmentTuning
+const (
+	DefaultMinFragmentSize = 64 << 10
+	DefaultMaxFragmentSize = 16 << 20
+	DefaultTargetTime      = 2 * time.Second
+)
+
+// FragmentTuning adapts the size of the fragments of a session to how long they take. Fragments
+// faster than TargetTime double the size, fragments taking more than twice as long halve it,
+// and a fragment that times out is sent again at half the size if the file can be read again.
+// Client.FragmentSize is the size of the first fragment. Fields that are zero get the defaults
+type FragmentTuning struct {
+	MinSize    int64         // Smallest fragment
+	MaxSize    int64         // Largest fragment, raised to MinSize if it is smaller
+	TargetTime time.Duration // Round trip of a fragment aimed for
+}
+
+// get the tuning with the defaults
+func (t FragmentTuning) withDefaults() FragmentTuning {
+	if t.MinSize <= 0 {
+		t.MinSize = DefaultMinFragmentSize
+	}
+	if t.MaxSize <= 0 {
+		t.MaxSize = DefaultMaxFragmentSize
+	}
+	if t.MaxSize < t.MinSize {
+		t.MaxSize = t.MinSize
+	}
+	if t.TargetTime <= 0 {
+		t.TargetTime = DefaultTargetTime
+	}
+	return t
+}
+
+// get the size of the next fragment of the session
+func (s *Session) nextFragmentSize() int64 {
+	if s.fragmentSize > 0 {
+		return s.fragmentSize
+	}
+	s.fragmentSize = s.client.FragmentSize
+	if s.fragmentSize <= 0 {
+		s.fragmentSize = DefaultFragmentSize
+	}
+	if s.client.FragmentTuning != nil {
+		t := s.client.FragmentTuning.withDefaults()
+		s.fragmentSize = max(t.MinSize, min(t.MaxSize, s.fragmentSize))
+	}
+	return s.fragmentSize
+}
+
+// adapt the fragment size to the round trip of a fragment of n bytes. Only whole fragments
+// grow it, the last one of a file is usually shorter
+func (s *Session) tune(n int64, rtt time.Duration) {
+	if s.client.FragmentTuning == nil {
+		return
+	}
+	t := s.client.FragmentTuning.withDefaults()
+	switch {
+	case rtt < t.TargetTime && n >= s.fragmentSize:
+		s.fragmentSize = min(t.MaxSize, s.fragmentSize*2)
+	case rtt > 2*t.TargetTime:
+		s.fragmentSize = max(t.MinSize, s.fragmentSize/2)
+	}
+}
+
+// halve the fragment size after a timeout, false if it is already the smallest
+func (s *Session) shrink() bool {
+	if s.client.FragmentTuning == nil {
+		return false
+	}
+	t := s.client.FragmentTuning.withDefaults()
+	if s.fragmentSize <= t.MinSize {
+		return false
+	}
+	s.fragmentSize = max(t.MinSize, s.fragmentSize/2)
+	return true
+}
+
+// check if a request failed because it took too long
+func isTimeout(err error) bool {
+	var bitsErr *Error
+	if errors.As(err, &bitsErr) {
+		return bitsErr.StatusCode == http.StatusRequestTimeout || bitsErr.StatusCode == http.StatusGatewayTimeout
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// wait until n more bytes can be sent within MaxBytesPerSecond. The bucket holds a second of
+// bytes, and a fragment larger than what is in it waits for the rest to be refilled
+func (c *Client) throttle(ctx context.Context, n int64) error {
+	if c.MaxBytesPerSecond <= 0 || n <= 0 {
+		return nil
+	}
+
+	c.mu.Lock()
+	rate := float64(c.MaxBytesPerSecond)
+	t := now()
+	if c.filled.IsZero() {
+		c.tokens = rate
+	} else {
+		c.tokens = min(rate, c.tokens+t.Sub(c.filled).Seconds()*rate)
+	}
+	c.filled = t
+	c.tokens -= float64(n)
+	wait := time.Duration(-c.tokens / rate * float64(time.Second))
+	c.mu.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+	if err := sleep(ctx, wait); err != nil {
+		// the bytes weren't sent
+		c.mu.Lock()
+		c.tokens += float64(n)
+		c.mu.Unlock()
+		return err
+	}
+	return nil
+}
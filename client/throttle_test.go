@@ -0,0 +1,208 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// serve a fake BITS server acknowledging the fragments, reply gets the start and length of each
+// fragment and returns the status of the reply. The lengths of the fragments are recorded
+func newAckServer(t *testing.T, reply func(start, n int64) int) (*httptest.Server, func() []int64) {
+	t.Helper()
+
+	var mu sync.Mutex
+	var lengths []int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		var start int64
+		fmt.Sscanf(r.Header.Get("Content-Range"), "bytes %d-", &start)
+		mu.Lock()
+		lengths = append(lengths, int64(len(data)))
+		mu.Unlock()
+		if status := reply(start, int64(len(data))); status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		w.Header().Set("BITS-Packet-Type", "Ack")
+		w.Header().Set("BITS-Received-Content-Range", strconv.FormatInt(start+int64(len(data)), 10))
+	}))
+	t.Cleanup(server.Close)
+	return server, func() []int64 {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]int64(nil), lengths...)
+	}
+}
+
+func TestThrottle(t *testing.T) {
+
+	clock := newFakeClock(t)
+	server, _ := newAckServer(t, func(start, n int64) int { return http.StatusOK })
+	ctx := context.Background()
+	c := &Client{FragmentSize: 500, MaxBytesPerSecond: 1000}
+	s := &Session{ID: "session", URL: server.URL, client: c}
+
+	// a second of bytes is sent at once, the rest at the rate
+	begin := now()
+	if _, err := s.SendFile(ctx, server.URL, bytes.NewReader(make([]byte, 3000)), 3000); err != nil {
+		t.Fatal(err)
+	}
+	ms := time.Millisecond
+	if want := []time.Duration{500 * ms, 500 * ms, 500 * ms, 500 * ms}; !reflect.DeepEqual(clock.slept(), want) {
+		t.Errorf("expected waits %v, got %v", want, clock.slept())
+	}
+	if elapsed := now().Sub(begin); elapsed != 2*time.Second {
+		t.Errorf("expected 3000 bytes to take 2s, took %v", elapsed)
+	}
+
+	// the bucket is shared by the sessions of the client, and refills while nothing is sent
+	clock.advance(250 * ms)
+	s = &Session{ID: "other", URL: server.URL, client: c}
+	if _, err := s.SendFile(ctx, server.URL, bytes.NewReader(make([]byte, 500)), 500); err != nil {
+		t.Fatal(err)
+	}
+	if waits := clock.slept(); len(waits) != 5 || waits[4] != 250*ms {
+		t.Errorf("expected a wait of 250ms, got %v", waits)
+	}
+
+	// a fragment larger than the bucket waits for the rest of it
+	c = &Client{FragmentSize: 2500, MaxBytesPerSecond: 1000}
+	s = &Session{ID: "session", URL: server.URL, client: c}
+	if _, err := s.SendFile(ctx, server.URL, bytes.NewReader(make([]byte, 2500)), 2500); err != nil {
+		t.Fatal(err)
+	}
+	if waits := clock.slept(); len(waits) != 6 || waits[5] != 1500*ms {
+		t.Errorf("expected a wait of 1.5s, got %v", waits)
+	}
+
+	// a canceled wait gives the bytes back
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := s.SendFile(canceled, server.URL, bytes.NewReader(make([]byte, 2500)), 2500); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the file to be canceled, got %v", err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.tokens != 0 {
+		t.Errorf("expected an empty bucket, got %v", c.tokens)
+	}
+}
+
+func TestFragmentTuning(t *testing.T) {
+
+	// the network slows down from 1000 to 100 bytes per second halfway through the file
+	clock := newFakeClock(t)
+	server, lengths := newAckServer(t, func(start, n int64) int {
+		rate := int64(1000)
+		if start >= 1500 {
+			rate = 100
+		}
+		clock.advance(time.Duration(n) * time.Second / time.Duration(rate))
+		return http.StatusOK
+	})
+	c := &Client{FragmentSize: 100, FragmentTuning: &FragmentTuning{MinSize: 100, MaxSize: 800, TargetTime: time.Second}}
+	s := &Session{ID: "session", URL: server.URL, client: c}
+	if _, err := s.SendFile(context.Background(), server.URL, bytes.NewReader(make([]byte, 3000)), 3000); err != nil {
+		t.Fatal(err)
+	}
+	if want := []int64{100, 200, 400, 800, 800, 400, 200, 100}; !reflect.DeepEqual(lengths(), want) {
+		t.Errorf("expected fragments of %v bytes, got %v", want, lengths())
+	}
+
+	// the size is kept for the next file of the session
+	if _, err := s.SendFile(context.Background(), server.URL, bytes.NewReader(make([]byte, 200)), 200); err != nil {
+		t.Fatal(err)
+	}
+	if got := lengths(); got[len(got)-1] != 200 || s.fragmentSize != 400 {
+		t.Errorf("expected the file in a fragment of a tuned size, got %v and %v", got, s.fragmentSize)
+	}
+
+	// the first fragment is within the bounds
+	s = &Session{ID: "session", URL: server.URL, client: &Client{FragmentTuning: &FragmentTuning{MaxSize: 1 << 10}}}
+	if size := s.nextFragmentSize(); size != DefaultMinFragmentSize {
+		t.Errorf("expected the fragment size to be the minimum %v, got %v", DefaultMinFragmentSize, size)
+	}
+}
+
+func TestFragmentTimeout(t *testing.T) {
+
+	newFakeClock(t)
+	tuning := &FragmentTuning{MinSize: 100, MaxSize: 800}
+
+	// fragments larger than 200 bytes time out
+	server, lengths := newAckServer(t, func(start, n int64) int {
+		if n > 200 {
+			return http.StatusGatewayTimeout
+		}
+		return http.StatusOK
+	})
+	s := &Session{ID: "session", URL: server.URL, client: &Client{FragmentSize: 800, FragmentTuning: tuning}}
+	if received, err := s.SendFile(context.Background(), server.URL, bytes.NewReader(make([]byte, 1000)), 1000); err != nil || received != 1000 {
+		t.Fatalf("failed to send the file: %v %v", received, err)
+	}
+	if got := lengths(); !reflect.DeepEqual(got[:3], []int64{800, 400, 200}) {
+		t.Errorf("expected the fragment to be halved until it went through, got %v", got)
+	}
+
+	// a file that can't be read again fails
+	s = &Session{ID: "session", URL: server.URL, client: &Client{FragmentSize: 800, FragmentTuning: tuning}}
+	if _, err := s.SendFile(context.Background(), server.URL, io.MultiReader(bytes.NewReader(make([]byte, 1000))), 1000); !isTimeout(err) {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+
+	// the smallest fragment timing out fails the file
+	server, lengths = newAckServer(t, func(start, n int64) int { return http.StatusGatewayTimeout })
+	s = &Session{ID: "session", URL: server.URL, client: &Client{FragmentSize: 800, FragmentTuning: tuning}}
+	if _, err := s.SendFile(context.Background(), server.URL, bytes.NewReader(make([]byte, 1000)), 1000); !isTimeout(err) {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+	if want := []int64{800, 400, 200, 100}; !reflect.DeepEqual(lengths(), want) {
+		t.Errorf("expected fragments of %v bytes, got %v", want, lengths())
+	}
+}
+
+func TestProgress(t *testing.T) {
+
+	server, _ := newAckServer(t, func(start, n int64) int { return http.StatusOK })
+	type progress struct{ sent, total int64 }
+	var got []progress
+	c := &Client{FragmentSize: 4, Progress: func(url string, sent, total int64) {
+		if url != server.URL+"/file.txt" {
+			t.Errorf("unexpected url %v", url)
+		}
+		got = append(got, progress{sent, total})
+	}}
+	s := &Session{ID: "session", URL: server.URL, client: c}
+
+	testcases := []struct {
+		name     string
+		data     string
+		size     int64
+		progress []progress
+	}{
+		{"known size", "0123456789", 10, []progress{{4, 10}, {8, 10}, {10, 10}}},
+		{"unknown size", "0123456789", -1, []progress{{4, -1}, {8, -1}, {10, 10}}},
+		{"empty", "", 0, []progress{{0, 0}}},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			got = nil
+			if _, err := s.SendFile(context.Background(), server.URL+"/file.txt", bytes.NewReader([]byte(tc.data)), tc.size); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.progress) {
+				t.Errorf("expected progress %v, got %v", tc.progress, got)
+			}
+		})
+	}
+}
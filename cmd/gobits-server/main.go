@@ -0,0 +1,253 @@
+// Command gobits-server is a standalone BITS upload server.
+//
+// It serves the gobits handler under a path prefix, and is configured with flags or the
+// environment variables named after them, like GOBITS_LISTEN for -listen. Flags take
+// precedence over the environment. The rest of the handler can be configured with a JSON file
+// given with -config, see gobits.LoadConfig, the flags and environment take precedence over it.
+// Completed files are moved to the destination directory, or left in the session directories
+// in the temp directory if there is none.
+//
+// The server stops on SIGINT or SIGTERM, letting the fragments being received finish. It logs
+// in JSON to stderr, and exits with status 2 if it is misconfigured.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"gitlab.com/magan/gobits"
+)
+
+// exit statuses
+const (
+	exitOK     = 0
+	exitFailed = 1 // the server failed while running
+	exitConfig = 2 // the flags or environment are invalid
+)
+
+// options are what the server is configured with
+type options struct {
+	listen          string
+	prefix          string
+	certFile        string
+	keyFile         string
+	tempDir         string
+	destDir         string
+	maxSize         uint64
+	maxFragmentSize uint64
+	allowed         []string
+	disallowed      []string
+	sessionTimeout  time.Duration
+	shutdownTimeout time.Duration
+	configFile      string
+	set             map[string]bool // the flags set on the command line or in the environment
+}
+
+// listFlag is a flag that can be repeated, or given as a comma separated list
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+// parse the flags, with the defaults taken from the environment
+func parseOptions(args []string, getenv func(string) string, output io.Writer) (options, error) {
+	opts := options{set: make(map[string]bool)}
+	var allowed, disallowed listFlag
+	fs := flag.NewFlagSet("gobits-server", flag.ContinueOnError)
+	fs.SetOutput(output)
+	fs.StringVar(&opts.listen, "listen", ":8080", "address to listen on")
+	fs.StringVar(&opts.prefix, "prefix", "/BITS/", "path the uploads are sent to")
+	fs.StringVar(&opts.certFile, "tls-cert", "", "TLS certificate file, serves HTTPS with -tls-key")
+	fs.StringVar(&opts.keyFile, "tls-key", "", "TLS key file")
+	fs.StringVar(&opts.tempDir, "temp-dir", filepath.Join(os.TempDir(), "gobits"), "directory of the unfinished uploads")
+	fs.StringVar(&opts.destDir, "dest-dir", "", "directory completed files are moved to")
+	fs.Uint64Var(&opts.maxSize, "max-size", 0, "max size in bytes of a file, 0 for no limit")
+	fs.Uint64Var(&opts.maxFragmentSize, "max-fragment-size", 0, "max size in bytes of a fragment, 0 for no limit")
+	fs.Var(&allowed, "allowed", "regexps of the allowed filenames, all if none")
+	fs.Var(&disallowed, "disallowed", "regexps of the disallowed filenames")
+	fs.DurationVar(&opts.sessionTimeout, "session-timeout", 0, "expire sessions that get no fragment for this long, 0 for never")
+	fs.DurationVar(&opts.shutdownTimeout, "shutdown-timeout", 30*time.Second, "max time to wait for fragments being received when stopping")
+	fs.StringVar(&opts.configFile, "config", "", "JSON config file of the handler, the flags take precedence over it")
+
+	// the environment is the default of the flags
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		name := "GOBITS_" + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if value := getenv(name); value != "" && err == nil {
+			if err = f.Value.Set(value); err != nil {
+				err = fmt.Errorf("invalid value %q for %v: %v", value, name, err)
+			}
+			opts.set[f.Name] = true
+		}
+	})
+	if err != nil {
+		return options{}, err
+	}
+	if err = fs.Parse(args); err != nil {
+		return options{}, err
+	}
+	fs.Visit(func(f *flag.Flag) {
+		opts.set[f.Name] = true
+	})
+	if fs.NArg() > 0 {
+		return options{}, fmt.Errorf("unexpected arguments %v", fs.Args())
+	}
+	if (opts.certFile == "") != (opts.keyFile == "") {
+		return options{}, errors.New("-tls-cert and -tls-key must be set together")
+	}
+	opts.allowed, opts.disallowed = allowed, disallowed
+	return opts, nil
+}
+
+// get the config of the handler of the options. The flags that are set take precedence over
+// the config file, and the others are only used if the file doesn't set them
+func handlerConfig(opts options, logger *slog.Logger) (gobits.Config, error) {
+	var cfg gobits.Config
+	if opts.configFile != "" {
+		var err error
+		if cfg, err = gobits.LoadConfig(opts.configFile); err != nil {
+			return gobits.Config{}, err
+		}
+	}
+	use := func(flag string, unset bool) bool {
+		return opts.set[flag] || unset
+	}
+
+	if use("temp-dir", cfg.TempDir == "") {
+		cfg.TempDir = opts.tempDir
+	}
+	if use("dest-dir", cfg.DestDir == "") {
+		cfg.DestDir = opts.destDir
+	}
+	if use("max-size", cfg.MaxSize == 0) {
+		cfg.MaxSize = opts.maxSize
+	}
+	if use("max-fragment-size", cfg.MaxFragmentSize == 0) {
+		cfg.MaxFragmentSize = opts.maxFragmentSize
+	}
+	if use("allowed", cfg.Allowed == nil) {
+		cfg.Allowed = opts.allowed
+	}
+	if use("disallowed", cfg.Disallowed == nil) {
+		cfg.Disallowed = opts.disallowed
+	}
+	if use("session-timeout", cfg.SessionTimeout == 0) {
+		cfg.SessionTimeout = opts.sessionTimeout
+	}
+	if use("prefix", cfg.PathPrefix == "") {
+		cfg.PathPrefix = opts.prefix
+	}
+	cfg.Logger = logger
+	return cfg, nil
+}
+
+// run the server until ctx is done. The address it listens on is sent to started, if it isn't
+// nil. Returns the exit status
+func run(ctx context.Context, args []string, getenv func(string) string, logger *slog.Logger, started chan<- net.Addr) int {
+	opts, err := parseOptions(args, getenv, io.Discard)
+	if err != nil {
+		logger.Error("invalid configuration", "error", err)
+		return exitConfig
+	}
+	cfg, err := handlerConfig(opts, logger)
+	if err != nil {
+		logger.Error("invalid configuration", "error", err)
+		return exitConfig
+	}
+	handler, err := gobits.NewHandler(cfg, nil)
+	if err != nil {
+		logger.Error("invalid configuration", "error", err)
+		return exitConfig
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(cfg.PathPrefix, handler)
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 30 * time.Second,
+		ErrorLog:          slog.NewLogLogger(logger.Handler(), slog.LevelWarn),
+	}
+
+	listener, err := net.Listen("tcp", opts.listen)
+	if err != nil {
+		logger.Error("failed to listen", "address", opts.listen, "error", err)
+		return exitConfig
+	}
+	logger.Info("server started", "address", listener.Addr().String(), "tls", opts.certFile != "", "temp_dir", cfg.TempDir, "dest_dir", cfg.DestDir)
+	if started != nil {
+		started <- listener.Addr()
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		if opts.certFile != "" {
+			served <- server.ServeTLS(listener, opts.certFile, opts.keyFile)
+		} else {
+			served <- server.Serve(listener)
+		}
+	}()
+
+	select {
+	case err = <-served:
+		logger.Error("server failed", "error", err)
+		return exitFailed
+	case <-ctx.Done():
+	}
+
+	// Stop taking new sessions, and let the fragments being received finish
+	logger.Info("server stopping")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), opts.shutdownTimeout)
+	defer cancel()
+	status := exitOK
+	if err = handler.Shutdown(shutdownCtx); err != nil {
+		logger.Error("failed to finish fragments", "error", err)
+		status = exitFailed
+	}
+	if err = server.Shutdown(shutdownCtx); err != nil {
+		logger.Error("failed to stop server", "error", err)
+		status = exitFailed
+	}
+
+	// Write the audit records and deliver the webhook events still queued
+	if err = handler.Close(shutdownCtx); err != nil {
+		logger.Error("failed to deliver queued events", "error", err)
+		status = exitFailed
+	}
+	logger.Info("server stopped")
+	return status
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// print the usage for -h, run logs everything else
+	if _, err := parseOptions(os.Args[1:], os.Getenv, os.Stderr); errors.Is(err, flag.ErrHelp) {
+		os.Exit(exitOK)
+	}
+
+	logger := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	os.Exit(run(ctx, os.Args[1:], os.Getenv, logger, nil))
+}
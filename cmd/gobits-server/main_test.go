@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gitlab.com/magan/gobits/client"
+)
+
+// syncBuffer is a buffer the server can log to while the test reads it
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// get the environment from a map
+func env(vars map[string]string) func(string) string {
+	return func(name string) string {
+		return vars[name]
+	}
+}
+
+func TestServer(t *testing.T) {
+
+	tempDir, destDir := t.TempDir(), filepath.Join(t.TempDir(), "dest")
+	var logs syncBuffer
+	logger := slog.New(slog.NewJSONHandler(&logs, nil))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	started := make(chan net.Addr, 1)
+	exited := make(chan int, 1)
+	go func() {
+		exited <- run(ctx, []string{"-listen", "127.0.0.1:0", "-temp-dir", tempDir, "-disallowed", `.*\.exe`}, env(map[string]string{
+			"GOBITS_DEST_DIR": destDir,
+			"GOBITS_MAX_SIZE": "1024",
+		}), logger, started)
+	}()
+
+	var addr net.Addr
+	select {
+	case addr = <-started:
+	case status := <-exited:
+		t.Fatalf("server exited with %v: %v", status, logs.String())
+	}
+	url := "http://" + addr.String() + "/BITS/"
+
+	// an upload of a file in two fragments
+	c := &client.Client{FragmentSize: 5}
+	if err := c.Ping(ctx, url); err != nil {
+		t.Fatalf("ping failed: %v", err)
+	}
+	session, err := c.CreateSession(ctx, url)
+	if err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+	if _, err = session.SendFile(ctx, url+"file.txt", strings.NewReader("0123456789"), 10); err != nil {
+		t.Fatalf("failed to send file: %v", err)
+	}
+
+	// the configuration is applied
+	var bitsErr *client.Error
+	if _, err = session.SendFile(ctx, url+"file.exe", strings.NewReader("x"), 1); !errors.As(err, &bitsErr) || bitsErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected the disallowed file to be refused, got %v", err)
+	}
+	if _, err = session.Close(ctx); err != nil {
+		t.Fatalf("failed to close session: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(destDir, "file.txt"))
+	if err != nil || string(data) != "0123456789" {
+		t.Errorf("expected the file in the destination directory, got %q, %v", data, err)
+	}
+
+	cancel()
+	select {
+	case status := <-exited:
+		if status != exitOK {
+			t.Errorf("expected exit status %v, got %v", exitOK, status)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("server didn't stop")
+	}
+
+	// the lifecycle is logged in JSON
+	var messages []string
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var entry struct{ Msg string }
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("invalid log line %q: %v", line, err)
+		}
+		messages = append(messages, entry.Msg)
+	}
+	for _, msg := range []string{"server started", "session created", "file received", "session closed", "server stopping", "server stopped"} {
+		found := false
+		for _, m := range messages {
+			found = found || m == msg
+		}
+		if !found {
+			t.Errorf("expected %q to be logged, got %v", msg, messages)
+		}
+	}
+}
+
+func TestServerConfigErrors(t *testing.T) {
+
+	testcases := []struct {
+		name string
+		args []string
+		env  map[string]string
+	}{
+		{"unknown flag", []string{"-unknown"}, nil},
+		{"invalid size", []string{"-max-size", "big"}, nil},
+		{"invalid environment", nil, map[string]string{"GOBITS_SESSION_TIMEOUT": "soon"}},
+		{"invalid regexp", []string{"-allowed", "["}, nil},
+		{"tls key without cert", []string{"-tls-key", "key.pem"}, nil},
+		{"arguments", []string{"extra"}, nil},
+		{"invalid address", []string{"-listen", "nowhere"}, nil},
+		{"missing config", []string{"-config", "missing.json"}, nil},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			var logs syncBuffer
+			args := append([]string{"-temp-dir", t.TempDir()}, tc.args...)
+			status := run(context.Background(), args, env(tc.env), slog.New(slog.NewJSONHandler(&logs, nil)), nil)
+			if status != exitConfig {
+				t.Errorf("expected exit status %v, got %v", exitConfig, status)
+			}
+			if !strings.Contains(logs.String(), `"level":"ERROR"`) {
+				t.Errorf("expected the error to be logged, got %v", logs.String())
+			}
+		})
+	}
+}
+
+func TestServerConfigFile(t *testing.T) {
+
+	file := filepath.Join(t.TempDir(), "gobits.json")
+	config := `{"dest_dir": "/srv/uploads", "max_size": "1GB", "allowed": ["\\.log$"], "path_prefix": "/uploads/"}`
+	if err := os.WriteFile(file, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the flags that are set take precedence over the file, and the others are defaults
+	opts, err := parseOptions([]string{"-config", file, "-max-size", "100", "-session-timeout", "1h"}, env(map[string]string{"GOBITS_DEST_DIR": "/srv/bits"}), io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := handlerConfig(opts, slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.MaxSize != 100 || cfg.DestDir != "/srv/bits" {
+		t.Errorf("expected the flags to take precedence, got %v and %v", cfg.MaxSize, cfg.DestDir)
+	}
+	if len(cfg.Allowed) != 1 || cfg.Allowed[0] != `\.log$` || cfg.PathPrefix != "/uploads/" {
+		t.Errorf("expected the settings of the file, got %v and %v", cfg.Allowed, cfg.PathPrefix)
+	}
+	if cfg.SessionTimeout != time.Hour || cfg.FragmentIdleTimeout != 0 {
+		t.Errorf("expected the session timeout to expire sessions, got %v and %v", cfg.SessionTimeout, cfg.FragmentIdleTimeout)
+	}
+	if cfg.TempDir != opts.tempDir {
+		t.Errorf("expected the default temp dir, got %v", cfg.TempDir)
+	}
+}
@@ -0,0 +1,435 @@
+package gobits
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fileConfig is the JSON of a config file. Only the settings that aren't code can be set, the
+// names are the fields of the Config in snake case
+type fileConfig struct {
+	TempDir                string     `json:"temp_dir"`
+	ShardDepth             int        `json:"shard_depth"`
+	DestDir                string     `json:"dest_dir"`
+	AllowedMethod          string     `json:"allowed_method"`
+	Protocol               string     `json:"protocol"`
+	Protocols              []string   `json:"protocols"`
+	MaxSize                any        `json:"max_size"`
+	MaxFragmentSize        any        `json:"max_fragment_size"`
+	Allowed                []string   `json:"allowed"`
+	Disallowed             []string   `json:"disallowed"`
+	FilterIgnoreCase       bool       `json:"filter_ignore_case"`
+	FilterAnchored         bool       `json:"filter_anchored"`
+	FilterMode             string     `json:"filter_mode"`
+	Rules                  []fileRule `json:"rules"`
+	StrictRanges           bool       `json:"strict_ranges"`
+	SessionSecret          string     `json:"session_secret"`
+	ReadTimeout            string     `json:"read_timeout"`
+	FragmentIdleTimeout    string     `json:"fragment_idle_timeout"`
+	SessionTimeout         string     `json:"session_timeout"`
+	AcceptEncoding         string     `json:"accept_encoding"`
+	ServerHeader           string     `json:"server_header"`
+	HealthPath             string     `json:"health_path"`
+	VerboseErrors          bool       `json:"verbose_errors"`
+	PartSuffix             string     `json:"part_suffix"`
+	PreservePath           bool       `json:"preserve_path"`
+	PathPrefix             string     `json:"path_prefix"`
+	MaxFilenameLength      int        `json:"max_filename_length"`
+	FilenamePattern        string     `json:"filename_pattern"`
+	WindowsSafeFilenames   bool       `json:"windows_safe_filenames"`
+	OnExistingFile         string     `json:"on_existing_file"`
+	OnCollision            string     `json:"on_collision"`
+	DeduplicateCreate      bool       `json:"deduplicate_create"`
+	IdempotencyHeader      string     `json:"idempotency_header"`
+	CaptureHeaders         []string   `json:"capture_headers"`
+	StrictClose            bool       `json:"strict_close"`
+	DeleteOnClose          bool       `json:"delete_on_close"`
+	SyncPolicy             string     `json:"sync_policy"`
+	MaxTempDirSize         any        `json:"max_temp_dir_size"`
+	CheckDiskSpace         bool       `json:"check_disk_space"`
+	Preallocate            bool       `json:"preallocate"`
+	HashFiles              bool       `json:"hash_files"`
+	HashAlgorithm          string     `json:"hash_algorithm"`
+	AdvertiseCapabilities  bool       `json:"advertise_capabilities"`
+	MaxTotalBytesPerSecond any        `json:"max_total_bytes_per_second"`
+	Expvar                 bool       `json:"expvar"`
+	ExpvarName             string     `json:"expvar_name"`
+	AllowedNetworks        []string   `json:"allowed_networks"`
+	DeniedNetworks         []string   `json:"denied_networks"`
+	TrustedProxies         []string   `json:"trusted_proxies"`
+	ProxyHeader            string     `json:"proxy_header"`
+	AuthenticateAll        bool       `json:"authenticate_all"`
+	BindSessions           bool       `json:"bind_sessions"`
+	BindIgnoreAddress      bool       `json:"bind_ignore_address"`
+	WebhookURL             string     `json:"webhook_url"`
+	WebhookSecret          string     `json:"webhook_secret"`
+}
+
+// fileRule is a Rule in a config file
+type fileRule struct {
+	Pattern string `json:"pattern"`
+	MinSize any    `json:"min_size"`
+	MaxSize any    `json:"max_size"`
+	Deny    bool   `json:"deny"`
+}
+
+// names of the policies in config files
+var (
+	filterModes = map[string]int{
+		"regexp": int(FilterRegexp),
+		"glob":   int(FilterGlob),
+	}
+	existingFilePolicies = map[string]int{
+		"overwrite": int(ExistingFileOverwrite),
+		"reject":    int(ExistingFileReject),
+		"rename":    int(ExistingFileRename),
+	}
+	syncPolicies = map[string]int{
+		"none":           int(SyncNone),
+		"on-complete":    int(SyncOnComplete),
+		"every-fragment": int(SyncEveryFragment),
+	}
+	proxyHeaders = map[string]int{
+		"x-forwarded-for": int(ProxyXForwarded),
+		"forwarded":       int(ProxyForwarded),
+	}
+	hashAlgorithms = map[string]int{
+		"sha256": int(HashSHA256),
+		"sha1":   int(HashSHA1),
+		"md5":    int(HashMD5),
+	}
+)
+
+// units of sizes, by their lower case names
+var sizeUnits = map[string]uint64{
+	"":    1,
+	"b":   1,
+	"kb":  1000,
+	"mb":  1000 * 1000,
+	"gb":  1000 * 1000 * 1000,
+	"tb":  1000 * 1000 * 1000 * 1000,
+	"kib": 1 << 10,
+	"mib": 1 << 20,
+	"gib": 1 << 30,
+	"tib": 1 << 40,
+}
+
+var sizePattern = regexp.MustCompile(`^([0-9]+(?:\.[0-9]+)?)\s*([a-zA-Z]*)$`)
+
+// LoadConfig reads a Config from a JSON file, for NewHandler. The names are the fields of the
+// Config in snake case, like "max_fragment_size", and unknown names are rejected. Sizes are
+// numbers of bytes or strings with a unit, like "200MB" or "1.5GiB", and timeouts are durations
+// like "30s". The policies are named in lower case, like "rename" or "every-fragment".
+//
+// Settings that are code, like the callbacks, can't be in the file, and are set on the returned
+// Config. Every invalid setting is reported at once, joined with errors.Join
+func LoadConfig(path string) (Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, err
+	}
+
+	var fc fileConfig
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	dec.UseNumber()
+	if err = dec.Decode(&fc); err != nil {
+		return Config{}, fmt.Errorf("failed to parse config '%s': %v", path, err)
+	}
+	if _, err = dec.Token(); err != io.EOF {
+		return Config{}, fmt.Errorf("failed to parse config '%s': unexpected data after the config", path)
+	}
+
+	cfg, err := fc.config()
+	if err != nil {
+		return Config{}, fmt.Errorf("invalid config '%s':\n%w", path, err)
+	}
+	return cfg, nil
+}
+
+// convert the file to a Config, and validate it
+func (fc fileConfig) config() (Config, error) {
+	var errs []error
+	fail := func(name string, err error) {
+		errs = append(errs, fmt.Errorf("%s: %w", name, err))
+	}
+	size := func(name string, value any) uint64 {
+		n, err := parseSize(value)
+		if err != nil {
+			fail(name, err)
+		}
+		return n
+	}
+	policy := func(name, value string, policies map[string]int) int {
+		if value == "" {
+			return 0
+		}
+		p, ok := policies[strings.ToLower(value)]
+		if !ok {
+			names := make([]string, 0, len(policies))
+			for n := range policies {
+				names = append(names, n)
+			}
+			sort.Strings(names)
+			fail(name, fmt.Errorf("unknown value '%s', must be one of %s", value, strings.Join(names, ", ")))
+		}
+		return p
+	}
+	duration := func(name, value string) time.Duration {
+		if value == "" {
+			return 0
+		}
+		d, err := time.ParseDuration(value)
+		if err == nil && d < 0 {
+			err = fmt.Errorf("negative duration '%s'", value)
+		}
+		if err != nil {
+			fail(name, err)
+		}
+		return d
+	}
+
+	cfg := Config{
+		TempDir:                fc.TempDir,
+		ShardDepth:             fc.ShardDepth,
+		DestDir:                fc.DestDir,
+		AllowedMethod:          fc.AllowedMethod,
+		Protocol:               fc.Protocol,
+		Protocols:              fc.Protocols,
+		MaxSize:                size("max_size", fc.MaxSize),
+		MaxFragmentSize:        size("max_fragment_size", fc.MaxFragmentSize),
+		Allowed:                fc.Allowed,
+		Disallowed:             fc.Disallowed,
+		FilterIgnoreCase:       fc.FilterIgnoreCase,
+		FilterAnchored:         fc.FilterAnchored,
+		FilterMode:             FilterMode(policy("filter_mode", fc.FilterMode, filterModes)),
+		StrictRanges:           fc.StrictRanges,
+		ReadTimeout:            duration("read_timeout", fc.ReadTimeout),
+		FragmentIdleTimeout:    duration("fragment_idle_timeout", fc.FragmentIdleTimeout),
+		SessionTimeout:         duration("session_timeout", fc.SessionTimeout),
+		AcceptEncoding:         fc.AcceptEncoding,
+		ServerHeader:           fc.ServerHeader,
+		HealthPath:             fc.HealthPath,
+		VerboseErrors:          fc.VerboseErrors,
+		PartSuffix:             fc.PartSuffix,
+		PreservePath:           fc.PreservePath,
+		PathPrefix:             fc.PathPrefix,
+		MaxFilenameLength:      fc.MaxFilenameLength,
+		FilenamePattern:        fc.FilenamePattern,
+		WindowsSafeFilenames:   fc.WindowsSafeFilenames,
+		OnExistingFile:         ExistingFilePolicy(policy("on_existing_file", fc.OnExistingFile, existingFilePolicies)),
+		OnCollision:            ExistingFilePolicy(policy("on_collision", fc.OnCollision, existingFilePolicies)),
+		DeduplicateCreate:      fc.DeduplicateCreate,
+		IdempotencyHeader:      fc.IdempotencyHeader,
+		CaptureHeaders:         fc.CaptureHeaders,
+		StrictClose:            fc.StrictClose,
+		DeleteOnClose:          fc.DeleteOnClose,
+		SyncPolicy:             SyncPolicy(policy("sync_policy", fc.SyncPolicy, syncPolicies)),
+		ProxyHeader:            ProxyHeader(policy("proxy_header", fc.ProxyHeader, proxyHeaders)),
+		MaxTempDirSize:         size("max_temp_dir_size", fc.MaxTempDirSize),
+		CheckDiskSpace:         fc.CheckDiskSpace,
+		Preallocate:            fc.Preallocate,
+		HashFiles:              fc.HashFiles,
+		HashAlgorithm:          HashAlgorithm(policy("hash_algorithm", fc.HashAlgorithm, hashAlgorithms)),
+		AdvertiseCapabilities:  fc.AdvertiseCapabilities,
+		MaxTotalBytesPerSecond: size("max_total_bytes_per_second", fc.MaxTotalBytesPerSecond),
+		Expvar:                 fc.Expvar,
+		ExpvarName:             fc.ExpvarName,
+		AllowedNetworks:        fc.AllowedNetworks,
+		DeniedNetworks:         fc.DeniedNetworks,
+		AuthenticateAll:        fc.AuthenticateAll,
+		BindSessions:           fc.BindSessions,
+		BindIgnoreAddress:      fc.BindIgnoreAddress,
+		WebhookURL:             fc.WebhookURL,
+	}
+	if fc.SessionSecret != "" {
+		cfg.SessionSecret = []byte(fc.SessionSecret)
+	}
+	if fc.WebhookSecret != "" {
+		cfg.WebhookSecret = []byte(fc.WebhookSecret)
+	}
+	for i, r := range fc.Rules {
+		name := fmt.Sprintf("rules[%d]", i)
+		cfg.Rules = append(cfg.Rules, Rule{
+			Pattern: r.Pattern,
+			MinSize: size(name+".min_size", r.MinSize),
+			MaxSize: size(name+".max_size", r.MaxSize),
+			Deny:    r.Deny,
+		})
+	}
+	for _, network := range fc.TrustedProxies {
+		prefixes, err := parseNetworks([]string{network})
+		if err != nil {
+			fail("trusted_proxies", err)
+			continue
+		}
+		cfg.TrustedProxies = append(cfg.TrustedProxies, prefixes...)
+	}
+
+	// the settings NewHandler would refuse, checked here to report them all
+	errs = append(errs, cfg.validate(true)...)
+
+	if len(errs) > 0 {
+		return Config{}, errors.Join(errs...)
+	}
+	return cfg, nil
+}
+
+// validate checks the settings of a Config, for NewHandler and LoadConfig, and returns every
+// invalid one. With keys, the errors are prefixed with the key of the setting in a config file,
+// and the settings are named by their keys instead of their fields
+func (cfg Config) validate(keys bool) []error {
+	var errs []error
+	fail := func(key string, err error) {
+		if keys && key != "" {
+			err = fmt.Errorf("%s: %w", key, err)
+		}
+		errs = append(errs, err)
+	}
+	name := func(field, key string) string {
+		if keys {
+			return key
+		}
+		return field
+	}
+
+	// protocols are GUIDs in braces
+	if cfg.Protocol != "" && !isProtocol(cfg.Protocol) {
+		fail("protocol", fmt.Errorf("%w '%s', must be a GUID in braces", ErrInvalidProtocol, cfg.Protocol))
+	}
+	for _, p := range cfg.Protocols {
+		if !isProtocol(p) {
+			fail("protocols", fmt.Errorf("%w '%s', must be a GUID in braces", ErrInvalidProtocol, p))
+		}
+	}
+
+	// the UUID only has so many characters before the first dash
+	if cfg.ShardDepth < 0 || cfg.ShardDepth > maxShardDepth {
+		fail("shard_depth", fmt.Errorf("%w: shard depth %d, must be 0 to %d", ErrInvalidOption, cfg.ShardDepth, maxShardDepth))
+	}
+	if cfg.MaxFilenameLength < 0 {
+		fail("max_filename_length", fmt.Errorf("%w: negative length %d", ErrInvalidOption, cfg.MaxFilenameLength))
+	}
+
+	// the policies must be known
+	if cfg.FilterMode != FilterRegexp && cfg.FilterMode != FilterGlob {
+		fail("filter_mode", fmt.Errorf("%w: filter mode %d", ErrInvalidOption, cfg.FilterMode))
+	}
+	if cfg.OnExistingFile < ExistingFileOverwrite || cfg.OnExistingFile > ExistingFileRename {
+		fail("on_existing_file", fmt.Errorf("%w: existing file policy %d", ErrInvalidOption, cfg.OnExistingFile))
+	}
+	if cfg.OnCollision < ExistingFileOverwrite || cfg.OnCollision > ExistingFileRename {
+		fail("on_collision", fmt.Errorf("%w: existing file policy %d", ErrInvalidOption, cfg.OnCollision))
+	}
+	if cfg.SyncPolicy < SyncNone || cfg.SyncPolicy > SyncEveryFragment {
+		fail("sync_policy", fmt.Errorf("%w: sync policy %d", ErrInvalidOption, cfg.SyncPolicy))
+	}
+	if cfg.ProxyHeader != ProxyXForwarded && cfg.ProxyHeader != ProxyForwarded {
+		fail("proxy_header", fmt.Errorf("%w: proxy header %d", ErrInvalidOption, cfg.ProxyHeader))
+	}
+	if cfg.HashFiles {
+		if _, err := cfg.HashAlgorithm.new(); err != nil {
+			fail("hash_algorithm", fmt.Errorf("%w: %v", ErrInvalidOption, err))
+		}
+	}
+
+	// the filters must compile, unless the FileFilter replaces them
+	if cfg.FileFilter == nil {
+		for _, pattern := range cfg.Allowed {
+			if _, err := compileFilter(cfg, pattern); err != nil {
+				fail("allowed", fmt.Errorf("%w: %v", ErrInvalidFilter, err))
+			}
+		}
+		for _, pattern := range cfg.Disallowed {
+			if _, err := compileFilter(cfg, pattern); err != nil {
+				fail("disallowed", fmt.Errorf("%w: %v", ErrInvalidFilter, err))
+			}
+		}
+		for i, rule := range cfg.Rules {
+			if _, err := compileFilter(cfg, rule.Pattern); err != nil {
+				fail(fmt.Sprintf("rules[%d].pattern", i), fmt.Errorf("%w: %v", ErrInvalidFilter, err))
+			}
+			if rule.MaxSize != 0 && rule.MinSize > rule.MaxSize {
+				fail(fmt.Sprintf("rules[%d]", i), fmt.Errorf("%w: %s %d is larger than %s %d", ErrInvalidOption,
+					name("MinSize", "min_size"), rule.MinSize, name("MaxSize", "max_size"), rule.MaxSize))
+			}
+		}
+	}
+	if cfg.FilenamePattern != "" {
+		if _, err := regexp.Compile(cfg.FilenamePattern); err != nil {
+			fail("filename_pattern", fmt.Errorf("%w: failed to compile regexp '%s': %v", ErrInvalidFilter, cfg.FilenamePattern, err))
+		}
+	}
+
+	// the networks are addresses or CIDR prefixes
+	for _, network := range cfg.AllowedNetworks {
+		if _, err := parseNetworks([]string{network}); err != nil {
+			fail("allowed_networks", err)
+		}
+	}
+	for _, network := range cfg.DeniedNetworks {
+		if _, err := parseNetworks([]string{network}); err != nil {
+			fail("denied_networks", err)
+		}
+	}
+	if cfg.WebhookURL != "" {
+		if u, err := url.Parse(cfg.WebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fail("webhook_url", fmt.Errorf("%w: webhook URL '%s' must be an absolute http or https URL", ErrInvalidOption, cfg.WebhookURL))
+		}
+	}
+
+	// options that do nothing without another are likely mistakes
+	needs := func(option, key, needed, neededKey string) {
+		fail("", fmt.Errorf("%w: %s needs %s", ErrConflictingOptions, name(option, key), name(needed, neededKey)))
+	}
+	if cfg.BindIgnoreAddress && !cfg.BindSessions {
+		needs("BindIgnoreAddress", "bind_ignore_address", "BindSessions", "bind_sessions")
+	}
+	if len(cfg.WebhookSecret) > 0 && cfg.WebhookURL == "" {
+		needs("WebhookSecret", "webhook_secret", "WebhookURL", "webhook_url")
+	}
+	if cfg.ExpvarName != "" && !cfg.Expvar {
+		needs("ExpvarName", "expvar_name", "Expvar", "expvar")
+	}
+	return errs
+}
+
+// parse a size of a config file, a number of bytes or a string with a unit
+func parseSize(value any) (uint64, error) {
+	switch v := value.(type) {
+	case nil:
+		return 0, nil
+	case json.Number:
+		n, err := strconv.ParseUint(v.String(), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid size %s, must be a whole number of bytes", v)
+		}
+		return n, nil
+	case string:
+		m := sizePattern.FindStringSubmatch(strings.TrimSpace(v))
+		if m == nil {
+			return 0, fmt.Errorf("invalid size '%s'", v)
+		}
+		unit, ok := sizeUnits[strings.ToLower(m[2])]
+		if !ok {
+			return 0, fmt.Errorf("invalid size '%s', unknown unit '%s'", v, m[2])
+		}
+		n, err := strconv.ParseFloat(m[1], 64)
+		if err != nil || n*float64(unit) >= math.MaxUint64 {
+			return 0, fmt.Errorf("invalid size '%s', too large", v)
+		}
+		return uint64(n * float64(unit)), nil
+	}
+	return 0, fmt.Errorf("invalid size %v, must be a number or a string", value)
+}
@@ -0,0 +1,189 @@
+package gobits
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "update the golden files of the tests")
+
+// describe the fields of a config that are set, one per line
+func describeConfig(cfg Config) string {
+	var sb strings.Builder
+	v := reflect.ValueOf(cfg)
+	for i := 0; i < v.NumField(); i++ {
+		if f := v.Field(i); !f.IsZero() {
+			value := f.Interface()
+			if secret, ok := value.([]byte); ok {
+				value = string(secret)
+			}
+			fmt.Fprintf(&sb, "%s: %v\n", v.Type().Field(i).Name, value)
+		}
+	}
+	return sb.String()
+}
+
+func TestLoadConfig(t *testing.T) {
+
+	files, err := filepath.Glob(filepath.Join("testdata", "config", "*.json"))
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no configs: %v", err)
+	}
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			cfg, err := LoadConfig(file)
+			if err != nil {
+				t.Fatalf("failed to load config: %v", err)
+			}
+
+			golden := strings.TrimSuffix(file, ".json") + ".golden"
+			got := describeConfig(cfg)
+			if *updateGolden {
+				if err = os.WriteFile(golden, []byte(got), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != string(want) {
+				t.Errorf("unexpected config, got:\n%s\nwant:\n%s", got, want)
+			}
+
+			// the config is accepted as it is, but kept out of the system directories
+			cfg.TempDir, cfg.DestDir = t.TempDir(), ""
+			if _, err = NewHandler(cfg, nil); err != nil {
+				t.Errorf("config refused by NewHandler: %v", err)
+			}
+		})
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		config string
+		errors []string
+	}{
+		{"syntax", `{"temp_dir": }`, []string{"failed to parse config"}},
+		{"unknown field", `{"tmp_dir": "/tmp"}`, []string{`unknown field "tmp_dir"`}},
+		{"callback", `{"session_callback": "log"}`, []string{`unknown field "session_callback"`}},
+		{"trailing data", `{} {}`, []string{"unexpected data after the config"}},
+		{"wrong type", `{"shard_depth": "2"}`, []string{"shard_depth"}},
+		{"size unit", `{"max_size": "20XB"}`, []string{"max_size: invalid size '20XB', unknown unit 'XB'"}},
+		{"size syntax", `{"max_fragment_size": "lots"}`, []string{"max_fragment_size: invalid size 'lots'"}},
+		{"negative size", `{"max_size": -1}`, []string{"max_size: invalid size -1"}},
+		{"fractional bytes", `{"max_size": 1.5}`, []string{"max_size: invalid size 1.5"}},
+		{"size type", `{"max_size": true}`, []string{"max_size: invalid size true"}},
+		{"size overflow", `{"max_temp_dir_size": "20000000TiB"}`, []string{"max_temp_dir_size: invalid size '20000000TiB', too large"}},
+		{"duration", `{"read_timeout": "10"}`, []string{"read_timeout: time: missing unit"}},
+		{"negative duration", `{"fragment_idle_timeout": "-1h"}`, []string{"fragment_idle_timeout: negative duration '-1h'"}},
+		{"filter mode", `{"filter_mode": "regex"}`, []string{"filter_mode: unknown value 'regex', must be one of glob, regexp"}},
+		{"existing file", `{"on_existing_file": "keep"}`, []string{"on_existing_file: unknown value 'keep'"}},
+		{"collision", `{"on_collision": "merge"}`, []string{"on_collision: unknown value 'merge'"}},
+		{"sync policy", `{"sync_policy": "always"}`, []string{"sync_policy: unknown value 'always', must be one of every-fragment, none, on-complete"}},
+		{"hash algorithm", `{"hash_algorithm": "sha512"}`, []string{"hash_algorithm: unknown value 'sha512'"}},
+		{"shard depth", `{"shard_depth": 5}`, []string{"shard_depth: invalid option: shard depth 5"}},
+		{"protocol", `{"protocol": "upload"}`, []string{"protocol: invalid protocol 'upload'"}},
+		{"protocols", `{"protocols": ["{7df0354d-249b-430f-820d-3d2a9bef4931}", "{nope}"]}`, []string{"protocols: invalid protocol '{nope}'"}},
+		{"allowed", `{"allowed": ["("]}`, []string{"allowed: invalid filter: failed to compile regexp '('"}},
+		{"disallowed glob", `{"filter_mode": "glob", "disallowed": ["["]}`, []string{"disallowed: invalid filter: invalid glob '['"}},
+		{"rule pattern", `{"rules": [{"pattern": "*"}]}`, []string{"rules[0].pattern: invalid filter: failed to compile regexp '*'"}},
+		{"rule sizes", `{"rules": [{"pattern": "a", "min_size": "2MB", "max_size": "1MB"}]}`, []string{"rules[0]: invalid option: min_size 2000000 is larger than max_size 1000000"}},
+		{"rule size", `{"rules": [{"pattern": "a"}, {"pattern": "b", "max_size": "big"}]}`, []string{"rules[1].max_size: invalid size 'big'"}},
+		{"filename pattern", `{"filename_pattern": "[a-"}`, []string{"filename_pattern: invalid filter: failed to compile regexp '[a-'"}},
+		{"filename length", `{"max_filename_length": -1}`, []string{"max_filename_length: invalid option: negative length -1"}},
+		{"allowed networks", `{"allowed_networks": ["10.0.0.0/33"]}`, []string{"allowed_networks: invalid network '10.0.0.0/33'"}},
+		{"denied networks", `{"denied_networks": ["example.com"]}`, []string{"denied_networks: invalid network 'example.com'"}},
+		{"trusted proxies", `{"trusted_proxies": ["proxy"]}`, []string{"trusted_proxies: invalid network 'proxy'"}},
+		{"proxy header", `{"proxy_header": "x-real-ip"}`, []string{"proxy_header: unknown value 'x-real-ip', must be one of forwarded, x-forwarded-for"}},
+		{"webhook url", `{"webhook_url": "hooks.example.com"}`, []string{"webhook_url: invalid option: webhook URL 'hooks.example.com'"}},
+		{"bind address", `{"bind_ignore_address": true}`, []string{"conflicting options: bind_ignore_address needs bind_sessions"}},
+		{"webhook secret", `{"webhook_secret": "secret"}`, []string{"conflicting options: webhook_secret needs webhook_url"}},
+		{"expvar name", `{"expvar_name": "uploads"}`, []string{"conflicting options: expvar_name needs expvar"}},
+		{"every mistake", `{"max_size": "1ZB", "read_timeout": "soon", "sync_policy": "never", "allowed": ["("]}`, []string{
+			"max_size: invalid size '1ZB'",
+			"read_timeout: time: invalid duration",
+			"sync_policy: unknown value 'never'",
+			"allowed: invalid filter: failed to compile regexp '('",
+		}},
+	}
+
+	dir := t.TempDir()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file := filepath.Join(dir, strings.ReplaceAll(test.name, " ", "-")+".json")
+			if err := os.WriteFile(file, []byte(test.config), 0644); err != nil {
+				t.Fatal(err)
+			}
+			_, err := LoadConfig(file)
+			if err == nil {
+				t.Fatal("expected the config to be refused")
+			}
+			for _, want := range test.errors {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("expected error %q in:\n%v", want, err)
+				}
+			}
+
+			// the invalid settings are reported one by one
+			var joined interface{ Unwrap() []error }
+			if errors.As(err, &joined) && len(joined.Unwrap()) != len(test.errors) {
+				t.Errorf("expected %d errors, got:\n%v", len(test.errors), err)
+			}
+		})
+	}
+
+	// the errors of NewHandler tell the invalid settings apart
+	sentinels := map[string]error{
+		`{"protocols": ["upload"]}`:                        ErrInvalidProtocol,
+		`{"rules": [{"pattern": "("}]}`:                    ErrInvalidFilter,
+		`{"trusted_proxies": ["proxy"]}`:                   ErrInvalidNetwork,
+		`{"shard_depth": -1}`:                              ErrInvalidOption,
+		`{"max_size": "big", "bind_ignore_address": true}`: ErrConflictingOptions,
+	}
+	for config, sentinel := range sentinels {
+		file := filepath.Join(dir, "sentinel.json")
+		if err := os.WriteFile(file, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadConfig(file); !errors.Is(err, sentinel) {
+			t.Errorf("%v: expected %v, got %v", config, sentinel, err)
+		}
+	}
+
+	if _, err := LoadConfig(filepath.Join(dir, "missing.json")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected a missing config to not exist, got %v", err)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+
+	tests := []struct {
+		value string
+		want  uint64
+	}{
+		{"0", 0},
+		{"512", 512},
+		{"512B", 512},
+		{"1kb", 1000},
+		{"1KiB", 1024},
+		{"200MB", 200 * 1000 * 1000},
+		{"200 MiB", 200 << 20},
+		{"1.5GiB", 3 << 29},
+		{"2TB", 2 * 1000 * 1000 * 1000 * 1000},
+	}
+	for _, test := range tests {
+		if got, err := parseSize(test.value); err != nil || got != test.want {
+			t.Errorf("%v: expected %v, got %v %v", test.value, test.want, got, err)
+		}
+	}
+}
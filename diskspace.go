@@ -0,0 +1,10 @@
+package gobits
+
+import "errors"
+
+// errDiskSpaceUnsupported is returned by freeSpace on platforms where it isn't known
+var errDiskSpaceUnsupported = errors.New("free disk space is unknown on this platform")
+
+// get the bytes available to the process on the file system of a directory. It is a variable
+// so tests can fake a full disk
+var freeSpace = diskFree
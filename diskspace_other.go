@@ -0,0 +1,8 @@
+//go:build !(linux || darwin || freebsd)
+
+package gobits
+
+// the free disk space isn't checked on other platforms
+func diskFree(dir string) (uint64, error) {
+	return 0, errDiskSpaceUnsupported
+}
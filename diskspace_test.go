@@ -0,0 +1,80 @@
+package gobits
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestCheckDiskSpace(t *testing.T) {
+
+	// a disk with 100 bytes left
+	var asked []string
+	freeSpace = func(dir string) (uint64, error) {
+		asked = append(asked, dir)
+		return 100, nil
+	}
+	defer func() { freeSpace = diskFree }()
+
+	testcases := []struct {
+		name   string
+		check  bool
+		length uint64
+		status int
+	}{
+		{name: "fits", check: true, length: 100, status: http.StatusOK},
+		{name: "too large", check: true, length: 1000, status: http.StatusInsufficientStorage},
+		{name: "not checked", length: 1000, status: http.StatusOK},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			asked = nil
+			h := newTestHandler(t, Config{CheckDiskSpace: tc.check}, nil)
+			uuid := createSession(t, h)
+
+			res := sendFragment(h, uuid, "file.bin", []byte("data"), 0, tc.length)
+			res.Body.Close()
+			if res.StatusCode != tc.status {
+				t.Fatalf("expected status %v, got %v", tc.status, res.StatusCode)
+			}
+			if tc.check != (len(asked) == 1) {
+				t.Errorf("expected the disk to be checked once: %v, got %v", tc.check, asked)
+			}
+			if res.StatusCode == http.StatusOK {
+				// later fragments of the file aren't checked again
+				res = sendFragment(h, uuid, "file.bin", []byte("more"), 4, tc.length)
+				res.Body.Close()
+				if len(asked) > 1 {
+					t.Errorf("disk checked again for a later fragment: %v", asked)
+				}
+				return
+			}
+			if context := res.Header.Get("BITS-Error-Context"); context != "4" {
+				t.Errorf("expected error context 4, got %v", context)
+			}
+			if _, err := os.Stat(filepath.Join(h.cfg.TempDir, uuid, "file.bin"+h.cfg.PartSuffix)); !os.IsNotExist(err) {
+				t.Errorf("part file created for a file that doesn't fit: %v", err)
+			}
+		})
+	}
+
+}
+
+func TestDiskFree(t *testing.T) {
+
+	free, err := diskFree(t.TempDir())
+	switch runtime.GOOS {
+	case "linux", "darwin", "freebsd":
+		if err != nil || free == 0 {
+			t.Errorf("expected the free space of the TempDir, got %v, %v", free, err)
+		}
+	default:
+		if err != errDiskSpaceUnsupported {
+			t.Errorf("expected %v, got %v", errDiskSpaceUnsupported, err)
+		}
+	}
+
+}
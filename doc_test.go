@@ -8,6 +8,7 @@ package gobits
 import (
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"path"
@@ -47,12 +48,71 @@ func ExampleConfig_defaults() {
 	_ = &Config{
 		TempDir:       path.Join(os.TempDir(), "gobits"),
 		AllowedMethod: "BITS_POST",
-		Protocol:      "{7df0354d-249b-430f-820d-3d2a9bef4931}",
+		Protocol:      ProtocolUpload15,
+		Protocols:     []string{ProtocolUpload15},
 		MaxSize:       0, // <= 0 means no limit
 		Allowed: []string{
 			".*",
 		},
-		Disallowed: []string{},
+		Disallowed:        []string{},
+		StrictRanges:      false,
+		AcceptEncoding:    "Identity",
+		PartSuffix:        ".gobits-part",
+		MaxFilenameLength: 243, // 255 minus the length of the part suffix
+	}
+
+}
+
+func ExampleConfig_filters() {
+
+	// match the filters case-insensitively against the whole filename, so "SETUP.EXE" is
+	// rejected while "exe.txt" and "setup.exe.txt" are allowed
+	_ = &Config{
+		Disallowed: []string{
+			`.*\.exe`,
+			`.*\.msi`,
+		},
+		FilterIgnoreCase: true,
+		FilterAnchored:   true,
+
+		// and reject renamed executables by their content
+		ContentSniffer: SniffExecutable,
+	}
+
+}
+
+func ExampleRule() {
+
+	// allow 2GB images, cap logs at 10MB except the debug log which is denied, and reject
+	// empty files of any other kind. The first matching rule is used
+	_ = &Config{
+		MaxSize: 2 << 30,
+		Rules: []Rule{
+			{Pattern: `.*\.wim`},
+			{Pattern: `debug\.log`, Deny: true},
+			{Pattern: `.*\.log`, MaxSize: 10 << 20},
+			{Pattern: `.*`, MinSize: 1, MaxSize: 1 << 30},
+		},
+	}
+
+}
+
+// jobFilter only allows the files announced for a job
+type jobFilter struct {
+	files map[string]uint64 // announced sizes by filename
+}
+
+func (f *jobFilter) Allow(session, filename string, declaredSize uint64) error {
+	if size, ok := f.files[filename]; !ok || size != declaredSize {
+		return &RejectError{Code: 0x80190194, Reason: "file not announced for the job"}
+	}
+	return nil
+}
+
+func ExampleFileFilter() {
+
+	_ = &Config{
+		FileFilter: &jobFilter{files: map[string]uint64{"report.pdf": 12345}},
 	}
 
 }
@@ -85,3 +145,19 @@ func ExampleCallbackFunc() {
 	}
 
 }
+
+func ExampleConfig_filenameMapper() {
+
+	// the name is derived from the fragment alone, so all fragments of a file end up in the
+	// same file without remembering anything
+	_ = &Config{
+		FilenameMapper: func(r *http.Request, session, requested string) (string, error) {
+			host, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%s_%s_%s", host, session, requested), nil
+		},
+	}
+
+}
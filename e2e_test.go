@@ -0,0 +1,211 @@
+package gobits
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"gitlab.com/magan/gobits/client"
+)
+
+// testURL is where the handler is for a client of testClient
+const testURL = "http://gobits.test/BITS/"
+
+// handlerTransport serves the requests of a client with a handler, without a server
+type handlerTransport struct {
+	h http.Handler
+}
+
+func (t handlerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	var body []byte
+	if r.Body != nil {
+		var err error
+		body, err = io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// the request as a server would get it, with canonical header keys
+	sr := httptest.NewRequest(r.Method, r.URL.String(), bytes.NewReader(body)).WithContext(r.Context())
+	for k, v := range r.Header {
+		for _, value := range v {
+			sr.Header.Add(k, value)
+		}
+	}
+	if r.ContentLength >= 0 {
+		sr.Header.Set("Content-Length", strconv.FormatInt(r.ContentLength, 10))
+	}
+
+	rec := httptest.NewRecorder()
+	t.h.ServeHTTP(rec, sr)
+	res := rec.Result()
+	res.Request = r
+	return res, nil
+}
+
+// a client sending its requests to the handler at testURL
+func testClient(h *Handler) *client.Client {
+	return &client.Client{
+		HTTPClient: &http.Client{Transport: handlerTransport{h}},
+		Method:     h.cfg.AllowedMethod,
+		Protocols:  []string{h.cfg.Protocol},
+	}
+}
+
+// create a session with the client of the handler
+func clientSession(t *testing.T, h *Handler) *client.Session {
+	t.Helper()
+
+	s, err := testClient(h).CreateSession(context.Background(), testURL)
+	if err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+	return s
+}
+
+// serve a handler over HTTP for the client
+func newTestServer(t *testing.T, cfg Config, cb CallbackFunc) (*Handler, string) {
+	t.Helper()
+
+	h := newTestHandler(t, cfg, cb)
+	server := httptest.NewServer(h)
+	t.Cleanup(server.Close)
+	return h, server.URL + "/BITS/"
+}
+
+func TestClientUpload(t *testing.T) {
+
+	var mu sync.Mutex
+	var received []string
+	destDir := t.TempDir()
+	_, url := newTestServer(t, Config{DestDir: destDir, PreservePath: true, PathPrefix: "/BITS/"}, func(event Event, session, path string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if event == EventRecieveFile {
+			received = append(received, filepath.Base(path))
+		}
+	})
+	ctx := context.Background()
+	c := &client.Client{FragmentSize: 1000}
+
+	if err := c.Ping(ctx, url); err != nil {
+		t.Fatalf("failed to ping: %v", err)
+	}
+	s, err := c.CreateSession(ctx, url)
+	if err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+
+	files := map[string][]byte{
+		"logs/app.log": bytes.Repeat([]byte("line\n"), 1000),
+		"empty.txt":    nil,
+		"small.txt":    []byte("small"),
+	}
+	for name, data := range files {
+		size := int64(len(data))
+		if name == "logs/app.log" {
+			size = -1
+		}
+		if n, err := s.SendFile(ctx, url+name, bytes.NewReader(data), size); err != nil || n != int64(len(data)) {
+			t.Fatalf("failed to send %v: %v %v", name, n, err)
+		}
+	}
+	result, err := s.Close(ctx)
+	if err != nil {
+		t.Fatalf("failed to close session: %v", err)
+	}
+	if result.SessionID != s.ID || len(result.Files) != len(files) {
+		t.Errorf("unexpected result %+v", result)
+	}
+
+	for name, want := range files {
+		if data, err := os.ReadFile(filepath.Join(destDir, filepath.FromSlash(name))); err != nil || !bytes.Equal(data, want) {
+			t.Errorf("expected %v to be received, got %v bytes, %v", name, len(data), err)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != len(files) {
+		t.Errorf("expected %v files to be received, got %v", len(files), received)
+	}
+}
+
+func TestClientResume(t *testing.T) {
+
+	h, url := newTestServer(t, Config{}, nil)
+	ctx := context.Background()
+	c := &client.Client{FragmentSize: 4}
+	s, err := c.CreateSession(ctx, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the start of the file is sent by an earlier attempt, and skipped by the client
+	content := "0123456789abcdefghij"
+	res := sendFragment(h, s.ID, "file.txt", []byte(content[:10]), 0, 20)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("failed to send fragment: %v", res.Status)
+	}
+	if n, err := s.SendFile(ctx, url+"file.txt", strings.NewReader(content), 20); err != nil || n != 20 {
+		t.Fatalf("failed to send the rest of the file: %v %v", n, err)
+	}
+	data, err := os.ReadFile(filepath.Join(h.cfg.TempDir, s.ID, "file.txt"))
+	if err != nil || string(data) != content {
+		t.Errorf("expected the whole file, got %q, %v", data, err)
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+
+	_, url := newTestServer(t, Config{MaxSize: 10, Disallowed: []string{`\.exe$`}}, nil)
+	ctx := context.Background()
+	c := &client.Client{}
+	s, err := c.CreateSession(ctx, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testcases := []struct {
+		name   string
+		file   string
+		size   int64
+		status int
+		code   uint32
+	}{
+		{"too large", "large.bin", 11, http.StatusRequestEntityTooLarge, 0},
+		{"disallowed", "setup.exe", 1, http.StatusBadRequest, codeAccessDenied},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := s.SendFile(ctx, url+tc.file, bytes.NewReader(make([]byte, tc.size)), tc.size)
+			var bitsErr *client.Error
+			if !errors.As(err, &bitsErr) {
+				t.Fatalf("expected a BITS error, got %v", err)
+			}
+			if bitsErr.StatusCode != tc.status || bitsErr.Code != tc.code || bitsErr.Context != int(ErrorContextRemoteFile) || bitsErr.SessionID != s.ID {
+				t.Errorf("unexpected error %+v", bitsErr)
+			}
+		})
+	}
+
+	// a canceled session is gone
+	if err = s.Cancel(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var bitsErr *client.Error
+	if _, err = s.Close(ctx); !errors.As(err, &bitsErr) || bitsErr.StatusCode != http.StatusNotFound {
+		t.Errorf("expected the session to be gone, got %v", err)
+	}
+}
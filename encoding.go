@@ -0,0 +1,68 @@
+package gobits
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"strings"
+)
+
+// Fragments sent with a Content-Encoding of gzip or deflate are decompressed before they are
+// stored. The Content-Range of such a fragment is the range of the decompressed file, and the
+// Content-Length is the size of the compressed body. Each fragment is compressed on its own, and
+// must decompress to exactly its range. Other encodings accepted by AcceptEncoding are stored
+// as they are sent
+//
+// A fragment is decompressed in memory, so its range is limited by MaxFragmentSize, or by
+// maxDecodedFragment without one. A small body can't claim a huge range and exhaust the memory
+
+// maxDecodedFragment is the largest range of a compressed fragment if there is no MaxFragmentSize
+const maxDecodedFragment = 64 << 20
+
+// Reasons for rejecting a compressed fragment
+var (
+	errEncodingInvalid = errors.New("invalid compressed data")
+	errEncodingLength  = errors.New("compressed data doesn't match the range")
+)
+
+// get the encoding a fragment is decompressed from, empty if it is stored as it is sent
+func decodedEncoding(encoding string) string {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "gzip", "x-gzip":
+		return "gzip"
+	case "deflate":
+		return "deflate"
+	}
+	return ""
+}
+
+// decompress the body of a fragment, which must decompress to size bytes with nothing following
+// the compressed data
+func decodeFragment(body []byte, encoding string, size uint64) ([]byte, error) {
+	in := bytes.NewReader(body)
+	var decoder io.ReadCloser
+	var err error
+	switch encoding {
+	case "gzip":
+		decoder, err = gzip.NewReader(in)
+	case "deflate":
+		// deflate in HTTP is zlib wrapped, RFC 9110
+		decoder, err = zlib.NewReader(in)
+	}
+	if err != nil {
+		return nil, errEncodingInvalid
+	}
+	defer decoder.Close()
+
+	// Read one byte too many to detect streams longer than the range
+	data, err := io.ReadAll(io.LimitReader(decoder, int64(size)+1))
+	if err != nil {
+		return nil, errEncodingInvalid
+	}
+	if uint64(len(data)) != size || in.Len() > 0 {
+		return nil, errEncodingLength
+	}
+	return data, nil
+}
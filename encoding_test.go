@@ -0,0 +1,166 @@
+package gobits
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// compress data with an encoding
+func compress(t *testing.T, encoding string, data []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	var w interface {
+		Write([]byte) (int, error)
+		Close() error
+	}
+	if encoding == "gzip" {
+		w = gzip.NewWriter(&buf)
+	} else {
+		w = zlib.NewWriter(&buf)
+	}
+	w.Write(data)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// send a compressed fragment of the range start to start+size-1
+func sendEncoded(h *Handler, uuid, filename, encoding string, body []byte, start, size, length uint64) *http.Response {
+	return doPacket(h, "Fragment", uuid, "/BITS/"+filename, map[string]string{
+		"Content-Range":    fmt.Sprintf("bytes %d-%d/%d", start, start+size-1, length),
+		"Content-Length":   strconv.Itoa(len(body)),
+		"Content-Encoding": encoding,
+	}, body)
+}
+
+func TestEncodedFragments(t *testing.T) {
+
+	content := bytes.Repeat([]byte("compressible "), 100)
+	half := uint64(len(content) / 2)
+	length := uint64(len(content))
+
+	for _, encoding := range []string{"gzip", "deflate"} {
+		t.Run(encoding, func(t *testing.T) {
+			h := newTestHandler(t, Config{AcceptEncoding: "gzip, deflate"}, nil)
+			uuid := createSession(t, h)
+
+			// the ranges are of the decompressed file
+			for _, start := range []uint64{0, half} {
+				res := sendEncoded(h, uuid, "file.txt", encoding, compress(t, encoding, content[start:start+half]), start, half, length)
+				res.Body.Close()
+				if res.StatusCode != http.StatusOK {
+					t.Fatalf("fragment at %v: %v", start, res.Status)
+				}
+				if got := res.Header.Get("BITS-Received-Content-Range"); got != strconv.FormatUint(start+half, 10) {
+					t.Errorf("fragment at %v: expected received range %v, got %v", start, start+half, got)
+				}
+			}
+
+			data, err := os.ReadFile(filepath.Join(h.cfg.TempDir, uuid, "file.txt"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, content) {
+				t.Errorf("unexpected content %q", data)
+			}
+		})
+	}
+}
+
+func TestEncodedFragmentsInvalid(t *testing.T) {
+
+	content := []byte("0123456789")
+	valid := compress(t, "gzip", content)
+
+	testcases := []struct {
+		name    string
+		body    []byte
+		size    uint64
+		headers map[string]string
+		status  int
+	}{
+		{"corrupt", []byte("not gzip at all"), 10, nil, http.StatusBadRequest},
+		{"truncated", valid[:len(valid)-4], 10, nil, http.StatusBadRequest},
+		{"longer than range", valid, 5, nil, http.StatusBadRequest},
+		{"shorter than range", valid, 20, nil, http.StatusBadRequest},
+		{"trailing data", append(append([]byte{}, valid...), 'x'), 10, nil, http.StatusBadRequest},
+		{"no content length", valid, 10, map[string]string{"Content-Length": ""}, http.StatusLengthRequired},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newTestHandler(t, Config{AcceptEncoding: "gzip"}, nil)
+			uuid := createSession(t, h)
+
+			headers := map[string]string{
+				"Content-Range":    fmt.Sprintf("bytes 0-%d/%d", tc.size-1, tc.size),
+				"Content-Length":   strconv.Itoa(len(tc.body)),
+				"Content-Encoding": "gzip",
+			}
+			for k, v := range tc.headers {
+				headers[k] = v
+			}
+			res := doPacket(h, "Fragment", uuid, "/BITS/file.txt", headers, tc.body)
+			res.Body.Close()
+			if res.StatusCode != tc.status {
+				t.Fatalf("expected status %v, got %v", tc.status, res.StatusCode)
+			}
+			if exist, _ := exists(filepath.Join(h.cfg.TempDir, uuid, "file.txt"+h.cfg.PartSuffix)); exist {
+				t.Error("nothing should be stored")
+			}
+		})
+	}
+}
+
+func TestEncodedFragmentsBomb(t *testing.T) {
+
+	// a few KB of gzip that would inflate to 10 GB
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	zeros := make([]byte, 1<<20)
+	for i := 0; i < 16; i++ {
+		w.Write(zeros)
+	}
+	w.Close()
+	bomb := buf.Bytes()
+	const length = 10 << 30
+
+	testcases := []struct {
+		name   string
+		cfg    Config
+		status int
+	}{
+		{"default limit", Config{AcceptEncoding: "gzip"}, http.StatusRequestEntityTooLarge},
+		{"max fragment size", Config{AcceptEncoding: "gzip", MaxFragmentSize: 1 << 20}, http.StatusRequestEntityTooLarge},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newTestHandler(t, tc.cfg, nil)
+			uuid := createSession(t, h)
+
+			res := sendEncoded(h, uuid, "bomb.bin", "gzip", bomb, 0, length, length)
+			res.Body.Close()
+			if res.StatusCode != tc.status {
+				t.Errorf("expected status %v, got %v", tc.status, res.Status)
+			}
+		})
+	}
+
+	// a range within the limit is still decompressed
+	h := newTestHandler(t, Config{AcceptEncoding: "gzip"}, nil)
+	uuid := createSession(t, h)
+	res := sendEncoded(h, uuid, "zeros.bin", "gzip", bomb, 0, 16<<20, 16<<20)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("expected the fragment to be received, got %v", res.Status)
+	}
+}
@@ -7,7 +7,6 @@ package main
 
 import (
 	"fmt"
-	"io"
 	"net/http"
 	"os"
 	"path"
@@ -23,7 +22,7 @@ func main() {
 	cfg := &gobits.Config{
 		TempDir:       path.Join(os.TempDir(), "gobits"),
 		AllowedMethod: "BITS_POST",
-		Protocol:      "{7df0354d-249b-430f-820d-3d2a9bef4931}",
+		Protocol:      gobits.ProtocolUpload15,
 
 		MaxSize: 200 * 1024 * 1024,
 
@@ -35,6 +34,8 @@ func main() {
 			".*\\.exe",
 			".*\\.msi",
 		},
+		FilterIgnoreCase: true,
+		FilterAnchored:   true,
 	}
 
 	// Callback to handle events
@@ -71,72 +72,3 @@ func main() {
 	http.Handle("/BITS/", bits)
 	fmt.Println(http.ListenAndServe(":8080", nil))
 }
-
-func moveFile(src, dst string) (err error) {
-	var fs os.FileInfo
-	if fs, err = os.Stat(src); err != nil {
-		return err
-	}
-	if !fs.Mode().IsRegular() {
-		return fmt.Errorf("source must be a file")
-	}
-
-	var fd os.FileInfo
-	if fd, err = os.Stat(dst); err != nil {
-		if !os.IsNotExist(err) {
-			// Some error with Stat
-			return err
-		}
-		// File doesnt exist
-	} else {
-		// File exists
-		if !fd.Mode().IsRegular() {
-			return fmt.Errorf("destination must be a file")
-		}
-		if os.SameFile(fs, fd) {
-			// No need to move the file, they are the same
-			return nil
-		}
-	}
-
-	// Best solution: Create a hard link and remove the old file
-	if err = os.Link(src, dst); err != nil {
-		// Ok, try and rename the file (move it)
-		if err = os.Rename(src, dst); err != nil {
-			// Failed to move it, then copy it
-			if err = copyFileContents(src, dst); err != nil {
-				// Well, what else can we do!?
-				return err
-			}
-		}
-	}
-	err = os.Remove(src)
-	return err
-}
-
-// copyFileContents copies the contents of the file named src to the file named
-// by dst. The file will be created if it does not already exist. If the
-// destination file exists, all it's contents will be replaced by the contents
-// of the source file.
-func copyFileContents(src, dst string) (err error) {
-	in, err := os.Open(src)
-	if err != nil {
-		return
-	}
-	defer in.Close()
-	out, err := os.Create(dst)
-	if err != nil {
-		return
-	}
-	defer func() {
-		cerr := out.Close()
-		if err == nil {
-			err = cerr
-		}
-	}()
-	if _, err = io.Copy(out, in); err != nil {
-		return
-	}
-	err = out.Sync()
-	return
-}
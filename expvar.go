@@ -0,0 +1,86 @@
+package gobits
+
+import (
+	"expvar"
+	"fmt"
+	"time"
+)
+
+// expvarMetrics publishes the metrics of a handler as an expvar map
+type expvarMetrics struct {
+	sessions   expvar.Int    // sessions created
+	active     expvar.Int    // sessions created since the start that are still active
+	received   expvar.Int    // bytes received
+	completed  expvar.Int    // files received completely
+	rejections expvar.Map    // rejected fragments, by result
+	lastError  expvar.String // the last error reported to the ErrorHandler
+}
+
+// publish the expvar map of a handler named "gobits." + name. Expvars can't be removed, so a
+// name can only be used once in a process
+func newExpvarMetrics(name string) (*expvarMetrics, error) {
+	name = "gobits." + name
+	if expvar.Get(name) != nil {
+		return nil, fmt.Errorf("expvar %s is already published", name)
+	}
+	m := &expvarMetrics{}
+	m.rejections.Init()
+	vars := new(expvar.Map).Init()
+	vars.Set("sessions", &m.sessions)
+	vars.Set("active_sessions", &m.active)
+	vars.Set("received_bytes", &m.received)
+	vars.Set("files_completed", &m.completed)
+	vars.Set("rejections", &m.rejections)
+	vars.Set("last_error", &m.lastError)
+	expvar.Publish(name, vars)
+	return m, nil
+}
+
+// IncCounter implements MetricsCollector
+func (m *expvarMetrics) IncCounter(name string, labels map[string]string, delta float64) {
+	switch name {
+	case MetricSessions:
+		if labels["event"] == "created" {
+			m.sessions.Add(int64(delta))
+		}
+	case MetricFragments:
+		if result := labels["result"]; result != FragmentAccepted {
+			m.rejections.Add(result, int64(delta))
+		}
+	case MetricReceivedBytes:
+		m.received.Add(int64(delta))
+	case MetricFilesCompleted:
+		m.completed.Add(int64(delta))
+	}
+}
+
+// SetGauge implements MetricsCollector
+func (m *expvarMetrics) SetGauge(name string, value float64) {
+	if name == MetricActiveSessions {
+		m.active.Set(int64(value))
+	}
+}
+
+// ObserveDuration implements MetricsCollector
+func (m *expvarMetrics) ObserveDuration(name string, d time.Duration) {}
+
+// multiMetrics sends the metrics to each of its collectors
+type multiMetrics []MetricsCollector
+
+func (c multiMetrics) IncCounter(name string, labels map[string]string, delta float64) {
+	for _, m := range c {
+		m.IncCounter(name, labels, delta)
+	}
+}
+
+func (c multiMetrics) SetGauge(name string, value float64) {
+	for _, m := range c {
+		m.SetGauge(name, value)
+	}
+}
+
+func (c multiMetrics) ObserveDuration(name string, d time.Duration) {
+	for _, m := range c {
+		m.ObserveDuration(name, d)
+	}
+}
@@ -0,0 +1,78 @@
+package gobits
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+)
+
+// get the expvars of a handler from /debug/vars
+func debugVars(t *testing.T, name string) map[string]interface{} {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	expvar.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/vars", nil))
+	var vars map[string]json.RawMessage
+	if err := json.Unmarshal(rec.Body.Bytes(), &vars); err != nil {
+		t.Fatal(err)
+	}
+	var handler map[string]interface{}
+	if err := json.Unmarshal(vars["gobits."+name], &handler); err != nil {
+		t.Fatal(err)
+	}
+	return handler
+}
+
+// expvars can't be published twice, runs of the tests need their own names
+var expvarRuns int
+
+func TestExpvar(t *testing.T) {
+
+	expvarRuns++
+	name := fmt.Sprintf("test%d", expvarRuns)
+	fs := &memFS{}
+	h := newTestHandler(t, Config{Expvar: true, ExpvarName: name, Disallowed: []string{`.*\.exe`}}, nil).WithFileSystem(fs)
+	before := debugVars(t, name)
+	if before["sessions"] != 0.0 || before["received_bytes"] != 0.0 {
+		t.Fatalf("unexpected vars before the upload: %v", before)
+	}
+
+	// a file, a rejected file and a failed write
+	uuid := createSession(t, h)
+	res := sendFragment(h, uuid, "file.txt", []byte("data"), 0, 4)
+	res.Body.Close()
+	res = sendFragment(h, uuid, "virus.exe", []byte("MZ"), 0, 2)
+	res.Body.Close()
+	fs.writeErr = syscall.ENOSPC
+	res = sendFragment(h, uuid, "other.txt", []byte("data"), 0, 4)
+	res.Body.Close()
+
+	vars := debugVars(t, name)
+	for name, value := range map[string]interface{}{
+		"sessions":        1.0,
+		"active_sessions": 1.0,
+		"received_bytes":  4.0,
+		"files_completed": 1.0,
+	} {
+		if vars[name] != value {
+			t.Errorf("expected %v to be %v, got %v", name, value, vars[name])
+		}
+	}
+	rejections, _ := vars["rejections"].(map[string]interface{})
+	if rejections[FragmentRejected] != 1.0 || rejections[FragmentError] != 1.0 {
+		t.Errorf("unexpected rejections: %v", vars["rejections"])
+	}
+	if vars["last_error"] == "" {
+		t.Error("expected the last error to be published")
+	}
+
+	// the name can't be used by another handler
+	if _, err := NewHandler(Config{TempDir: t.TempDir(), Expvar: true, ExpvarName: name}, nil); err == nil {
+		t.Error("expected a second handler with the same expvar name to fail")
+	}
+
+}
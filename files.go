@@ -0,0 +1,51 @@
+package gobits
+
+import "sort"
+
+// FileStatus is what is known about a file sent to a session
+type FileStatus struct {
+	Name      string // The file relative to the session directory
+	Length    uint64 // The declared length, UnknownLength until a fragment declares it
+	Received  uint64 // Bytes received of the file
+	Completed bool   // The whole file is received
+}
+
+// Pending returns the number of files sent to the session that aren't completed yet
+func (s Session) Pending() int {
+	pending := 0
+	for _, f := range s.Files {
+		if !f.Completed {
+			pending++
+		}
+	}
+	return pending
+}
+
+// list the files sent to a tracked session, sorted by name. Sessions that aren't tracked have
+// no files, they aren't loaded for this
+func (b *Handler) sessionFiles(uuid string) []FileStatus {
+	b.mu.Lock()
+	s, ok := b.sessions[uuid]
+	b.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var files []FileStatus
+	for src, length := range s.lengths {
+		f := FileStatus{Name: b.sessionPath(uuid, src), Length: length, Completed: s.completed[src]}
+		if f.Completed {
+			// it may have been moved away
+			f.Received = length
+		} else if size, _, err := receivedSize(b.fs, src, src+b.cfg.PartSuffix); err == nil {
+			f.Received = size
+		}
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name < files[j].Name
+	})
+	return files
+}
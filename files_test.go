@@ -0,0 +1,58 @@
+package gobits
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestSessionFiles(t *testing.T) {
+
+	var received []Session
+	h := newTestHandler(t, Config{SessionCallback: func(event Event, s Session) {
+		if event == EventRecieveFile {
+			received = append(received, s)
+		}
+	}}, nil)
+	uuid := createSession(t, h)
+
+	fragments := []struct {
+		filename string
+		data     string
+		start    uint64
+		length   uint64
+	}{
+		{"b.txt", "0123", 0, 8},
+		{"a.txt", "data", 0, 4},
+		{"b.txt", "4567", 4, 8},
+	}
+	for _, f := range fragments {
+		res := sendFragment(h, uuid, f.filename, []byte(f.data), f.start, f.length)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("failed to send fragment of %v: %v", f.filename, res.Status)
+		}
+	}
+
+	expected := [][]FileStatus{
+		{{Name: "a.txt", Length: 4, Received: 4, Completed: true}, {Name: "b.txt", Length: 8, Received: 4}},
+		{{Name: "a.txt", Length: 4, Received: 4, Completed: true}, {Name: "b.txt", Length: 8, Received: 8, Completed: true}},
+	}
+	if len(received) != len(expected) {
+		t.Fatalf("expected %v received files, got %v", len(expected), len(received))
+	}
+	for i, s := range received {
+		if len(s.Files) != len(expected[i]) {
+			t.Errorf("event %v: expected files %+v, got %+v", i, expected[i], s.Files)
+			continue
+		}
+		for j, f := range s.Files {
+			if f != expected[i][j] {
+				t.Errorf("event %v: expected files %+v, got %+v", i, expected[i], s.Files)
+				break
+			}
+		}
+	}
+	if received[0].Pending() != 1 || received[1].Pending() != 0 {
+		t.Errorf("expected 1 and 0 pending files, got %v and %v", received[0].Pending(), received[1].Pending())
+	}
+}
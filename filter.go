@@ -0,0 +1,248 @@
+package gobits
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// FilterMode is the syntax of the Allowed and Disallowed filters and the Rules
+type FilterMode int
+
+// Syntaxes of the filters
+const (
+	FilterRegexp FilterMode = 0 // Regular expressions, like `.*\.jpg`
+	FilterGlob   FilterMode = 1 // Patterns matched by path.Match against the whole filename, like "*.jpg"
+)
+
+// FileFilter decides if a file may be uploaded. Allow is called for the first fragment of a file,
+// with the requested filename and the file size declared by the client, before anything is
+// written. The decision is kept for the following fragments, unless they declare another size.
+// The size is UnknownLength for fragments sent without it, a file isn't completed until a
+// fragment with the size is allowed. A non-nil error rejects the file, use a RejectError to
+// choose the BITS error code
+type FileFilter interface {
+	Allow(session, filename string, declaredSize uint64) error
+}
+
+// RejectError is the reason a file is rejected, with the error code sent to the client
+type RejectError struct {
+	Code   int    // BITS error code, a HRESULT
+	Reason string // Description of why the file is rejected
+}
+
+func (e *RejectError) Error() string {
+	return e.Reason
+}
+
+// Reasons for rejecting a file
+var (
+	ErrFileDisallowed     = &RejectError{Code: codeAccessDenied, Reason: "filename is not allowed"}
+	ErrFileSize           = &RejectError{Code: codeAccessDenied, Reason: "file size is not allowed"}
+	ErrFilenameRestricted = &RejectError{Code: codeAccessDenied, Reason: "filename can't be stored"}
+)
+
+// Rule limits the declared size of files with a name matching Pattern. Rules are evaluated in
+// order, and only the first rule matching a file is used. Files are rejected if the rule denies
+// them, or if their size is outside MinSize and MaxSize, a MaxSize of zero means no limit beyond
+// Config.MaxSize, and a MinSize of one refuses empty files. The pattern is matched like the
+// Allowed and Disallowed filters, which are applied before the rules
+type Rule struct {
+	Pattern string
+	MinSize uint64
+	MaxSize uint64
+	Deny    bool
+}
+
+// rejects reports if the rule rejects a file of the given size
+func (r Rule) rejects(size uint64) error {
+	if r.Deny {
+		return ErrFileDisallowed
+	}
+	if size == UnknownLength {
+		// checked when the size is sent
+		return nil
+	}
+	if size < r.MinSize || (r.MaxSize > 0 && size > r.MaxSize) {
+		return ErrFileSize
+	}
+	return nil
+}
+
+// regexpFilter is the FileFilter used when the config doesn't have one. It matches the
+// Allowed and Disallowed filters and the Rules against the base name of the file
+type regexpFilter struct {
+	allowed    []matcher
+	disallowed []matcher
+	rules      []regexpRule
+}
+
+type regexpRule struct {
+	Rule
+	re matcher
+}
+
+// matcher is a compiled filter, a *regexp.Regexp or a glob
+type matcher interface {
+	MatchString(s string) bool
+}
+
+// glob is a filter in the FilterGlob mode
+type glob struct {
+	pattern    string
+	ignoreCase bool
+}
+
+func (g glob) MatchString(s string) bool {
+	if g.ignoreCase {
+		s = strings.ToLower(s)
+	}
+	match, _ := path.Match(g.pattern, s)
+	return match
+}
+
+// compile the filters and rules of a config, with the matching options applied
+func newRegexpFilter(cfg Config) (*regexpFilter, error) {
+	f := &regexpFilter{}
+	compile := func(pattern string) (matcher, error) {
+		return compileFilter(cfg, pattern)
+	}
+
+	for _, n := range cfg.Allowed {
+		re, err := compile(n)
+		if err != nil {
+			return nil, err
+		}
+		f.allowed = append(f.allowed, re)
+	}
+	for _, n := range cfg.Disallowed {
+		re, err := compile(n)
+		if err != nil {
+			return nil, err
+		}
+		f.disallowed = append(f.disallowed, re)
+	}
+	for _, rule := range cfg.Rules {
+		re, err := compile(rule.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		f.rules = append(f.rules, regexpRule{Rule: rule, re: re})
+	}
+	return f, nil
+}
+
+// compile a pattern of the filters or rules in the FilterMode of the config
+func compileFilter(cfg Config, pattern string) (matcher, error) {
+	if cfg.FilterMode == FilterGlob {
+		return compileGlob(pattern, cfg.FilterIgnoreCase)
+	}
+	re, err := regexp.Compile(filterPattern(pattern, cfg.FilterIgnoreCase, cfg.FilterAnchored))
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile regexp '%s': %v", pattern, err)
+	}
+	return re, nil
+}
+
+// Allow implements FileFilter
+func (f *regexpFilter) Allow(session, filename string, declaredSize uint64) error {
+	name := path.Base(filename)
+
+	// See if filename is blacklisted
+	for _, re := range f.disallowed {
+		if re.MatchString(name) {
+			return ErrFileDisallowed
+		}
+	}
+
+	// See if filename is whitelisted
+	allowed := false
+	for _, re := range f.allowed {
+		if re.MatchString(name) {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return ErrFileDisallowed
+	}
+
+	// The first matching rule decides
+	if rule, ok := f.rule(name); ok {
+		return rule.rejects(declaredSize)
+	}
+	return nil
+}
+
+// rule finds the first rule matching the base name of a file
+func (f *regexpFilter) rule(name string) (Rule, bool) {
+	for _, rule := range f.rules {
+		if rule.re.MatchString(name) {
+			return rule.Rule, true
+		}
+	}
+	return Rule{}, false
+}
+
+// check that a fragment sent without the file size doesn't reach past the MaxSize of the rule
+// for the file. The MinSize is checked once the size is sent
+func (b *Handler) allowRange(filename string, end uint64) error {
+	f, ok := b.filter.(*regexpFilter)
+	if !ok {
+		return nil
+	}
+	if rule, ok := f.rule(path.Base(filename)); ok && rule.MaxSize > 0 && end > rule.MaxSize {
+		return ErrFileSize
+	}
+	return nil
+}
+
+// filterDecision is what the file filter decided for a file with the declared size
+type filterDecision struct {
+	length uint64
+	err    error
+}
+
+// ask the file filter if a file may be uploaded. The filter is only asked for the first fragment
+// of the file, and again if the file is sent with another size, e.g. once the size is known
+func (b *Handler) allowFile(uuid, filename string, length uint64) error {
+	s := b.lockSession(uuid)
+	defer s.mu.Unlock()
+	if decision, ok := s.decisions[filename]; ok && decision.length == length {
+		return decision.err
+	}
+	var err error
+	if f, ok := b.filter.(CertFileFilter); ok {
+		err = f.AllowCert(s.origin.cert, uuid, filename, length)
+	} else {
+		err = b.filter.Allow(uuid, filename, length)
+	}
+	if s.decisions == nil {
+		s.decisions = make(map[string]filterDecision)
+	}
+	s.decisions[filename] = filterDecision{length: length, err: err}
+	return err
+}
+
+// check the syntax of a glob, globs always match the whole filename
+func compileGlob(pattern string, ignoreCase bool) (glob, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return glob{}, fmt.Errorf("invalid glob '%s': %v", pattern, err)
+	}
+	if ignoreCase {
+		pattern = strings.ToLower(pattern)
+	}
+	return glob{pattern: pattern, ignoreCase: ignoreCase}, nil
+}
+
+// apply the matching options to a filter pattern
+func filterPattern(pattern string, ignoreCase, anchored bool) string {
+	if anchored {
+		pattern = "^(?:" + pattern + ")$"
+	}
+	if ignoreCase {
+		pattern = "(?i)" + pattern
+	}
+	return pattern
+}
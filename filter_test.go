@@ -0,0 +1,347 @@
+package gobits
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// manifestFilter only allows the files in a manifest, with their announced sizes
+type manifestFilter map[string]uint64
+
+func (m manifestFilter) Allow(session, filename string, declaredSize uint64) error {
+	size, ok := m[filename]
+	if !ok {
+		return &RejectError{Code: 0x80190194, Reason: "not in manifest"}
+	}
+	if size != declaredSize {
+		return errors.New("size differs from manifest")
+	}
+	return nil
+}
+
+func TestRegexpFilter(t *testing.T) {
+
+	f, err := newRegexpFilter(Config{
+		Allowed:    []string{`.*\.txt`, `.*\.zip`},
+		Disallowed: []string{`secret.*`},
+		Rules:      []Rule{{Pattern: `.*\.zip`, MinSize: 1, MaxSize: 10}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testcases := []struct {
+		filename string
+		size     uint64
+		err      error
+	}{
+		{filename: "file.txt", size: 100},
+		{filename: "dir/file.txt", size: 100},
+		{filename: "file.exe", size: 100, err: ErrFileDisallowed},
+		{filename: "secret.txt", size: 100, err: ErrFileDisallowed},
+		{filename: "file.zip", size: 10},
+		{filename: "file.zip", size: 11, err: ErrFileSize},
+		{filename: "file.zip", size: 0, err: ErrFileSize},
+		{filename: "file.zip", size: UnknownLength},
+		{filename: "file.exe", size: UnknownLength, err: ErrFileDisallowed},
+	}
+
+	for _, tc := range testcases {
+		if err := f.Allow("session", tc.filename, tc.size); err != tc.err {
+			t.Errorf("Allow(%q, %v) = %v, expected %v", tc.filename, tc.size, err, tc.err)
+		}
+	}
+
+	if _, err := newRegexpFilter(Config{Disallowed: []string{"("}}); err == nil {
+		t.Error("expected an invalid pattern to fail")
+	}
+
+}
+
+func TestRuleUnknownLength(t *testing.T) {
+
+	h := newTestHandler(t, Config{Rules: []Rule{{Pattern: `.*\.zip`, MinSize: 1, MaxSize: 10}}}, nil)
+	uuid := createSession(t, h)
+
+	// fragments without the file size must still fit within the rule
+	testcases := []struct {
+		rng    string
+		status int
+	}{
+		{rng: "bytes 0-4/*", status: http.StatusOK},
+		{rng: "bytes 5-9/*", status: http.StatusOK},
+		{rng: "bytes 10-14/*", status: http.StatusBadRequest},
+	}
+
+	for _, tc := range testcases {
+		res := doPacket(h, "Fragment", uuid, "/BITS/file.zip", map[string]string{
+			"Content-Range":  tc.rng,
+			"Content-Length": "5",
+		}, []byte("01234"))
+		res.Body.Close()
+		if res.StatusCode != tc.status {
+			t.Errorf("%v: expected status %v, got %v", tc.rng, tc.status, res.StatusCode)
+		}
+	}
+
+}
+
+func TestGlobFilter(t *testing.T) {
+
+	f, err := newRegexpFilter(Config{
+		FilterMode:       FilterGlob,
+		FilterIgnoreCase: true,
+		Allowed:          []string{"*.jpg", "*.zip"},
+		Disallowed:       []string{"secret*", "?.jpg"},
+		Rules:            []Rule{{Pattern: "*.zip", MaxSize: 10}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testcases := []struct {
+		filename string
+		size     uint64
+		err      error
+	}{
+		{filename: "photo.jpg", size: 100},
+		{filename: "PHOTO.JPG", size: 100},
+		{filename: "dir/photo.jpg", size: 100},
+		{filename: "photo.jpg.exe", size: 100, err: ErrFileDisallowed},
+		{filename: "photo.jpeg", size: 100, err: ErrFileDisallowed},
+		{filename: "xjpg", size: 100, err: ErrFileDisallowed},
+		{filename: "secret.jpg", size: 100, err: ErrFileDisallowed},
+		{filename: "a.jpg", size: 100, err: ErrFileDisallowed},
+		{filename: "file.zip", size: 10},
+		{filename: "file.zip", size: 11, err: ErrFileSize},
+	}
+
+	for _, tc := range testcases {
+		if err := f.Allow("session", tc.filename, tc.size); err != tc.err {
+			t.Errorf("Allow(%q, %v) = %v, expected %v", tc.filename, tc.size, err, tc.err)
+		}
+	}
+
+	// everything is allowed by default
+	h := newTestHandler(t, Config{FilterMode: FilterGlob}, nil)
+	if err := h.filter.Allow("session", "file.txt", 4); err != nil {
+		t.Errorf("expected files to be allowed by default, got %v", err)
+	}
+
+	// invalid globs are caught by NewHandler
+	if _, err := NewHandler(Config{FilterMode: FilterGlob, Disallowed: []string{"[a-"}}, nil); err == nil {
+		t.Error("expected an invalid glob to fail")
+	}
+
+}
+
+func TestFileFilter(t *testing.T) {
+
+	audit := &syncBuffer{}
+	h := newTestHandler(t, Config{
+		Disallowed:  []string{`.*\.txt`}, // overridden by the filter
+		FileFilter:  manifestFilter{"file.txt": 4},
+		AuditWriter: audit,
+	}, nil)
+	uuid := createSession(t, h)
+
+	testcases := []struct {
+		filename string
+		data     string
+		status   int
+		code     string
+	}{
+		{filename: "file.txt", data: "data", status: http.StatusOK, code: ""},
+		{filename: "other.txt", data: "data", status: http.StatusBadRequest, code: "80190194"},
+		{filename: "file.txt", data: "more data", status: http.StatusBadRequest, code: "80070005"},
+	}
+
+	for _, tc := range testcases {
+		res := sendFragment(h, uuid, tc.filename, []byte(tc.data), 0, uint64(len(tc.data)))
+		res.Body.Close()
+		if res.StatusCode != tc.status {
+			t.Errorf("%v: expected status %v, got %v", tc.filename, tc.status, res.StatusCode)
+		}
+		if code := res.Header.Get("BITS-Error-Code"); code != tc.code {
+			t.Errorf("%v: expected error code %q, got %q", tc.filename, tc.code, code)
+		}
+	}
+
+	// the reasons are written to the audit log
+	deadline := time.Now().Add(time.Second)
+	for strings.Count(audit.String(), "\n") < 4 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	for _, reason := range []string{`"reason":"not in manifest"`, `"reason":"size differs from manifest"`} {
+		if !strings.Contains(audit.String(), reason) {
+			t.Errorf("expected %s in the audit log: %v", reason, audit.String())
+		}
+	}
+
+}
+
+// countingFilter counts the files it is asked about, and denies files named "denied.txt"
+type countingFilter struct {
+	mu    sync.Mutex
+	asked map[string]int
+}
+
+func (c *countingFilter) Allow(session, filename string, declaredSize uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.asked[filename]++
+	if filename == "denied.txt" {
+		return ErrFileDisallowed
+	}
+	return nil
+}
+
+func TestFilterOncePerFile(t *testing.T) {
+
+	filter := &countingFilter{asked: make(map[string]int)}
+	h := newTestHandler(t, Config{FileFilter: filter}, nil)
+	uuid := createSession(t, h)
+
+	// every fragment of a file is decided like the first one
+	content := []byte("0123456789ab")
+	for _, filename := range []string{"one.txt", "two.txt", "denied.txt"} {
+		for start := 0; start < len(content); start += 4 {
+			res := sendFragment(h, uuid, filename, content[start:start+4], uint64(start), uint64(len(content)))
+			res.Body.Close()
+			expected := http.StatusOK
+			if filename == "denied.txt" {
+				expected = http.StatusBadRequest
+			}
+			if res.StatusCode != expected {
+				t.Errorf("%v at %v: expected status %v, got %v", filename, start, expected, res.StatusCode)
+			}
+		}
+	}
+	for _, filename := range []string{"one.txt", "two.txt", "denied.txt"} {
+		if filter.asked[filename] != 1 {
+			t.Errorf("expected the filter to be asked once about %v, was asked %v times", filename, filter.asked[filename])
+		}
+	}
+
+	// the filter is asked again when the size changes
+	res := doPacket(h, "Fragment", uuid, "/BITS/three.txt", map[string]string{
+		"Content-Range":  "bytes 0-3/*",
+		"Content-Length": "4",
+	}, content[:4])
+	res.Body.Close()
+	res = sendFragment(h, uuid, "three.txt", content[4:], 4, uint64(len(content)))
+	res.Body.Close()
+	if filter.asked["three.txt"] != 2 {
+		t.Errorf("expected the filter to be asked twice about three.txt, was asked %v times", filter.asked["three.txt"])
+	}
+
+}
+
+func TestEmptyAllowed(t *testing.T) {
+
+	var rejected []string
+	h := newTestHandler(t, Config{Allowed: []string{}}, func(event Event, session, path string) {
+		if event == EventRejectFile {
+			rejected = append(rejected, path)
+		}
+	})
+	uuid := createSession(t, h)
+
+	// an empty whitelist isn't replaced by the default, every file is rejected
+	filenames := []string{"file.txt", "photo.jpg", "noext", ".hidden"}
+	for _, filename := range filenames {
+		res := sendFragment(h, uuid, filename, []byte("data"), 0, 4)
+		res.Body.Close()
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected %v to be rejected, got %v", filename, res.Status)
+		}
+	}
+	if len(rejected) != len(filenames) {
+		t.Errorf("expected %v files rejected, got %v", len(filenames), rejected)
+	}
+
+}
+
+func TestCompiledFilters(t *testing.T) {
+
+	cfg := Config{
+		Allowed:         []string{`.*\.txt`, `.*\.zip`, `^report-\d+`},
+		Disallowed:      []string{`secret.*`, `.*~`},
+		FilenamePattern: `^[a-z0-9.~-]+$`,
+	}
+	h := newTestHandler(t, cfg, nil)
+
+	// the compiled filters decide like the patterns matched one by one
+	matchAny := func(patterns []string, name string) bool {
+		for _, p := range patterns {
+			if match, _ := regexp.MatchString(p, name); match {
+				return true
+			}
+		}
+		return false
+	}
+	filenames := []string{"file.txt", "file.zip", "file.exe", "secret.txt", "file.txt~", "report-12", "report-x", "File.txt", "a.txt.exe"}
+	for _, name := range filenames {
+		expected := matchAny(cfg.Allowed, name) && !matchAny(cfg.Disallowed, name)
+		if got := h.filter.Allow("session", name, 4) == nil; got != expected {
+			t.Errorf("%v: expected allowed %v, got %v", name, expected, got)
+		}
+		match, _ := regexp.MatchString(cfg.FilenamePattern, name)
+		if got := h.filenameAllowed(name); got != match {
+			t.Errorf("%v: expected filename allowed %v, got %v", name, match, got)
+		}
+	}
+
+}
+
+// The cost of checking a filename against the filters, compiled once or for every fragment
+func BenchmarkFilters(b *testing.B) {
+
+	cfg := Config{
+		Allowed:         []string{`.*\.txt`, `.*\.zip`, `.*\.jpg`, `.*\.png`},
+		Disallowed:      []string{`secret.*`, `.*~`, `.*\.tmp`},
+		FilenamePattern: `^[a-zA-Z0-9._-]+$`,
+	}
+	const filename = "holiday-photo-0042.jpg"
+
+	b.Run("compiled", func(b *testing.B) {
+		h, err := NewHandler(cfg, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for i := 0; i < b.N; i++ {
+			if !h.filenameAllowed(filename) || h.filter.Allow("session", filename, 4) != nil {
+				b.Fatal("filename not allowed")
+			}
+		}
+	})
+
+	b.Run("per-fragment", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if match, _ := regexp.MatchString(cfg.FilenamePattern, filename); !match {
+				b.Fatal("filename not allowed")
+			}
+			for _, p := range cfg.Disallowed {
+				if match, _ := regexp.MatchString(p, filename); match {
+					b.Fatal("filename disallowed")
+				}
+			}
+			allowed := false
+			for _, p := range cfg.Allowed {
+				if match, _ := regexp.MatchString(p, filename); match {
+					allowed = true
+					break
+				}
+			}
+			if !allowed {
+				b.Fatal("filename not allowed")
+			}
+		}
+	})
+
+}
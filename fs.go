@@ -0,0 +1,80 @@
+package gobits
+
+import (
+	"io"
+	"os"
+	"time"
+)
+
+// fileSystem is where the handler stores the files uploaded to a session. Session directories
+// and their metadata are always created on the OS file system, so RemoveAll must remove them
+// from there as well
+type fileSystem interface {
+	OpenFile(name string, flag int, perm os.FileMode) (fsFile, error)
+	Stat(name string) (os.FileInfo, error)
+	MkdirAll(path string, perm os.FileMode) error
+	Remove(name string) error
+	RemoveAll(path string) error
+	Rename(oldpath, newpath string) error
+	Chtimes(name string, atime, mtime time.Time) error
+}
+
+// fsFile is an open file in a fileSystem
+type fsFile interface {
+	io.Reader
+	io.WriterAt
+	io.Closer
+	Sync() error
+}
+
+// osFS is the default fileSystem, the one of the operating system
+type osFS struct{}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (fsFile, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		// don't return a typed nil
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+func (osFS) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (osFS) Chtimes(name string, atime, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+
+// WithFileSystem makes the handler store uploaded files in fs instead of on the OS file system,
+// and returns the handler. It is meant for tests, and must be called before the handler is used
+func (b *Handler) WithFileSystem(fs fileSystem) *Handler {
+	b.fs = fs
+	return b
+}
+
+// check if a file exists in a file system
+func fsExists(fs fileSystem, path string) (bool, error) {
+	var err error
+	if _, err = fs.Stat(path); err != nil && os.IsNotExist(err) {
+		return false, nil
+	}
+	return true, err
+}
@@ -0,0 +1,319 @@
+package gobits
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// memFS is a fileSystem keeping its files in memory, failing opens and writes with the given errors
+type memFS struct {
+	mu        sync.Mutex
+	files     map[string][]byte
+	mtimes    map[string]time.Time
+	openErr   error
+	writeErr  error
+	removeErr error
+}
+
+func (m *memFS) OpenFile(name string, flag int, perm os.FileMode) (fsFile, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.openErr != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: m.openErr}
+	}
+	if m.files == nil {
+		m.files = make(map[string][]byte)
+	}
+	if _, ok := m.files[name]; !ok && flag&os.O_CREATE == 0 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	if flag&os.O_TRUNC != 0 || m.files[name] == nil {
+		m.files[name] = []byte{}
+	}
+	return &memFile{fs: m, name: name}, nil
+}
+
+func (m *memFS) Stat(name string) (os.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.files[name]
+	if !ok {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return memFileInfo{name: filepath.Base(name), size: int64(len(data)), modTime: m.mtimes[name]}, nil
+}
+
+func (m *memFS) MkdirAll(path string, perm os.FileMode) error {
+	return nil
+}
+
+func (m *memFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.removeErr != nil {
+		return &os.PathError{Op: "remove", Path: name, Err: m.removeErr}
+	}
+	if _, ok := m.files[name]; !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	delete(m.files, name)
+	return nil
+}
+
+// remove the files under path, and the session directory holding the metadata on the OS
+func (m *memFS) RemoveAll(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.removeErr != nil {
+		return &os.PathError{Op: "removeall", Path: path, Err: m.removeErr}
+	}
+	for name := range m.files {
+		if name == path || strings.HasPrefix(name, path+string(filepath.Separator)) {
+			delete(m.files, name)
+			delete(m.mtimes, name)
+		}
+	}
+	return os.RemoveAll(path)
+}
+
+func (m *memFS) Rename(oldpath, newpath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.files[oldpath]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrNotExist}
+	}
+	delete(m.files, oldpath)
+	m.files[newpath] = data
+	if mtime, ok := m.mtimes[oldpath]; ok {
+		m.mtimes[newpath] = mtime
+		delete(m.mtimes, oldpath)
+	}
+	return nil
+}
+
+func (m *memFS) Chtimes(name string, atime, mtime time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.files[name]; !ok {
+		return &os.PathError{Op: "chtimes", Path: name, Err: os.ErrNotExist}
+	}
+	if m.mtimes == nil {
+		m.mtimes = make(map[string]time.Time)
+	}
+	m.mtimes[name] = mtime
+	return nil
+}
+
+// get the content of a file, false if it doesn't exist
+func (m *memFS) content(name string) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.files[name]
+	return string(data), ok
+}
+
+// memFile is an open file in a memFS
+type memFile struct {
+	fs     *memFS
+	name   string
+	offset int
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	data := f.fs.files[f.name]
+	if f.offset >= len(data) {
+		return 0, io.EOF
+	}
+	n := copy(p, data[f.offset:])
+	f.offset += n
+	return n, nil
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.fs.writeErr != nil {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: f.fs.writeErr}
+	}
+	data := f.fs.files[f.name]
+	if end := int(off) + len(p); end > len(data) {
+		data = append(data, make([]byte, end-len(data))...)
+	}
+	copy(data[off:], p)
+	f.fs.files[f.name] = data
+	return len(p), nil
+}
+
+func (f *memFile) Close() error {
+	return nil
+}
+
+func (f *memFile) Sync() error {
+	return nil
+}
+
+// memFileInfo describes a file in a memFS
+type memFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (i memFileInfo) Name() string       { return i.name }
+func (i memFileInfo) Size() int64        { return i.size }
+func (i memFileInfo) Mode() os.FileMode  { return 0600 }
+func (i memFileInfo) ModTime() time.Time { return i.modTime }
+func (i memFileInfo) IsDir() bool        { return false }
+func (i memFileInfo) Sys() interface{}   { return nil }
+
+func TestFileSystem(t *testing.T) {
+
+	testcases := []struct {
+		name     string
+		openErr  error
+		writeErr error
+		status   int
+	}{
+		{name: "stored", status: http.StatusOK},
+		{name: "open fails", openErr: syscall.EACCES, status: http.StatusInternalServerError},
+		{name: "write fails", writeErr: syscall.ENOSPC, status: http.StatusInternalServerError},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			var reported error
+			var received []string
+			fs := &memFS{openErr: tc.openErr, writeErr: tc.writeErr}
+			h := newTestHandler(t, Config{
+				ErrorHandler: func(err error, r *http.Request) {
+					reported = err
+				},
+			}, func(event Event, session, path string) {
+				if event == EventRecieveFile {
+					received = append(received, path)
+				}
+			}).WithFileSystem(fs)
+			uuid := createSession(t, h)
+			src := filepath.Join(h.cfg.TempDir, uuid, "file.txt")
+			if abs, err := filepath.Abs(src); err == nil {
+				src = abs
+			}
+
+			mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+			res := sendFragment(h, uuid, "file.txt", []byte("01234"), 0, 10)
+			res.Body.Close()
+			if res.StatusCode == http.StatusOK {
+				res = doPacket(h, "Fragment", uuid, "/BITS/file.txt", map[string]string{
+					"Content-Range":    "bytes 5-9/10",
+					"Content-Length":   "5",
+					"X-Original-Mtime": mtime.Format(time.RFC3339),
+				}, []byte("56789"))
+				res.Body.Close()
+			}
+			if res.StatusCode != tc.status {
+				t.Fatalf("expected status %v, got %v", tc.status, res.StatusCode)
+			}
+
+			// nothing is stored on disk
+			if exist, _ := exists(src); exist {
+				t.Error("file stored on the OS file system")
+			}
+
+			// the error is the one of the file system
+			if tc.openErr != nil || tc.writeErr != nil {
+				if !errors.Is(reported, tc.openErr) && !errors.Is(reported, tc.writeErr) {
+					t.Errorf("unexpected error reported: %v", reported)
+				}
+				if len(received) > 0 {
+					t.Errorf("file received: %v", received)
+				}
+				return
+			}
+			if content, ok := fs.content(src); !ok || content != "0123456789" {
+				t.Errorf("unexpected content in the file system: %q", content)
+			}
+			if info, err := fs.Stat(src); err != nil || !info.ModTime().Equal(mtime) {
+				t.Errorf("expected the modification time %v in the file system, got %v", mtime, err)
+			}
+			if _, ok := fs.content(src + h.cfg.PartSuffix); ok {
+				t.Error("part file left in the file system")
+			}
+			if len(received) != 1 || received[0] != src {
+				t.Errorf("expected %v to be received, got %v", src, received)
+			}
+		})
+	}
+
+}
+
+func TestFileSystemRemoveParts(t *testing.T) {
+
+	var reported error
+	fs := &memFS{}
+	h := newTestHandler(t, Config{
+		ErrorHandler: func(err error, r *http.Request) {
+			reported = err
+		},
+	}, nil).WithFileSystem(fs)
+
+	// an unfinished file that can't be removed is reported, the session is canceled anyway
+	uuid := createSession(t, h)
+	res := sendFragment(h, uuid, "file.txt", []byte("01234"), 0, 10)
+	res.Body.Close()
+	fs.mu.Lock()
+	fs.removeErr = syscall.EACCES
+	fs.mu.Unlock()
+	res = doPacket(h, "Cancel-Session", uuid, "/BITS/", nil, nil)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("expected the session to be canceled, got %v", res.Status)
+	}
+	if !errors.Is(reported, syscall.EACCES) {
+		t.Errorf("unexpected error reported: %v", reported)
+	}
+
+}
+
+func TestFileSystemRemoveAll(t *testing.T) {
+
+	fs := &memFS{}
+	h := newTestHandler(t, Config{DeleteOnClose: true}, nil).WithFileSystem(fs)
+
+	// closed sessions are removed with DeleteOnClose, and terminated sessions always
+	closed := createSession(t, h)
+	terminated := createSession(t, h)
+	for _, uuid := range []string{closed, terminated} {
+		res := sendFragment(h, uuid, "file.txt", []byte("data"), 0, 4)
+		res.Body.Close()
+	}
+	res := doPacket(h, "Close-Session", closed, "/BITS/", nil, nil)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("close failed: %v", res.Status)
+	}
+	if err := h.TerminateSession(terminated); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, uuid := range []string{closed, terminated} {
+		dir, _ := filepath.Abs(h.sessionDir(uuid))
+		if _, ok := fs.content(filepath.Join(dir, "file.txt")); ok {
+			t.Errorf("%v: file left in the file system", uuid)
+		}
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			t.Errorf("%v: expected the session directory to be removed, got %v", uuid, err)
+		}
+	}
+
+}
@@ -6,48 +6,518 @@ Copyright (C) 2017  Magnus Andersson
 package gobits
 
 import (
+	"context"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"io/ioutil"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
+	"net/netip"
+	"net/url"
 	"os"
 	"path"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Event if the type of the event for the callback
 type Event int
 
-// Events that is sent to the callback
+// Events that is sent to the callback. Rejections are told apart by what is rejected, a file of a
+// session with EventRejectFile, or a client before it reaches a session with EventRejectClient
 const (
 	EventCreateSession Event = 0 // A new session is created
 	EventRecieveFile   Event = 1 // a file is recieved
 	EventCloseSession  Event = 2 // a session is closed
 	EventCancelSession Event = 3 // a session is canceled
+	EventRejectFile    Event = 4 // a file is rejected by the file filter or content sniffer, the path is the filename
+	EventRejectClient  Event = 5 // a client is refused by the AllowedNetworks or DeniedNetworks, the path is its address
 )
 
-// CallbackFunc is the function that is called when an event occurs
+// Version is the version of gobits, sent in the Server header by default
+const Version = "1.0"
+
+// ProtocolUpload15 is the GUID of the BITS 1.5 Upload Protocol
+// https://msdn.microsoft.com/en-us/library/aa362833(v=vs.85).aspx
+const ProtocolUpload15 = "{7df0354d-249b-430f-820d-3d2a9bef4931}"
+
+// String returns the name of the event
+func (e Event) String() string {
+	switch e {
+	case EventCreateSession:
+		return "create-session"
+	case EventRecieveFile:
+		return "receive-file"
+	case EventCloseSession:
+		return "close-session"
+	case EventCancelSession:
+		return "cancel-session"
+	case EventRejectFile:
+		return "reject-file"
+	case EventRejectClient:
+		return "reject-client"
+	}
+	return "event-" + strconv.Itoa(int(e))
+}
+
+// CallbackFunc is the function that is called when an event occurs. Besides the uploaded files,
+// session directories contain a ".gobits-session.json" file with the state of the session. With
+// Config.DestDir set, the path of a received file is where it was moved
 type CallbackFunc func(event Event, Session, Path string)
 
+// Session is what is known about a session when an event occurs, passed to Config.SessionCallback.
+// Fields that don't apply to the event are empty
+type Session struct {
+	ID          string   // The session UUID
+	Path        string   // The path passed to CallbackFunc
+	Filename    string   // A received file, relative to the session directory
+	Bytes       uint64   // The size of a received file, or the bytes received in a closed session
+	ContentType string   // The MIME type of a received file, sent by the client or detected
+	Hash        string   // The hex digest of a received file, if Config.HashFiles is set
+	Reason      error    // Why a file is rejected
+	Incomplete  []string // Files that weren't completed when the session was closed
+	Principal   string   // Who created the session, by Config.Authenticator
+
+	// ClientCert is the verified TLS certificate of the client that created the session, if any
+	ClientCert *ClientCert
+
+	// Files are the files sent to the session so far, with how much of them is received. It is
+	// empty for EventCreateSession
+	Files []FileStatus
+
+	// Headers are the values of Config.CaptureHeaders sent with Create-Session, by canonical name
+	Headers map[string]string
+
+	// Request is the request causing the event, to read its headers. It is nil for sessions
+	// terminated with TerminateSession. The body must not be read
+	Request *http.Request
+}
+
 // Config contains configuration information
 type Config struct {
-	TempDir       string   // Directory to store unfinished files in
-	AllowedMethod string   // Allowed method name
-	Protocol      string   // Protocol to use
-	MaxSize       uint64   // Max size of uploaded file
-	Allowed       []string // Whitelisted filter
-	Disallowed    []string // Blacklisted filter
+	TempDir              string             // Directory to store unfinished files in
+	ShardDepth           int                // Levels of directories, named by the start of the session UUID, above the session directories in TempDir
+	DestDir              string             // Directory completed files are moved to before they are received, created if needed. They stay in the session directory if empty
+	AllowedMethod        string             // Allowed method name
+	Protocol             string             // Protocol to use, kept for compatibility, added first to Protocols
+	Protocols            []string           // Protocols to use as GUIDs in braces, ordered by preference
+	MaxSize              uint64             // Max size of uploaded file
+	MaxFragmentSize      uint64             // Max size of a single fragment
+	Allowed              []string           // Whitelisted filter, nil allows everything and empty nothing
+	Disallowed           []string           // Blacklisted filter
+	FilterIgnoreCase     bool               // Match the Allowed and Disallowed filters case-insensitively
+	FilterAnchored       bool               // The Allowed and Disallowed filters must match the whole filename
+	FilterMode           FilterMode         // How the Allowed and Disallowed filters and the Rules are matched, regexps by default
+	Rules                []Rule             // Ordered size limits for files matching a filename pattern, first match wins
+	FileFilter           FileFilter         // Decides which files are allowed, overrides Allowed, Disallowed and Rules
+	StrictRanges         bool               // Reply 416 instead of Ack to fragments that are already received
+	SessionSecret        []byte             // If set, session ids are signed with HMAC-SHA256 using this secret
+	ReadTimeout          time.Duration      // Max time to spend reading the body of a fragment, zero means no limit
+	FragmentIdleTimeout  time.Duration      // Terminate a session when an incomplete file gets no fragment for this long, zero means never
+	SessionTimeout       time.Duration      // Expire a session that gets no fragment for this long after it is created or its last fragment, zero means never
+	AcceptEncoding       string             // Comma separated encodings accepted for fragments, "-" omits the header. Fragments in gzip or deflate are decompressed, to at most MaxFragmentSize or 64 MiB
+	ServerHeader         string             // Server header of the replies, "gobits/" and the version by default, "-" omits the header
+	HealthPath           string             // Path answering GET with the health of the handler, like HealthHandler, instead of BITS
+	VerboseErrors        bool               // Describe errors in plain text in the body of the reply, for debugging
+	PartSuffix           string             // Suffix added to the filename of unfinished files, removed when the file is complete
+	PreservePath         bool               // Keep the request path after PathPrefix as directories in the session directory
+	PathPrefix           string             // Path the handler is mounted at, not part of the preserved path
+	MaxFilenameLength    int                // Max length in bytes of a filename, by default 255 minus the length of the PartSuffix so unfinished files fit in 255 bytes too
+	FilenamePattern      string             // Regexp that filenames must match
+	WindowsSafeFilenames bool               // Only allow filenames that are valid on Windows
+	OnExistingFile       ExistingFilePolicy // What to do when a completed file is uploaded again in the same session
+	OnCollision          ExistingFilePolicy // What to do when files declared with different names are stored under the same name
+	DeduplicateCreate    bool               // Return the existing session when create-session is retried with the same idempotency key
+	IdempotencyHeader    string             // Header with the client supplied idempotency key
+	CaptureHeaders       []string           // Headers of Create-Session kept with the session, passed to SessionCallback
+	StrictClose          bool               // Reject close-session while files sent to the session are incomplete
+	DeleteOnClose        bool               // Remove the session directory once the callbacks of EventCloseSession return, otherwise the app removes it
+	SyncPolicy           SyncPolicy         // When received data is flushed to disk
+	SessionStore         SessionStore       // Keeps track of the sessions, defaults to the session directories in TempDir
+	MaxTempDirSize       uint64             // Max number of bytes held in TempDir, fragments beyond it are rejected, zero means no limit
+	CheckDiskSpace       bool               // Reject new files larger than the free space of the file system of TempDir
+	Preallocate          bool               // Allocate the disk space of new files of known size before they are written, on Linux
+	HashFiles            bool               // Hash the files while they are received, the digest is passed to SessionCallback
+	HashAlgorithm        HashAlgorithm      // The hash used by HashFiles, SHA-256 by default
+
+	// AdvertiseCapabilities sends the protocols and size limits of the server in the Ack of a ping
+	AdvertiseCapabilities bool
+
+	// MaxTotalBytesPerSecond caps the rate fragment bodies are read at, shared by all sessions.
+	// Zero means no limit
+	MaxTotalBytesPerSecond uint64
+
+	// Limiter, if set, is used as the shared limit instead of MaxTotalBytesPerSecond
+	Limiter Limiter
+
+	// Metrics, if set, collects the metrics of the handler
+	Metrics MetricsCollector
+
+	// Tracer, if set, traces the create-session, fragment, close-session and cancel-session packets
+	Tracer Tracer
+
+	// Logger, if set, gets structured records of the requests and sessions, with the LogKey
+	// attributes. Nothing is logged to it by default
+	Logger *slog.Logger
+
+	// Expvar publishes counters of the handler with expvar, as the map "gobits." + ExpvarName.
+	// The name defaults to "default", and must be unique in the process
+	Expvar     bool
+	ExpvarName string
+
+	// TenantResolver, if set, gets the tenant of a new session. Sessions are kept in a directory
+	// of their tenant in TempDir, and the tenant is recorded in the SessionStore so the other
+	// packets of the session don't resolve it again. Tenants must be directory names of letters,
+	// digits, dashes, underscores and dots. Errors and invalid tenants refuse the session with a 403
+	TenantResolver func(r *http.Request) (string, error)
+
+	// ClientIP returns the address identifying the client of a request, defaults to RemoteIP, or
+	// to TrustedProxyIP if TrustedProxies is set. It is used for deduplication, session binding,
+	// events and the audit log
+	ClientIP func(r *http.Request) string
+
+	// AllowedNetworks are the networks clients must be in, as CIDR prefixes or addresses. Empty
+	// allows every client. DeniedNetworks are the networks clients are refused from, even if
+	// they are allowed. Refused clients get a 403 and fire EventRejectClient
+	AllowedNetworks []string
+	DeniedNetworks  []string
+
+	// TrustedProxies are the networks of the reverse proxies in front of the handler. The address
+	// of the client of their requests is taken from the ProxyHeader they set, X-Forwarded-For by
+	// default. Hooks building absolute URLs get the scheme and host the client used from
+	// TrustedProxyURL
+	TrustedProxies []netip.Prefix
+	ProxyHeader    ProxyHeader
+
+	// FilenameMapper, if set, is called with the requested filename of each fragment, and returns the
+	// filename to store the file as. It must return the same name for every fragment of a file
+	FilenameMapper func(r *http.Request, session, requested string) (string, error)
+
+	// ContentSniffer, if set, is called with the start of each file before any of it is stored, and
+	// rejects the file by returning an error. The head is shorter than 512 bytes when less of the file
+	// is received, and the sniffer is called again with more of it by the following fragments
+	ContentSniffer func(filename string, head []byte) error
+
+	// Finalize, if set, is called with each completed file while it is still in the session
+	// directory, before it is moved to DestDir and received. The file is rejected and removed if
+	// it returns an error, use a RejectError to choose the BITS error code
+	Finalize func(session Session) error
+
+	// BeforeFragment, if set, is called with each fragment before its body is read, with the
+	// range of the file it holds. The total is UnknownLength if the client doesn't send it, and
+	// an empty file is the range 0-0 of 0. An error refuses the fragment with a 403 in the
+	// remote application context, use a RejectError to choose the BITS error code. The file
+	// isn't rejected, the client may send the fragment again
+	BeforeFragment func(s Session, rangeStart, rangeEnd, total uint64) error
+
+	// InspectorFactory, if set, creates an inspector for each file, e.g. a virus scanner
+	InspectorFactory InspectorFactory
+
+	// SessionCallback, if set, is called after the callback with what is known about the session
+	// and the event, like the content type of a received file
+	SessionCallback func(event Event, s Session)
+
+	// Authenticator, if set, authenticates the Ping and Create-Session packets. Refused requests
+	// get a 401 with the challenges of the authenticator, and the principal is passed to the
+	// events of the session it creates. Use ClientCertificate to authenticate by TLS certificate
+	Authenticator AuthenticatorFunc
+
+	// AuthenticateAll makes the Authenticator authenticate every packet, not only the ones
+	// starting a session. It is implied by BindSessions
+	AuthenticateAll bool
+
+	// BindSessions refuses fragment, close-session and cancel-session packets that don't come
+	// from the client that created the session, with a 403. Sessions created by an authenticated
+	// client are bound to the principal, the others to the address of the client by ClientIP
+	BindSessions bool
+
+	// BindIgnoreAddress keeps BindSessions from binding sessions to addresses, for clients that
+	// change address behind NAT. Sessions are still bound to principals
+	BindIgnoreAddress bool
+
+	// ErrorHandler is called with the underlying error whenever the handler replies with an internal error
+	ErrorHandler func(err error, r *http.Request)
+
+	// AuditWriter, if set, gets one JSON object per line for each event. Writes are done in the
+	// background, and records are dropped if the writer can't keep up. Failed writes and dropped
+	// records are counted in the Stats, they don't fail the upload. The objects have:
+	//
+	//	time          when the event happened, RFC 3339 in UTC
+	//	event         create-session, receive-file, reject-file, close-session, cancel-session,
+	//	              expire-session for sessions terminated with TerminateSession or by
+	//	              the SessionTimeout, or
+	//	              reject-client for clients refused by their network
+	//	session       the session id, empty for reject-client
+	//	filename      the received file relative to the session directory, or the rejected filename
+	//	bytes         the size of a received file, or the bytes received in a closed session
+	//	content_type  the MIME type of a received file
+	//	hash          the hex digest of a received file, with HashFiles
+	//	remote        the address of the client, by ClientIP
+	//	user_agent    the User-Agent of the client
+	//	principal     who created the session, by the Authenticator
+	//	client_cert   the verified TLS certificate the session was created with, an object with
+	//	              the subject common name, sans, and the hex SHA-256 fingerprint
+	//	reason        why a file is rejected
+	//	incomplete    the files that weren't complete when the session was closed
+	AuditWriter io.Writer
+
+	// WebhookURL, if set, gets a POST of each event, with the same JSON object as the audit log
+	// and the event in the X-GoBITS-Event header. Events are delivered in the background, and
+	// retried with exponential backoff until the webhook replies 2xx. Events that can't be
+	// delivered are dropped, and counted in MetricWebhooksDropped
+	WebhookURL string
+
+	// WebhookSecret, if set, signs the events with HMAC-SHA256. The hex signature of the body
+	// is sent as "sha256=<signature>" in the X-GoBITS-Signature header
+	WebhookSecret []byte
+
+	// WebhookClient sends the events, defaults to a client with a timeout of 10 seconds
+	WebhookClient *http.Client
 }
 
 // Handler contains the config and the callback
 type Handler struct {
 	cfg      Config
 	callback CallbackFunc
+
+	mu       sync.Mutex
+	created  map[string]string        // session UUIDs by idempotency key
+	creating map[string]chan struct{} // idempotency keys of sessions being created, closed once they are
+	sessions map[string]*session      // tracked sessions by UUID
+	audit    chan []byte              // queued lines for the audit writer
+	webhooks chan webhookEvent        // queued events for the webhook
+	shutdown bool                     // no new sessions are created
+	inflight int                      // number of fragments being handled
+	usage    uint64                   // bytes held in the TempDir, if there is a budget
+	idle     chan struct{}            // closed when no fragments are handled, during shutdown
+	closed   chan struct{}            // closed by Close, stops the sweep of the sessions
+	queueMu  sync.RWMutex             // held to queue audit records and webhook events, and to close the queues
+	workers  sync.WaitGroup           // the sweep, the audit writer and the webhook, done once they stop
+
+	// gives up on the webhook events still queued when Close is done waiting
+	stopWebhooks context.CancelFunc
+
+	filter  FileFilter       // FileFilter, or the filters and rules of the config
+	fs      fileSystem       // where uploaded files are stored
+	newHash func() hash.Hash // creates the hashes of HashFiles
+
+	// the compiled FilenamePattern, nil if there is none
+	filenamePattern *regexp.Regexp
+
+	// the parsed AllowedNetworks and DeniedNetworks
+	allowedNetworks []netip.Prefix
+	deniedNetworks  []netip.Prefix
+
+	// the limit on the rate of all fragment bodies, nil if there is none
+	limiter Limiter
+
+	auditErrors  atomic.Uint64 // failed writes to the AuditWriter
+	auditDropped atomic.Uint64 // audit records dropped because the AuditWriter can't keep up
+
+	metrics  MetricsCollector // Metrics, or one discarding them
+	expvars  *expvarMetrics   // the published expvars, nil unless Expvar is set
+	activeMu sync.Mutex       // guards active and origins, apart from mu so events don't contend with fragments
+	active   map[string]bool  // sessions created since the start that are still active
+
+	// how the sessions that aren't closed or canceled were created, by UUID
+	origins map[string]origin
+
+	healthMu sync.Mutex // guards the last probe of the TempDir by the health checks
+	probedAt time.Time  // when the TempDir was last probed, zero if it never was
+	probeErr error      // the result of the last probe
+
+	tenantMu    sync.Mutex              // guards tenants and tenantStats, apart from mu
+	tenants     map[string]string       // tenants of the tracked sessions, by UUID
+	tenantStats map[string]*TenantStats // statistics by tenant
+}
+
+// session holds the state of a session
+type session struct {
+	mu        sync.Mutex        // held while writing to the session directory, so fragments are written one at a time
+	dir       string            // absolute path of the session directory
+	loaded    bool              // the metadata is loaded from the session directory
+	created   time.Time         // when the session was created, zero if unknown
+	origin    origin            // who created the session, and the captured headers
+	state     sessionState      // only active sessions accept packets
+	renamed   map[string]string // files stored under another name because of collisions, by declared name
+	names     map[string]string // names the files were declared with by the client, by path
+	lengths   map[string]uint64 // declared lengths of the files sent to the session, by path
+	types     map[string]string // MIME types of the files sent to the session, by path
+	completed map[string]bool   // files completed in the session, by path
+	size      uint64            // bytes the session holds in the TempDir, guarded by the handler
+	touched   time.Time         // when the session was created, loaded, got its last fragment or finished
+	evicted   bool              // the session is no longer tracked, and is loaded again by the next packet
+	received  uint64            // bytes received in the session, not counting fragments sent again
+
+	// running hashes of the files being received, by path. They aren't saved with the metadata,
+	// after a restart they are computed from the part files again
+	hashes map[string]*fileHash
+
+	// inspectors of the files being received, by path
+	inspectors map[string]*inspector
+
+	// what the file filter decided for the files of the session, by requested filename. They
+	// aren't saved with the metadata, after a restart the filter is asked again
+	decisions map[string]filterDecision
+
+	// watchdogs of the files waiting for their next fragment, by path
+	watchdogs map[string]*watchdog
+}
+
+// remember the name a file is declared with, the request path of its fragments. Returns true
+// if the name is new
+func (s *session) claim(src, name string) bool {
+	if s.names == nil {
+		s.names = make(map[string]string)
+	}
+	if s.names[src] == name {
+		return false
+	}
+	s.names[src] = name
+	return true
+}
+
+// check if a file is stored at the path for another declared name
+func (s *session) collides(src, name string) bool {
+	owner, ok := s.names[src]
+	return ok && owner != name
+}
+
+// forget everything about a file, so it can be sent again from scratch
+func (s *session) forget(src string) {
+	delete(s.names, src)
+	delete(s.lengths, src)
+	delete(s.types, src)
+	delete(s.completed, src)
+	delete(s.hashes, src)
+	s.closeInspector(src)
+	s.unwatch(src)
+}
+
+// remember the MIME type of a file. Returns true if the type is new
+func (s *session) setType(src, contentType string) bool {
+	if s.types == nil {
+		s.types = make(map[string]string)
+	}
+	if s.types[src] == contentType {
+		return false
+	}
+	s.types[src] = contentType
+	return true
 }
 
+// remember the declared length of a file sent to the session, an unknown length doesn't replace
+// a known one. Returns true if the length is new
+func (s *session) announce(src string, length uint64) bool {
+	if s.lengths == nil {
+		s.lengths = make(map[string]uint64)
+	}
+	declared, ok := s.lengths[src]
+	if (ok && length == UnknownLength) || (ok && declared == length) {
+		return false
+	}
+	s.lengths[src] = length
+	return true
+}
+
+// check if a file was sent to the session with another declared length. An unknown length
+// doesn't conflict with anything
+func (s *session) lengthChanged(src string, length uint64) bool {
+	declared, ok := s.lengths[src]
+	return ok && declared != length && declared != UnknownLength && length != UnknownLength
+}
+
+// list the files sent to the session that haven't reached their declared length
+func (s *session) incomplete(fs fileSystem, partSuffix string) ([]string, error) {
+	var files []string
+	for src, length := range s.lengths {
+		size, completed, err := receivedSize(fs, src, src+partSuffix)
+		if err != nil {
+			return nil, err
+		}
+		if size != length || !completed {
+			files = append(files, src)
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// remove the unfinished files of the session, they can't be completed once it is closed or canceled.
+// Returns the number of bytes removed, and the files that couldn't be removed joined in an error
+func (s *session) removeParts(fs fileSystem, partSuffix string) (uint64, error) {
+	var removed uint64
+	var errs []error
+	for src := range s.lengths {
+		if s.completed[src] {
+			continue
+		}
+		s.closeInspector(src)
+		s.unwatch(src)
+		info, err := fs.Stat(src + partSuffix)
+		if err == nil {
+			err = fs.Remove(src + partSuffix)
+		}
+		if err == nil {
+			removed += uint64(info.Size())
+		} else if !os.IsNotExist(err) {
+			errs = append(errs, err)
+		}
+	}
+	return removed, errors.Join(errs...)
+}
+
+// sessionState is where a session is in its life cycle
+type sessionState int
+
+const (
+	sessionActive   sessionState = iota // fragments may be sent to the session
+	sessionClosing                      // the session is closed, but the callback hasn't returned yet
+	sessionClosed                       // the session is closed
+	sessionCanceled                     // the session is canceled by the client, or terminated
+	sessionExpired                      // the session, or a file of it, got no fragment in time
+)
+
+// ErrSessionNotFound is returned when a session doesn't exist
+var ErrSessionNotFound = errors.New("session not found")
+
+// Errors returned by NewHandler for an invalid Config, wrapped with what is wrong
+var (
+	ErrInvalidProtocol    = errors.New("invalid protocol")         // A protocol isn't a GUID in braces
+	ErrInvalidFilter      = errors.New("invalid filter")           // A filter, rule or FilenamePattern doesn't compile
+	ErrInvalidNetwork     = errors.New("invalid network")          // A network isn't an address or CIDR prefix
+	ErrInvalidOption      = errors.New("invalid option")           // An option is out of range, like an unknown policy
+	ErrConflictingOptions = errors.New("conflicting options")      // An option needs another that isn't set
+	ErrTempDirUnwritable  = errors.New("temp dir is not writable") // The TempDir can't be created or written to
+)
+
+// ExistingFilePolicy decides what happens when a file that is already completed is uploaded again,
+// or when two files would be stored under the same name, e.g. files in different directories
+// without PreservePath. Sending the last fragment of a file completed in the same session again
+// is a retry, not a new upload
+type ExistingFilePolicy int
+
+// Policies for files that are uploaded again or collide
+const (
+	ExistingFileOverwrite ExistingFilePolicy = 0 // The completed file is replaced by the new upload
+	ExistingFileReject    ExistingFilePolicy = 1 // The new upload is rejected
+	ExistingFileRename    ExistingFilePolicy = 2 // The new upload is stored as "name (1).ext", "name (2).ext", ...
+)
+
 // ErrorContext is the type of the event for the callback
 type ErrorContext int
 
@@ -64,11 +534,24 @@ const (
 	ErrorContextRemoteApplication        ErrorContext = 7 // The server application that BITS passed the upload file to generated an error while processing the upload file
 )
 
-// NewHandler return a new Handler with sane defaults
+// NewHandler return a new Handler with sane defaults. The TempDir is created if it doesn't exist,
+// and an invalid Config returns an error wrapping ErrInvalidFilter or another of the Config errors,
+// for every invalid setting joined with errors.Join
 func NewHandler(cfg Config, cb CallbackFunc) (b *Handler, err error) {
 	b = &Handler{
 		cfg:      cfg,
 		callback: cb,
+		fs:       osFS{},
+	}
+
+	// every invalid setting is reported at once. The Authenticator is code, so it is only
+	// checked here and not when a config file is loaded
+	errs := cfg.validate(false)
+	if cfg.AuthenticateAll && cfg.Authenticator == nil {
+		errs = append(errs, fmt.Errorf("%w: AuthenticateAll needs an Authenticator", ErrConflictingOptions))
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
 	}
 
 	// make sure we have a method
@@ -76,10 +559,62 @@ func NewHandler(cfg Config, cb CallbackFunc) (b *Handler, err error) {
 		b.cfg.AllowedMethod = "BITS_POST"
 	}
 
+	// protocols are compared case-insensitively and advertised in lower case
+	b.cfg.Protocol = strings.ToLower(b.cfg.Protocol)
+	protocols := make([]string, 0, len(b.cfg.Protocols))
+	for _, p := range b.cfg.Protocols {
+		if selectProtocol(protocols, []string{p}) == "" {
+			protocols = append(protocols, strings.ToLower(p))
+		}
+	}
+	b.cfg.Protocols = protocols
+
+	// the single protocol is preferred over the others
+	if b.cfg.Protocol != "" && selectProtocol(b.cfg.Protocols, []string{b.cfg.Protocol}) == "" {
+		b.cfg.Protocols = append([]string{b.cfg.Protocol}, b.cfg.Protocols...)
+	}
+
 	// this will probably never change, unless a very custom server is made
+	if len(b.cfg.Protocols) == 0 {
+		b.cfg.Protocols = []string{ProtocolUpload15}
+	}
 	if b.cfg.Protocol == "" {
-		// https://msdn.microsoft.com/en-us/library/aa362833(v=vs.85).aspx
-		b.cfg.Protocol = "{7df0354d-249b-430f-820d-3d2a9bef4931}" // BITS 1.5 Upload Protocol
+		b.cfg.Protocol = b.cfg.Protocols[0]
+	}
+
+	// we only handle unencoded data by default
+	if b.cfg.AcceptEncoding == "" {
+		b.cfg.AcceptEncoding = "Identity"
+	}
+	if b.cfg.ServerHeader == "" {
+		b.cfg.ServerHeader = "gobits/" + Version
+	}
+
+	// the standard header for idempotency keys
+	if b.cfg.IdempotencyHeader == "" {
+		b.cfg.IdempotencyHeader = "Idempotency-Key"
+	}
+
+	// only clients in the allowed networks are served, the networks are validated
+	b.allowedNetworks, _ = parseNetworks(b.cfg.AllowedNetworks)
+	b.deniedNetworks, _ = parseNetworks(b.cfg.DeniedNetworks)
+
+	// identify clients by their address, or the address the trusted proxies forward
+	if b.cfg.ClientIP == nil && len(b.cfg.TrustedProxies) > 0 {
+		b.cfg.ClientIP = TrustedProxyIP(b.cfg.TrustedProxies, b.cfg.ProxyHeader)
+	}
+	if b.cfg.ClientIP == nil {
+		b.cfg.ClientIP = RemoteIP
+	}
+
+	// unfinished files should not look complete to anyone scanning the directory
+	if b.cfg.PartSuffix == "" {
+		b.cfg.PartSuffix = ".gobits-part"
+	}
+
+	// most filesystems doesn't allow names longer than 255 bytes, and unfinished files have a suffix
+	if b.cfg.MaxFilenameLength <= 0 {
+		b.cfg.MaxFilenameLength = 255 - len(b.cfg.PartSuffix)
 	}
 
 	// setup the temporary directory
@@ -87,28 +622,539 @@ func NewHandler(cfg Config, cb CallbackFunc) (b *Handler, err error) {
 		b.cfg.TempDir = path.Join(os.TempDir(), "gobits")
 	}
 
-	// if the allowed filter isn't specified, allow everything
-	if len(b.cfg.Allowed) == 0 {
+	// if the allowed filter isn't specified, allow everything. An empty filter allows nothing
+	if b.cfg.Allowed == nil && b.cfg.FilterMode == FilterGlob {
+		b.cfg.Allowed = []string{"*"}
+	} else if b.cfg.Allowed == nil {
 		b.cfg.Allowed = []string{".*"}
 	}
 
-	// Make sure all regexp compiles
-	for _, n := range b.cfg.Allowed {
-		_, err = regexp.Compile(n)
-		if err != nil {
-			return nil, fmt.Errorf("failed to compile regexp '%s': %v", n, err)
+	// keep track of sessions by their directories
+	if b.cfg.SessionStore == nil {
+		b.cfg.SessionStore = dirStore{dir: b.cfg.TempDir, depth: b.cfg.ShardDepth, tenants: b.cfg.TenantResolver != nil}
+	}
+
+	// the hash and the patterns are validated
+	if b.cfg.HashFiles {
+		b.newHash, _ = b.cfg.HashAlgorithm.new()
+	}
+	if b.cfg.FilenamePattern != "" {
+		b.filenamePattern = regexp.MustCompile(b.cfg.FilenamePattern)
+	}
+	if b.cfg.Limiter != nil {
+		b.limiter = b.cfg.Limiter
+	} else if b.cfg.MaxTotalBytesPerSecond > 0 {
+		b.limiter = newTokenBucket(b.cfg.MaxTotalBytesPerSecond)
+	}
+	if b.cfg.FileFilter != nil {
+		b.filter = b.cfg.FileFilter
+	} else if b.filter, err = newRegexpFilter(b.cfg); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidFilter, err)
+	}
+
+	// make sure files can be stored, rather than failing the first session
+	if err = checkTempDir(b.cfg.TempDir); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrTempDirUnwritable, err)
+	}
+
+	// count what is already in the TempDir against its budget
+	if b.cfg.MaxTempDirSize > 0 {
+		if b.usage, err = dirSize(b.cfg.TempDir); err != nil {
+			return nil, fmt.Errorf("%w: failed to get the size of '%s': %v", ErrTempDirUnwritable, b.cfg.TempDir, err)
 		}
 	}
-	for _, n := range b.cfg.Disallowed {
-		_, err = regexp.Compile(n)
-		if err != nil {
-			return nil, fmt.Errorf("failed to compile regexp '%s': %v", n, err)
+
+	// Published last, an expvar can't be removed if the handler fails
+	b.metrics = noMetrics{}
+	if b.cfg.Metrics != nil {
+		b.metrics = b.cfg.Metrics
+	}
+	if b.cfg.Expvar {
+		if b.cfg.ExpvarName == "" {
+			b.cfg.ExpvarName = "default"
+		}
+		if b.expvars, err = newExpvarMetrics(b.cfg.ExpvarName); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidOption, err)
+		}
+		if b.cfg.Metrics != nil {
+			b.metrics = multiMetrics{b.cfg.Metrics, b.expvars}
+		} else {
+			b.metrics = b.expvars
 		}
 	}
 
+	// Started last, so a handler that fails has nothing running
+	b.closed = make(chan struct{})
+	b.workers.Add(1)
+	go b.sweepSessions(b.closed)
+
+	// start writing the audit log
+	if b.cfg.AuditWriter != nil {
+		b.audit = make(chan []byte, auditBufferSize)
+		b.workers.Add(1)
+		go b.writeAudit(b.cfg.AuditWriter, b.audit)
+	}
+
+	// start delivering events to the webhook
+	if b.cfg.WebhookURL != "" {
+		if b.cfg.WebhookClient == nil {
+			b.cfg.WebhookClient = &http.Client{Timeout: 10 * time.Second}
+		}
+		b.webhooks = make(chan webhookEvent, webhookQueueSize)
+		var ctx context.Context
+		ctx, b.stopWebhooks = context.WithCancel(context.Background())
+		b.workers.Add(1)
+		go b.deliverWebhooks(ctx)
+	}
+
 	return
 }
 
+// report an internal error to the error handler, if there is one
+func (b *Handler) reportError(err error, r *http.Request) {
+	if b.expvars != nil {
+		b.expvars.lastError.Set(err.Error())
+	}
+	b.logError(err, r)
+	if b.cfg.ErrorHandler != nil {
+		b.cfg.ErrorHandler(err, r)
+	}
+}
+
+// get an active session and lock it
+func (b *Handler) lockSession(uuid string) *session {
+	for {
+		b.mu.Lock()
+		if b.sessions == nil {
+			b.sessions = make(map[string]*session)
+		}
+		s, ok := b.sessions[uuid]
+		if !ok {
+			s = &session{dir: b.sessionDir(uuid)}
+			if dir, err := filepath.Abs(s.dir); err == nil {
+				s.dir = dir
+			}
+			b.sessions[uuid] = s
+		}
+		b.mu.Unlock()
+
+		// Sessions that aren't tracked, e.g. after a restart, are restored from their metadata
+		s.mu.Lock()
+		if s.evicted {
+			// swept while we waited, the next one is loaded again
+			s.mu.Unlock()
+			continue
+		}
+		if !s.loaded {
+			if err := s.load(); err != nil {
+				b.reportError(fmt.Errorf("ignoring session metadata of %v: %w", s.dir, err), nil)
+			}
+			s.loaded = true
+			s.touched = time.Now()
+			b.rememberOrigin(uuid, s.origin)
+
+			// what the session holds is already counted against the budget
+			if b.cfg.MaxTempDirSize > 0 {
+				size, _ := dirSize(s.dir)
+				b.mu.Lock()
+				s.size = size
+				b.mu.Unlock()
+			}
+		}
+		return s
+	}
+}
+
+// start tracking a new session, so it is swept even if it never gets a fragment
+func (b *Handler) trackSession(uuid string, created time.Time, o origin) {
+	s := &session{dir: b.sessionDir(uuid), loaded: true, created: created, touched: created, origin: o}
+	if dir, err := filepath.Abs(s.dir); err == nil {
+		s.dir = dir
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.sessions == nil {
+		b.sessions = make(map[string]*session)
+	}
+	b.sessions[uuid] = s
+}
+
+// stop tracking a session
+func (b *Handler) dropSession(uuid string) {
+	b.mu.Lock()
+	delete(b.sessions, uuid)
+	b.mu.Unlock()
+}
+
+// move a session from one state to another, returns false if it isn't in the from state
+func (b *Handler) transition(uuid string, from, to sessionState) bool {
+	s := b.lockSession(uuid)
+	defer s.mu.Unlock()
+	if s.state != from {
+		return false
+	}
+	s.state = to
+	s.touched = time.Now()
+
+	// The callback may have removed the directory already
+	if exist, _ := exists(s.dir); exist {
+		b.saveSession(s, nil)
+	}
+	return true
+}
+
+// write the metadata of a locked session. Failures are reported, the session works without
+// metadata until the server is restarted
+func (b *Handler) saveSession(s *session, r *http.Request) {
+	if err := s.save(); err != nil {
+		b.reportError(fmt.Errorf("failed to write session metadata of %v: %w", s.dir, err), r)
+	}
+}
+
+// check if a session accepts packets. Sessions that aren't tracked, e.g. after a restart, are
+// active as long as their directory exists
+func (b *Handler) activeSession(uuid string) bool {
+	b.mu.Lock()
+	s, ok := b.sessions[uuid]
+	b.mu.Unlock()
+	if !ok {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state == sessionActive
+}
+
+// stop tracking a finished session once its directory is gone. Until then it is kept, so late
+// packets for it are rejected
+func (b *Handler) releaseSession(uuid string) {
+	if exist, _ := exists(b.sessionDir(uuid)); !exist {
+		b.mu.Lock()
+		s, ok := b.sessions[uuid]
+		b.mu.Unlock()
+		if ok {
+			b.release(s, s.size)
+		}
+		b.dropSession(uuid)
+		b.forgetTenant(uuid)
+	}
+}
+
+// TerminateSession cancels a session and removes its directory, as if the client had canceled it.
+// Fragments being written to the session when it is terminated fail
+func (b *Handler) TerminateSession(id string) error {
+	uuid, ok := b.verifySessionID(id)
+	if !ok {
+		return ErrSessionNotFound
+	}
+	return b.terminate(uuid, sessionCanceled, nil)
+}
+
+// end a session in the state and remove its directory, if check passes for the locked session.
+// Returns ErrSessionNotFound if it doesn't
+func (b *Handler) terminate(uuid string, state sessionState, check func(s *session) bool) error {
+
+	// Mark the session as terminated, and remove it while no fragment is being written
+	s := b.lockSession(uuid)
+	if check != nil && !check(s) {
+		s.mu.Unlock()
+		return ErrSessionNotFound
+	}
+	s.state = state
+	for src := range s.inspectors {
+		s.closeInspector(src)
+	}
+	for src := range s.watchdogs {
+		s.unwatch(src)
+	}
+	b.dropSession(uuid)
+
+	// Gone from the store first, so no other server recreates the directory of the session
+	b.deleteSession(nil, uuid)
+
+	destDir := b.sessionDir(uuid)
+	exist, err := exists(destDir)
+	if err == nil && exist {
+		// in case the directory is only partly removed
+		b.saveSession(s, nil)
+		if err = b.fs.RemoveAll(destDir); err == nil {
+			b.release(s, s.size)
+		}
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if !exist {
+		return ErrSessionNotFound
+	}
+
+	// a retried create must not get this session anymore
+	b.forgetSession(uuid)
+
+	b.event(nil, EventCancelSession, uuid, eventInfo{path: destDir})
+	b.forgetTenant(uuid)
+	return nil
+}
+
+// find a session in the store, and make sure it has a directory here in case it was created
+// by another server sharing the store
+func (b *Handler) findSession(uuid string) (string, error) {
+	if _, err := b.cfg.SessionStore.Get(uuid); err != nil {
+		return "", err
+	}
+	dir := b.sessionDir(uuid)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// record what is received of a file, if the store keeps it. The fragment is written either way
+func (b *Handler) storeProgress(r *http.Request, uuid string, file FileStatus) {
+	store, ok := b.cfg.SessionStore.(ProgressStore)
+	if !ok {
+		return
+	}
+	if err := store.Progress(uuid, file); err != nil {
+		b.reportError(err, r)
+	}
+}
+
+// remove a finished session from the store, the session is finished even if it fails
+func (b *Handler) deleteSession(r *http.Request, uuid string) {
+	if err := b.cfg.SessionStore.Delete(uuid); err != nil {
+		b.reportError(err, r)
+	}
+}
+
+// IncompleteFiles lists the files sent to an active or closing session that haven't reached their
+// declared length, relative to the session directory. Call it from the callback of
+// EventCloseSession to see what the client left unfinished
+func (b *Handler) IncompleteFiles(id string) ([]string, error) {
+	uuid, ok := b.verifySessionID(id)
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	b.mu.Lock()
+	s, ok := b.sessions[uuid]
+	b.mu.Unlock()
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state != sessionActive && s.state != sessionClosing {
+		return nil, ErrSessionNotFound
+	}
+	files, err := s.incomplete(b.fs, b.cfg.PartSuffix)
+	if err != nil {
+		return nil, err
+	}
+	for i, f := range files {
+		files[i] = b.sessionPath(uuid, f)
+	}
+	return files, nil
+}
+
+// get a path in a session directory as a slash separated path relative to the directory
+func (b *Handler) sessionPath(uuid, path string) string {
+	if dir, err := filepath.Abs(b.sessionDir(uuid)); err == nil {
+		if rel, err := filepath.Rel(dir, path); err == nil {
+			return filepath.ToSlash(rel)
+		}
+	}
+	return filepath.Base(path)
+}
+
+// Shutdown stops creating new sessions, and waits for the fragments being handled to finish or
+// the context to be done. Create-session requests get 503 Service Unavailable from now on, while
+// fragments are still accepted so clients can finish uploading
+func (b *Handler) Shutdown(ctx context.Context) error {
+	b.mu.Lock()
+	b.shutdown = true
+	if b.inflight == 0 {
+		b.mu.Unlock()
+		return nil
+	}
+	if b.idle == nil {
+		b.idle = make(chan struct{})
+	}
+	idle := b.idle
+	b.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops the sweep of the sessions, and waits until the queued audit records are written
+// and the queued webhook events are delivered. If ctx is done first, the webhook events not yet
+// delivered are dropped and its error is returned. Events after Close only go to the callbacks.
+// Call Shutdown first to let the fragments being handled finish
+func (b *Handler) Close(ctx context.Context) error {
+	b.queueMu.Lock()
+	select {
+	case <-b.closed:
+	default:
+		close(b.closed)
+		if b.audit != nil {
+			close(b.audit)
+		}
+		if b.webhooks != nil {
+			close(b.webhooks)
+		}
+	}
+	b.queueMu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		b.workers.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		if b.stopWebhooks != nil {
+			b.stopWebhooks()
+		}
+		return ctx.Err()
+	}
+}
+
+// check if the handler is shutting down
+func (b *Handler) shuttingDown() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.shutdown
+}
+
+// count a fragment as being handled, until the returned function is called
+func (b *Handler) track() func() {
+	b.mu.Lock()
+	b.inflight++
+	b.mu.Unlock()
+
+	return func() {
+		b.mu.Lock()
+		b.inflight--
+		if b.inflight == 0 && b.idle != nil {
+			close(b.idle)
+			b.idle = nil
+		}
+		b.mu.Unlock()
+	}
+}
+
+// find the session created with an idempotency key, or claim the key to create it. A create in
+// flight with the same key is waited for, so only one session is created. The session store is
+// only asked after mu is released. A claimed key is released with releaseKey
+func (b *Handler) claimKey(ctx context.Context, key string) (uuid string, claimed bool, err error) {
+	for {
+		b.mu.Lock()
+		uuid, ok := b.created[key]
+		wait, creating := b.creating[key]
+		if !ok && !creating {
+			if b.creating == nil {
+				b.creating = make(map[string]chan struct{})
+			}
+			b.creating[key] = make(chan struct{})
+			b.mu.Unlock()
+			return "", true, nil
+		}
+		b.mu.Unlock()
+
+		if creating {
+			select {
+			case <-wait:
+				continue
+			case <-ctx.Done():
+				return "", false, ctx.Err()
+			}
+		}
+		if _, err := b.cfg.SessionStore.Get(uuid); err == nil {
+			return uuid, false, nil
+		}
+
+		// the session is gone, the key can be used again
+		b.mu.Lock()
+		if b.created[key] == uuid {
+			delete(b.created, key)
+		}
+		b.mu.Unlock()
+	}
+}
+
+// release a claimed idempotency key, with the session created for it or an empty uuid if the
+// create failed
+func (b *Handler) releaseKey(key, uuid string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if uuid != "" {
+		if b.created == nil {
+			b.created = make(map[string]string)
+		}
+		b.created[key] = uuid
+	}
+	close(b.creating[key])
+	delete(b.creating, key)
+}
+
+// forget all idempotency keys of a session
+func (b *Handler) forgetSession(uuid string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for key, u := range b.created {
+		if u == uuid {
+			delete(b.created, key)
+		}
+	}
+}
+
+// RemoteIP returns the host portion of the remote address of a request. This is the default
+// for Config.ClientIP
+func RemoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// ForwardedIP returns the client address set by a proxy in the X-Real-IP or X-Forwarded-For
+// header, falling back to RemoteIP. Only use it behind a proxy that sets these headers, since
+// they are trivial for a client to spoof. TrustedProxyIP only trusts the headers of known proxies
+func ForwardedIP(r *http.Request) string {
+	if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+		return ip.String()
+	}
+
+	// The first address in the list is the client, the rest are proxies
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		if ip := net.ParseIP(strings.TrimSpace(strings.Split(forwarded, ",")[0])); ip != nil {
+			return ip.String()
+		}
+	}
+
+	return RemoteIP(r)
+}
+
+// BITS error codes, HRESULTs, sent to the client
+const (
+	codeAccessDenied    = 0x80070005 // E_ACCESSDENIED, the file is rejected
+	codeInvalidData     = 0x8007000d // ERROR_INVALID_DATA, the declared length of a file changed
+	codeNotSupported    = 0x80070032 // ERROR_NOT_SUPPORTED, none of the offered protocols are supported
+	codeInvalidArgument = 0x80070057 // E_INVALIDARG, the client didn't offer any protocols
+	codeMoreData        = 0x800700ea // ERROR_MORE_DATA, the session is closed before all files are complete
+	codeSessionNotFound = 0x80070490 // ERROR_NOT_FOUND, the session doesn't exist or is closed or canceled
+	codeInvalidOwner    = 0x8007051b // ERROR_INVALID_OWNER, the session was created by another client
+)
+
 // returns a BITS error
 func bitsError(w http.ResponseWriter, uuid string, status, code int, context ErrorContext) {
 	w.Header().Add("BITS-Packet-Type", "Ack")
@@ -121,6 +1167,73 @@ func bitsError(w http.ResponseWriter, uuid string, status, code int, context Err
 	w.Write(nil)
 }
 
+// maxDrainSize is the max number of bytes discarded from a rejected request body
+const maxDrainSize = 256 << 10
+
+// drainWriter discards the unread request body before an error status is written, so the
+// connection can be reused by the client. If the body is too large, the connection is closed
+type drainWriter struct {
+	http.ResponseWriter
+	body io.Reader
+}
+
+func (d *drainWriter) WriteHeader(status int) {
+	if status >= http.StatusBadRequest && d.body != nil && d.Header().Get("Connection") != "close" {
+		if n, _ := io.CopyN(ioutil.Discard, d.body, maxDrainSize+1); n > maxDrainSize {
+			d.Header().Set("Connection", "close")
+		}
+	}
+	d.body = nil
+	d.ResponseWriter.WriteHeader(status)
+}
+
+func (d *drainWriter) Write(p []byte) (int, error) {
+	d.body = nil
+	return d.ResponseWriter.Write(p)
+}
+
+// Unwrap returns the original ResponseWriter, for use by http.ResponseController
+func (d *drainWriter) Unwrap() http.ResponseWriter {
+	return d.ResponseWriter
+}
+
+// select the first of our protocols that the client supports, or "" if there is none. GUIDs
+// are compared case-insensitively, the protocol is returned the way the client sent it since
+// some clients compare it case-sensitively
+func selectProtocol(ours, theirs []string) string {
+	for _, p := range ours {
+		for _, t := range theirs {
+			if strings.EqualFold(p, t) {
+				return t
+			}
+		}
+	}
+	return ""
+}
+
+// check if a protocol is a GUID in braces, like ProtocolUpload15
+func isProtocol(protocol string) bool {
+	if len(protocol) < 2 || protocol[0] != '{' || protocol[len(protocol)-1] != '}' {
+		return false
+	}
+	return isValidUUID(strings.ToLower(protocol[1 : len(protocol)-1]))
+}
+
+// check if a content encoding is in the comma separated list of accepted encodings. Unencoded
+// content is always accepted
+func acceptsEncoding(accepted, encoding string) bool {
+	encoding = strings.TrimSpace(encoding)
+	if encoding == "" || strings.EqualFold(encoding, "identity") {
+		return true
+	}
+	for _, a := range strings.Split(accepted, ",") {
+		if strings.EqualFold(strings.TrimSpace(a), encoding) {
+			return true
+		}
+	}
+	return false
+}
+
 // generate a new UUID
 func newUUID() (string, error) {
 	// Stolen from http://play.golang.org/p/4FkNSiUDMg
@@ -139,57 +1252,381 @@ func newUUID() (string, error) {
 }
 
 func isValidUUID(uuid string) bool {
-	const match = "[a-f0-9]{8}-[a-f0-9]{4}-[a-f0-9]{4}-[a-f0-9]{4}-[a-f0-9]{12}"
+	const match = "^[a-f0-9]{8}-[a-f0-9]{4}-[a-f0-9]{4}-[a-f0-9]{4}-[a-f0-9]{12}$"
 
 	b, _ := regexp.Match(match, []byte(uuid))
 	return b
 }
 
+// sign a session UUID, returning the session id to hand out to the client
+func (b *Handler) signSessionID(uuid string) string {
+	if len(b.cfg.SessionSecret) == 0 {
+		return uuid
+	}
+
+	mac := hmac.New(sha256.New, b.cfg.SessionSecret)
+	mac.Write([]byte(uuid))
+	return uuid + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+// verify a session id sent by the client, returning the session UUID
+func (b *Handler) verifySessionID(sessionID string) (string, bool) {
+	if len(b.cfg.SessionSecret) == 0 {
+		return sessionID, isValidUUID(sessionID)
+	}
+
+	// Split the id into UUID and signature
+	i := strings.LastIndex(sessionID, ".")
+	if i < 0 {
+		return "", false
+	}
+	uuid := sessionID[:i]
+	if !isValidUUID(uuid) {
+		return "", false
+	}
+	signature, err := hex.DecodeString(sessionID[i+1:])
+	if err != nil {
+		return "", false
+	}
+
+	// Make sure the signature matches
+	mac := hmac.New(sha256.New, b.cfg.SessionSecret)
+	mac.Write([]byte(uuid))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return "", false
+	}
+
+	return uuid, true
+}
+
+// errReadTimeout is returned by a deadlineReader when the deadline has passed
+var errReadTimeout = errors.New("read timeout")
+
+// deadlineReader fails all reads once the deadline has passed
+type deadlineReader struct {
+	r        io.Reader
+	deadline time.Time
+}
+
+func (d *deadlineReader) Read(p []byte) (n int, err error) {
+	if time.Now().After(d.deadline) {
+		return 0, errReadTimeout
+	}
+	n, err = d.r.Read(p)
+	if err == nil && time.Now().After(d.deadline) {
+		err = errReadTimeout
+	}
+	return
+}
+
+// errInvalidFilename is returned when a request path doesn't end with a usable filename
+var errInvalidFilename = errors.New("invalid filename")
+
+// get the filename from the last segment of an escaped URL path. The segment is unescaped,
+// and rejected if it is empty or could be used to escape the session directory
+func filenameFromPath(escapedPath string) (string, error) {
+	_, segment := path.Split(escapedPath)
+	filename, err := url.PathUnescape(segment)
+	if err != nil {
+		return "", err
+	}
+	if !validFilename(filename) {
+		return "", errInvalidFilename
+	}
+	return filename, nil
+}
+
+// get a slash separated path, relative to the handler prefix, from an escaped URL path. Each
+// segment is unescaped and validated, and the path is rejected if it is absolute or could be
+// used to escape the session directory
+func relativePathFromPath(escapedPath, prefix string) (string, error) {
+	if !strings.HasPrefix(escapedPath, prefix) {
+		return "", errInvalidFilename
+	}
+	rel := escapedPath[len(prefix):]
+	if !strings.HasSuffix(prefix, "/") {
+		if !strings.HasPrefix(rel, "/") {
+			return "", errInvalidFilename
+		}
+		rel = rel[1:]
+	}
+	if strings.HasPrefix(rel, "/") || strings.HasSuffix(rel, "/") {
+		return "", errInvalidFilename
+	}
+
+	var segments []string
+	for _, segment := range strings.Split(rel, "/") {
+		segment, err := url.PathUnescape(segment)
+		if err != nil {
+			return "", err
+		}
+		if segment == "." {
+			continue
+		}
+		if !validFilename(segment) {
+			return "", errInvalidFilename
+		}
+		segments = append(segments, segment)
+	}
+
+	// The last segment must be an actual filename
+	if len(segments) == 0 {
+		return "", errInvalidFilename
+	}
+	return strings.Join(segments, "/"), nil
+}
+
+// check a filename, or each segment of a nested path, against the configured length and
+// character restrictions. Names ending in the PartSuffix would be taken for unfinished files
+func (b *Handler) filenameAllowed(filename string) bool {
+	if filename == metadataFile {
+		return false
+	}
+	for _, segment := range strings.Split(filename, "/") {
+		if len(segment) > b.cfg.MaxFilenameLength || strings.HasSuffix(segment, b.cfg.PartSuffix) {
+			return false
+		}
+		if b.cfg.WindowsSafeFilenames && !windowsSafeFilename(segment) {
+			return false
+		}
+		if b.filenamePattern != nil && !b.filenamePattern.MatchString(segment) {
+			return false
+		}
+	}
+	return true
+}
+
+// check that a filename is valid on Windows
+// https://docs.microsoft.com/en-us/windows/win32/fileio/naming-a-file
+func windowsSafeFilename(filename string) bool {
+	if strings.ContainsAny(filename, `<>:"/\|?*`) || strings.HasSuffix(filename, ".") || strings.HasSuffix(filename, " ") {
+		return false
+	}
+	for _, c := range filename {
+		if c < 32 {
+			return false
+		}
+	}
+
+	// Reserved device names aren't allowed, not even with an extension
+	name := strings.ToUpper(strings.SplitN(filename, ".", 2)[0])
+	switch name {
+	case "CON", "PRN", "AUX", "NUL":
+		return false
+	}
+	if len(name) == 4 && (strings.HasPrefix(name, "COM") || strings.HasPrefix(name, "LPT")) && name[3] >= '1' && name[3] <= '9' {
+		return false
+	}
+	return true
+}
+
+// check that a filename is usable. If nested is true, it may be a slash separated relative path
+func validPath(filename string, nested bool) bool {
+	if !nested {
+		return validFilename(filename)
+	}
+	for _, segment := range strings.Split(filename, "/") {
+		if !validFilename(segment) {
+			return false
+		}
+	}
+	return true
+}
+
+// check that a filename is a single, usable, path element
+func validFilename(filename string) bool {
+	if filename == "" || filename == "." || filename == ".." {
+		return false
+	}
+	return !strings.ContainsAny(filename, "/\\\x00")
+}
+
+// get the number of bytes received of a file, either from the unfinished part file or,
+// if there is none, the completed file. completed is true if the size is of the completed file
+func receivedSize(fs fileSystem, src, part string) (size uint64, completed bool, err error) {
+	var info os.FileInfo
+	if info, err = fs.Stat(part); err == nil {
+		return uint64(info.Size()), false, nil
+	} else if !os.IsNotExist(err) {
+		return 0, false, err
+	}
+	if info, err = fs.Stat(src); err == nil {
+		return uint64(info.Size()), true, nil
+	} else if !os.IsNotExist(err) {
+		return 0, false, err
+	}
+	return 0, false, nil
+}
+
+// find a free filename for a file that already exists, by adding " (1)", " (2)", ... to its name.
+// The name is only free if there is no unfinished file with it either
+func uniqueFilename(fs fileSystem, src, partSuffix string) (string, error) {
+	ext := filepath.Ext(src)
+	base := strings.TrimSuffix(src, ext)
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s (%d)%s", base, i, ext)
+		exist, err := fsExists(fs, candidate)
+		if err == nil && !exist {
+			exist, err = fsExists(fs, candidate+partSuffix)
+		}
+		if err != nil {
+			return "", err
+		}
+		if !exist {
+			return candidate, nil
+		}
+	}
+}
+
+// parse a timestamp, either in RFC3339 format or as seconds since the Unix epoch
+func parseMtime(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	sec, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, errors.New("invalid timestamp syntax")
+	}
+	return time.Unix(sec, 0), nil
+}
+
 // check if file exists
 func exists(path string) (bool, error) {
-	var err error
-	if _, err = os.Stat(path); err != nil && os.IsNotExist(err) {
-		return false, nil
-	}
-	return true, err
+	return fsExists(osFS{}, path)
 }
 
-// parse a HTTP range header
-func parseRange(rangeString string) (rangeStart, rangeEnd, fileLength uint64, err error) {
+// Errors returned when parsing a HTTP range header
+var (
+	errRangeSyntax   = errors.New("invalid range syntax")
+	errRangeInverted = errors.New("invalid range, start is after end")
+	errRangeLength   = errors.New("invalid range, end is beyond file length")
+	errRangeOverflow = errors.New("invalid range, value too large")
+)
+
+// UnknownLength is the total of a Content-Range with "*" as the file length
+const UnknownLength = math.MaxUint64
+
+// split a "bytes range/length" header into its range and length
+func splitRange(rangeString string) (rng, length string, err error) {
 
-	// We only support "range #-#/#" syntax
+	// We only support "range #-#/#" and "range */#" syntax
+	rangeString = strings.TrimSpace(rangeString)
 	if !strings.HasPrefix(rangeString, "bytes ") {
-		return 0, 0, 0, errors.New("invalid range syntax")
+		return "", "", errRangeSyntax
 	}
 
-	// Remove leading 6 characters
-	rangeArray := strings.Split(rangeString[6:], "/")
+	// Remove leading "bytes" and any spaces following it
+	rangeArray := strings.Split(strings.TrimLeft(rangeString[6:], " "), "/")
 	if len(rangeArray) != 2 {
-		return 0, 0, 0, errors.New("invalid range syntax")
+		return "", "", errRangeSyntax
+	}
+	return rangeArray[0], rangeArray[1], nil
+
+}
+
+// parse the total length of a range, values at the boundary would overflow when calculating sizes
+func parseLength(length string) (uint64, error) {
+	n, err := strconv.ParseUint(length, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n == math.MaxUint64 {
+		return 0, errRangeOverflow
+	}
+	return n, nil
+}
+
+// ParseContentRange parses a "bytes start-end/total" Content-Range header, as sent with fragments.
+// The total is UnknownLength if it is "*", and an empty file is sent as "bytes 0-0/0"
+func ParseContentRange(s string) (start, end, total uint64, err error) {
+	return parseContentRange(s, false)
+}
+
+// parse a Content-Range header. If overshoot is true, the range may end beyond the total as long
+// as it starts before it, like the final fragment of a buggy client
+func parseContentRange(s string, overshoot bool) (start, end, total uint64, err error) {
+
+	rng, length, err := splitRange(s)
+	if err != nil {
+		return 0, 0, 0, err
 	}
 
 	// Parse total length
-	if fileLength, err = strconv.ParseUint(rangeArray[1], 10, 64); err != nil {
+	if length == "*" {
+		total = UnknownLength
+	} else if total, err = parseLength(length); err != nil {
 		return 0, 0, 0, err
 	}
 
 	// Get start and end of range
-	rangeArray = strings.Split(rangeArray[0], "-")
+	rangeArray := strings.Split(rng, "-")
 	if len(rangeArray) != 2 {
-		return 0, 0, 0, errors.New("invalid range syntax")
+		return 0, 0, 0, errRangeSyntax
 	}
 
 	// Parse start value
-	if rangeStart, err = strconv.ParseUint(rangeArray[0], 10, 64); err != nil {
+	if start, err = strconv.ParseUint(rangeArray[0], 10, 64); err != nil {
 		return 0, 0, 0, err
 	}
 
 	// Parse end value
-	if rangeEnd, err = strconv.ParseUint(rangeArray[1], 10, 64); err != nil {
+	if end, err = strconv.ParseUint(rangeArray[1], 10, 64); err != nil {
 		return 0, 0, 0, err
 	}
 
-	// Return values
-	return rangeStart, rangeEnd, fileLength, nil
+	// Values at the boundary would overflow when calculating sizes
+	if start == math.MaxUint64 || end == math.MaxUint64 {
+		return 0, 0, 0, errRangeOverflow
+	}
+
+	// An empty file is sent as a single "bytes 0-0/0" fragment without data
+	if total == 0 && start == 0 && end == 0 {
+		return 0, 0, 0, nil
+	}
+
+	// Make sure the range makes sense
+	if start > end {
+		return 0, 0, 0, errRangeInverted
+	}
+	if total != UnknownLength && end >= total && (!overshoot || start >= total) {
+		return 0, 0, 0, errRangeLength
+	}
+
+	return start, end, total, nil
+
+}
+
+// FormatContentRange formats a Content-Range header for a fragment, the reverse of ParseContentRange
+func FormatContentRange(start, end, total uint64) string {
+	if total == UnknownLength {
+		return fmt.Sprintf("bytes %d-%d/*", start, end)
+	}
+	return fmt.Sprintf("bytes %d-%d/%d", start, end, total)
+}
+
+// parse a HTTP range header. If query is true, the header is a "bytes */#" query for the
+// current progress, and only the fileLength is set. The fileLength is UnknownLength if the
+// client sent "*" instead of it. The range may overshoot the end of the file, the handler
+// drops the bytes beyond it
+func parseRange(rangeString string) (rangeStart, rangeEnd, fileLength uint64, query bool, err error) {
+
+	rng, length, err := splitRange(rangeString)
+	if err != nil {
+		return 0, 0, 0, false, err
+	}
+
+	// A star instead of a range is a query for the current progress
+	if rng == "*" {
+		if fileLength, err = parseLength(length); err != nil {
+			return 0, 0, 0, false, err
+		}
+		return 0, 0, fileLength, true, nil
+	}
+
+	if rangeStart, rangeEnd, fileLength, err = parseContentRange(rangeString, true); err != nil {
+		return 0, 0, 0, false, err
+	}
+	return rangeStart, rangeEnd, fileLength, false, nil
 
 }
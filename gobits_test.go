@@ -1,11 +1,17 @@
 package gobits
 
 import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
 	"net/http/httptest"
 	"os"
 	"path"
 	"regexp"
+	"runtime"
 	"testing"
+	"time"
 )
 
 func TestNewHandler(t *testing.T) {
@@ -19,26 +25,38 @@ func TestNewHandler(t *testing.T) {
 		{
 			name:       "default config",
 			input:      &Config{},
-			output:     &Config{TempDir: path.Join(os.TempDir(), "gobits"), AllowedMethod: "BITS_POST", Protocol: "{7df0354d-249b-430f-820d-3d2a9bef4931}", MaxSize: 0, Allowed: []string{".*"}, Disallowed: []string{}},
+			output:     &Config{TempDir: path.Join(os.TempDir(), "gobits"), AllowedMethod: "BITS_POST", Protocol: "{7df0354d-249b-430f-820d-3d2a9bef4931}", MaxSize: 0, Allowed: []string{".*"}, Disallowed: []string{}, AcceptEncoding: "Identity", PartSuffix: ".gobits-part"},
 			errorMatch: "",
 		},
 		{
 			name:       "specified config",
-			input:      &Config{TempDir: "/tmp", AllowedMethod: "FOO_BAR", Protocol: "{11111111-2222-3333-4444-555555555555}", MaxSize: 10, Allowed: []string{"foo"}, Disallowed: []string{"bar"}},
-			output:     &Config{TempDir: "/tmp", AllowedMethod: "FOO_BAR", Protocol: "{11111111-2222-3333-4444-555555555555}", MaxSize: 10, Allowed: []string{"foo"}, Disallowed: []string{"bar"}},
+			input:      &Config{TempDir: "/tmp", AllowedMethod: "FOO_BAR", Protocol: "{11111111-2222-3333-4444-555555555555}", MaxSize: 10, Allowed: []string{"foo"}, Disallowed: []string{"bar"}, AcceptEncoding: "gzip", PartSuffix: ".tmp"},
+			output:     &Config{TempDir: "/tmp", AllowedMethod: "FOO_BAR", Protocol: "{11111111-2222-3333-4444-555555555555}", MaxSize: 10, Allowed: []string{"foo"}, Disallowed: []string{"bar"}, AcceptEncoding: "gzip", PartSuffix: ".tmp"},
 			errorMatch: "",
 		},
+		{
+			name:       "protocol casing",
+			input:      &Config{Protocol: "{7DF0354D-249B-430F-820D-3D2A9BEF4931}"},
+			output:     &Config{TempDir: path.Join(os.TempDir(), "gobits"), AllowedMethod: "BITS_POST", Protocol: ProtocolUpload15, Allowed: []string{".*"}, Disallowed: []string{}, AcceptEncoding: "Identity", PartSuffix: ".gobits-part"},
+			errorMatch: "",
+		},
+		{
+			name:       "invalid_protocol",
+			input:      &Config{Protocols: []string{"upload"}},
+			output:     &Config{},
+			errorMatch: "^invalid protocol 'upload'",
+		},
 		{
 			name:       "invalid_allowed",
 			input:      &Config{Allowed: []string{"?"}},
 			output:     &Config{},
-			errorMatch: "^failed to compile regexp .*",
+			errorMatch: "^invalid filter: failed to compile regexp .*",
 		},
 		{
 			name:       "invalid_disallowed",
 			input:      &Config{Disallowed: []string{"?"}},
 			output:     &Config{},
-			errorMatch: "^failed to compile regexp .*",
+			errorMatch: "^invalid filter: failed to compile regexp .*",
 		},
 	}
 
@@ -66,6 +84,15 @@ func TestNewHandler(t *testing.T) {
 			if h.cfg.Protocol != tc.output.Protocol {
 				t.Errorf("invalid default protocol: %v, expected %v", h.cfg.Protocol, tc.output.Protocol)
 			}
+			if h.cfg.AcceptEncoding != tc.output.AcceptEncoding {
+				t.Errorf("invalid default accept encoding: %v, expected %v", h.cfg.AcceptEncoding, tc.output.AcceptEncoding)
+			}
+			if h.cfg.PartSuffix != tc.output.PartSuffix {
+				t.Errorf("invalid default part suffix: %v, expected %v", h.cfg.PartSuffix, tc.output.PartSuffix)
+			}
+			if len(h.cfg.Protocols) == 0 || h.cfg.Protocols[0] != tc.output.Protocol {
+				t.Errorf("invalid default protocols: %v, expected %v first", h.cfg.Protocols, tc.output.Protocol)
+			}
 			if h.cfg.MaxSize != tc.output.MaxSize {
 				t.Errorf("invalid default max size: %d, expected %d", h.cfg.MaxSize, tc.output.MaxSize)
 			}
@@ -94,6 +121,87 @@ func TestNewHandler(t *testing.T) {
 
 }
 
+func TestNewHandlerErrors(t *testing.T) {
+
+	file := path.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	authenticator := func(r *http.Request) (string, error) { return "", nil }
+
+	testcases := []struct {
+		name string
+		cfg  Config
+		err  error
+	}{
+		{"protocol", Config{Protocol: "{upload}"}, ErrInvalidProtocol},
+		{"protocols", Config{Protocols: []string{ProtocolUpload15, "upload"}}, ErrInvalidProtocol},
+		{"allowed", Config{Allowed: []string{"("}}, ErrInvalidFilter},
+		{"disallowed glob", Config{FilterMode: FilterGlob, Disallowed: []string{"[a-"}}, ErrInvalidFilter},
+		{"rule", Config{Rules: []Rule{{Pattern: "*"}}}, ErrInvalidFilter},
+		{"rule sizes", Config{Rules: []Rule{{Pattern: "a", MinSize: 2, MaxSize: 1}}}, ErrInvalidOption},
+		{"filename pattern", Config{FilenamePattern: "[a-"}, ErrInvalidFilter},
+		{"allowed network", Config{AllowedNetworks: []string{"10.0.0.0/33"}}, ErrInvalidNetwork},
+		{"denied network", Config{DeniedNetworks: []string{"example.com"}}, ErrInvalidNetwork},
+		{"shard depth", Config{ShardDepth: -1}, ErrInvalidOption},
+		{"filename length", Config{MaxFilenameLength: -1}, ErrInvalidOption},
+		{"webhook url", Config{WebhookURL: "hooks.example.com"}, ErrInvalidOption},
+		{"hash algorithm", Config{HashFiles: true, HashAlgorithm: 42}, ErrInvalidOption},
+		{"filter mode", Config{FilterMode: 3}, ErrInvalidOption},
+		{"existing file policy", Config{OnExistingFile: 3}, ErrInvalidOption},
+		{"collision policy", Config{OnCollision: -1}, ErrInvalidOption},
+		{"sync policy", Config{SyncPolicy: 3}, ErrInvalidOption},
+		{"proxy header", Config{ProxyHeader: 2}, ErrInvalidOption},
+		{"authenticate all", Config{AuthenticateAll: true}, ErrConflictingOptions},
+		{"bind address", Config{BindIgnoreAddress: true, Authenticator: authenticator}, ErrConflictingOptions},
+		{"webhook secret", Config{WebhookSecret: []byte("secret")}, ErrConflictingOptions},
+		{"expvar name", Config{ExpvarName: "uploads"}, ErrConflictingOptions},
+		{"temp dir file", Config{TempDir: file}, ErrTempDirUnwritable},
+		{"temp dir in file", Config{TempDir: path.Join(file, "gobits")}, ErrTempDirUnwritable},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.cfg.TempDir == "" {
+				tc.cfg.TempDir = t.TempDir()
+			}
+			_, err := NewHandler(tc.cfg, nil)
+			if !errors.Is(err, tc.err) {
+				t.Errorf("expected %v, got %v", tc.err, err)
+			}
+		})
+	}
+
+	// every invalid setting is reported at once
+	_, err := NewHandler(Config{TempDir: t.TempDir(), Protocol: "{upload}", ShardDepth: -1, BindIgnoreAddress: true}, nil)
+	for _, expected := range []error{ErrInvalidProtocol, ErrInvalidOption, ErrConflictingOptions} {
+		if !errors.Is(err, expected) {
+			t.Errorf("expected %v, got %v", expected, err)
+		}
+	}
+
+	// a rejected config leaves nothing running
+	before := runtime.NumGoroutine()
+	for i := 0; i < 10; i++ {
+		cfg := Config{TempDir: t.TempDir(), AuditWriter: io.Discard, WebhookURL: "http://localhost/", SyncPolicy: 3}
+		if _, err := NewHandler(cfg, nil); err == nil {
+			t.Fatal("expected the config to be rejected")
+		}
+	}
+	if after := runtime.NumGoroutine(); after >= before+10 {
+		t.Errorf("expected no goroutines to be started, went from %v to %v", before, after)
+	}
+
+	// the TempDir is created
+	dir := path.Join(t.TempDir(), "new", "gobits")
+	if _, err := NewHandler(Config{TempDir: dir}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		t.Errorf("expected the TempDir to be created, got %v", err)
+	}
+}
+
 func TestBitsError(t *testing.T) {
 
 	testcases := []struct {
@@ -203,6 +311,7 @@ func TestParseRange(t *testing.T) {
 		rangeStart uint64
 		rangeEnd   uint64
 		fileLength uint64
+		query      bool
 		errorMatch string
 	}{
 		{
@@ -242,17 +351,97 @@ func TestParseRange(t *testing.T) {
 			rangeEnd:   20,
 			fileLength: 100,
 		},
+		{
+			name:       "inverted range",
+			input:      "bytes 20-10/100",
+			errorMatch: "start is after end",
+		},
+		{
+			name:       "end equals length",
+			input:      "bytes 0-100/100",
+			rangeEnd:   100,
+			fileLength: 100,
+		},
+		{
+			name:       "end beyond length",
+			input:      "bytes 0-18446744073709551614/5",
+			rangeEnd:   18446744073709551614,
+			fileLength: 5,
+		},
+		{
+			name:       "end at boundary",
+			input:      "bytes 0-18446744073709551615/5",
+			errorMatch: "value too large",
+		},
+		{
+			name:       "length at boundary",
+			input:      "bytes 0-10/18446744073709551615",
+			errorMatch: "value too large",
+		},
+		{
+			name:       "length overflow",
+			input:      "bytes 0-10/18446744073709551616",
+			errorMatch: "strconv.ParseUint: parsing",
+		},
+		{
+			name:       "surrounding whitespace",
+			input:      "  bytes 10-20/100 ",
+			rangeStart: 10,
+			rangeEnd:   20,
+			fileLength: 100,
+		},
+		{
+			name:       "multiple spaces",
+			input:      "bytes   10-20/100",
+			rangeStart: 10,
+			rangeEnd:   20,
+			fileLength: 100,
+		},
+		{
+			name:       "query",
+			input:      "bytes */100",
+			fileLength: 100,
+			query:      true,
+		},
+		{
+			name:       "query invalid length",
+			input:      "bytes */a",
+			errorMatch: "strconv.ParseUint: parsing",
+		},
+		{
+			name:  "empty file",
+			input: "bytes 0-0/0",
+		},
+		{
+			name:       "empty file with data",
+			input:      "bytes 0-1/0",
+			errorMatch: "end is beyond file length",
+		},
+		{
+			name:       "start beyond file length",
+			input:      "bytes 100-109/100",
+			errorMatch: "end is beyond file length",
+		},
+		{
+			name:       "single byte",
+			input:      "bytes 0-0/1",
+			rangeStart: 0,
+			rangeEnd:   0,
+			fileLength: 1,
+		},
 	}
 
 	for _, tc := range testcases {
 		t.Run(tc.name, func(t *testing.T) {
-			rangeStart, rangeEnd, fileLength, err := parseRange(tc.input)
+			rangeStart, rangeEnd, fileLength, query, err := parseRange(tc.input)
 
 			if err != nil {
 				if b, _ := regexp.Match(tc.errorMatch, []byte(err.Error())); !b {
 					t.Errorf("unexpected error: %v", err)
 					return
 				}
+			} else if tc.errorMatch != "" {
+				t.Errorf("expected error %v, got nil", tc.errorMatch)
 			}
 
 			if rangeStart != tc.rangeStart {
@@ -267,7 +456,613 @@ func TestParseRange(t *testing.T) {
 				t.Errorf("invalid fileLength %v, expected %v", fileLength, tc.fileLength)
 			}
 
+			if query != tc.query {
+				t.Errorf("invalid query %v, expected %v", query, tc.query)
+			}
+
+		})
+	}
+
+}
+
+func TestParseContentRange(t *testing.T) {
+
+	testcases := []struct {
+		input string
+		start uint64
+		end   uint64
+		total uint64
+		err   bool
+	}{
+		{input: "bytes 10-20/100", start: 10, end: 20, total: 100},
+		{input: "bytes 0-0/0"},
+		{input: "bytes 10-20/*", start: 10, end: 20, total: UnknownLength},
+		{input: "bytes 0-18446744073709551614/*", end: 18446744073709551614, total: UnknownLength},
+		{input: "bytes 20-10/*", err: true},
+		{input: "bytes */100", err: true},
+		{input: "bytes */*", err: true},
+		{input: "bytes 0-10/18446744073709551615", err: true},
+		{input: "bytes 90-109/100", err: true},
+	}
+
+	for _, tc := range testcases {
+		start, end, total, err := ParseContentRange(tc.input)
+		if (err != nil) != tc.err {
+			t.Errorf("%q: unexpected error %v", tc.input, err)
+			continue
+		}
+		if start != tc.start || end != tc.end || total != tc.total {
+			t.Errorf("%q: expected %v-%v/%v, got %v-%v/%v", tc.input, tc.start, tc.end, tc.total, start, end, total)
+		}
+	}
+
+	// the server gets the unknown length too
+	if _, _, length, query, err := parseRange("bytes 10-20/*"); err != nil || query || length != UnknownLength {
+		t.Errorf("expected an unknown length, got %v, %v, %v", length, query, err)
+	}
+
+}
+
+func TestFormatContentRange(t *testing.T) {
+
+	testcases := []struct {
+		start, end, total uint64
+		output            string
+	}{
+		{start: 10, end: 20, total: 100, output: "bytes 10-20/100"},
+		{output: "bytes 0-0/0"},
+		{start: 10, end: 20, total: UnknownLength, output: "bytes 10-20/*"},
+	}
+
+	for _, tc := range testcases {
+		output := FormatContentRange(tc.start, tc.end, tc.total)
+		if output != tc.output {
+			t.Errorf("expected %q, got %q", tc.output, output)
+		}
+
+		// and back again
+		start, end, total, err := ParseContentRange(output)
+		if err != nil || start != tc.start || end != tc.end || total != tc.total {
+			t.Errorf("round trip of %q failed: %v-%v/%v, %v", output, start, end, total, err)
+		}
+	}
+
+}
+
+func FuzzContentRange(f *testing.F) {
+
+	f.Add(uint64(10), uint64(20), uint64(100))
+	f.Add(uint64(0), uint64(0), uint64(0))
+	f.Add(uint64(0), uint64(10), uint64(UnknownLength))
+
+	f.Fuzz(func(t *testing.T, start, end, total uint64) {
+		s := FormatContentRange(start, end, total)
+		pStart, pEnd, pTotal, err := ParseContentRange(s)
+		if err != nil {
+			return
+		}
+		if pStart != start || pEnd != end || pTotal != total {
+			t.Errorf("round trip of %q gave %v-%v/%v", s, pStart, pEnd, pTotal)
+		}
+	})
+
+}
+
+func FuzzParseRange(f *testing.F) {
+
+	for _, seed := range []string{
+		"bytes 0-0/1",
+		"bytes 10-20/100",
+		"bytes 20-10/100",
+		"bytes 0-100/100",
+		"bytes 0-18446744073709551615/5",
+		"bytes 0-10/18446744073709551615",
+		"bytes   10-20/100",
+		" bytes 10-20/100 ",
+		"bytes -/",
+		"bytes 1-2-3/4",
+		"bytes 1/2/3",
+		"bytes */100",
+		"bytes 0-0/0",
+		"a",
+		"",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, input string) {
+		rangeStart, rangeEnd, fileLength, query, err := parseRange(input)
+		if query {
+			return
+		}
+		if err != nil {
+			return
+		}
+
+		if rangeStart > rangeEnd {
+			t.Errorf("inverted range accepted: %q", input)
+		}
+		if rangeStart >= fileLength && fileLength != 0 {
+			t.Errorf("range beyond file length accepted: %q", input)
+		}
+		if rangeEnd-rangeStart+1 == 0 {
+			t.Errorf("range size overflow accepted: %q", input)
+		}
+	})
+
+}
+
+func TestSessionID(t *testing.T) {
+
+	const uuid = "01234567-89ab-4def-8123-456789abcdef"
+
+	plain := &Handler{}
+	if id := plain.signSessionID(uuid); id != uuid {
+		t.Errorf("unsigned id should be the uuid, got %v", id)
+	}
+	if u, ok := plain.verifySessionID(uuid); !ok || u != uuid {
+		t.Errorf("failed to verify unsigned id: %v", uuid)
+	}
+	if _, ok := plain.verifySessionID("../" + uuid); ok {
+		t.Errorf("invalid id should not verify")
+	}
+
+	signed := &Handler{cfg: Config{SessionSecret: []byte("secret")}}
+	id := signed.signSessionID(uuid)
+	if u, ok := signed.verifySessionID(id); !ok || u != uuid {
+		t.Errorf("failed to verify signed id: %v", id)
+	}
+	if _, ok := signed.verifySessionID(uuid); ok {
+		t.Errorf("id without signature should not verify")
+	}
+
+	other := &Handler{cfg: Config{SessionSecret: []byte("other")}}
+	if _, ok := other.verifySessionID(id); ok {
+		t.Errorf("id signed with another secret should not verify")
+	}
+
+}
+
+func TestParseMtime(t *testing.T) {
+
+	testcases := []struct {
+		name       string
+		input      string
+		output     time.Time
+		errorMatch string
+	}{
+		{
+			name:   "rfc3339",
+			input:  "2017-06-01T12:30:00Z",
+			output: time.Date(2017, 6, 1, 12, 30, 0, 0, time.UTC),
+		},
+		{
+			name:   "unix epoch",
+			input:  "1496320200",
+			output: time.Date(2017, 6, 1, 12, 30, 0, 0, time.UTC),
+		},
+		{
+			name:       "invalid",
+			input:      "yesterday",
+			errorMatch: "invalid timestamp syntax",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			mtime, err := parseMtime(tc.input)
+			if err != nil {
+				if tc.errorMatch == "" || err.Error() != tc.errorMatch {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if !mtime.Equal(tc.output) {
+				t.Errorf("invalid time %v, expected %v", mtime, tc.output)
+			}
+		})
+	}
+
+}
+
+func TestDrainWriter(t *testing.T) {
+
+	testcases := []struct {
+		name       string
+		size       int
+		status     int
+		remaining  int
+		connection string
+	}{
+		{
+			name:      "error with small body",
+			size:      1024,
+			status:    400,
+			remaining: 0,
+		},
+		{
+			name:       "error with large body",
+			size:       maxDrainSize + 10,
+			status:     400,
+			remaining:  9,
+			connection: "close",
+		},
+		{
+			name:      "success",
+			size:      1024,
+			status:    200,
+			remaining: 1024,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			body := bytes.NewReader(make([]byte, tc.size))
+			rec := httptest.NewRecorder()
+
+			w := &drainWriter{ResponseWriter: rec, body: body}
+			w.WriteHeader(tc.status)
+
+			if body.Len() != tc.remaining {
+				t.Errorf("expected %v bytes left in body, got %v", tc.remaining, body.Len())
+			}
+			if rec.Header().Get("Connection") != tc.connection {
+				t.Errorf("expected connection %q, got %q", tc.connection, rec.Header().Get("Connection"))
+			}
+		})
+	}
+
+}
+
+func TestAcceptsEncoding(t *testing.T) {
+
+	testcases := []struct {
+		accepted string
+		encoding string
+		result   bool
+	}{
+		{accepted: "Identity", encoding: "", result: true},
+		{accepted: "Identity", encoding: "identity", result: true},
+		{accepted: "Identity", encoding: "gzip", result: false},
+		{accepted: "-", encoding: "gzip", result: false},
+		{accepted: "gzip, deflate", encoding: "deflate", result: true},
+		{accepted: "gzip, deflate", encoding: "GZIP", result: true},
+		{accepted: "gzip, deflate", encoding: "br", result: false},
+	}
+
+	for _, tc := range testcases {
+		if r := acceptsEncoding(tc.accepted, tc.encoding); r != tc.result {
+			t.Errorf("acceptsEncoding(%q, %q) = %v, expected %v", tc.accepted, tc.encoding, r, tc.result)
+		}
+	}
+
+}
+
+func TestSelectProtocol(t *testing.T) {
+
+	const (
+		a = "{11111111-2222-3333-4444-555555555555}"
+		b = "{66666666-7777-8888-9999-000000000000}"
+		c = "{aaaaaaaa-bbbb-cccc-dddd-eeeeeeeeeeee}"
+	)
+
+	testcases := []struct {
+		name   string
+		ours   []string
+		theirs []string
+		output string
+	}{
+		{
+			name:   "no overlap",
+			ours:   []string{a},
+			theirs: []string{b, c},
+			output: "",
+		},
+		{
+			name:   "multiple overlap",
+			ours:   []string{a, b, c},
+			theirs: []string{c, b},
+			output: b,
+		},
+		{
+			name:   "server order wins",
+			ours:   []string{c, b},
+			theirs: []string{b, c},
+			output: c,
+		},
+		{
+			name:   "case insensitive",
+			ours:   []string{c},
+			theirs: []string{"{AAAAAAAA-BBBB-CCCC-DDDD-EEEEEEEEEEEE}"},
+			output: "{AAAAAAAA-BBBB-CCCC-DDDD-EEEEEEEEEEEE}",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if p := selectProtocol(tc.ours, tc.theirs); p != tc.output {
+				t.Errorf("invalid protocol %q, expected %q", p, tc.output)
+			}
+		})
+	}
+
+}
+
+func TestFilenameFromPath(t *testing.T) {
+
+	testcases := []struct {
+		name       string
+		input      string
+		output     string
+		errorMatch string
+	}{
+		{
+			name:   "plain",
+			input:  "/BITS/report.csv",
+			output: "report.csv",
+		},
+		{
+			name:   "encoded space",
+			input:  "/BITS/my%20report.csv",
+			output: "my report.csv",
+		},
+		{
+			name:       "encoded dot dot",
+			input:      "/BITS/%2e%2e",
+			errorMatch: "invalid filename",
+		},
+		{
+			name:       "encoded slash",
+			input:      "/BITS/..%2f..%2fetc%2fpasswd",
+			errorMatch: "invalid filename",
+		},
+		{
+			name:       "encoded backslash",
+			input:      "/BITS/..%5cfile",
+			errorMatch: "invalid filename",
+		},
+		{
+			name:       "trailing slash",
+			input:      "/BITS/report.csv/",
+			errorMatch: "invalid filename",
+		},
+		{
+			name:       "invalid escape",
+			input:      "/BITS/report%zz",
+			errorMatch: "invalid URL escape",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			filename, err := filenameFromPath(tc.input)
+			if err != nil {
+				if tc.errorMatch == "" {
+					t.Errorf("unexpected error: %v", err)
+				} else if b, _ := regexp.MatchString(tc.errorMatch, err.Error()); !b {
+					t.Errorf("unexpected error: %v, expected %v", err, tc.errorMatch)
+				}
+				return
+			}
+			if tc.errorMatch != "" {
+				t.Errorf("expected error %v, got nil", tc.errorMatch)
+			}
+			if filename != tc.output {
+				t.Errorf("invalid filename %q, expected %q", filename, tc.output)
+			}
+		})
+	}
+
+}
+
+func TestRelativePathFromPath(t *testing.T) {
+
+	testcases := []struct {
+		name       string
+		input      string
+		prefix     string
+		output     string
+		errorMatch string
+	}{
+		{
+			name:   "nested",
+			input:  "/BITS/job42/logs/app/trace.etl",
+			prefix: "/BITS/",
+			output: "job42/logs/app/trace.etl",
+		},
+		{
+			name:   "prefix without slash",
+			input:  "/BITS/job42/trace.etl",
+			prefix: "/BITS",
+			output: "job42/trace.etl",
+		},
+		{
+			name:   "encoded and dot segments",
+			input:  "/BITS/my%20logs/./trace.etl",
+			prefix: "/BITS/",
+			output: "my logs/trace.etl",
+		},
+		{
+			name:       "dot dot",
+			input:      "/BITS/logs/../../trace.etl",
+			prefix:     "/BITS/",
+			errorMatch: "invalid filename",
+		},
+		{
+			name:       "encoded dot dot",
+			input:      "/BITS/logs/%2e%2e/trace.etl",
+			prefix:     "/BITS/",
+			errorMatch: "invalid filename",
+		},
+		{
+			name:       "absolute",
+			input:      "/BITS//etc/passwd",
+			prefix:     "/BITS/",
+			errorMatch: "invalid filename",
+		},
+		{
+			name:       "trailing slash",
+			input:      "/BITS/logs/",
+			prefix:     "/BITS/",
+			errorMatch: "invalid filename",
+		},
+		{
+			name:       "prefix without slash not at boundary",
+			input:      "/BITSX/trace.etl",
+			prefix:     "/BITS",
+			errorMatch: "invalid filename",
+		},
+		{
+			name:       "wrong prefix",
+			input:      "/other/trace.etl",
+			prefix:     "/BITS/",
+			errorMatch: "invalid filename",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			rel, err := relativePathFromPath(tc.input, tc.prefix)
+			if err != nil {
+				if tc.errorMatch == "" {
+					t.Errorf("unexpected error: %v", err)
+				} else if b, _ := regexp.MatchString(tc.errorMatch, err.Error()); !b {
+					t.Errorf("unexpected error: %v, expected %v", err, tc.errorMatch)
+				}
+				return
+			}
+			if tc.errorMatch != "" {
+				t.Errorf("expected error %v, got nil", tc.errorMatch)
+			}
+			if rel != tc.output {
+				t.Errorf("invalid path %q, expected %q", rel, tc.output)
+			}
+		})
+	}
+
+}
+
+func TestWindowsSafeFilename(t *testing.T) {
+
+	testcases := []struct {
+		input  string
+		result bool
+	}{
+		{input: "report.csv", result: true},
+		{input: "my report (1).csv", result: true},
+		{input: "console.log", result: true},
+		{input: "COM10.txt", result: true},
+		{input: "a<b.txt", result: false},
+		{input: "a:b.txt", result: false},
+		{input: `a"b.txt`, result: false},
+		{input: "a|b.txt", result: false},
+		{input: "a?b.txt", result: false},
+		{input: "a*b.txt", result: false},
+		{input: "a\\b.txt", result: false},
+		{input: "a\tb.txt", result: false},
+		{input: "trailing.", result: false},
+		{input: "trailing ", result: false},
+		{input: "CON", result: false},
+		{input: "nul.txt", result: false},
+		{input: "Com1.log", result: false},
+		{input: "LPT9", result: false},
+	}
+
+	for _, tc := range testcases {
+		if r := windowsSafeFilename(tc.input); r != tc.result {
+			t.Errorf("windowsSafeFilename(%q) = %v, expected %v", tc.input, r, tc.result)
+		}
+	}
+
+}
+
+func TestClientIP(t *testing.T) {
+
+	testcases := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		remote     string
+		forwarded  string
+	}{
+		{
+			name:       "ipv4",
+			remoteAddr: "192.0.2.1:1234",
+			remote:     "192.0.2.1",
+			forwarded:  "192.0.2.1",
+		},
+		{
+			name:       "ipv6",
+			remoteAddr: "[2001:db8::1]:1234",
+			remote:     "2001:db8::1",
+			forwarded:  "2001:db8::1",
+		},
+		{
+			name:       "ipv6 with zone",
+			remoteAddr: "[fe80::1%eth0]:1234",
+			remote:     "fe80::1%eth0",
+			forwarded:  "fe80::1%eth0",
+		},
+		{
+			name:       "x-real-ip",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string]string{"X-Real-IP": "2001:db8::2", "X-Forwarded-For": "192.0.2.3"},
+			remote:     "10.0.0.1",
+			forwarded:  "2001:db8::2",
+		},
+		{
+			name:       "x-forwarded-for",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string]string{"X-Forwarded-For": " 192.0.2.3, 10.0.0.2"},
+			remote:     "10.0.0.1",
+			forwarded:  "192.0.2.3",
+		},
+		{
+			name:       "invalid forwarded",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string]string{"X-Forwarded-For": "unknown"},
+			remote:     "10.0.0.1",
+			forwarded:  "10.0.0.1",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("BITS_POST", "/BITS/", nil)
+			r.RemoteAddr = tc.remoteAddr
+			for k, v := range tc.headers {
+				r.Header.Set(k, v)
+			}
+
+			if ip := RemoteIP(r); ip != tc.remote {
+				t.Errorf("invalid remote ip %q, expected %q", ip, tc.remote)
+			}
+			if ip := ForwardedIP(r); ip != tc.forwarded {
+				t.Errorf("invalid forwarded ip %q, expected %q", ip, tc.forwarded)
+			}
 		})
 	}
 
 }
+
+func TestFilterPattern(t *testing.T) {
+
+	testcases := []struct {
+		pattern    string
+		ignoreCase bool
+		anchored   bool
+		output     string
+	}{
+		{pattern: `.*\.exe`, output: `.*\.exe`},
+		{pattern: `.*\.exe`, ignoreCase: true, output: `(?i).*\.exe`},
+		{pattern: `foo|bar`, anchored: true, output: `^(?:foo|bar)$`},
+		{pattern: `foo|bar`, ignoreCase: true, anchored: true, output: `(?i)^(?:foo|bar)$`},
+	}
+
+	for _, tc := range testcases {
+		if p := filterPattern(tc.pattern, tc.ignoreCase, tc.anchored); p != tc.output {
+			t.Errorf("filterPattern(%q, %v, %v) = %q, expected %q", tc.pattern, tc.ignoreCase, tc.anchored, p, tc.output)
+		}
+	}
+
+}
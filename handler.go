@@ -1,20 +1,45 @@
 package gobits
 
 import (
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
-	"path"
 	"path/filepath"
-	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 // ServeHTTP handler
 func (b *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Make sure unread request bodies are discarded before errors are written, describe the
+	// errors if asked to, and keep the status for the metrics and traces
+	w = &drainWriter{ResponseWriter: w, body: r.Body}
+	if b.cfg.VerboseErrors {
+		w = &verboseWriter{ResponseWriter: w}
+	}
+	sw := &statusWriter{ResponseWriter: w}
+	w = sw
+
+	// Identify the server in every reply
+	if b.cfg.ServerHeader != "-" {
+		w.Header().Set("Server", b.cfg.ServerHeader)
+	}
+
+	// Health checks don't need BITS headers
+	if b.isHealthCheck(r) {
+		b.serveHealth(w, r)
+		return
+	}
+
 	// Only allow BITS requests
 	if r.Method != b.cfg.AllowedMethod {
+		w.Header().Set("Allow", b.cfg.AllowedMethod)
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
@@ -23,18 +48,52 @@ func (b *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	packetType := strings.ToLower(r.Header.Get("BITS-Packet-Type"))
 	sessionID := r.Header.Get("BITS-Session-Id")
 
+	// Trace the packets that change sessions
+	var span Span
+	if r, span = b.startSpan(r, packetType, sessionID); span != nil {
+		defer endSpan(span, sw)
+	}
+	r = b.withStatus(r, sw)
+	defer b.logRequest(r, sw, packetType, sessionID)
+
+	// Only clients in the allowed networks are served
+	if !b.checkNetwork(w, r, sessionID) {
+		return
+	}
+
+	// Only authenticated clients can start sessions
+	var ok bool
+	if r, ok = b.authenticate(w, r, packetType, sessionID); !ok {
+		return
+	}
+
+	// Only the client that created a session can send packets to it
+	if packetType == "fragment" || packetType == "close-session" || packetType == "cancel-session" {
+		if !b.checkBinding(w, r, sessionID) {
+			return
+		}
+	}
+
 	// Take appropriate action based on what type of packet we got
 	switch packetType {
 	case "ping":
 		b.bitsPing(w, r)
 	case "create-session":
+		if b.shuttingDown() {
+			bitsError(w, "", http.StatusServiceUnavailable, 0, ErrorContextRemoteFile)
+			return
+		}
 		b.bitsCreate(w, r)
 	case "cancel-session":
 		b.bitsCancel(w, r, sessionID)
 	case "close-session":
 		b.bitsClose(w, r, sessionID)
 	case "fragment":
+		done := b.track()
+		defer done()
+		start := time.Now()
 		b.bitsFragment(w, r, sessionID)
+		b.fragmentHandled(sw, time.Since(start))
 	default:
 		bitsError(w, "", http.StatusBadRequest, 0, ErrorContextRemoteFile)
 	}
@@ -44,311 +103,933 @@ func (b *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 // https://msdn.microsoft.com/en-us/library/aa363135(v=vs.85).aspx
 func (b *Handler) bitsPing(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("BITS-Packet-Type", "Ack")
+	if b.cfg.AdvertiseCapabilities {
+		b.advertise(w)
+	}
 	w.Write(nil)
 }
 
+// add the capabilities of the server to an Ack. The protocols are in the order of preference, and
+// size limits are only sent if there are any
+func (b *Handler) advertise(w http.ResponseWriter) {
+	for _, protocol := range b.cfg.Protocols {
+		w.Header().Add("BITS-Protocol", protocol)
+	}
+	if b.cfg.AcceptEncoding != "-" {
+		w.Header().Add("Accept-Encoding", b.cfg.AcceptEncoding)
+	}
+	if b.cfg.MaxSize > 0 {
+		w.Header().Add("X-GoBITS-Max-Size", strconv.FormatUint(b.cfg.MaxSize, 10))
+	}
+	if b.cfg.MaxFragmentSize > 0 {
+		w.Header().Add("X-GoBITS-Max-Fragment-Size", strconv.FormatUint(b.cfg.MaxFragmentSize, 10))
+	}
+}
+
 // use the Create-Session packet to request an upload session with the BITS server.
 // https://msdn.microsoft.com/en-us/library/aa362833(v=vs.85).aspx
 func (b *Handler) bitsCreate(w http.ResponseWriter, r *http.Request) {
 
-	// Check for correct protocol
-	var protocol string
-	protocols := strings.Split(r.Header.Get("BITS-Supported-Protocols"), " ")
-	for _, protocol = range protocols {
-		if protocol == b.cfg.AllowedMethod {
-			break
-		}
+	// The client must offer at least one protocol
+	supported := strings.Fields(r.Header.Get("BITS-Supported-Protocols"))
+	if len(supported) == 0 {
+		bitsError(w, "", http.StatusBadRequest, codeInvalidArgument, ErrorContextRemoteFile)
+		return
 	}
-	if protocol != b.cfg.Protocol {
+
+	// Pick the protocol we prefer the most of the ones the client supports
+	protocol := selectProtocol(b.cfg.Protocols, supported)
+	if protocol == "" {
 		// no matching protocol found
-		bitsError(w, "", http.StatusBadRequest, 0, ErrorContextRemoteFile)
+		bitsError(w, "", http.StatusBadRequest, codeNotSupported, ErrorContextRemoteFile)
 		return
 	}
 
+	// Sessions of tenants are kept apart
+	tenant, err := b.resolveTenant(r)
+	if err != nil {
+		refusedBecause(r, err)
+		bitsError(w, "", http.StatusForbidden, codeAccessDenied, ErrorContextRemoteFile)
+		return
+	}
+
+	// A retried create with the same idempotency key gets the session that was created the first time
+	var key string
+	if b.cfg.DeduplicateCreate {
+		if key = r.Header.Get(b.cfg.IdempotencyHeader); key != "" {
+			// Keys are only unique per client
+			key = b.cfg.ClientIP(r) + " " + key
+
+			uuid, claimed, err := b.claimKey(r.Context(), key)
+			if err != nil {
+				bitsError(w, "", http.StatusServiceUnavailable, 0, ErrorContextRemoteFile)
+				return
+			}
+			if !claimed {
+				b.createAck(w, protocol, b.signSessionID(uuid))
+				return
+			}
+			// the key is released as soon as the session is stored, or when the create fails
+			defer func() {
+				if key != "" {
+					b.releaseKey(key, "")
+				}
+			}()
+		}
+	}
+
 	// Create new session UUID
 	uuid, err := newUUID()
 	if err != nil {
+		b.reportError(err, r)
 		bitsError(w, "", http.StatusInternalServerError, 0, ErrorContextRemoteFile)
 		return
 	}
 
 	// Create session directory
-	tmpDir := path.Join(b.cfg.TempDir, uuid)
-	if err = os.MkdirAll(tmpDir, 0600); err != nil {
+	b.rememberTenant(uuid, tenant)
+	tmpDir := b.sessionDir(uuid)
+	if err = os.MkdirAll(tmpDir, 0700); err != nil {
+		b.forgetTenant(uuid)
+		b.reportError(err, r)
 		bitsError(w, "", http.StatusInternalServerError, 0, ErrorContextRemoteFile)
 		return
 	}
 
-	// make sure we actually have a callback before calling it
-	if b.callback != nil {
-		b.callback(EventCreateSession, uuid, tmpDir)
+	// Keep the creation time with the session
+	created := time.Now().UTC()
+	o := origin{principal: requestPrincipal(r), remote: b.cfg.ClientIP(r), headers: b.captureHeaders(r), cert: ClientCertificate(r)}
+	m := sessionMetadata{Created: created, Principal: o.principal, Remote: o.remote, Headers: o.headers, Cert: o.cert}
+	if err = writeMetadata(tmpDir, m); err != nil {
+		b.reportError(fmt.Errorf("failed to write session metadata of %v: %w", tmpDir, err), r)
+	}
+	if err = b.cfg.SessionStore.Create(uuid, SessionInfo{Created: created, Touched: created, Tenant: tenant}); err != nil {
+		b.fs.RemoveAll(tmpDir)
+		b.forgetTenant(uuid)
+		b.reportError(err, r)
+		bitsError(w, "", http.StatusInternalServerError, 0, ErrorContextRemoteFile)
+		return
 	}
 
-	// https://msdn.microsoft.com/en-us/library/aa362771(v=vs.85).aspx
+	b.trackSession(uuid, created, o)
+
+	// Remember the session, in case the client retries
+	if key != "" {
+		b.releaseKey(key, uuid)
+		key = ""
+	}
+
+	b.rememberOrigin(uuid, o)
+
+	// make sure we actually have a callback before calling it
+	b.event(r, EventCreateSession, uuid, eventInfo{path: tmpDir})
+
+	sessionID := b.signSessionID(uuid)
+	spanAttributes(r, Attribute{Key: AttributeSessionID, Value: sessionID})
+	b.createAck(w, protocol, sessionID)
+
+}
+
+// acknowledge a created session
+// https://msdn.microsoft.com/en-us/library/aa362771(v=vs.85).aspx
+func (b *Handler) createAck(w http.ResponseWriter, protocol, sessionID string) {
 	w.Header().Add("BITS-Packet-Type", "Ack")
 	w.Header().Add("BITS-Protocol", protocol)
-	w.Header().Add("BITS-Session-Id", uuid)
-	w.Header().Add("Accept-Encoding", "Identity")
+	w.Header().Add("BITS-Session-Id", sessionID)
+	if b.cfg.AcceptEncoding != "-" {
+		w.Header().Add("Accept-Encoding", b.cfg.AcceptEncoding)
+	}
 	w.Write(nil)
 
 }
 
 // Use the Fragment packet to send a fragment of the upload file to the server
 // https://msdn.microsoft.com/en-us/library/aa362842(v=vs.85).aspx
-func (b *Handler) bitsFragment(w http.ResponseWriter, r *http.Request, uuid string) {
+func (b *Handler) bitsFragment(w http.ResponseWriter, r *http.Request, sessionID string) {
 
 	// Check for correct session
-	if uuid == "" || !isValidUUID(uuid) {
+	uuid, ok := b.verifySessionID(sessionID)
+	if !ok {
 		bitsError(w, "", http.StatusBadRequest, 0, ErrorContextRemoteFile)
 		return
 	}
 
 	// Check for existing session
-	var srcDir string
-	srcDir = path.Join(b.cfg.TempDir, uuid)
-	if b, _ := exists(srcDir); !b {
-		bitsError(w, uuid, http.StatusBadRequest, 0, ErrorContextRemoteFile)
+	srcDir, err := b.findSession(uuid)
+	if err == ErrSessionNotFound || (err == nil && !b.activeSession(uuid)) {
+		bitsError(w, sessionID, http.StatusNotFound, codeSessionNotFound, ErrorContextRemoteFile)
+		return
+	} else if err != nil {
+		b.reportError(err, r)
+		bitsError(w, sessionID, http.StatusInternalServerError, 0, ErrorContextRemoteFile)
+		return
+	}
+	if err = b.cfg.SessionStore.Touch(uuid); err != nil {
+		b.reportError(err, r)
+		bitsError(w, sessionID, http.StatusInternalServerError, 0, ErrorContextRemoteFile)
 		return
 	}
 
-	// Get filename and make sure the path is correct
-	_, filename := path.Split(r.RequestURI)
-	if filename == "" {
-		bitsError(w, uuid, http.StatusBadRequest, 0, ErrorContextRemoteFile)
+	// Get filename and make sure the path is correct. If the path is preserved, the filename
+	// is a slash separated path relative to the session directory
+	var filename string
+	if b.cfg.PreservePath {
+		filename, err = relativePathFromPath(r.URL.EscapedPath(), b.cfg.PathPrefix)
+	} else {
+		filename, err = filenameFromPath(r.URL.EscapedPath())
+	}
+	if err != nil {
+		bitsError(w, sessionID, http.StatusBadRequest, 0, ErrorContextRemoteFile)
 		return
 	}
 
-	var err error
-	var match bool
+	// Parse range
+	var rangeStart, rangeEnd, fileLength uint64
+	var query bool
+	rangeStart, rangeEnd, fileLength, query, err = parseRange(r.Header.Get("Content-Range"))
+	if err != nil {
+		bitsError(w, sessionID, http.StatusBadRequest, 0, ErrorContextRemoteFile)
+		return
+	}
 
-	// See if filename is blacklisted. If so, return an error
-	for _, reg := range b.cfg.Disallowed {
-		match, err = regexp.MatchString(reg, filename)
-		if err != nil {
-			bitsError(w, uuid, http.StatusBadRequest, 0, ErrorContextRemoteFile)
-			return
-		}
-		if match {
-			// File is blacklisted
-			bitsError(w, uuid, http.StatusBadRequest, 0, ErrorContextRemoteFile)
+	// See if the file is allowed, before anything is written
+	if err = b.allowFile(uuid, filename, fileLength); err != nil {
+		b.rejectFile(w, r, sessionID, uuid, filename, err, ErrorContextRemoteFile)
+		return
+	}
+	if fileLength == UnknownLength {
+		if err = b.allowRange(filename, rangeEnd+1); err != nil {
+			b.rejectFile(w, r, sessionID, uuid, filename, err, ErrorContextRemoteFile)
 			return
 		}
 	}
 
-	// See if filename is whitelisted
-	allowed := false
-	for _, reg := range b.cfg.Allowed {
-		match, err = regexp.MatchString(reg, filename)
-		if err != nil {
-			bitsError(w, uuid, http.StatusBadRequest, 0, ErrorContextRemoteFile)
+	// Let the application decide what to store the file as
+	if b.cfg.FilenameMapper != nil {
+		filename, err = b.cfg.FilenameMapper(r, uuid, filename)
+		if err != nil || !validPath(filename, b.cfg.PreservePath) {
+			bitsError(w, sessionID, http.StatusBadRequest, 0, ErrorContextRemoteFile)
 			return
 		}
-		if match {
-			allowed = true
-			break
-		}
 	}
-	if !allowed {
-		// No whitelisting rules matched!
-		bitsError(w, uuid, http.StatusBadRequest, 0, ErrorContextRemoteFile)
+
+	// Make sure the name can be stored where the file is going
+	if !b.filenameAllowed(filename) {
+		b.rejectFile(w, r, sessionID, uuid, filename, ErrFilenameRestricted, ErrorContextRemoteFile)
 		return
 	}
 
 	var src string
 
 	// Get absolute paths to file
-	src, err = filepath.Abs(filepath.Join(srcDir, filename))
+	src, err = filepath.Abs(filepath.Join(srcDir, filepath.FromSlash(filename)))
 	if err != nil {
-		src = filepath.Join(srcDir, filename)
+		src = filepath.Join(srcDir, filepath.FromSlash(filename))
 	}
 
-	// Parse range
-	var rangeStart, rangeEnd, fileLength uint64
-	rangeStart, rangeEnd, fileLength, err = parseRange(r.Header.Get("Content-Range"))
-	if err != nil {
-		bitsError(w, uuid, http.StatusBadRequest, 0, ErrorContextRemoteFile)
+	// A directory with the same name is in the way
+	if info, err := b.fs.Stat(src); err == nil && info.IsDir() {
+		bitsError(w, sessionID, http.StatusBadRequest, 0, ErrorContextRemoteFile)
 		return
 	}
 
-	// Check filesize
-	if b.cfg.MaxSize > 0 && fileLength > b.cfg.MaxSize {
-		bitsError(w, uuid, http.StatusRequestEntityTooLarge, 0, ErrorContextRemoteFile)
+	// Make sure we can handle the encoding of the data. Compressed fragments are decompressed
+	// to their range
+	if !acceptsEncoding(b.cfg.AcceptEncoding, r.Header.Get("Content-Encoding")) {
+		bitsError(w, sessionID, http.StatusBadRequest, 0, ErrorContextRemoteFile)
 		return
 	}
+	encoding := decodedEncoding(r.Header.Get("Content-Encoding"))
 
-	// Get the length of the posted data
+	// Check filesize. If the client doesn't send it, at least the range must fit
+	size := fileLength
+	if size == UnknownLength {
+		size = rangeEnd + 1
+	}
+	if b.cfg.MaxSize > 0 && size > b.cfg.MaxSize {
+		bitsError(w, sessionID, http.StatusRequestEntityTooLarge, 0, ErrorContextRemoteFile)
+		return
+	}
+
+	// Calculate the size of the range, an empty file is sent as an empty range
+	var rangeSize uint64
+	if !query && fileLength > 0 {
+		rangeSize = rangeEnd - rangeStart + 1
+	}
+
+	// Get the length of the posted data. If it is missing, e.g. when a proxy has
+	// re-chunked the body, expect the size of the range instead
 	var fragmentSize uint64
-	fragmentSize, err = strconv.ParseUint(r.Header.Get("Content-Length"), 10, 64)
-	if err != nil {
-		bitsError(w, uuid, http.StatusBadRequest, 0, ErrorContextRemoteFile)
+	if contentLength := r.Header.Get("Content-Length"); contentLength != "" {
+		fragmentSize, err = strconv.ParseUint(contentLength, 10, 64)
+		if err != nil {
+			bitsError(w, sessionID, http.StatusBadRequest, 0, ErrorContextRemoteFile)
+			return
+		}
+	} else if encoding != "" && !query {
+		// the compressed size can't be told from the range
+		bitsError(w, sessionID, http.StatusLengthRequired, 0, ErrorContextRemoteFile)
 		return
+	} else {
+		fragmentSize = rangeSize
 	}
 
-	// Get posted data and confirm size
-	data, err := ioutil.ReadAll(r.Body) // should probably not read everything into memory like this
-	if err != nil {
-		bitsError(w, uuid, http.StatusBadRequest, 0, ErrorContextRemoteFile)
+	// Check that content-range size matches content-length
+	if rangeSize != fragmentSize && (encoding == "" || query) {
+		bitsError(w, sessionID, http.StatusBadRequest, 0, ErrorContextRemoteFile)
+		return
+	}
+
+	// Check fragment size, both compressed and decompressed
+	if b.cfg.MaxFragmentSize > 0 && (fragmentSize > b.cfg.MaxFragmentSize || rangeSize > b.cfg.MaxFragmentSize) {
+		bitsError(w, sessionID, http.StatusRequestEntityTooLarge, 0, ErrorContextRemoteFile)
+		return
+	}
+	if encoding != "" && !query && b.cfg.MaxFragmentSize == 0 && rangeSize > maxDecodedFragment {
+		bitsError(w, sessionID, http.StatusRequestEntityTooLarge, 0, ErrorContextRemoteFile)
+		return
+	}
+
+	// The client asks how much we have got, answer with the size on disk
+	if query {
+		session := b.lockSession(uuid)
+		if session.state != sessionActive {
+			session.mu.Unlock()
+			bitsError(w, sessionID, http.StatusNotFound, codeSessionNotFound, ErrorContextRemoteFile)
+			return
+		}
+		name := r.URL.EscapedPath()
+		if renamed, ok := session.renamed[name]; ok {
+			src = renamed
+		}
+		received, completed, err := receivedSize(b.fs, src, src+b.cfg.PartSuffix)
+		if session.collides(src, name) {
+			// nothing is received of this file, the file stored there is another
+			received, completed = 0, false
+		}
+		if err != nil {
+			session.mu.Unlock()
+			b.reportError(err, r)
+			bitsError(w, sessionID, http.StatusInternalServerError, 0, ErrorContextRemoteFile)
+			return
+		}
+		if session.lengthChanged(src, fileLength) && received > 0 && !completed {
+			session.mu.Unlock()
+			bitsError(w, sessionID, http.StatusBadRequest, codeInvalidData, ErrorContextRemoteFile)
+			return
+		}
+		if session.announce(src, fileLength) {
+			b.saveSession(session, r)
+		}
+		session.mu.Unlock()
+
+		w.Header().Add("BITS-Packet-Type", "Ack")
+		w.Header().Add("BITS-Session-Id", sessionID)
+		w.Header().Add("BITS-Received-Content-Range", strconv.FormatUint(received, 10))
+		w.Write(nil)
+		return
+	}
+
+	// Let the application authorize the fragment before any of it is read
+	if !b.authorizeFragment(w, r, sessionID, uuid, filename, src, rangeStart, rangeEnd, fileLength) {
+		return
+	}
+
+	// Limit the time a client may spend sending the fragment
+	var body io.Reader = r.Body
+	if b.cfg.ReadTimeout > 0 {
+		deadline := time.Now().Add(b.cfg.ReadTimeout)
+
+		// Not all ResponseWriters support deadlines, the reader below catches slow clients anyway
+		http.NewResponseController(w).SetReadDeadline(deadline)
+		body = &deadlineReader{r: r.Body, deadline: deadline}
+	}
+
+	// Share the bandwidth of all sessions
+	if b.limiter != nil {
+		body = &limitReader{r: body, ctx: r.Context(), limiter: b.limiter}
+	}
+
+	// Get posted data and confirm size, reading at most one byte too many to detect oversized bodies
+	data, err := ioutil.ReadAll(io.LimitReader(body, int64(fragmentSize)+1)) // should probably not read everything into memory like this
+	if err == errReadTimeout || os.IsTimeout(err) {
+		// No point in trying to drain the body of a slow client
+		w.Header().Set("Connection", "close")
+		bitsError(w, sessionID, http.StatusRequestTimeout, 0, ErrorContextGeneralTransport)
+		return
+	} else if err != nil {
+		bitsError(w, sessionID, http.StatusBadRequest, 0, ErrorContextRemoteFile)
 		return
 	}
 	if uint64(len(data)) != fragmentSize {
-		bitsError(w, uuid, http.StatusBadRequest, 0, ErrorContextRemoteFile)
+		bitsError(w, sessionID, http.StatusBadRequest, 0, ErrorContextRemoteFile)
 		return
 	}
+	if encoding != "" {
+		if data, err = decodeFragment(data, encoding, rangeSize); err != nil {
+			refusedBecause(r, err)
+			bitsError(w, sessionID, http.StatusBadRequest, codeInvalidData, ErrorContextRemoteFile)
+			return
+		}
+	}
 
-	// Check that content-range size matches content-length
-	if rangeEnd-rangeStart+1 != fragmentSize {
-		bitsError(w, uuid, http.StatusBadRequest, 0, ErrorContextRemoteFile)
+	// Hold the session while writing, so it isn't closed or terminated halfway
+	session := b.lockSession(uuid)
+	unlock := sync.OnceFunc(session.mu.Unlock)
+	defer unlock()
+	if exist, _ := exists(srcDir); session.state != sessionActive || !exist {
+		bitsError(w, sessionID, http.StatusNotFound, codeSessionNotFound, ErrorContextRemoteFile)
 		return
 	}
+	session.touched = time.Now()
 
-	// Open or create file
-	var file *os.File
+	// Create the directories of a preserved path, a file in the way means the paths collide
+	if b.cfg.PreservePath {
+		if err = b.fs.MkdirAll(filepath.Dir(src), 0700); err != nil {
+			bitsError(w, sessionID, http.StatusBadRequest, 0, ErrorContextRemoteFile)
+			return
+		}
+	}
+
+	// Fragments of a file that was renamed because of a collision goes to the renamed file
+	name := r.URL.EscapedPath()
+	requested := src
+	if renamed, ok := session.renamed[name]; ok {
+		src = renamed
+	}
+
+	// Get the size of what we have received so far
+	part := src + b.cfg.PartSuffix
 	var fileSize uint64
-	var exist bool
-	exist, err = exists(src)
+	var completed bool
+	fileSize, completed, err = receivedSize(b.fs, src, part)
 	if err != nil {
-		bitsError(w, uuid, http.StatusBadRequest, 0, ErrorContextRemoteFile)
+		b.reportError(err, r)
+		bitsError(w, sessionID, http.StatusInternalServerError, 0, ErrorContextRemoteFile)
 		return
 	}
-	if exist {
-		// Create file
-		file, err = os.OpenFile(src, os.O_CREATE|os.O_WRONLY, 0600)
-		if err != nil {
-			bitsError(w, uuid, http.StatusInternalServerError, 0, ErrorContextRemoteFile)
-			return
-		}
-		defer file.Close()
 
-		// New file, size is zero
-		fileSize = 0
+	// A file completed in this session may be moved away, by DestDir or the callback. Its final
+	// fragment can still be retried
+	if !completed && fileSize == 0 && session.completed[src] {
+		if length, ok := session.lengths[src]; ok && length != UnknownLength {
+			fileSize, completed = length, true
+		}
+	}
 
-	} else {
-		// Open file for append
-		file, err = os.OpenFile(src, os.O_APPEND|os.O_WRONLY, 0666)
-		if err != nil {
-			bitsError(w, uuid, http.StatusInternalServerError, 0, ErrorContextRemoteFile)
+	// Another file is stored under the same name, e.g. a file with the same name in another
+	// directory when the path isn't preserved
+	if session.collides(src, name) {
+		switch b.cfg.OnCollision {
+		case ExistingFileReject:
+			bitsError(w, sessionID, http.StatusConflict, 0, ErrorContextRemoteFile)
 			return
+		case ExistingFileRename:
+			if src, err = uniqueFilename(b.fs, requested, b.cfg.PartSuffix); err != nil {
+				b.reportError(err, r)
+				bitsError(w, sessionID, http.StatusInternalServerError, 0, ErrorContextRemoteFile)
+				return
+			}
+			if session.renamed == nil {
+				session.renamed = make(map[string]string)
+			}
+			session.renamed[name] = src
+			part = src + b.cfg.PartSuffix
+		default:
+			session.forget(src)
 		}
-		defer file.Close()
+		fileSize = 0
+		completed = false
+	}
 
-		// Get size on disk
-		var info os.FileInfo
-		info, err = file.Stat()
-		if err != nil {
-			bitsError(w, uuid, http.StatusInternalServerError, 0, ErrorContextRemoteFile)
+	// Fragments without the file length belong to a file with the length sent by other fragments
+	if length, ok := session.lengths[src]; ok && fileLength == UnknownLength {
+		fileLength = length
+	}
+
+	// A fragment can overshoot the end of the file, but not start beyond it
+	if fileLength != UnknownLength && fileLength > 0 && rangeStart >= fileLength {
+		bitsError(w, sessionID, http.StatusBadRequest, codeInvalidData, ErrorContextRemoteFile)
+		return
+	}
+
+	// The last fragment of a file completed in this session is sent again, probably because the
+	// ack was lost. Ack it again, without receiving the file twice
+	if completed && session.completed[src] && fileSize == fileLength && !session.lengthChanged(src, fileLength) &&
+		(rangeEnd+1 >= fileLength || fileLength == 0) {
+		w.Header().Add("BITS-Packet-Type", "Ack")
+		w.Header().Add("BITS-Session-Id", sessionID)
+		w.Header().Add("BITS-Received-Content-Range", strconv.FormatUint(fileSize, 10))
+		w.Write(nil)
+		return
+	}
+
+	// A fragment starting from the beginning of a completed file is a new upload of it
+	if completed && rangeStart == 0 {
+		switch b.cfg.OnExistingFile {
+		case ExistingFileReject:
+			bitsError(w, sessionID, http.StatusConflict, 0, ErrorContextRemoteFile)
 			return
+		case ExistingFileRename:
+			if src, err = uniqueFilename(b.fs, requested, b.cfg.PartSuffix); err != nil {
+				b.reportError(err, r)
+				bitsError(w, sessionID, http.StatusInternalServerError, 0, ErrorContextRemoteFile)
+				return
+			}
+			if session.renamed == nil {
+				session.renamed = make(map[string]string)
+			}
+			session.renamed[name] = src
+			part = src + b.cfg.PartSuffix
 		}
-		fileSize = uint64(info.Size())
+		fileSize = 0
+		completed = false
+	}
 
+	// The declared length can't change once the file is started, or be less than what is received
+	if (session.lengthChanged(src, fileLength) && fileSize > 0) || (fileLength != UnknownLength && fileSize > fileLength) {
+		bitsError(w, sessionID, http.StatusBadRequest, codeInvalidData, ErrorContextRemoteFile)
+		return
+	}
+
+	// Remember the file, so close-session can tell if it is complete, and its type from the first fragment
+	announced, claimed := session.announce(src, fileLength), session.claim(src, name)
+	typed := rangeStart == 0 && session.setType(src, detectContentType(r, data))
+	if announced || claimed || typed {
+		b.saveSession(session, r)
 	}
 
 	// Sanity checks
 	if rangeEnd < fileSize {
 		// The range is already written to disk
-		w.Header().Add("BITS-Recieved-Content-Range", strconv.FormatUint(fileSize, 10))
-		bitsError(w, uuid, http.StatusRequestedRangeNotSatisfiable, 0, ErrorContextRemoteFile)
+		if b.cfg.StrictRanges {
+			w.Header().Add("BITS-Recieved-Content-Range", strconv.FormatUint(fileSize, 10))
+			bitsError(w, sessionID, http.StatusRequestedRangeNotSatisfiable, 0, ErrorContextRemoteFile)
+			return
+		}
+
+		// Probably a retried fragment, just ack the current offset so the client moves on
+		w.Header().Add("BITS-Packet-Type", "Ack")
+		w.Header().Add("BITS-Session-Id", sessionID)
+		w.Header().Add("BITS-Received-Content-Range", strconv.FormatUint(fileSize, 10))
+		w.Write(nil)
 		return
-	} else if rangeStart > fileSize {
+	}
+	if completed {
+		// The file is uploaded again, start over
+		fileSize = 0
+	}
+	if rangeStart > fileSize {
 		// start must be <= fileSize, else there will be a gap
 		w.Header().Add("BITS-Recieved-Content-Range", strconv.FormatUint(fileSize, 10))
-		bitsError(w, uuid, http.StatusRequestedRangeNotSatisfiable, 0, ErrorContextRemoteFile)
+		bitsError(w, sessionID, http.StatusRequestedRangeNotSatisfiable, 0, ErrorContextRemoteFile)
 		return
 	}
 
-	// Calculate the offset in the slice, if overlapping
-	var dataOffset = fileSize - rangeStart
+	// Drop the bytes a final fragment sends beyond the end of the file
+	if fileLength != UnknownLength && rangeEnd >= fileLength {
+		data = data[:fileLength-rangeStart]
+	}
+
+	// Let the application inspect the start of the file before it is stored. Until enough of
+	// the file is received, the head is what is staged so far followed by the new data
+	if b.cfg.ContentSniffer != nil && fileSize < sniffLength {
+		var head []byte
+		if head, err = fileHead(b.fs, part, fileSize, data[fileSize-rangeStart:]); err != nil {
+			b.reportError(err, r)
+			bitsError(w, sessionID, http.StatusInternalServerError, 0, ErrorContextRemoteFile)
+			return
+		}
+		if err = b.cfg.ContentSniffer(filename, head); err != nil {
+			if fileSize > 0 {
+				b.releaseFile(session, part)
+				b.fs.Remove(part)
+			}
+			session.forget(src)
+			b.saveSession(session, r)
+			unlock()
+			b.rejectFile(w, r, sessionID, uuid, filename, err, ErrorContextRemoteApplication)
+			return
+		}
+	}
+
+	// Make sure a new file fits on the disk before any of it is written
+	if b.cfg.CheckDiskSpace && fileSize == 0 && fileLength != UnknownLength {
+		free, err := freeSpace(session.dir)
+		if err == nil && free < fileLength {
+			bitsError(w, sessionID, http.StatusInsufficientStorage, 0, ErrorContextLocalFile)
+			return
+		} else if err != nil && err != errDiskSpaceUnsupported {
+			b.reportError(err, r)
+		}
+	}
+
+	// Keep within the budget of the TempDir, a file that is started over replaces what was received of it
+	var growth uint64
+	if end := rangeStart + uint64(len(data)); end > fileSize {
+		growth = end - fileSize
+	}
+	if fileSize == 0 {
+		b.releaseFile(session, part)
+	}
+	if !b.reserve(session, growth) {
+		bitsError(w, sessionID, http.StatusInsufficientStorage, 0, ErrorContextLocalFile)
+		return
+	}
+	defer func() {
+		// the fragment wasn't written after all
+		b.release(session, growth)
+	}()
+
+	// Open or create the in-progress file
+	var file fsFile
+	if fileSize == 0 {
+		file, err = b.fs.OpenFile(part, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	} else {
+		file, err = b.fs.OpenFile(part, os.O_WRONLY, 0600)
+	}
+	if err != nil {
+		b.reportError(err, r)
+		bitsError(w, sessionID, http.StatusInternalServerError, 0, ErrorContextRemoteFile)
+		return
+	}
+	defer file.Close()
+
+	// Reserve the disk space of a new file, so a full disk fails it before anything is written
+	if b.cfg.Preallocate && fileSize == 0 && fileLength != UnknownLength && fileLength > 0 {
+		if err = preallocate(file, fileLength); err != nil {
+			file.Close()
+			b.fs.Remove(part)
+			if errors.Is(err, syscall.ENOSPC) {
+				bitsError(w, sessionID, http.StatusInsufficientStorage, 0, ErrorContextLocalFile)
+				return
+			}
+			b.reportError(err, r)
+			bitsError(w, sessionID, http.StatusInternalServerError, 0, ErrorContextRemoteFile)
+			return
+		}
+	}
 
-	// Write the data to file
-	var written uint64
+	// Write the data where it belongs, overlapping bytes are overwritten with the same data
 	var wr int
-	wr, err = file.Write(data[dataOffset:])
+	wr, err = file.WriteAt(data, int64(rangeStart))
 	if err != nil {
-		bitsError(w, uuid, http.StatusInternalServerError, 0, ErrorContextRemoteFile)
+		b.reportError(err, r)
+		bitsError(w, sessionID, http.StatusInternalServerError, 0, ErrorContextRemoteFile)
 		return
 	}
-	written = uint64(wr)
+
+	spanAttributes(r, Attribute{Key: AttributeBytesWritten, Value: wr})
 
 	// Make sure we wrote everything we wanted
-	if written != fragmentSize-dataOffset {
-		bitsError(w, uuid, http.StatusInternalServerError, 0, ErrorContextRemoteFile)
+	if wr != len(data) {
+		b.reportError(io.ErrShortWrite, r)
+		bitsError(w, sessionID, http.StatusInternalServerError, 0, ErrorContextRemoteFile)
 		return
 	}
+	session.received += growth
+	b.metrics.IncCounter(MetricReceivedBytes, nil, float64(growth))
+	b.tenantReceived(uuid, growth)
+	growth = 0
+
+	// Hash what is new of the file
+	if b.cfg.HashFiles {
+		var fresh []byte
+		if end := rangeStart + uint64(wr); end > fileSize {
+			fresh = data[fileSize-rangeStart:]
+		}
+		if err = b.hashFragment(session, src, part, fileSize, fresh); err != nil {
+			b.reportError(err, r)
+			bitsError(w, sessionID, http.StatusInternalServerError, 0, ErrorContextRemoteFile)
+			return
+		}
+	}
+
+	// Flush the fragment to disk, and the new file to its directory
+	if b.cfg.SyncPolicy == SyncEveryFragment {
+		if err = syncFile(file); err == nil && fileSize == 0 {
+			err = syncDir(filepath.Dir(part))
+		}
+		if err != nil {
+			b.reportError(err, r)
+			bitsError(w, sessionID, http.StatusInternalServerError, 0, ErrorContextRemoteFile)
+			return
+		}
+	}
+
+	// Let the inspector see what is new of the file, and what it thinks of the complete file
+	if b.cfg.InspectorFactory != nil {
+		var fresh []byte
+		if end := rangeStart + uint64(wr); end > fileSize {
+			fresh = data[fileSize-rangeStart:]
+		}
+		err = b.inspectFragment(session, uuid, filename, src, part, fileLength, fileSize, fresh)
+		if err == nil && fileLength != UnknownLength && rangeStart+uint64(wr) >= fileLength {
+			err = session.closeInspector(src)
+		}
+		if err != nil {
+			file.Close()
+			b.releaseFile(session, part)
+			b.fs.Remove(part)
+			session.forget(src)
+			b.saveSession(session, r)
+			unlock()
+			b.rejectFile(w, r, sessionID, uuid, filename, err, ErrorContextRemoteApplication)
+			return
+		}
+	}
+
+	// The file is received up to the end of the fragment, unless we already had more
+	if end := rangeStart + uint64(wr); end > fileSize {
+		fileSize = end
+	}
+
+	// Watch for the client stalling before the file is complete
+	if b.cfg.FragmentIdleTimeout > 0 {
+		if fileLength != UnknownLength && fileSize >= fileLength {
+			session.unwatch(src)
+		} else {
+			b.watchFile(session, uuid, src)
+		}
+	}
 
 	// Check if we have written everything
-	if rangeEnd+1 == fileLength {
-		// File is done! Manually close it, since the callback probably don't wnat the file to be open
-		file.Close()
+	if fileLength != UnknownLength && fileSize >= fileLength {
+		// File is done! Flush it before it is reported as received
+		if b.cfg.SyncPolicy == SyncOnComplete {
+			if err = syncFile(file); err != nil {
+				b.reportError(err, r)
+				bitsError(w, sessionID, http.StatusInternalServerError, 0, ErrorContextRemoteFile)
+				return
+			}
+		}
+
+		// Manually close it, since the callback probably don't wnat the file to be open
+		if err = file.Close(); err != nil {
+			b.reportError(err, r)
+			bitsError(w, sessionID, http.StatusInternalServerError, 0, ErrorContextRemoteFile)
+			return
+		}
+
+		// Move it in place under its real name, replacing a file uploaded before
+		if part != src {
+			b.releaseFile(session, src)
+			if err = b.fs.Rename(part, src); err != nil {
+				b.reportError(err, r)
+				bitsError(w, sessionID, http.StatusInternalServerError, 0, ErrorContextRemoteFile)
+				return
+			}
+		}
+
+		// Restore the original modification time, if the client sent one
+		if mtimeString := r.Header.Get("X-Original-Mtime"); mtimeString != "" {
+			if mtime, err := parseMtime(mtimeString); err != nil {
+				b.logWarning(r, "invalid X-Original-Mtime ignored", err)
+			} else if err = b.fs.Chtimes(src, time.Now(), mtime); err != nil {
+				b.reportError(err, r)
+			}
+		}
+
+		// Let the application have the final say about the file
+		contentType := session.types[src]
+		digest := session.digest(src)
+		if b.cfg.Finalize != nil {
+			err = b.cfg.Finalize(Session{
+				ID:          uuid,
+				Path:        src,
+				Filename:    b.sessionPath(uuid, src),
+				Bytes:       fileLength,
+				ContentType: contentType,
+				Hash:        digest,
+			})
+			if err != nil {
+				b.releaseFile(session, src)
+				b.fs.Remove(src)
+				session.forget(src)
+				b.saveSession(session, r)
+				unlock()
+				b.rejectFile(w, r, sessionID, uuid, filename, err, ErrorContextRemoteApplication)
+				return
+			}
+		}
+
+		// Move it out of the session directory. If it can't be moved, it is received where it is
+		dst := src
+		if b.cfg.DestDir != "" {
+			if dst, err = b.moveToDest(uuid, src); err == ErrFileExists {
+				b.releaseFile(session, src)
+				b.fs.Remove(src)
+				session.forget(src)
+				b.saveSession(session, r)
+				unlock()
+				b.event(r, EventRejectFile, uuid, eventInfo{path: filename, reason: err})
+				bitsError(w, sessionID, http.StatusConflict, 0, ErrorContextRemoteFile)
+				return
+			} else if err != nil {
+				b.reportError(err, r)
+				dst = src
+			} else {
+				b.release(session, fileLength)
+			}
+		}
+
+		// Flush the directory entry of the file where it ended up
+		if b.cfg.SyncPolicy != SyncNone {
+			if err = syncDir(filepath.Dir(dst)); err != nil {
+				b.reportError(err, r)
+				bitsError(w, sessionID, http.StatusInternalServerError, 0, ErrorContextRemoteFile)
+				return
+			}
+		}
 
-		// Call the callback
-		if b.callback != nil {
-			b.callback(EventRecieveFile, uuid, src)
+		if session.completed == nil {
+			session.completed = make(map[string]bool)
 		}
+		session.completed[src] = true
+		b.saveSession(session, r)
+
+		// Call the callback, without holding the session
+		unlock()
+		b.event(r, EventRecieveFile, uuid, eventInfo{path: dst, filename: b.sessionPath(uuid, src), bytes: fileLength, contentType: contentType, hash: digest})
 
 	}
 
+	// Keep what is received of the file with the session, for stores that do
+	b.storeProgress(r, uuid, FileStatus{
+		Name:      b.sessionPath(uuid, src),
+		Length:    fileLength,
+		Received:  fileSize,
+		Completed: fileLength != UnknownLength && fileSize >= fileLength,
+	})
+
 	// https://msdn.microsoft.com/en-us/library/aa362773(v=vs.85).aspx
 	w.Header().Add("BITS-Packet-Type", "Ack")
-	w.Header().Add("BITS-Session-Id", uuid)
-	w.Header().Add("BITS-Received-Content-Range", strconv.FormatUint(fileSize+uint64(written), 10))
+	w.Header().Add("BITS-Session-Id", sessionID)
+	w.Header().Add("BITS-Received-Content-Range", strconv.FormatUint(fileSize, 10))
 	w.Write(nil)
 
 }
 
+// reject a file, the BITS error code is taken from the reason if it is a RejectError
+func (b *Handler) rejectFile(w http.ResponseWriter, r *http.Request, sessionID, uuid, filename string, reason error, context ErrorContext) {
+	code := codeAccessDenied
+	var rejectErr *RejectError
+	if errors.As(reason, &rejectErr) {
+		code = rejectErr.Code
+	}
+	b.event(r, EventRejectFile, uuid, eventInfo{path: filename, reason: reason})
+	bitsError(w, sessionID, http.StatusBadRequest, code, context)
+}
+
 // Use the Cancel-Session packet to terminate the upload session with the BITS server.
 // https://msdn.microsoft.com/en-us/library/aa362829(v=vs.85).aspx
-func (b *Handler) bitsCancel(w http.ResponseWriter, r *http.Request, uuid string) {
+func (b *Handler) bitsCancel(w http.ResponseWriter, r *http.Request, sessionID string) {
 	// Check for correct session
-	if uuid == "" || !isValidUUID(uuid) {
-		bitsError(w, uuid, http.StatusBadRequest, 0, ErrorContextRemoteFile)
+	uuid, ok := b.verifySessionID(sessionID)
+	if !ok {
+		bitsError(w, sessionID, http.StatusBadRequest, 0, ErrorContextRemoteFile)
 		return
 	}
-	destDir := path.Join(b.cfg.TempDir, uuid)
-	exist, err := exists(destDir)
-	if err != nil {
-		bitsError(w, uuid, http.StatusBadRequest, 0, ErrorContextRemoteFile)
+	destDir, err := b.findSession(uuid)
+	if err == ErrSessionNotFound || (err == nil && !b.transition(uuid, sessionActive, sessionCanceled)) {
+		bitsError(w, sessionID, http.StatusNotFound, codeSessionNotFound, ErrorContextRemoteFile)
 		return
-	}
-	if !exist {
-		bitsError(w, uuid, http.StatusBadRequest, 0, ErrorContextRemoteFile)
+	} else if err != nil {
+		b.reportError(err, r)
+		bitsError(w, sessionID, http.StatusInternalServerError, 0, ErrorContextRemoteFile)
 		return
 	}
 
-	// do the callback
-	if b.callback != nil {
-		b.callback(EventCancelSession, uuid, destDir)
+	// the client gave up on the unfinished files
+	session := b.lockSession(uuid)
+	removed, err := session.removeParts(b.fs, b.cfg.PartSuffix)
+	b.release(session, removed)
+	session.mu.Unlock()
+	if err != nil {
+		b.reportError(err, r)
 	}
 
+	// a retried create must not get this session anymore
+	b.forgetSession(uuid)
+	b.deleteSession(r, uuid)
+
+	// do the callback
+	b.event(r, EventCancelSession, uuid, eventInfo{path: destDir})
+	b.releaseSession(uuid)
+
 	w.Header().Add("BITS-Packet-Type", "Ack")
-	w.Header().Add("BITS-Session-Id", uuid)
+	w.Header().Add("BITS-Session-Id", sessionID)
 	w.Write(nil)
 }
 
 // Use the Close-Session packet to tell the BITS server that file upload is complete and to end the session.
 // https://msdn.microsoft.com/en-us/library/aa362830(v=vs.85).aspx
-func (b *Handler) bitsClose(w http.ResponseWriter, r *http.Request, uuid string) {
+func (b *Handler) bitsClose(w http.ResponseWriter, r *http.Request, sessionID string) {
 	// Check for correct session
-	if uuid == "" || !isValidUUID(uuid) {
-		bitsError(w, uuid, http.StatusBadRequest, 0, ErrorContextRemoteFile)
+	uuid, ok := b.verifySessionID(sessionID)
+	if !ok {
+		bitsError(w, sessionID, http.StatusBadRequest, 0, ErrorContextRemoteFile)
+		return
+	}
+	destDir, err := b.findSession(uuid)
+	if err == ErrSessionNotFound {
+		bitsError(w, sessionID, http.StatusNotFound, codeSessionNotFound, ErrorContextRemoteFile)
+		return
+	} else if err != nil {
+		b.reportError(err, r)
+		bitsError(w, sessionID, http.StatusInternalServerError, 0, ErrorContextRemoteFile)
 		return
 	}
-	destDir := path.Join(b.cfg.TempDir, uuid)
-	exist, err := exists(destDir)
+
+	// Find the files that aren't complete, stop accepting fragments and remove the unfinished files
+	session := b.lockSession(uuid)
+	if session.state != sessionActive {
+		session.mu.Unlock()
+		bitsError(w, sessionID, http.StatusNotFound, codeSessionNotFound, ErrorContextRemoteFile)
+		return
+	}
+	incomplete, err := session.incomplete(b.fs, b.cfg.PartSuffix)
 	if err != nil {
-		bitsError(w, uuid, http.StatusBadRequest, 0, ErrorContextRemoteFile)
+		session.mu.Unlock()
+		b.reportError(err, r)
+		bitsError(w, sessionID, http.StatusInternalServerError, 0, ErrorContextRemoteFile)
 		return
 	}
-	if !exist {
-		bitsError(w, uuid, http.StatusBadRequest, 0, ErrorContextRemoteFile)
+	if b.cfg.StrictClose && len(incomplete) > 0 {
+		session.mu.Unlock()
+		bitsError(w, sessionID, http.StatusBadRequest, codeMoreData, ErrorContextRemoteFile)
 		return
 	}
+	session.state = sessionClosing
+	removed, err := session.removeParts(b.fs, b.cfg.PartSuffix)
+	b.release(session, removed)
+	received := session.received
+	session.mu.Unlock()
+	if err != nil {
+		b.reportError(err, r)
+	}
+	for i, f := range incomplete {
+		incomplete[i] = b.sessionPath(uuid, f)
+	}
+
+	// a retried create must not get this session anymore
+	b.forgetSession(uuid)
+	b.deleteSession(r, uuid)
 
 	// do the callback
-	if b.callback != nil {
-		b.callback(EventCloseSession, uuid, destDir)
+	b.event(r, EventCloseSession, uuid, eventInfo{path: destDir, bytes: received, incomplete: incomplete})
+	b.transition(uuid, sessionClosing, sessionClosed)
+
+	// The files are the app's once the callbacks return, unless they are removed with the session
+	if b.cfg.DeleteOnClose {
+		if err = b.fs.RemoveAll(destDir); err != nil {
+			b.reportError(err, r)
+		}
 	}
+	b.releaseSession(uuid)
 
 	// https://msdn.microsoft.com/en-us/library/aa362712(v=vs.85).aspx
 	w.Header().Add("BITS-Packet-Type", "Ack")
-	w.Header().Add("BITS-Session-Id", uuid)
+	w.Header().Add("BITS-Session-Id", sessionID)
 	w.Write(nil)
 }
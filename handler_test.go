@@ -0,0 +1,2606 @@
+package gobits
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gitlab.com/magan/gobits/client"
+)
+
+// create a handler storing its sessions in a temporary directory
+func newTestHandler(t *testing.T, cfg Config, cb CallbackFunc) *Handler {
+	t.Helper()
+
+	cfg.TempDir = t.TempDir()
+	h, err := NewHandler(cfg, cb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close(context.Background()) })
+	return h
+}
+
+// send a BITS packet to the handler and return the response
+func doPacket(h *Handler, packetType, uuid, target string, headers map[string]string, body []byte) *http.Response {
+	r := httptest.NewRequest(h.cfg.AllowedMethod, target, bytes.NewReader(body))
+	r.Header.Set("BITS-Packet-Type", packetType)
+	if uuid != "" {
+		r.Header.Set("BITS-Session-Id", uuid)
+	}
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	return rec.Result()
+}
+
+// create a new session with the client and return its id
+func createSession(t *testing.T, h *Handler) string {
+	t.Helper()
+
+	return clientSession(t, h).ID
+}
+
+// send a fragment of data, starting at offset start, of a file with the total size of length
+func sendFragment(h *Handler, uuid, filename string, data []byte, start, length uint64) *http.Response {
+	return doPacket(h, "Fragment", uuid, "/BITS/"+filename, map[string]string{
+		"Content-Range":  fmt.Sprintf("bytes %d-%d/%d", start, start+uint64(len(data))-1, length),
+		"Content-Length": strconv.Itoa(len(data)),
+	}, data)
+}
+
+func TestFragmentDuplicate(t *testing.T) {
+
+	content := []byte("0123456789abcdefghij")
+
+	testcases := []struct {
+		name     string
+		strict   bool
+		start    uint64
+		end      uint64
+		status   int
+		received string
+	}{
+		{
+			name:     "exact duplicate",
+			start:    0,
+			end:      9,
+			status:   http.StatusOK,
+			received: "10",
+		},
+		{
+			name:     "subset",
+			start:    2,
+			end:      5,
+			status:   http.StatusOK,
+			received: "10",
+		},
+		{
+			name:     "exact duplicate strict",
+			strict:   true,
+			start:    0,
+			end:      9,
+			status:   http.StatusRequestedRangeNotSatisfiable,
+			received: "",
+		},
+		{
+			name:     "overlapping",
+			start:    5,
+			end:      14,
+			status:   http.StatusOK,
+			received: "15",
+		},
+	}
+
+	for _, tc := range testcases {
+
+		t.Run(tc.name, func(t *testing.T) {
+			var received int
+			h := newTestHandler(t, Config{StrictRanges: tc.strict}, func(event Event, session, path string) {
+				if event == EventRecieveFile {
+					received++
+				}
+			})
+			uuid := createSession(t, h)
+
+			res := sendFragment(h, uuid, "file.txt", content[:10], 0, uint64(len(content)))
+			res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("first fragment failed: %v", res.Status)
+			}
+
+			res = sendFragment(h, uuid, "file.txt", content[tc.start:tc.end+1], tc.start, uint64(len(content)))
+			res.Body.Close()
+			if res.StatusCode != tc.status {
+				t.Errorf("expected status %v, got %v", tc.status, res.StatusCode)
+			}
+			if res.Header.Get("BITS-Received-Content-Range") != tc.received {
+				t.Errorf("expected received range %q, got %q", tc.received, res.Header.Get("BITS-Received-Content-Range"))
+			}
+
+			data, err := ioutil.ReadFile(path.Join(h.cfg.TempDir, uuid, "file.txt"+h.cfg.PartSuffix))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, content[:len(data)]) {
+				t.Errorf("unexpected file content: %q", data)
+			}
+			if received != 0 {
+				t.Errorf("file should not be completed")
+			}
+		})
+	}
+
+}
+
+func TestSignedSessionID(t *testing.T) {
+
+	h := newTestHandler(t, Config{SessionSecret: []byte("secret")}, nil)
+	sessionID := createSession(t, h)
+	uuid := sessionID[:strings.Index(sessionID, ".")]
+
+	tampered := []byte(sessionID)
+	if tampered[len(tampered)-1] == '0' {
+		tampered[len(tampered)-1] = '1'
+	} else {
+		tampered[len(tampered)-1] = '0'
+	}
+
+	testcases := []struct {
+		name      string
+		sessionID string
+		status    int
+	}{
+		{
+			name:      "valid signature",
+			sessionID: sessionID,
+			status:    http.StatusOK,
+		},
+		{
+			name:      "tampered signature",
+			sessionID: string(tampered),
+			status:    http.StatusBadRequest,
+		},
+		{
+			name:      "missing signature",
+			sessionID: uuid,
+			status:    http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testcases {
+
+		t.Run(tc.name, func(t *testing.T) {
+			res := sendFragment(h, tc.sessionID, "file.txt", []byte("data"), 0, 10)
+			res.Body.Close()
+			if res.StatusCode != tc.status {
+				t.Errorf("expected status %v, got %v", tc.status, res.StatusCode)
+			}
+		})
+	}
+
+}
+
+// slowReader returns one byte at a time, sleeping before each read
+type slowReader struct {
+	data  []byte
+	delay time.Duration
+}
+
+func (s *slowReader) Read(p []byte) (int, error) {
+	if len(s.data) == 0 {
+		return 0, io.EOF
+	}
+	time.Sleep(s.delay)
+	n := copy(p[:1], s.data)
+	s.data = s.data[n:]
+	return n, nil
+}
+
+func TestFragmentReadTimeout(t *testing.T) {
+
+	h := newTestHandler(t, Config{ReadTimeout: 50 * time.Millisecond}, nil)
+	uuid := createSession(t, h)
+
+	data := []byte("0123456789abcdefghij")
+	r := httptest.NewRequest(h.cfg.AllowedMethod, "/BITS/file.txt", &slowReader{data: data, delay: 10 * time.Millisecond})
+	r.Header.Set("BITS-Packet-Type", "Fragment")
+	r.Header.Set("BITS-Session-Id", uuid)
+	r.Header.Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", len(data)-1, len(data)))
+	r.Header.Set("Content-Length", strconv.Itoa(len(data)))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	res := rec.Result()
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusRequestTimeout {
+		t.Errorf("expected status %v, got %v", http.StatusRequestTimeout, res.StatusCode)
+	}
+	if b, _ := exists(path.Join(h.cfg.TempDir, uuid, "file.txt")); b {
+		t.Errorf("partial file should not exist")
+	}
+
+}
+
+func TestFragmentQuery(t *testing.T) {
+
+	var received string
+	h := newTestHandler(t, Config{}, func(event Event, session, path string) {
+		if event == EventRecieveFile {
+			received = path
+		}
+	})
+	uuid := createSession(t, h)
+
+	content := []byte("0123456789abcdefghij")
+	length := uint64(len(content))
+
+	// upload the first half
+	res := sendFragment(h, uuid, "file.txt", content[:10], 0, length)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("first fragment failed: %v", res.Status)
+	}
+
+	// ask how much the server has
+	res = doPacket(h, "Fragment", uuid, "/BITS/file.txt", map[string]string{
+		"Content-Range":  fmt.Sprintf("bytes */%d", length),
+		"Content-Length": "0",
+	}, nil)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("query failed: %v", res.Status)
+	}
+	offset, err := strconv.ParseUint(res.Header.Get("BITS-Received-Content-Range"), 10, 64)
+	if err != nil {
+		t.Fatalf("invalid received range: %v", err)
+	}
+	if offset != 10 {
+		t.Errorf("expected offset 10, got %v", offset)
+	}
+
+	// resume from the reported offset
+	res = sendFragment(h, uuid, "file.txt", content[offset:], offset, length)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("last fragment failed: %v", res.Status)
+	}
+
+	if received == "" {
+		t.Fatal("file was never completed")
+	}
+	data, err := ioutil.ReadFile(received)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, content) {
+		t.Errorf("unexpected file content: %q", data)
+	}
+
+}
+
+func TestFragmentEmptyFile(t *testing.T) {
+
+	received := map[string]bool{}
+	h := newTestHandler(t, Config{}, func(event Event, session, path string) {
+		if event == EventRecieveFile {
+			received[filepath.Base(path)] = true
+		}
+	})
+	session := clientSession(t, h)
+	uuid := session.ID
+
+	// an empty file, as it is sent on the wire
+	res := doPacket(h, "Fragment", uuid, "/BITS/empty.txt", map[string]string{
+		"Content-Range":  "bytes 0-0/0",
+		"Content-Length": "0",
+	}, nil)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("empty fragment failed: %v", res.Status)
+	}
+	if res.Header.Get("BITS-Received-Content-Range") != "0" {
+		t.Errorf("expected received range 0, got %q", res.Header.Get("BITS-Received-Content-Range"))
+	}
+
+	// and a normal file in the same session
+	if _, err := session.SendFile(context.Background(), testURL+"file.txt", strings.NewReader("data"), 4); err != nil {
+		t.Fatalf("fragment failed: %v", err)
+	}
+
+	for _, name := range []string{"empty.txt", "file.txt"} {
+		if !received[name] {
+			t.Errorf("file %v was never completed", name)
+		}
+	}
+
+	info, err := os.Stat(path.Join(h.cfg.TempDir, uuid, "empty.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 0 {
+		t.Errorf("expected empty file, got size %v", info.Size())
+	}
+
+	// empty files can be refused with a rule
+	h = newTestHandler(t, Config{Rules: []Rule{{Pattern: ".*", MinSize: 1}}}, nil)
+	session = clientSession(t, h)
+	var bitsErr *client.Error
+	if _, err = session.SendFile(context.Background(), testURL+"empty.txt", strings.NewReader(""), 0); !errors.As(err, &bitsErr) || bitsErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status %v, got %v", http.StatusBadRequest, err)
+	}
+	if exist, _ := exists(path.Join(h.cfg.TempDir, session.ID, "empty.txt")); exist {
+		t.Error("expected the empty file to be refused")
+	}
+
+}
+
+func TestFragmentOriginalMtime(t *testing.T) {
+
+	h := newTestHandler(t, Config{}, nil)
+	mtime := time.Date(2017, 6, 1, 12, 30, 0, 0, time.UTC)
+	c := testClient(h)
+	c.Header = http.Header{"X-Original-Mtime": {mtime.Format(time.RFC3339)}}
+	ctx := context.Background()
+	s, err := c.CreateSession(ctx, testURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.SendFile(ctx, testURL+"file.txt", strings.NewReader("data"), 4); err != nil {
+		t.Fatalf("fragment failed: %v", err)
+	}
+
+	info, err := os.Stat(path.Join(h.cfg.TempDir, s.ID, "file.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(mtime) {
+		t.Errorf("invalid modification time %v, expected %v", info.ModTime(), mtime)
+	}
+
+}
+
+func TestFragmentChunked(t *testing.T) {
+
+	testcases := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{
+			name:   "exact",
+			body:   "0123456789",
+			status: http.StatusOK,
+		},
+		{
+			name:   "short body",
+			body:   "012345678",
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "long body",
+			body:   "0123456789a",
+			status: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testcases {
+
+		t.Run(tc.name, func(t *testing.T) {
+			h := newTestHandler(t, Config{}, nil)
+			uuid := createSession(t, h)
+
+			var chunked bool
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				chunked = r.ContentLength == -1 && r.Header.Get("Content-Length") == ""
+				h.ServeHTTP(w, r)
+			}))
+			defer srv.Close()
+
+			// a body of unknown length is sent with chunked transfer encoding
+			r, err := http.NewRequest(h.cfg.AllowedMethod, srv.URL+"/BITS/file.txt", io.MultiReader(strings.NewReader(tc.body)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.Header.Set("BITS-Packet-Type", "Fragment")
+			r.Header.Set("BITS-Session-Id", uuid)
+			r.Header.Set("Content-Range", "bytes 0-9/20")
+
+			res, err := srv.Client().Do(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+
+			if !chunked {
+				t.Fatal("fragment was not sent chunked")
+			}
+			if res.StatusCode != tc.status {
+				t.Errorf("expected status %v, got %v", tc.status, res.StatusCode)
+			}
+			if res.StatusCode != http.StatusOK {
+				return
+			}
+
+			data, err := ioutil.ReadFile(path.Join(h.cfg.TempDir, uuid, "file.txt"+h.cfg.PartSuffix))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tc.body {
+				t.Errorf("unexpected file content: %q", data)
+			}
+		})
+	}
+
+}
+
+// A client retrying rejected fragments should be able to reuse its connection
+func BenchmarkRejectedFragmentRetry(b *testing.B) {
+
+	h, err := NewHandler(Config{TempDir: b.TempDir(), Disallowed: []string{`\.exe$`}}, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	var conns int64
+	srv := httptest.NewUnstartedServer(h)
+	srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&conns, 1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	rec := httptest.NewRecorder()
+	r := httptest.NewRequest(h.cfg.AllowedMethod, "/BITS/", nil)
+	r.Header.Set("BITS-Packet-Type", "Create-Session")
+	r.Header.Set("BITS-Supported-Protocols", h.cfg.Protocol)
+	h.ServeHTTP(rec, r)
+	uuid := rec.Result().Header.Get("BITS-Session-Id")
+
+	data := make([]byte, 64<<10)
+	client := srv.Client()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r, err := http.NewRequest(h.cfg.AllowedMethod, srv.URL+"/BITS/file.exe", bytes.NewReader(data))
+		if err != nil {
+			b.Fatal(err)
+		}
+		r.Header.Set("BITS-Packet-Type", "Fragment")
+		r.Header.Set("BITS-Session-Id", uuid)
+		r.Header.Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", len(data)-1, len(data)))
+
+		res, err := client.Do(r)
+		if err != nil {
+			b.Fatal(err)
+		}
+		io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+		if res.StatusCode != http.StatusBadRequest {
+			b.Fatalf("expected status %v, got %v", http.StatusBadRequest, res.StatusCode)
+		}
+	}
+	b.StopTimer()
+
+	b.ReportMetric(float64(atomic.LoadInt64(&conns))/float64(b.N), "conns/op")
+
+}
+
+func TestPingCapabilities(t *testing.T) {
+
+	headers := []string{"BITS-Protocol", "Accept-Encoding", "X-GoBITS-Max-Size", "X-GoBITS-Max-Fragment-Size"}
+
+	testcases := []struct {
+		name     string
+		cfg      Config
+		expected map[string][]string
+	}{
+		{name: "disabled", cfg: Config{MaxSize: 100}},
+		{
+			name: "enabled",
+			cfg: Config{
+				AdvertiseCapabilities: true,
+				Protocols:             []string{ProtocolUpload15, "{11111111-2222-3333-4444-555555555555}"},
+				MaxSize:               100,
+				MaxFragmentSize:       10,
+			},
+			expected: map[string][]string{
+				"BITS-Protocol":              {ProtocolUpload15, "{11111111-2222-3333-4444-555555555555}"},
+				"Accept-Encoding":            {"Identity"},
+				"X-GoBITS-Max-Size":          {"100"},
+				"X-GoBITS-Max-Fragment-Size": {"10"},
+			},
+		},
+		{
+			name: "no limits",
+			cfg:  Config{AdvertiseCapabilities: true, AcceptEncoding: "-"},
+			expected: map[string][]string{
+				"BITS-Protocol": {ProtocolUpload15},
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newTestHandler(t, tc.cfg, nil)
+			res := doPacket(h, "Ping", "", "/BITS/", nil, nil)
+			res.Body.Close()
+			if res.StatusCode != http.StatusOK || res.Header.Get("BITS-Packet-Type") != "Ack" {
+				t.Fatalf("ping failed: %v", res.Status)
+			}
+			for _, header := range headers {
+				if values := res.Header.Values(header); !reflect.DeepEqual(values, tc.expected[header]) {
+					t.Errorf("expected %v to be %q, got %q", header, tc.expected[header], values)
+				}
+			}
+		})
+	}
+
+}
+
+func TestAcceptEncoding(t *testing.T) {
+
+	h := newTestHandler(t, Config{AcceptEncoding: "gzip"}, nil)
+
+	res := doPacket(h, "Create-Session", "", "/BITS/", map[string]string{
+		"BITS-Supported-Protocols": h.cfg.Protocol,
+	}, nil)
+	res.Body.Close()
+	if res.Header.Get("Accept-Encoding") != "gzip" {
+		t.Errorf("expected Accept-Encoding gzip, got %q", res.Header.Get("Accept-Encoding"))
+	}
+	uuid := res.Header.Get("BITS-Session-Id")
+
+	res = doPacket(h, "Fragment", uuid, "/BITS/file.txt", map[string]string{
+		"Content-Range":    "bytes 0-3/4",
+		"Content-Length":   "4",
+		"Content-Encoding": "br",
+	}, []byte("data"))
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status %v for unsupported encoding, got %v", http.StatusBadRequest, res.StatusCode)
+	}
+
+	h = newTestHandler(t, Config{AcceptEncoding: "-"}, nil)
+	res = doPacket(h, "Create-Session", "", "/BITS/", map[string]string{
+		"BITS-Supported-Protocols": h.cfg.Protocol,
+	}, nil)
+	res.Body.Close()
+	if _, ok := res.Header["Accept-Encoding"]; ok {
+		t.Errorf("expected no Accept-Encoding header, got %q", res.Header.Get("Accept-Encoding"))
+	}
+
+}
+
+func TestFragmentPartSuffix(t *testing.T) {
+
+	h := newTestHandler(t, Config{PartSuffix: ".uploading"}, nil)
+	uuid := createSession(t, h)
+
+	final := path.Join(h.cfg.TempDir, uuid, "file.txt")
+	part := final + ".uploading"
+
+	res := sendFragment(h, uuid, "file.txt", []byte("01234"), 0, 10)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("first fragment failed: %v", res.Status)
+	}
+	if b, _ := exists(final); b {
+		t.Errorf("final file should not exist before completion")
+	}
+	if b, _ := exists(part); !b {
+		t.Errorf("part file should exist before completion")
+	}
+
+	res = sendFragment(h, uuid, "file.txt", []byte("56789"), 5, 10)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("last fragment failed: %v", res.Status)
+	}
+	if b, _ := exists(final); !b {
+		t.Errorf("final file should exist after completion")
+	}
+	if b, _ := exists(part); b {
+		t.Errorf("part file should not exist after completion")
+	}
+
+	// a retried last fragment is still acked
+	res = sendFragment(h, uuid, "file.txt", []byte("56789"), 5, 10)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("retried fragment failed: %v", res.Status)
+	}
+	if res.Header.Get("BITS-Received-Content-Range") != "10" {
+		t.Errorf("expected received range 10, got %q", res.Header.Get("BITS-Received-Content-Range"))
+	}
+
+}
+
+func TestUnfinishedFilesRemoved(t *testing.T) {
+
+	for _, packetType := range []string{"Close-Session", "Cancel-Session"} {
+		t.Run(packetType, func(t *testing.T) {
+			// the filters match the filename, not the unfinished file
+			h := newTestHandler(t, Config{Allowed: []string{`.*\.txt`}, FilterAnchored: true}, nil)
+			ctx := context.Background()
+			s := clientSession(t, h)
+			dir := path.Join(h.cfg.TempDir, s.ID)
+
+			// the client sends whole files, the unfinished one is cut short on the wire
+			if _, err := s.SendFile(ctx, testURL+"done.txt", strings.NewReader("01234"), 5); err != nil {
+				t.Fatalf("fragment of done.txt failed: %v", err)
+			}
+			res := sendFragment(h, s.ID, "half.txt", []byte("01234"), 0, 10)
+			res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("fragment of half.txt failed: %v", res.Status)
+			}
+			if b, _ := exists(path.Join(dir, "half.txt"+h.cfg.PartSuffix)); !b {
+				t.Fatal("part file should exist before the session is closed")
+			}
+
+			var err error
+			if packetType == "Close-Session" {
+				_, err = s.Close(ctx)
+			} else {
+				err = s.Cancel(ctx)
+			}
+			if err != nil {
+				t.Fatalf("%v failed: %v", packetType, err)
+			}
+			if b, _ := exists(path.Join(dir, "half.txt"+h.cfg.PartSuffix)); b {
+				t.Error("part file should be removed")
+			}
+			if b, _ := exists(path.Join(dir, "done.txt")); !b {
+				t.Error("completed file should be kept")
+			}
+		})
+	}
+
+}
+
+func TestErrorHandler(t *testing.T) {
+
+	var reported error
+	tmpFile := path.Join(t.TempDir(), "file")
+	h, err := NewHandler(Config{
+		TempDir: tmpFile,
+		ErrorHandler: func(err error, r *http.Request) {
+			reported = err
+		},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// replace the temporary directory with a file, so the session directory can't be created
+	if err = os.Remove(tmpFile); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(tmpFile, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	res := doPacket(h, "Create-Session", "", "/BITS/", map[string]string{
+		"BITS-Supported-Protocols": h.cfg.Protocol,
+	}, nil)
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusInternalServerError {
+		t.Errorf("expected status %v, got %v", http.StatusInternalServerError, res.StatusCode)
+	}
+	if reported == nil {
+		t.Fatal("error handler was never called")
+	}
+	var pathErr *os.PathError
+	if !errors.As(reported, &pathErr) || pathErr.Op != "mkdir" {
+		t.Errorf("expected the underlying mkdir error, got %v", reported)
+	}
+
+}
+
+func TestCreateSessionProtocol(t *testing.T) {
+
+	const other = "{11111111-2222-3333-4444-555555555555}"
+
+	testcases := []struct {
+		name      string
+		protocols []string
+		supported string
+		status    int
+		protocol  string
+		code      string
+	}{
+		{
+			name:      "no overlap",
+			protocols: []string{ProtocolUpload15},
+			supported: other,
+			status:    http.StatusBadRequest,
+			code:      "80070032",
+		},
+		{
+			name:      "empty",
+			protocols: []string{ProtocolUpload15},
+			supported: " ",
+			status:    http.StatusBadRequest,
+			code:      "80070057",
+		},
+		{
+			name:      "multiple overlap",
+			protocols: []string{other, ProtocolUpload15},
+			supported: ProtocolUpload15 + " " + other,
+			status:    http.StatusOK,
+			protocol:  other,
+		},
+		{
+			name:      "client casing",
+			protocols: []string{ProtocolUpload15},
+			supported: strings.ToUpper(ProtocolUpload15),
+			status:    http.StatusOK,
+			protocol:  strings.ToUpper(ProtocolUpload15),
+		},
+		{
+			name:      "only one supported",
+			protocols: []string{other, ProtocolUpload15},
+			supported: ProtocolUpload15,
+			status:    http.StatusOK,
+			protocol:  ProtocolUpload15,
+		},
+	}
+
+	for _, tc := range testcases {
+
+		t.Run(tc.name, func(t *testing.T) {
+			h := newTestHandler(t, Config{Protocols: tc.protocols}, nil)
+
+			res := doPacket(h, "Create-Session", "", "/BITS/", map[string]string{
+				"BITS-Supported-Protocols": tc.supported,
+			}, nil)
+			res.Body.Close()
+
+			if res.StatusCode != tc.status {
+				t.Errorf("expected status %v, got %v", tc.status, res.StatusCode)
+			}
+			if res.Header.Get("BITS-Protocol") != tc.protocol {
+				t.Errorf("expected protocol %q, got %q", tc.protocol, res.Header.Get("BITS-Protocol"))
+			}
+			if res.Header.Get("BITS-Error-Code") != tc.code {
+				t.Errorf("expected error code %q, got %q", tc.code, res.Header.Get("BITS-Error-Code"))
+			}
+		})
+	}
+
+	// a missing header is the same as an empty one
+	h := newTestHandler(t, Config{}, nil)
+	res := doPacket(h, "Create-Session", "", "/BITS/", nil, nil)
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest || res.Header.Get("BITS-Error-Code") != "80070057" {
+		t.Errorf("expected status 400 with error code 80070057, got %v with %q", res.StatusCode, res.Header.Get("BITS-Error-Code"))
+	}
+
+}
+
+func TestFragmentFilename(t *testing.T) {
+
+	testcases := []struct {
+		name     string
+		target   string
+		status   int
+		filename string
+	}{
+		{
+			name:     "encoded space",
+			target:   "/BITS/my%20file.txt",
+			status:   http.StatusOK,
+			filename: "my file.txt",
+		},
+		{
+			name:     "query string",
+			target:   "/BITS/upload/report.csv?token=abc",
+			status:   http.StatusOK,
+			filename: "report.csv",
+		},
+		{
+			name:   "blacklisted with query string",
+			target: "/BITS/evil.exe?x",
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "encoded dot dot",
+			target: "/BITS/%2e%2e",
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "trailing slash",
+			target: "/BITS/file.txt/",
+			status: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testcases {
+
+		t.Run(tc.name, func(t *testing.T) {
+			var received string
+			h := newTestHandler(t, Config{Disallowed: []string{`\.exe$`}}, func(event Event, session, path string) {
+				if event == EventRecieveFile {
+					received = path
+				}
+			})
+			uuid := createSession(t, h)
+
+			res := doPacket(h, "Fragment", uuid, tc.target, map[string]string{
+				"Content-Range":  "bytes 0-3/4",
+				"Content-Length": "4",
+			}, []byte("data"))
+			res.Body.Close()
+
+			if res.StatusCode != tc.status {
+				t.Errorf("expected status %v, got %v", tc.status, res.StatusCode)
+			}
+			if tc.filename == "" {
+				return
+			}
+			if received != path.Join(h.cfg.TempDir, uuid, tc.filename) {
+				t.Errorf("unexpected received file %q, expected %q", received, tc.filename)
+			}
+			if b, _ := exists(received); !b {
+				t.Errorf("file should exist: %v", received)
+			}
+		})
+	}
+
+}
+
+func TestFragmentMaxFragmentSize(t *testing.T) {
+
+	h := newTestHandler(t, Config{MaxFragmentSize: 4}, nil)
+	uuid := createSession(t, h)
+
+	res := sendFragment(h, uuid, "file.txt", []byte("01234"), 0, 10)
+	res.Body.Close()
+	if res.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected status %v for over-limit fragment, got %v", http.StatusRequestEntityTooLarge, res.StatusCode)
+	}
+
+	res = sendFragment(h, uuid, "file.txt", []byte("0123"), 0, 10)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("expected status %v for at-limit fragment, got %v", http.StatusOK, res.StatusCode)
+	}
+
+}
+
+func TestFragmentPreservePath(t *testing.T) {
+
+	var received []string
+	h := newTestHandler(t, Config{PreservePath: true, PathPrefix: "/BITS/"}, func(event Event, session, path string) {
+		if event == EventRecieveFile {
+			received = append(received, path)
+		}
+	})
+	s := clientSession(t, h)
+	uuid := s.ID
+
+	// files in different directories don't collide
+	for _, name := range []string{"job42/logs/app/trace.etl", "job42/logs/web/trace.etl"} {
+		if _, err := s.SendFile(context.Background(), testURL+name, strings.NewReader("data"), 4); err != nil {
+			t.Errorf("failed to send %v: %v", name, err)
+		}
+	}
+	expected := []string{
+		filepath.Join(h.cfg.TempDir, uuid, "job42", "logs", "app", "trace.etl"),
+		filepath.Join(h.cfg.TempDir, uuid, "job42", "logs", "web", "trace.etl"),
+	}
+	if len(received) != len(expected) {
+		t.Fatalf("expected received files %v, got %v", expected, received)
+	}
+	for i := range expected {
+		if received[i] != expected[i] {
+			t.Errorf("expected received file %v, got %v", expected[i], received[i])
+		}
+	}
+
+	// traversal, absolute paths and collisions are rejected, the paths are sent as they are
+	for _, target := range []string{
+		"/BITS/job42/../../trace.etl",
+		"/BITS//etc/trace.etl",
+		"/BITS/job42/logs",
+		"/BITS/job42/logs/app/trace.etl/nested",
+	} {
+		res := doPacket(h, "Fragment", uuid, target, map[string]string{
+			"Content-Range":  "bytes 0-3/4",
+			"Content-Length": "4",
+		}, []byte("data"))
+		res.Body.Close()
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected status %v for %v, got %v", http.StatusBadRequest, target, res.StatusCode)
+		}
+	}
+
+}
+
+func TestFragmentFilenameMapper(t *testing.T) {
+
+	testcases := []struct {
+		name     string
+		mapped   string
+		err      error
+		status   int
+		filename string
+	}{
+		{
+			name:     "renamed",
+			mapped:   "host_file.txt",
+			status:   http.StatusOK,
+			filename: "host_file.txt",
+		},
+		{
+			name:   "traversal",
+			mapped: "../file.txt",
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "error",
+			err:    errors.New("no name for you"),
+			status: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testcases {
+
+		t.Run(tc.name, func(t *testing.T) {
+			var received string
+			h := newTestHandler(t, Config{
+				FilenameMapper: func(r *http.Request, session, requested string) (string, error) {
+					if requested != "file.txt" {
+						t.Errorf("unexpected requested filename %q", requested)
+					}
+					return tc.mapped, tc.err
+				},
+			}, func(event Event, session, path string) {
+				if event == EventRecieveFile {
+					received = path
+				}
+			})
+			s := clientSession(t, h)
+
+			status := http.StatusOK
+			_, err := s.SendFile(context.Background(), testURL+"file.txt", strings.NewReader("data"), 4)
+			var bitsErr *client.Error
+			if errors.As(err, &bitsErr) {
+				status = bitsErr.StatusCode
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if status != tc.status {
+				t.Errorf("expected status %v, got %v", tc.status, status)
+			}
+			if tc.filename == "" {
+				return
+			}
+			if received != filepath.Join(h.cfg.TempDir, s.ID, tc.filename) {
+				t.Errorf("unexpected received file %q, expected %q", received, tc.filename)
+			}
+		})
+	}
+
+}
+
+func TestCreateSessionDeduplicate(t *testing.T) {
+
+	var created int
+	h := newTestHandler(t, Config{DeduplicateCreate: true}, func(event Event, session, path string) {
+		if event == EventCreateSession {
+			created++
+		}
+	})
+
+	create := func(key string) string {
+		res := doPacket(h, "Create-Session", "", "/BITS/", map[string]string{
+			"BITS-Supported-Protocols": h.cfg.Protocol,
+			"Idempotency-Key":          key,
+		}, nil)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("failed to create session: %v", res.Status)
+		}
+		return res.Header.Get("BITS-Session-Id")
+	}
+
+	first := create("job-1")
+	if retried := create("job-1"); retried != first {
+		t.Errorf("retried create should return session %v, got %v", first, retried)
+	}
+	if created != 1 {
+		t.Errorf("expected 1 created session, got %v", created)
+	}
+	if other := create("job-2"); other == first {
+		t.Errorf("another key should get a new session")
+	}
+
+	// a closed session is not returned again
+	res := doPacket(h, "Close-Session", first, "/BITS/", nil, nil)
+	res.Body.Close()
+	if again := create("job-1"); again == first {
+		t.Errorf("closed session should not be returned")
+	}
+
+}
+
+func TestCreateSessionDeduplicateConcurrent(t *testing.T) {
+
+	// the callback can use the handler while a keyed session is created
+	var mu sync.Mutex
+	var created []string
+	var h *Handler
+	h = newTestHandler(t, Config{DeduplicateCreate: true}, func(event Event, session, path string) {
+		if event == EventCreateSession {
+			h.Stats()
+			time.Sleep(10 * time.Millisecond)
+			mu.Lock()
+			created = append(created, session)
+			mu.Unlock()
+		}
+	})
+
+	// concurrent creates with the same key get the same session
+	ids := make([]string, 5)
+	var wg sync.WaitGroup
+	for i := range ids {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res := doPacket(h, "Create-Session", "", "/BITS/", map[string]string{
+				"BITS-Supported-Protocols": h.cfg.Protocol,
+				"Idempotency-Key":          "job-1",
+			}, nil)
+			res.Body.Close()
+			ids[i] = res.Header.Get("BITS-Session-Id")
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("create deadlocked")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(created) != 1 {
+		t.Fatalf("expected 1 created session, got %v", created)
+	}
+	for _, id := range ids {
+		if id != created[0] {
+			t.Errorf("expected every create to get session %v, got %v", created[0], ids)
+			break
+		}
+	}
+}
+
+// blockingReader signals when it is first read from, and then blocks until released
+type blockingReader struct {
+	data     []byte
+	reading  chan struct{}
+	released chan struct{}
+}
+
+func (b *blockingReader) Read(p []byte) (int, error) {
+	if b.reading != nil {
+		close(b.reading)
+		b.reading = nil
+		<-b.released
+	}
+	if len(b.data) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, b.data)
+	b.data = b.data[n:]
+	return n, nil
+}
+
+func TestTerminateSession(t *testing.T) {
+
+	t.Run("idle", func(t *testing.T) {
+		var canceled string
+		h := newTestHandler(t, Config{}, func(event Event, session, path string) {
+			if event == EventCancelSession {
+				canceled = session
+			}
+		})
+		uuid := createSession(t, h)
+
+		if err := h.TerminateSession(uuid); err != nil {
+			t.Fatal(err)
+		}
+		if canceled != uuid {
+			t.Errorf("expected cancel event for %v, got %q", uuid, canceled)
+		}
+		if b, _ := exists(path.Join(h.cfg.TempDir, uuid)); b {
+			t.Errorf("session directory should be removed")
+		}
+
+		res := sendFragment(h, uuid, "file.txt", []byte("data"), 0, 4)
+		res.Body.Close()
+		if res.StatusCode != http.StatusNotFound {
+			t.Errorf("expected status %v after terminate, got %v", http.StatusBadRequest, res.StatusCode)
+		}
+
+		if err := h.TerminateSession(uuid); err != ErrSessionNotFound {
+			t.Errorf("expected %v terminating again, got %v", ErrSessionNotFound, err)
+		}
+	})
+
+	t.Run("in-flight fragment", func(t *testing.T) {
+		h := newTestHandler(t, Config{}, nil)
+		uuid := createSession(t, h)
+
+		// the session is tracked once a fragment has been written to it
+		res := sendFragment(h, uuid, "file.txt", []byte("01234"), 0, 10)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("first fragment failed: %v", res.Status)
+		}
+
+		body := &blockingReader{data: []byte("56789"), reading: make(chan struct{}), released: make(chan struct{})}
+		reading := body.reading
+		r := httptest.NewRequest(h.cfg.AllowedMethod, "/BITS/file.txt", body)
+		r.Header.Set("BITS-Packet-Type", "Fragment")
+		r.Header.Set("BITS-Session-Id", uuid)
+		r.Header.Set("Content-Range", "bytes 5-9/10")
+		r.Header.Set("Content-Length", "5")
+
+		rec := httptest.NewRecorder()
+		done := make(chan struct{})
+		go func() {
+			h.ServeHTTP(rec, r)
+			close(done)
+		}()
+
+		<-reading
+		if err := h.TerminateSession(uuid); err != nil {
+			t.Fatal(err)
+		}
+		close(body.released)
+		<-done
+
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("expected status %v for in-flight fragment, got %v", http.StatusNotFound, rec.Code)
+		}
+		if b, _ := exists(path.Join(h.cfg.TempDir, uuid)); b {
+			t.Errorf("session directory should be removed")
+		}
+	})
+
+}
+
+func TestFragmentExistingFile(t *testing.T) {
+
+	testcases := []struct {
+		name     string
+		policy   ExistingFilePolicy
+		status   int
+		received string
+		content  map[string]string
+	}{
+		{
+			name:     "overwrite",
+			policy:   ExistingFileOverwrite,
+			status:   http.StatusOK,
+			received: "file.txt",
+			content:  map[string]string{"file.txt": "abcdefghij"},
+		},
+		{
+			name:    "reject",
+			policy:  ExistingFileReject,
+			status:  http.StatusConflict,
+			content: map[string]string{"file.txt": "0123456789"},
+		},
+		{
+			name:     "rename",
+			policy:   ExistingFileRename,
+			status:   http.StatusOK,
+			received: "file (1).txt",
+			content:  map[string]string{"file.txt": "0123456789", "file (1).txt": "abcdefghij"},
+		},
+	}
+
+	for _, tc := range testcases {
+
+		t.Run(tc.name, func(t *testing.T) {
+			var received []string
+			h := newTestHandler(t, Config{OnExistingFile: tc.policy}, func(event Event, session, path string) {
+				if event == EventRecieveFile {
+					received = append(received, filepath.Base(path))
+				}
+			})
+			uuid := createSession(t, h)
+
+			// resuming a partial file still works, including a retried fragment
+			for _, f := range []struct {
+				data  string
+				start uint64
+			}{{"01234", 0}, {"01234", 0}, {"56789", 5}, {"56789", 5}} {
+				res := sendFragment(h, uuid, "file.txt", []byte(f.data), f.start, 10)
+				res.Body.Close()
+				if res.StatusCode != http.StatusOK {
+					t.Fatalf("fragment %v failed: %v", f.start, res.Status)
+				}
+			}
+
+			// upload it again
+			res := sendFragment(h, uuid, "file.txt", []byte("abcde"), 0, 10)
+			res.Body.Close()
+			if res.StatusCode != tc.status {
+				t.Fatalf("expected status %v, got %v", tc.status, res.StatusCode)
+			}
+			if res.StatusCode == http.StatusOK {
+				res = sendFragment(h, uuid, "file.txt", []byte("fghij"), 5, 10)
+				res.Body.Close()
+				if res.StatusCode != http.StatusOK {
+					t.Fatalf("last fragment failed: %v", res.Status)
+				}
+			}
+
+			expected := []string{"file.txt"}
+			if tc.received != "" {
+				expected = append(expected, tc.received)
+			}
+			if strings.Join(received, ",") != strings.Join(expected, ",") {
+				t.Errorf("expected received files %v, got %v", expected, received)
+			}
+			for name, content := range tc.content {
+				data, err := ioutil.ReadFile(path.Join(h.cfg.TempDir, uuid, name))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(data) != content {
+					t.Errorf("unexpected content of %v: %q, expected %q", name, data, content)
+				}
+			}
+		})
+	}
+
+}
+
+func TestFragmentCollision(t *testing.T) {
+
+	testcases := []struct {
+		name     string
+		policy   ExistingFilePolicy
+		status   int
+		received string
+		content  map[string]string
+	}{
+		{
+			name:     "overwrite",
+			policy:   ExistingFileOverwrite,
+			status:   http.StatusOK,
+			received: "file.txt",
+			content:  map[string]string{"file.txt": "abcdefghij"},
+		},
+		{
+			name:    "reject",
+			policy:  ExistingFileReject,
+			status:  http.StatusConflict,
+			content: map[string]string{"file.txt": "0123456789"},
+		},
+		{
+			name:     "rename",
+			policy:   ExistingFileRename,
+			status:   http.StatusOK,
+			received: "file (1).txt",
+			content:  map[string]string{"file.txt": "0123456789", "file (1).txt": "abcdefghij"},
+		},
+	}
+
+	for _, tc := range testcases {
+
+		t.Run(tc.name, func(t *testing.T) {
+			var received []string
+			h := newTestHandler(t, Config{OnCollision: tc.policy}, func(event Event, session, path string) {
+				if event == EventRecieveFile {
+					received = append(received, filepath.Base(path))
+				}
+			})
+			uuid := createSession(t, h)
+
+			// without the path preserved, both files are stored as file.txt
+			res := sendFragment(h, uuid, "a/file.txt", []byte("0123456789"), 0, 10)
+			res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("first file failed: %v", res.Status)
+			}
+
+			// a query for the other file doesn't get the progress of the first
+			res = doPacket(h, "Fragment", uuid, "/BITS/b/file.txt", map[string]string{"Content-Range": "bytes */10"}, nil)
+			res.Body.Close()
+			if got := res.Header.Get("BITS-Received-Content-Range"); got != "0" {
+				t.Errorf("expected nothing received of the other file, got %v", got)
+			}
+
+			res = sendFragment(h, uuid, "b/file.txt", []byte("abcde"), 0, 10)
+			res.Body.Close()
+			if res.StatusCode != tc.status {
+				t.Fatalf("expected status %v, got %v", tc.status, res.StatusCode)
+			}
+			if res.StatusCode == http.StatusOK {
+				res = sendFragment(h, uuid, "b/file.txt", []byte("fghij"), 5, 10)
+				res.Body.Close()
+				if res.StatusCode != http.StatusOK {
+					t.Fatalf("last fragment failed: %v", res.Status)
+				}
+			}
+
+			expected := []string{"file.txt"}
+			if tc.received != "" {
+				expected = append(expected, tc.received)
+			}
+			if strings.Join(received, ",") != strings.Join(expected, ",") {
+				t.Errorf("expected received files %v, got %v", expected, received)
+			}
+			for name, content := range tc.content {
+				data, err := ioutil.ReadFile(path.Join(h.cfg.TempDir, uuid, name))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(data) != content {
+					t.Errorf("unexpected content of %v: %q, expected %q", name, data, content)
+				}
+			}
+
+			// the first file is still a retry of itself, not a collision
+			res = sendFragment(h, uuid, "a/file.txt", []byte("56789"), 5, 10)
+			res.Body.Close()
+			if tc.policy != ExistingFileOverwrite && res.StatusCode != http.StatusOK {
+				t.Errorf("retry of the first file failed: %v", res.Status)
+			}
+		})
+	}
+
+}
+
+func TestFragmentFilenameRestrictions(t *testing.T) {
+
+	testcases := []struct {
+		name   string
+		cfg    Config
+		target string
+		status int
+	}{
+		{
+			name:   "default max length",
+			target: "/BITS/" + strings.Repeat("a", 244),
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "at default max length",
+			target: "/BITS/" + strings.Repeat("a", 243),
+			status: http.StatusOK,
+		},
+		{
+			name:   "beyond NAME_MAX",
+			target: "/BITS/" + strings.Repeat("a", 300),
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "custom max length",
+			cfg:    Config{MaxFilenameLength: 8},
+			target: "/BITS/file.txt.bak",
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "encoded windows character",
+			cfg:    Config{WindowsSafeFilenames: true},
+			target: "/BITS/a%3Cb.txt",
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "windows safe",
+			cfg:    Config{WindowsSafeFilenames: true},
+			target: "/BITS/a%20b.txt",
+			status: http.StatusOK,
+		},
+		{
+			name:   "part suffix",
+			target: "/BITS/file.txt.gobits-part",
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "custom part suffix",
+			cfg:    Config{PartSuffix: ".partial"},
+			target: "/BITS/file.txt.partial",
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "part suffix directory",
+			cfg:    Config{PreservePath: true, PathPrefix: "/BITS/"},
+			target: "/BITS/dir.gobits-part/file.txt",
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "pattern mismatch",
+			cfg:    Config{FilenamePattern: `^[a-z.]+$`},
+			target: "/BITS/File.txt",
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "pattern match",
+			cfg:    Config{FilenamePattern: `^[a-z.]+$`},
+			target: "/BITS/file.txt",
+			status: http.StatusOK,
+		},
+	}
+
+	for _, tc := range testcases {
+
+		t.Run(tc.name, func(t *testing.T) {
+			var rejected string
+			h := newTestHandler(t, tc.cfg, func(event Event, session, path string) {
+				if event == EventRejectFile {
+					rejected = path
+				}
+			})
+			uuid := createSession(t, h)
+
+			res := doPacket(h, "Fragment", uuid, tc.target, map[string]string{
+				"Content-Range":  "bytes 0-3/4",
+				"Content-Length": "4",
+			}, []byte("data"))
+			res.Body.Close()
+
+			if res.StatusCode != tc.status {
+				t.Errorf("expected status %v, got %v", tc.status, res.StatusCode)
+			}
+			if (rejected != "") != (tc.status == http.StatusBadRequest) {
+				t.Errorf("unexpected rejected file %q", rejected)
+			}
+			if tc.status == http.StatusBadRequest && res.Header.Get("BITS-Error-Context") != "5" {
+				t.Errorf("expected error context 5, got %q", res.Header.Get("BITS-Error-Context"))
+			}
+		})
+	}
+
+}
+
+func TestCreateSessionDeduplicateClientIP(t *testing.T) {
+
+	h := newTestHandler(t, Config{DeduplicateCreate: true, ClientIP: ForwardedIP}, nil)
+
+	create := func(client string) string {
+		res := doPacket(h, "Create-Session", "", "/BITS/", map[string]string{
+			"BITS-Supported-Protocols": h.cfg.Protocol,
+			"Idempotency-Key":          "job-1",
+			"X-Forwarded-For":          client,
+		}, nil)
+		res.Body.Close()
+		return res.Header.Get("BITS-Session-Id")
+	}
+
+	// the same key from another client is another session
+	first := create("2001:db8::1")
+	if other := create("2001:db8::2"); other == first {
+		t.Errorf("another client should get a new session")
+	}
+	if retried := create("2001:db8::1"); retried != first {
+		t.Errorf("retried create should return session %v, got %v", first, retried)
+	}
+
+}
+
+func TestFragmentFilterOptions(t *testing.T) {
+
+	testcases := []struct {
+		name       string
+		ignoreCase bool
+		anchored   bool
+		filename   string
+		status     int
+	}{
+		{name: "default upper case", filename: "SETUP.EXE", status: http.StatusOK},
+		{name: "default lower case", filename: "setup.exe", status: http.StatusBadRequest},
+		{name: "default partial", filename: "setup.exe.txt", status: http.StatusBadRequest},
+		{name: "safe upper case", ignoreCase: true, anchored: true, filename: "SETUP.EXE", status: http.StatusBadRequest},
+		{name: "safe no extension", ignoreCase: true, anchored: true, filename: "exe.txt", status: http.StatusOK},
+		{name: "safe partial", ignoreCase: true, anchored: true, filename: "setup.exe.txt", status: http.StatusOK},
+	}
+
+	for _, tc := range testcases {
+
+		t.Run(tc.name, func(t *testing.T) {
+			h := newTestHandler(t, Config{
+				Disallowed:       []string{`.*\.exe`},
+				FilterIgnoreCase: tc.ignoreCase,
+				FilterAnchored:   tc.anchored,
+			}, nil)
+			uuid := createSession(t, h)
+
+			res := sendFragment(h, uuid, tc.filename, []byte("data"), 0, 4)
+			res.Body.Close()
+			if res.StatusCode != tc.status {
+				t.Errorf("expected status %v, got %v", tc.status, res.StatusCode)
+			}
+		})
+	}
+
+}
+
+func TestFragmentRules(t *testing.T) {
+
+	rules := []Rule{
+		{Pattern: `.*\.zip`, MaxSize: 10},
+		{Pattern: `.*`, MinSize: 1},
+	}
+
+	testcases := []struct {
+		name     string
+		filename string
+		length   uint64
+		status   int
+	}{
+		{name: "small zip", filename: "file.zip", length: 10, status: http.StatusOK},
+		{name: "large zip", filename: "file.zip", length: 11, status: http.StatusBadRequest},
+		{name: "large text", filename: "file.txt", length: 11, status: http.StatusOK},
+		{name: "empty text", filename: "file.txt", length: 0, status: http.StatusBadRequest},
+	}
+
+	for _, tc := range testcases {
+
+		t.Run(tc.name, func(t *testing.T) {
+			var rejected []string
+			h := newTestHandler(t, Config{Rules: rules}, func(event Event, session, path string) {
+				if event == EventRejectFile {
+					rejected = append(rejected, path)
+				}
+			})
+			uuid := createSession(t, h)
+
+			headers := map[string]string{
+				"Content-Range":  fmt.Sprintf("bytes 0-%d/%d", tc.length-1, tc.length),
+				"Content-Length": strconv.FormatUint(tc.length, 10),
+			}
+			if tc.length == 0 {
+				headers["Content-Range"] = "bytes 0-0/0"
+			}
+			res := doPacket(h, "Fragment", uuid, "/BITS/"+tc.filename, headers, bytes.Repeat([]byte("x"), int(tc.length)))
+			res.Body.Close()
+			if res.StatusCode != tc.status {
+				t.Fatalf("expected status %v, got %v", tc.status, res.StatusCode)
+			}
+			if tc.status != http.StatusOK && (len(rejected) != 1 || rejected[0] != tc.filename) {
+				t.Errorf("expected %v to be rejected, got %v", tc.filename, rejected)
+			}
+
+			// the size is checked on queries too
+			res = doPacket(h, "Fragment", uuid, "/BITS/"+tc.filename, map[string]string{
+				"Content-Range":  fmt.Sprintf("bytes */%d", tc.length),
+				"Content-Length": "0",
+			}, nil)
+			res.Body.Close()
+			if res.StatusCode != tc.status {
+				t.Errorf("expected query status %v, got %v", tc.status, res.StatusCode)
+			}
+		})
+	}
+
+	if _, err := NewHandler(Config{Rules: []Rule{{Pattern: "("}}}, nil); err == nil {
+		t.Error("expected an invalid rule pattern to fail")
+	}
+
+}
+
+func TestFragmentRuleOrder(t *testing.T) {
+
+	logLimit := Rule{Pattern: `.*\.log`, MaxSize: 10}
+	anyLimit := Rule{Pattern: `.*`, MaxSize: 100}
+	denyDebug := Rule{Pattern: `debug\.log`, Deny: true}
+
+	testcases := []struct {
+		name     string
+		rules    []Rule
+		filename string
+		length   uint64
+		status   int
+	}{
+		{name: "specific first", rules: []Rule{logLimit, anyLimit}, filename: "app.log", length: 50, status: http.StatusBadRequest},
+		{name: "generic first", rules: []Rule{anyLimit, logLimit}, filename: "app.log", length: 50, status: http.StatusOK},
+		{name: "other file", rules: []Rule{logLimit, anyLimit}, filename: "app.txt", length: 50, status: http.StatusOK},
+		{name: "over generic", rules: []Rule{logLimit, anyLimit}, filename: "app.txt", length: 101, status: http.StatusBadRequest},
+		{name: "deny first", rules: []Rule{denyDebug, logLimit}, filename: "debug.log", length: 5, status: http.StatusBadRequest},
+		{name: "deny last", rules: []Rule{logLimit, denyDebug}, filename: "debug.log", length: 5, status: http.StatusOK},
+	}
+
+	for _, tc := range testcases {
+
+		t.Run(tc.name, func(t *testing.T) {
+			h := newTestHandler(t, Config{Rules: tc.rules}, nil)
+			uuid := createSession(t, h)
+
+			res := sendFragment(h, uuid, tc.filename, bytes.Repeat([]byte("x"), int(tc.length)), 0, tc.length)
+			res.Body.Close()
+			if res.StatusCode != tc.status {
+				t.Errorf("expected status %v, got %v", tc.status, res.StatusCode)
+			}
+		})
+	}
+
+	// the limit is checked on every fragment, so the received bytes can't grow past it
+	t.Run("larger length", func(t *testing.T) {
+		h := newTestHandler(t, Config{Rules: []Rule{logLimit}}, nil)
+		uuid := createSession(t, h)
+
+		res := sendFragment(h, uuid, "app.log", []byte("01234"), 0, 10)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("first fragment failed: %v", res.Status)
+		}
+		res = sendFragment(h, uuid, "app.log", []byte("56789abcdef"), 5, 16)
+		res.Body.Close()
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected status %v, got %v", http.StatusBadRequest, res.StatusCode)
+		}
+	})
+
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+
+	h := newTestHandler(t, Config{}, nil)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/BITS/", nil))
+	res := rec.Result()
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expected status %v, got %v", http.StatusMethodNotAllowed, res.StatusCode)
+	}
+	if allow := res.Header.Get("Allow"); allow != "BITS_POST" {
+		t.Errorf("expected Allow header %q, got %q", "BITS_POST", allow)
+	}
+
+}
+
+func TestFragmentContentSniffer(t *testing.T) {
+
+	var rejected []string
+	var sniffed int
+	h := newTestHandler(t, Config{
+		ContentSniffer: func(filename string, head []byte) error {
+			sniffed++
+			return SniffExecutable(filename, head)
+		},
+	}, func(event Event, session, path string) {
+		if event == EventRejectFile {
+			rejected = append(rejected, path)
+		}
+	})
+	uuid := createSession(t, h)
+
+	// the magic number is split over two fragments
+	res := sendFragment(h, uuid, "setup.txt", []byte("\x7fE"), 0, 8)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("first fragment failed: %v", res.Status)
+	}
+	res = sendFragment(h, uuid, "setup.txt", []byte("LF"), 2, 8)
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status %v, got %v", http.StatusBadRequest, res.StatusCode)
+	}
+	if context := res.Header.Get("BITS-Error-Context"); context != "7" {
+		t.Errorf("expected error context 7, got %q", context)
+	}
+	if len(rejected) != 1 || rejected[0] != "setup.txt" {
+		t.Errorf("expected setup.txt to be rejected, got %v", rejected)
+	}
+	if exist, _ := exists(filepath.Join(h.cfg.TempDir, uuid, "setup.txt"+h.cfg.PartSuffix)); exist {
+		t.Error("expected the staged file to be removed")
+	}
+
+	// the sniffer isn't called once the head is received
+	data := bytes.Repeat([]byte("x"), sniffLength+10)
+	sniffed = 0
+	for _, start := range []int{0, sniffLength, sniffLength + 5} {
+		end := start + 5
+		if start == 0 {
+			end = sniffLength
+		}
+		res = sendFragment(h, uuid, "file.txt", data[start:end], uint64(start), uint64(len(data)))
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("fragment %v failed: %v", start, res.Status)
+		}
+	}
+	if sniffed != 1 {
+		t.Errorf("expected the sniffer to be called once, got %v", sniffed)
+	}
+
+}
+
+func TestFragmentOverlap(t *testing.T) {
+
+	testcases := []struct {
+		name      string
+		fragments []string // fragments of "0123456789" as "start:data"
+		received  []string
+	}{
+		{name: "adjacent", fragments: []string{"0:01234", "5:56789"}, received: []string{"5", "10"}},
+		{name: "overlapping", fragments: []string{"0:0123", "2:23456", "6:6789"}, received: []string{"4", "7", "10"}},
+		{name: "contained", fragments: []string{"0:012345", "2:234", "6:6789"}, received: []string{"6", "6", "10"}},
+	}
+
+	for _, tc := range testcases {
+
+		t.Run(tc.name, func(t *testing.T) {
+			h := newTestHandler(t, Config{}, nil)
+			uuid := createSession(t, h)
+
+			for i, f := range tc.fragments {
+				start, data, _ := strings.Cut(f, ":")
+				offset, _ := strconv.ParseUint(start, 10, 64)
+				res := sendFragment(h, uuid, "file.txt", []byte(data), offset, 10)
+				res.Body.Close()
+				if res.StatusCode != http.StatusOK {
+					t.Fatalf("fragment %v failed: %v", f, res.Status)
+				}
+				if received := res.Header.Get("BITS-Received-Content-Range"); received != tc.received[i] {
+					t.Errorf("fragment %v: expected received range %v, got %v", f, tc.received[i], received)
+				}
+			}
+
+			content, err := os.ReadFile(filepath.Join(h.cfg.TempDir, uuid, "file.txt"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(content) != "0123456789" {
+				t.Errorf("expected content %q, got %q", "0123456789", content)
+			}
+		})
+	}
+
+}
+
+func TestSessionState(t *testing.T) {
+
+	notFound := strconv.FormatUint(codeSessionNotFound, 16)
+
+	testcases := []struct {
+		name    string
+		packets []string // packets sent after the session is created
+		status  []int
+	}{
+		{name: "fragment after close", packets: []string{"Close-Session", "Fragment"}, status: []int{200, 404}},
+		{name: "query after close", packets: []string{"Close-Session", "Query"}, status: []int{200, 404}},
+		{name: "close twice", packets: []string{"Close-Session", "Close-Session"}, status: []int{200, 404}},
+		{name: "cancel after close", packets: []string{"Close-Session", "Cancel-Session"}, status: []int{200, 404}},
+		{name: "fragment after cancel", packets: []string{"Cancel-Session", "Fragment"}, status: []int{200, 404}},
+		{name: "close after cancel", packets: []string{"Cancel-Session", "Close-Session"}, status: []int{200, 404}},
+		{name: "cancel twice", packets: []string{"Cancel-Session", "Cancel-Session"}, status: []int{200, 404}},
+		{name: "fragment before close", packets: []string{"Fragment", "Close-Session", "Fragment"}, status: []int{200, 200, 404}},
+	}
+
+	for _, tc := range testcases {
+
+		t.Run(tc.name, func(t *testing.T) {
+			// the callback leaves the session directory in place
+			h := newTestHandler(t, Config{}, nil)
+			uuid := createSession(t, h)
+
+			for i, packet := range tc.packets {
+				var res *http.Response
+				switch packet {
+				case "Fragment":
+					res = sendFragment(h, uuid, "file.txt", []byte("data"), 0, 8)
+				case "Query":
+					res = doPacket(h, "Fragment", uuid, "/BITS/file.txt", map[string]string{
+						"Content-Range":  "bytes */8",
+						"Content-Length": "0",
+					}, nil)
+				default:
+					res = doPacket(h, packet, uuid, "/BITS/", nil, nil)
+				}
+				res.Body.Close()
+
+				if res.StatusCode != tc.status[i] {
+					t.Errorf("%v %v: expected status %v, got %v", i, packet, tc.status[i], res.StatusCode)
+				}
+				if res.StatusCode != http.StatusOK && res.Header.Get("BITS-Error-Code") != notFound {
+					t.Errorf("%v %v: expected error code %v, got %v", i, packet, notFound, res.Header.Get("BITS-Error-Code"))
+				}
+			}
+		})
+	}
+
+	// fragments sent while the close callback runs are rejected
+	t.Run("fragment while closing", func(t *testing.T) {
+		var h *Handler
+		var status int
+		h = newTestHandler(t, Config{}, func(event Event, session, path string) {
+			if event == EventCloseSession {
+				res := sendFragment(h, session, "file.txt", []byte("data"), 0, 4)
+				res.Body.Close()
+				status = res.StatusCode
+			}
+		})
+		s := clientSession(t, h)
+
+		if _, err := s.Close(context.Background()); err != nil {
+			t.Fatalf("close failed: %v", err)
+		}
+		if status != http.StatusNotFound {
+			t.Errorf("expected status %v, got %v", http.StatusNotFound, status)
+		}
+	})
+
+	// a session removed by the callback isn't tracked anymore
+	t.Run("released", func(t *testing.T) {
+		h := newTestHandler(t, Config{}, func(event Event, session, path string) {
+			if event == EventCloseSession {
+				os.RemoveAll(path)
+			}
+		})
+		s := clientSession(t, h)
+
+		if _, err := s.Close(context.Background()); err != nil {
+			t.Fatalf("close failed: %v", err)
+		}
+		h.mu.Lock()
+		_, tracked := h.sessions[s.ID]
+		h.mu.Unlock()
+		if tracked {
+			t.Error("expected the session to be released")
+		}
+	})
+
+	// only one of concurrent close and cancel packets succeeds
+	t.Run("concurrent", func(t *testing.T) {
+		var events atomic.Int32
+		h := newTestHandler(t, Config{}, func(event Event, session, path string) {
+			if event == EventCloseSession || event == EventCancelSession {
+				events.Add(1)
+			}
+		})
+		s := clientSession(t, h)
+		ctx := context.Background()
+
+		var ok atomic.Int32
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				var err error
+				if i%2 == 1 {
+					err = s.Cancel(ctx)
+				} else {
+					_, err = s.Close(ctx)
+				}
+				if err == nil {
+					ok.Add(1)
+				}
+			}()
+		}
+		wg.Wait()
+
+		if ok.Load() != 1 || events.Load() != 1 {
+			t.Errorf("expected one packet and event to succeed, got %v and %v", ok.Load(), events.Load())
+		}
+	})
+
+}
+
+// Fragments of the same file are written one at a time, whatever order they arrive in
+func TestFragmentConcurrent(t *testing.T) {
+
+	content := []byte("0123456789abcdefghij")
+	h := newTestHandler(t, Config{}, nil)
+
+	for i := 0; i < 20; i++ {
+		uuid := createSession(t, h)
+
+		var wg sync.WaitGroup
+		for _, start := range []uint64{0, 10} {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				// a fragment arriving before the one in front of it is retried, like a client would
+				for retry := 0; retry < 100; retry++ {
+					res := sendFragment(h, uuid, "file.txt", content[start:start+10], start, uint64(len(content)))
+					res.Body.Close()
+					if res.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+						return
+					}
+					time.Sleep(time.Millisecond)
+				}
+			}()
+		}
+		wg.Wait()
+
+		data, err := os.ReadFile(filepath.Join(h.cfg.TempDir, uuid, "file.txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, content) {
+			t.Fatalf("unexpected file content: %q", data)
+		}
+	}
+
+}
+
+func TestCloseSessionBytes(t *testing.T) {
+
+	var closed []Session
+	h := newTestHandler(t, Config{
+		SessionCallback: func(event Event, s Session) {
+			if event == EventCloseSession {
+				closed = append(closed, s)
+			}
+		},
+	}, nil)
+	uuid := createSession(t, h)
+
+	// retried fragments aren't counted twice
+	for _, f := range []struct {
+		filename string
+		data     string
+		start    uint64
+		length   uint64
+	}{
+		{"first.txt", "01234", 0, 10},
+		{"first.txt", "01234", 0, 10},
+		{"first.txt", "56789", 5, 10},
+		{"second.txt", "abcdef", 0, 6},
+	} {
+		res := sendFragment(h, uuid, f.filename, []byte(f.data), f.start, f.length)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("fragment of %v failed: %v", f.filename, res.Status)
+		}
+	}
+
+	res := doPacket(h, "Close-Session", uuid, "/BITS/", nil, nil)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("close failed: %v", res.Status)
+	}
+	if len(closed) != 1 || closed[0].Bytes != 16 {
+		t.Errorf("expected the session to be closed with 16 bytes received, got %+v", closed)
+	}
+
+}
+
+func TestCloseSessionIncomplete(t *testing.T) {
+
+	t.Run("complete", func(t *testing.T) {
+		var incomplete []string
+		var err error
+		var h *Handler
+		h = newTestHandler(t, Config{StrictClose: true}, func(event Event, session, path string) {
+			if event == EventCloseSession {
+				incomplete, err = h.IncompleteFiles(session)
+			}
+		})
+		ctx := context.Background()
+		s := clientSession(t, h)
+
+		if _, err := s.SendFile(ctx, testURL+"file.txt", strings.NewReader("data"), 4); err != nil {
+			t.Fatalf("fragment failed: %v", err)
+		}
+		if _, err := s.Close(ctx); err != nil {
+			t.Fatalf("close failed: %v", err)
+		}
+		if err != nil || len(incomplete) != 0 {
+			t.Errorf("expected no incomplete files, got %v, %v", incomplete, err)
+		}
+	})
+
+	t.Run("strict", func(t *testing.T) {
+		h := newTestHandler(t, Config{StrictClose: true}, nil)
+		ctx := context.Background()
+		s := clientSession(t, h)
+
+		res := sendFragment(h, s.ID, "half.txt", []byte("da"), 0, 4)
+		res.Body.Close()
+		var bitsErr *client.Error
+		if _, err := s.Close(ctx); !errors.As(err, &bitsErr) || bitsErr.StatusCode != http.StatusBadRequest || bitsErr.Code != codeMoreData {
+			t.Errorf("expected status %v with error code %x, got %v", http.StatusBadRequest, codeMoreData, err)
+		}
+
+		// the session is still active, so the client can finish the file and close again
+		if _, err := s.ResumeFile(ctx, testURL+"half.txt", strings.NewReader("data"), 4); err != nil {
+			t.Fatalf("failed to finish the file: %v", err)
+		}
+		if _, err := s.Close(ctx); err != nil {
+			t.Errorf("expected close to succeed, got %v", err)
+		}
+	})
+
+	t.Run("lenient", func(t *testing.T) {
+		audit := &syncBuffer{}
+		var incomplete []string
+		var h *Handler
+		h = newTestHandler(t, Config{AuditWriter: audit, PreservePath: true, PathPrefix: "/BITS/"}, func(event Event, session, path string) {
+			if event == EventCloseSession {
+				incomplete, _ = h.IncompleteFiles(session)
+			}
+		})
+		ctx := context.Background()
+		s := clientSession(t, h)
+
+		// a file that is done, one cut short on the wire, and one only asked for its progress
+		if _, err := s.SendFile(ctx, testURL+"done.txt", strings.NewReader("data"), 4); err != nil {
+			t.Fatalf("fragment failed: %v", err)
+		}
+		res := sendFragment(h, s.ID, "dir/half.txt", []byte("da"), 0, 4)
+		res.Body.Close()
+		if _, err := s.Received(ctx, testURL+"started.txt", 4); err != nil {
+			t.Fatalf("query failed: %v", err)
+		}
+		if _, err := s.Close(ctx); err != nil {
+			t.Fatalf("close failed: %v", err)
+		}
+
+		expected := []string{"dir/half.txt", "started.txt"}
+		if !reflect.DeepEqual(incomplete, expected) {
+			t.Errorf("expected incomplete files %v, got %v", expected, incomplete)
+		}
+
+		deadline := time.Now().Add(time.Second)
+		for !strings.Contains(audit.String(), "close-session") && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if !strings.Contains(audit.String(), `"incomplete":["dir/half.txt","started.txt"]`) {
+			t.Errorf("expected the incomplete files in the audit log: %v", audit.String())
+		}
+	})
+
+}
+
+func TestFragmentLengthChanged(t *testing.T) {
+
+	testcases := []struct {
+		name   string
+		start  uint64
+		data   string
+		length uint64
+		status int
+	}{
+		{name: "same", start: 4, data: "4567", length: 10, status: http.StatusOK},
+		{name: "growing", start: 4, data: "4567", length: 20, status: http.StatusBadRequest},
+		{name: "shrinking", start: 4, data: "4567", length: 8, status: http.StatusBadRequest},
+		{name: "completing early", start: 4, data: "45", length: 6, status: http.StatusBadRequest},
+		{name: "over max size", start: 4, data: "4567", length: 100, status: http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tc := range testcases {
+
+		t.Run(tc.name, func(t *testing.T) {
+			var received bool
+			h := newTestHandler(t, Config{MaxSize: 50}, func(event Event, session, path string) {
+				received = received || event == EventRecieveFile
+			})
+			uuid := createSession(t, h)
+
+			res := sendFragment(h, uuid, "file.txt", []byte("0123"), 0, 10)
+			res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("first fragment failed: %v", res.Status)
+			}
+
+			res = sendFragment(h, uuid, "file.txt", []byte(tc.data), tc.start, tc.length)
+			res.Body.Close()
+			if res.StatusCode != tc.status {
+				t.Errorf("expected status %v, got %v", tc.status, res.StatusCode)
+			}
+			if tc.status == http.StatusBadRequest && res.Header.Get("BITS-Error-Code") != "8007000d" {
+				t.Errorf("expected error code 8007000d, got %q", res.Header.Get("BITS-Error-Code"))
+			}
+			if received {
+				t.Error("file completed")
+			}
+
+			// queries must declare the same length too
+			res = doPacket(h, "Fragment", uuid, "/BITS/file.txt", map[string]string{
+				"Content-Range":  fmt.Sprintf("bytes */%d", tc.length),
+				"Content-Length": "0",
+			}, nil)
+			res.Body.Close()
+			if res.StatusCode != tc.status {
+				t.Errorf("expected query status %v, got %v", tc.status, res.StatusCode)
+			}
+		})
+	}
+
+	// a completed file may be uploaded again with another length
+	h := newTestHandler(t, Config{}, nil)
+	uuid := createSession(t, h)
+	for _, data := range []string{"0123", "012345"} {
+		res := sendFragment(h, uuid, "file.txt", []byte(data), 0, uint64(len(data)))
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("upload of %v bytes failed: %v", len(data), res.Status)
+		}
+	}
+
+}
+
+func TestFragmentFinalRetry(t *testing.T) {
+
+	testcases := []struct {
+		name      string
+		strict    bool
+		fragments []string
+	}{
+		{name: "lenient", fragments: []string{"01234", "56789"}},
+		{name: "strict", strict: true, fragments: []string{"01234", "56789"}},
+		{name: "single fragment", fragments: []string{"0123456789"}},
+		{name: "single fragment strict", strict: true, fragments: []string{"0123456789"}},
+		{name: "empty", fragments: []string{""}},
+	}
+
+	for _, tc := range testcases {
+
+		t.Run(tc.name, func(t *testing.T) {
+			var received int
+			h := newTestHandler(t, Config{StrictRanges: tc.strict}, func(event Event, session, path string) {
+				if event == EventRecieveFile {
+					received++
+				}
+			})
+			uuid := createSession(t, h)
+
+			length := uint64(len(strings.Join(tc.fragments, "")))
+			send := func(start uint64, data string) *http.Response {
+				if length == 0 {
+					return doPacket(h, "Fragment", uuid, "/BITS/file.txt", map[string]string{
+						"Content-Range":  "bytes 0-0/0",
+						"Content-Length": "0",
+					}, nil)
+				}
+				return sendFragment(h, uuid, "file.txt", []byte(data), start, length)
+			}
+
+			var start uint64
+			for _, f := range tc.fragments[:len(tc.fragments)-1] {
+				res := send(start, f)
+				res.Body.Close()
+				start += uint64(len(f))
+			}
+
+			// the final fragment is sent twice
+			last := tc.fragments[len(tc.fragments)-1]
+			for i := 0; i < 2; i++ {
+				res := send(start, last)
+				res.Body.Close()
+				if res.StatusCode != http.StatusOK {
+					t.Errorf("final fragment %v failed: %v", i, res.Status)
+				}
+				if received := res.Header.Get("BITS-Received-Content-Range"); received != strconv.FormatUint(length, 10) {
+					t.Errorf("final fragment %v: expected received range %v, got %v", i, length, received)
+				}
+			}
+			if received != 1 {
+				t.Errorf("expected the file to be received once, got %v", received)
+			}
+		})
+	}
+
+}
+
+func TestFragmentUnknownLength(t *testing.T) {
+
+	type fragment struct {
+		contentRange string
+		data         string
+		status       int
+		received     string
+	}
+
+	testcases := []struct {
+		name      string
+		fragments []fragment
+		completed bool
+	}{
+		{
+			name: "total sent last",
+			fragments: []fragment{
+				{"bytes 0-4/*", "01234", http.StatusOK, "5"},
+				{"bytes 5-9/10", "56789", http.StatusOK, "10"},
+			},
+			completed: true,
+		},
+		{
+			name: "total sent first",
+			fragments: []fragment{
+				{"bytes 0-4/10", "01234", http.StatusOK, "5"},
+				{"bytes 5-9/*", "56789", http.StatusOK, "10"},
+			},
+			completed: true,
+		},
+		{
+			name: "total never sent",
+			fragments: []fragment{
+				{"bytes 0-4/*", "01234", http.StatusOK, "5"},
+				{"bytes 5-9/*", "56789", http.StatusOK, "10"},
+			},
+		},
+		{
+			name: "total less than received",
+			fragments: []fragment{
+				{"bytes 0-9/*", "0123456789", http.StatusOK, "10"},
+				{"bytes 0-4/5", "01234", http.StatusBadRequest, ""},
+			},
+		},
+		{
+			name: "over max size",
+			fragments: []fragment{
+				{"bytes 0-4/*", "01234", http.StatusOK, "5"},
+				{"bytes 5-19/*", "56789abcdefghij", http.StatusRequestEntityTooLarge, ""},
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+
+		t.Run(tc.name, func(t *testing.T) {
+			var received int
+			var h *Handler
+			var incomplete []string
+			h = newTestHandler(t, Config{MaxSize: 16}, func(event Event, session, path string) {
+				switch event {
+				case EventRecieveFile:
+					received++
+				case EventCloseSession:
+					incomplete, _ = h.IncompleteFiles(session)
+				}
+			})
+			uuid := createSession(t, h)
+
+			for _, f := range tc.fragments {
+				res := doPacket(h, "Fragment", uuid, "/BITS/file.txt", map[string]string{
+					"Content-Range":  f.contentRange,
+					"Content-Length": strconv.Itoa(len(f.data)),
+				}, []byte(f.data))
+				res.Body.Close()
+				if res.StatusCode != f.status {
+					t.Errorf("%v: expected status %v, got %v", f.contentRange, f.status, res.StatusCode)
+				}
+				if received := res.Header.Get("BITS-Received-Content-Range"); received != f.received {
+					t.Errorf("%v: expected received range %q, got %q", f.contentRange, f.received, received)
+				}
+			}
+
+			res := doPacket(h, "Close-Session", uuid, "/BITS/", nil, nil)
+			res.Body.Close()
+
+			if tc.completed {
+				if received != 1 || len(incomplete) != 0 {
+					t.Errorf("expected the file to be completed, got %v events and incomplete %v", received, incomplete)
+				}
+				content, err := os.ReadFile(filepath.Join(h.cfg.TempDir, uuid, "file.txt"))
+				if err != nil || string(content) != "0123456789" {
+					t.Errorf("unexpected content %q: %v", content, err)
+				}
+			} else if received != 0 || len(incomplete) != 1 {
+				t.Errorf("expected the file to be incomplete, got %v events and incomplete %v", received, incomplete)
+			}
+		})
+	}
+
+}
+
+func TestShutdown(t *testing.T) {
+
+	var received int32
+	h := newTestHandler(t, Config{}, func(event Event, session, path string) {
+		if event == EventRecieveFile {
+			atomic.AddInt32(&received, 1)
+		}
+	})
+	uuid := createSession(t, h)
+
+	// start a fragment that blocks while its body is read
+	body := &blockingReader{data: []byte("data"), reading: make(chan struct{}), released: make(chan struct{})}
+	reading := body.reading
+	r := httptest.NewRequest(h.cfg.AllowedMethod, "/BITS/file.txt", body)
+	r.Header.Set("BITS-Packet-Type", "Fragment")
+	r.Header.Set("BITS-Session-Id", uuid)
+	r.Header.Set("Content-Range", "bytes 0-3/4")
+	r.Header.Set("Content-Length", "4")
+
+	rec := httptest.NewRecorder()
+	fragmentDone := make(chan struct{})
+	go func() {
+		h.ServeHTTP(rec, r)
+		close(fragmentDone)
+	}()
+	<-reading
+
+	// the fragment keeps shutdown from finishing
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := h.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected shutdown to time out, got %v", err)
+	}
+
+	shutdownDone := make(chan error)
+	go func() {
+		shutdownDone <- h.Shutdown(context.Background())
+	}()
+
+	// new sessions are refused
+	res := doPacket(h, "Create-Session", "", "/BITS/", map[string]string{
+		"BITS-Supported-Protocols": ProtocolUpload15,
+	}, nil)
+	res.Body.Close()
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected status %v, got %v", http.StatusServiceUnavailable, res.StatusCode)
+	}
+
+	// and the fragment finishes
+	close(body.released)
+	if err := <-shutdownDone; err != nil {
+		t.Errorf("shutdown failed: %v", err)
+	}
+	<-fragmentDone
+	if rec.Code != http.StatusOK {
+		t.Errorf("fragment failed: %v", rec.Code)
+	}
+	if atomic.LoadInt32(&received) != 1 {
+		t.Error("file was never received")
+	}
+
+	// shutting down an idle handler returns right away
+	if err := h.Shutdown(context.Background()); err != nil {
+		t.Errorf("shutdown failed: %v", err)
+	}
+
+}
+
+func TestFragmentFinalOvershoot(t *testing.T) {
+
+	testcases := []struct {
+		name  string
+		final string
+	}{
+		{"exact", "6789"},
+		{"overshoot", "6789garbage"},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			var received string
+			h := newTestHandler(t, Config{}, func(event Event, session, path string) {
+				if event == EventRecieveFile {
+					received = path
+				}
+			})
+			uuid := createSession(t, h)
+
+			res := sendFragment(h, uuid, "file.txt", []byte("012345"), 0, 10)
+			res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("first fragment failed: %v", res.Status)
+			}
+
+			res = sendFragment(h, uuid, "file.txt", []byte(tc.final), 6, 10)
+			res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("final fragment failed: %v", res.Status)
+			}
+			if got := res.Header.Get("BITS-Received-Content-Range"); got != "10" {
+				t.Errorf("expected 10 bytes received, got %v", got)
+			}
+			if received == "" {
+				t.Fatal("file was never received")
+			}
+			if data, err := os.ReadFile(received); err != nil || string(data) != "0123456789" {
+				t.Errorf("unexpected content %q: %v", data, err)
+			}
+
+			// a retry of the final fragment is acked again
+			received = ""
+			res = sendFragment(h, uuid, "file.txt", []byte(tc.final), 6, 10)
+			res.Body.Close()
+			if res.StatusCode != http.StatusOK || received != "" {
+				t.Errorf("retried final fragment: status %v, received %q", res.Status, received)
+			}
+		})
+	}
+
+	// a fragment can't start beyond the end of the file
+	h := newTestHandler(t, Config{}, nil)
+	uuid := createSession(t, h)
+	res := sendFragment(h, uuid, "file.txt", []byte("0123"), 0, 10)
+	res.Body.Close()
+	res = sendFragment(h, uuid, "file.txt", []byte("0123"), 10, UnknownLength)
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status %v, got %v", http.StatusBadRequest, res.StatusCode)
+	}
+}
+
+func TestSessionRequest(t *testing.T) {
+
+	var correlation []string
+	h := newTestHandler(t, Config{
+		SessionCallback: func(event Event, s Session) {
+			if event == EventRecieveFile {
+				correlation = append(correlation, s.Request.Header.Get("X-Correlation-Id"))
+			}
+			if event == EventCancelSession && s.Request != nil {
+				t.Error("terminated session with a request")
+			}
+		},
+	}, nil)
+	c := testClient(h)
+	c.Header = http.Header{"X-Correlation-Id": {"job-42"}}
+	ctx := context.Background()
+	s, err := c.CreateSession(ctx, testURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the headers of the fragment completing the file are available in the callback
+	if _, err = s.SendFile(ctx, testURL+"file.txt", strings.NewReader("data"), 4); err != nil {
+		t.Fatalf("fragment failed: %v", err)
+	}
+	if len(correlation) != 1 || correlation[0] != "job-42" {
+		t.Errorf("expected the correlation id job-42, got %v", correlation)
+	}
+	if err := h.TerminateSession(s.ID); err != nil {
+		t.Fatal(err)
+	}
+
+}
+
+func TestServerHeader(t *testing.T) {
+
+	testcases := []struct {
+		name     string
+		header   string
+		expected string
+	}{
+		{name: "default", expected: "gobits/" + Version},
+		{name: "custom", header: "uploads/2.1", expected: "uploads/2.1"},
+		{name: "disabled", header: "-", expected: ""},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newTestHandler(t, Config{ServerHeader: tc.header}, nil)
+
+			res := doPacket(h, "Create-Session", "", "/BITS/", map[string]string{
+				"BITS-Supported-Protocols": h.cfg.Protocol,
+			}, nil)
+			res.Body.Close()
+			uuid := res.Header.Get("BITS-Session-Id")
+			responses := map[string]*http.Response{"create": res}
+			responses["fragment"] = sendFragment(h, uuid, "file.txt", []byte("data"), 0, 4)
+			responses["fragment"].Body.Close()
+			responses["close"] = doPacket(h, "Close-Session", uuid, "/BITS/", nil, nil)
+			responses["close"].Body.Close()
+
+			for packet, res := range responses {
+				if res.StatusCode != http.StatusOK {
+					t.Errorf("%v failed: %v", packet, res.Status)
+				}
+				if _, ok := res.Header["Server"]; ok != (tc.expected != "") || res.Header.Get("Server") != tc.expected {
+					t.Errorf("%v: expected Server %q, got %q", packet, tc.expected, res.Header.Get("Server"))
+				}
+			}
+		})
+	}
+
+}
+
+func TestSessionNotFound(t *testing.T) {
+
+	h := newTestHandler(t, Config{}, nil)
+	unknown, err := newUUID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	notFound := strconv.FormatUint(codeSessionNotFound, 16)
+
+	testcases := []struct {
+		name    string
+		session string
+		status  int
+		code    string
+	}{
+		{name: "unknown session", session: unknown, status: http.StatusNotFound, code: notFound},
+		{name: "missing session header", status: http.StatusBadRequest, code: "0"},
+		{name: "malformed session id", session: "not-a-session", status: http.StatusBadRequest, code: "0"},
+	}
+
+	for _, tc := range testcases {
+		for _, packet := range []string{"Fragment", "Close-Session", "Cancel-Session"} {
+			var res *http.Response
+			if packet == "Fragment" {
+				res = sendFragment(h, tc.session, "file.txt", []byte("data"), 0, 4)
+			} else {
+				res = doPacket(h, packet, tc.session, "/BITS/", nil, nil)
+			}
+			res.Body.Close()
+			if res.StatusCode != tc.status {
+				t.Errorf("%v, %v: expected status %v, got %v", tc.name, packet, tc.status, res.StatusCode)
+			}
+			if code := res.Header.Get("BITS-Error-Code"); code != tc.code {
+				t.Errorf("%v, %v: expected error code %v, got %v", tc.name, packet, tc.code, code)
+			}
+		}
+	}
+
+}
+
+func TestCloseSessionDelete(t *testing.T) {
+
+	for _, deleteOnClose := range []bool{false, true} {
+		t.Run(fmt.Sprintf("delete %v", deleteOnClose), func(t *testing.T) {
+			var received []byte
+			var dir string
+			h := newTestHandler(t, Config{DeleteOnClose: deleteOnClose, MaxTempDirSize: 100}, func(event Event, session, path string) {
+				if event == EventCloseSession {
+					dir = path
+					received, _ = os.ReadFile(filepath.Join(path, "file.txt"))
+				}
+			})
+			ctx := context.Background()
+			s := clientSession(t, h)
+			if _, err := s.SendFile(ctx, testURL+"file.txt", strings.NewReader("data"), 4); err != nil {
+				t.Fatalf("fragment failed: %v", err)
+			}
+			if _, err := s.Close(ctx); err != nil {
+				t.Fatalf("close failed: %v", err)
+			}
+
+			// the callback always gets the files, they are only kept for the app without DeleteOnClose
+			if string(received) != "data" {
+				t.Errorf("expected the callback to read the file, got %q", received)
+			}
+			_, err := os.Stat(filepath.Join(dir, "file.txt"))
+			if deleteOnClose && !os.IsNotExist(err) {
+				t.Errorf("expected the session directory to be removed, got %v", err)
+			} else if !deleteOnClose && err != nil {
+				t.Errorf("expected the file to be kept, got %v", err)
+			}
+
+			// removed files no longer count towards MaxTempDirSize
+			h.mu.Lock()
+			usage := h.usage
+			h.mu.Unlock()
+			if want := map[bool]uint64{false: 4, true: 0}[deleteOnClose]; usage != want {
+				t.Errorf("expected %v bytes in use, got %v", want, usage)
+			}
+		})
+	}
+}
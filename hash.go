@@ -0,0 +1,79 @@
+package gobits
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+)
+
+// HashAlgorithm is the hash computed of received files when Config.HashFiles is set
+type HashAlgorithm int
+
+// Algorithms for hashing received files
+const (
+	HashSHA256 HashAlgorithm = 0 // SHA-256
+	HashSHA1   HashAlgorithm = 1 // SHA-1
+	HashMD5    HashAlgorithm = 2 // MD5
+)
+
+// get a function creating hashes of an algorithm
+func (a HashAlgorithm) new() (func() hash.Hash, error) {
+	switch a {
+	case HashSHA256:
+		return sha256.New, nil
+	case HashSHA1:
+		return sha1.New, nil
+	case HashMD5:
+		return md5.New, nil
+	}
+	return nil, fmt.Errorf("unknown hash algorithm %d", a)
+}
+
+// fileHash is the running hash of a file being received
+type fileHash struct {
+	hash.Hash
+	size uint64 // number of bytes hashed
+}
+
+// add the data of a fragment to the running hash of a file, where size bytes were received
+// before the fragment. If the hash isn't at that size, e.g. after a restart, it is computed
+// from the part file again
+func (b *Handler) hashFragment(s *session, src, part string, size uint64, data []byte) error {
+	h := s.hashes[src]
+	if h == nil || h.size != size {
+		h = &fileHash{Hash: b.newHash()}
+		if size > 0 {
+			f, err := b.fs.OpenFile(part, os.O_RDONLY, 0)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			if _, err = io.CopyN(h, f, int64(size)); err != nil {
+				return err
+			}
+			h.size = size
+		}
+		if s.hashes == nil {
+			s.hashes = make(map[string]*fileHash)
+		}
+		s.hashes[src] = h
+	}
+	h.Write(data)
+	h.size += uint64(len(data))
+	return nil
+}
+
+// get the hex digest of a completed file, and stop hashing it
+func (s *session) digest(src string) string {
+	h, ok := s.hashes[src]
+	if !ok {
+		return ""
+	}
+	delete(s.hashes, src)
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,70 @@
+package gobits
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHashFiles(t *testing.T) {
+
+	content := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+
+	testcases := []struct {
+		name      string
+		algorithm HashAlgorithm
+		hash      func() hash.Hash
+		restart   bool
+	}{
+		{name: "sha256", algorithm: HashSHA256, hash: sha256.New},
+		{name: "sha1", algorithm: HashSHA1, hash: sha1.New},
+		{name: "md5", algorithm: HashMD5, hash: md5.New},
+		{name: "restarted", algorithm: HashSHA256, hash: sha256.New, restart: true},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			var digests []string
+			cb := func(event Event, s Session) {
+				if event == EventRecieveFile {
+					digests = append(digests, s.Hash)
+				}
+			}
+			h := newTestHandler(t, Config{HashFiles: true, HashAlgorithm: tc.algorithm, SessionCallback: cb}, nil)
+			uuid := createSession(t, h)
+
+			// the second fragment overlaps the first
+			for i, f := range []struct{ start, end uint64 }{{0, 10}, {5, 20}, {20, 36}} {
+				if i == 2 && tc.restart {
+					h = restartHandler(t, h, nil)
+				}
+				res := sendFragment(h, uuid, "file.txt", content[f.start:f.end], f.start, uint64(len(content)))
+				res.Body.Close()
+				if res.StatusCode != http.StatusOK {
+					t.Fatalf("fragment %v failed: %v", i, res.Status)
+				}
+			}
+
+			data, err := os.ReadFile(filepath.Join(h.cfg.TempDir, uuid, "file.txt"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := tc.hash()
+			expected.Write(data)
+			if len(digests) != 1 || digests[0] != hex.EncodeToString(expected.Sum(nil)) {
+				t.Errorf("expected digest %x, got %v", expected.Sum(nil), digests)
+			}
+		})
+	}
+
+	if _, err := NewHandler(Config{HashFiles: true, HashAlgorithm: 42}, nil); err == nil {
+		t.Error("expected an unknown hash algorithm to fail")
+	}
+
+}
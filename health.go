@@ -0,0 +1,95 @@
+package gobits
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// How long the result of probing the TempDir is reused, so frequent health checks don't write a
+// file each
+const healthProbeInterval = 5 * time.Second
+
+// health is the body of a health check
+type health struct {
+	Status          string `json:"status"` // ok, or unavailable
+	ActiveSessions  int    `json:"active_sessions"`
+	TempDirWritable bool   `json:"temp_dir_writable"`
+	ShuttingDown    bool   `json:"shutting_down"`
+}
+
+// HealthHandler returns a handler for health checks, e.g. by a load balancer. It isn't a BITS
+// handler, so mount it on its own path, or set Config.HealthPath. It replies 200 with a JSON
+// object of the state of the handler, or 503 if files can't be written to the TempDir or the
+// handler is shutting down
+func (b *Handler) HealthHandler() http.Handler {
+	return http.HandlerFunc(b.serveHealth)
+}
+
+// reply to a health check
+func (b *Handler) serveHealth(w http.ResponseWriter, r *http.Request) {
+	b.activeMu.Lock()
+	active := len(b.active)
+	b.activeMu.Unlock()
+
+	h := health{
+		Status:          "ok",
+		ActiveSessions:  active,
+		TempDirWritable: b.tempDirWritable(),
+		ShuttingDown:    b.shuttingDown(),
+	}
+	status := http.StatusOK
+	if !h.TempDirWritable || h.ShuttingDown {
+		h.Status = "unavailable"
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		json.NewEncoder(w).Encode(h)
+	}
+}
+
+// check if a request is a health check, a GET or HEAD of the HealthPath
+func (b *Handler) isHealthCheck(r *http.Request) bool {
+	return b.cfg.HealthPath != "" && r.URL.Path == b.cfg.HealthPath &&
+		(r.Method == http.MethodGet || r.Method == http.MethodHead)
+}
+
+// check that a file can be created in the TempDir, probing it at most once per interval
+func (b *Handler) tempDirWritable() bool {
+	b.healthMu.Lock()
+	defer b.healthMu.Unlock()
+	if b.probedAt.IsZero() || time.Since(b.probedAt) >= healthProbeInterval {
+		b.probeErr = probeTempDir(b.fs, b.cfg.TempDir)
+		b.probedAt = time.Now()
+	}
+	return b.probeErr == nil
+}
+
+// create the TempDir if it doesn't exist, and make sure files can be written to it
+func checkTempDir(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	return probeTempDir(osFS{}, dir)
+}
+
+// write and remove a file in the TempDir
+func probeTempDir(fs fileSystem, dir string) error {
+	id, err := newUUID()
+	if err != nil {
+		return err
+	}
+	name := filepath.Join(dir, ".gobits-health-"+id)
+	f, err := fs.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return fs.Remove(name)
+}
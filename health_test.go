@@ -0,0 +1,139 @@
+package gobits
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// get the health of a handler
+func checkHealth(t *testing.T, h *Handler) (int, health) {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	h.HealthHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	var body health
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("invalid health %q: %v", rec.Body.String(), err)
+	}
+	return rec.Code, body
+}
+
+func TestHealthHandler(t *testing.T) {
+
+	h := newTestHandler(t, Config{}, nil)
+	createSession(t, h)
+	createSession(t, h)
+
+	status, body := checkHealth(t, h)
+	if status != http.StatusOK || body != (health{Status: "ok", ActiveSessions: 2, TempDirWritable: true}) {
+		t.Errorf("unexpected health %v %+v", status, body)
+	}
+
+	// the probe file is removed
+	entries, err := os.ReadDir(h.cfg.TempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("expected only the session directories in the TempDir, got %v", entries)
+	}
+
+	// a GET isn't a BITS request
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected the BITS handler to refuse the health check, got %v", rec.Code)
+	}
+
+	// a handler shutting down is taken out of rotation
+	h.Shutdown(context.Background())
+	if status, body = checkHealth(t, h); status != http.StatusServiceUnavailable || !body.ShuttingDown {
+		t.Errorf("unexpected health while shutting down %v %+v", status, body)
+	}
+
+}
+
+func TestHealthHandlerUnwritable(t *testing.T) {
+
+	h := newTestHandler(t, Config{}, nil)
+
+	// the TempDir is gone
+	h.cfg.TempDir = filepath.Join(h.cfg.TempDir, "missing")
+	status, body := checkHealth(t, h)
+	if status != http.StatusServiceUnavailable || body.Status != "unavailable" || body.TempDirWritable {
+		t.Errorf("unexpected health %v %+v", status, body)
+	}
+
+}
+
+func TestHealthHandlerFileSystem(t *testing.T) {
+
+	fs := &memFS{}
+	h := newTestHandler(t, Config{}, nil).WithFileSystem(fs)
+
+	// the probe goes through the file system, and removes its file
+	if status, body := checkHealth(t, h); status != http.StatusOK || !body.TempDirWritable {
+		t.Errorf("unexpected health %v %+v", status, body)
+	}
+	if len(fs.files) != 0 {
+		t.Errorf("expected the probe file to be removed, got %v", fs.files)
+	}
+
+	// the result is reused for a while
+	fs.openErr = os.ErrPermission
+	if status, body := checkHealth(t, h); status != http.StatusOK || !body.TempDirWritable {
+		t.Errorf("expected the last probe to be reused, got %v %+v", status, body)
+	}
+
+	// and probed again once it is stale
+	h.probedAt = h.probedAt.Add(-healthProbeInterval)
+	if status, body := checkHealth(t, h); status != http.StatusServiceUnavailable || body.TempDirWritable {
+		t.Errorf("unexpected health %v %+v", status, body)
+	}
+
+}
+
+func TestHealthPath(t *testing.T) {
+
+	h := newTestHandler(t, Config{HealthPath: "/BITS/healthz"}, nil)
+
+	get := func(method string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, "/BITS/healthz", nil))
+		return rec
+	}
+
+	rec := get(http.MethodGet)
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected status %v, got %v", http.StatusOK, rec.Code)
+	}
+	var body health
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Status != "ok" {
+		t.Errorf("unexpected health %q: %v", rec.Body.String(), err)
+	}
+	if rec = get(http.MethodHead); rec.Code != http.StatusOK || rec.Body.Len() != 0 {
+		t.Errorf("unexpected HEAD reply %v %q", rec.Code, rec.Body.String())
+	}
+
+	// BITS requests to the path are still handled as BITS
+	res := doPacket(h, "Ping", "", "/BITS/healthz", nil, nil)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || res.Header.Get("BITS-Packet-Type") != "Ack" {
+		t.Errorf("expected the ping to be acknowledged, got %v", res.Status)
+	}
+	if rec = get(http.MethodPut); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status %v, got %v", http.StatusMethodNotAllowed, rec.Code)
+	}
+
+	// not ready while shutting down
+	h.Shutdown(context.Background())
+	if rec = get(http.MethodGet); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status %v while shutting down, got %v", http.StatusServiceUnavailable, rec.Code)
+	}
+
+}
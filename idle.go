@@ -0,0 +1,46 @@
+package gobits
+
+import "time"
+
+// watchdog terminates the session of a file that doesn't get a fragment in time
+type watchdog struct {
+	timer *time.Timer
+}
+
+// start or restart the watchdog of a file, when a fragment is written to it and it isn't
+// complete. The session must be locked
+func (b *Handler) watchFile(s *session, uuid, src string) {
+	s.unwatch(src)
+	w := &watchdog{}
+	w.timer = time.AfterFunc(b.cfg.FragmentIdleTimeout, func() {
+		b.fileIdle(uuid, src, w)
+	})
+	if s.watchdogs == nil {
+		s.watchdogs = make(map[string]*watchdog)
+	}
+	s.watchdogs[src] = w
+}
+
+// stop the watchdog of a file, it is complete or abandoned
+func (s *session) unwatch(src string) {
+	if w, ok := s.watchdogs[src]; ok {
+		w.timer.Stop()
+		delete(s.watchdogs, src)
+	}
+}
+
+// terminate the session of a file that didn't get a fragment for the FragmentIdleTimeout, unless
+// the watchdog was stopped or restarted while it fired. That is checked with the session locked
+// for the termination, so a fragment arriving meanwhile either restarts the watchdog first or
+// finds the session gone
+func (b *Handler) fileIdle(uuid, src string, w *watchdog) {
+	b.mu.Lock()
+	_, ok := b.sessions[uuid]
+	b.mu.Unlock()
+	if !ok {
+		return
+	}
+	b.terminate(uuid, sessionExpired, func(s *session) bool {
+		return s.state == sessionActive && s.watchdogs[src] == w
+	})
+}
@@ -0,0 +1,111 @@
+package gobits
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFragmentIdleTimeout(t *testing.T) {
+
+	canceled := make(chan string, 1)
+	h := newTestHandler(t, Config{FragmentIdleTimeout: 50 * time.Millisecond}, func(event Event, session, path string) {
+		if event == EventCancelSession {
+			canceled <- session
+		}
+	})
+
+	// fragments arriving in time keep the session
+	uuid := createSession(t, h)
+	for start := 0; start < 10; start += 2 {
+		res := sendFragment(h, uuid, "steady.txt", []byte("0123456789")[start:start+2], uint64(start), 10)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("fragment at %v failed: %v", start, res.Status)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// a complete file isn't watched anymore
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case session := <-canceled:
+		t.Fatalf("session %v canceled with the file complete", session)
+	default:
+	}
+
+	// a file stalling after its first fragment cancels the session
+	res := sendFragment(h, uuid, "stalled.txt", []byte("01234"), 0, 10)
+	res.Body.Close()
+	select {
+	case session := <-canceled:
+		if session != uuid {
+			t.Errorf("expected session %v to be canceled, got %v", uuid, session)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("session not canceled")
+	}
+	if _, err := os.Stat(filepath.Join(h.cfg.TempDir, uuid)); !os.IsNotExist(err) {
+		t.Errorf("partial data left behind: %v", err)
+	}
+	res = sendFragment(h, uuid, "stalled.txt", []byte("56789"), 5, 10)
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound || res.Header.Get("BITS-Error-Code") != "80070490" {
+		t.Errorf("expected the session to be gone, got %v %v", res.Status, res.Header.Get("BITS-Error-Code"))
+	}
+
+}
+
+func TestFragmentIdleRestarted(t *testing.T) {
+
+	canceled := make(chan string, 1)
+	h := newTestHandler(t, Config{FragmentIdleTimeout: time.Hour}, func(event Event, session, path string) {
+		if event == EventCancelSession {
+			canceled <- session
+		}
+	})
+	uuid := createSession(t, h)
+	res := sendFragment(h, uuid, "file.txt", []byte("01234"), 0, 10)
+	res.Body.Close()
+
+	// get the watchdog of the file
+	watched := func() (string, *watchdog) {
+		s := h.lockSession(uuid)
+		defer s.mu.Unlock()
+		for src, w := range s.watchdogs {
+			return src, w
+		}
+		t.Fatal("file not watched")
+		return "", nil
+	}
+	src, stale := watched()
+
+	// a watchdog firing after a fragment restarted it leaves the session alone
+	res = sendFragment(h, uuid, "file.txt", []byte("567"), 5, 10)
+	res.Body.Close()
+	h.fileIdle(uuid, src, stale)
+	select {
+	case session := <-canceled:
+		t.Fatalf("session %v terminated by a stale watchdog", session)
+	default:
+	}
+
+	// the current one terminates it
+	_, current := watched()
+	h.fileIdle(uuid, src, current)
+	select {
+	case session := <-canceled:
+		if session != uuid {
+			t.Errorf("expected session %v to be terminated, got %v", uuid, session)
+		}
+	default:
+		t.Fatal("session not terminated")
+	}
+	res = sendFragment(h, uuid, "file.txt", []byte("89"), 8, 10)
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("expected the session to be gone, got %v", res.Status)
+	}
+}
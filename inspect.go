@@ -0,0 +1,67 @@
+package gobits
+
+import (
+	"io"
+	"os"
+)
+
+// InspectorFactory creates an inspector for a file, which gets every byte of the file in order
+// while it is received. The total size is UnknownLength if the client didn't send it. The
+// inspector is closed when the file is complete, and an error from Write or Close rejects the
+// file. If a file is abandoned, e.g. when the session is closed before it is complete, the
+// inspector is closed too and its error ignored
+type InspectorFactory func(session, filename string, totalSize uint64) (io.WriteCloser, error)
+
+// inspector is the inspector of a file being received
+type inspector struct {
+	io.WriteCloser
+	size uint64 // number of bytes written to the inspector
+}
+
+// pass the data of a fragment to the inspector of a file, where size bytes were received before
+// the fragment. The inspector is created for the first fragment. If it isn't at that size,
+// e.g. after a restart, a new inspector gets the part file first
+func (b *Handler) inspectFragment(s *session, uuid, filename, src, part string, length, size uint64, data []byte) error {
+	in := s.inspectors[src]
+	if in == nil || in.size != size {
+		if in != nil {
+			in.Close()
+		}
+		w, err := b.cfg.InspectorFactory(uuid, filename, length)
+		if err != nil {
+			delete(s.inspectors, src)
+			return err
+		}
+		in = &inspector{WriteCloser: w}
+		if s.inspectors == nil {
+			s.inspectors = make(map[string]*inspector)
+		}
+		s.inspectors[src] = in
+		if size > 0 {
+			f, err := b.fs.OpenFile(part, os.O_RDONLY, 0)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			if _, err = io.CopyN(in, f, int64(size)); err != nil {
+				return err
+			}
+			in.size = size
+		}
+	}
+	if _, err := in.Write(data); err != nil {
+		return err
+	}
+	in.size += uint64(len(data))
+	return nil
+}
+
+// close the inspector of a completed file, returning its verdict
+func (s *session) closeInspector(src string) error {
+	in, ok := s.inspectors[src]
+	if !ok {
+		return nil
+	}
+	delete(s.inspectors, src)
+	return in.Close()
+}
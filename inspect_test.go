@@ -0,0 +1,150 @@
+package gobits
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// countingInspector counts the bytes it is given
+type countingInspector struct {
+	n      *int
+	closed *int
+}
+
+func (c countingInspector) Write(p []byte) (int, error) {
+	*c.n += len(p)
+	return len(p), nil
+}
+
+func (c countingInspector) Close() error {
+	*c.closed++
+	return nil
+}
+
+// patternInspector keeps what it is given, and rejects it on Close if it contains the pattern
+type patternInspector struct {
+	bytes.Buffer
+	pattern []byte
+}
+
+func (p *patternInspector) Close() error {
+	if bytes.Contains(p.Bytes(), p.pattern) {
+		return &RejectError{Code: 0x800700E1, Reason: "file contains a virus"}
+	}
+	return nil
+}
+
+func TestInspectorCounts(t *testing.T) {
+
+	content := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+
+	for _, restart := range []bool{false, true} {
+		t.Run(fmt.Sprintf("restart %v", restart), func(t *testing.T) {
+			var created, counted, closed int
+			var total uint64
+			factory := func(session, filename string, totalSize uint64) (io.WriteCloser, error) {
+				created++
+				total = totalSize
+				counted = 0
+				return countingInspector{n: &counted, closed: &closed}, nil
+			}
+			h := newTestHandler(t, Config{InspectorFactory: factory}, nil)
+			uuid := createSession(t, h)
+
+			// the second fragment overlaps the first, the inspector sees each byte once
+			for i, f := range []struct{ start, end uint64 }{{0, 10}, {5, 20}, {20, 36}} {
+				if i == 2 && restart {
+					h = restartHandler(t, h, nil)
+				}
+				res := sendFragment(h, uuid, "file.txt", content[f.start:f.end], f.start, uint64(len(content)))
+				res.Body.Close()
+				if res.StatusCode != http.StatusOK {
+					t.Fatalf("fragment %v failed: %v", i, res.Status)
+				}
+			}
+
+			expected := 1
+			if restart {
+				expected = 2
+			}
+			if created != expected {
+				t.Errorf("expected %v inspectors, got %v", expected, created)
+			}
+			if total != uint64(len(content)) {
+				t.Errorf("expected total size %v, got %v", len(content), total)
+			}
+			if counted != len(content) {
+				t.Errorf("expected %v bytes inspected, got %v", len(content), counted)
+			}
+			if closed != 1 {
+				t.Errorf("expected the inspector to be closed once, got %v", closed)
+			}
+		})
+	}
+
+}
+
+func TestInspectorRejects(t *testing.T) {
+
+	testcases := []struct {
+		name     string
+		content  string
+		rejected bool
+	}{
+		{name: "clean", content: "nothing to see here"},
+		{name: "infected", content: "some EICAR test file", rejected: true},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			var rejected, received bool
+			factory := func(session, filename string, totalSize uint64) (io.WriteCloser, error) {
+				return &patternInspector{pattern: []byte("EICAR")}, nil
+			}
+			h := newTestHandler(t, Config{InspectorFactory: factory}, func(event Event, session, path string) {
+				rejected = rejected || event == EventRejectFile
+				received = received || event == EventRecieveFile
+			})
+			uuid := createSession(t, h)
+
+			// the pattern is split between the fragments
+			data := []byte(tc.content)
+			res := sendFragment(h, uuid, "file.txt", data[:8], 0, uint64(len(data)))
+			res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("first fragment failed: %v", res.Status)
+			}
+			res = sendFragment(h, uuid, "file.txt", data[8:], 8, uint64(len(data)))
+			res.Body.Close()
+
+			src := filepath.Join(h.cfg.TempDir, uuid, "file.txt")
+			if !tc.rejected {
+				if res.StatusCode != http.StatusOK || !received {
+					t.Fatalf("file not received: %v", res.Status)
+				}
+				return
+			}
+			if res.StatusCode != http.StatusBadRequest {
+				t.Fatalf("expected status %v, got %v", http.StatusBadRequest, res.StatusCode)
+			}
+			if code := res.Header.Get("BITS-Error-Code"); code != "800700e1" {
+				t.Errorf("unexpected error code %v", code)
+			}
+			if !rejected || received {
+				t.Errorf("expected the file to be rejected, rejected %v received %v", rejected, received)
+			}
+			for _, name := range []string{src, src + h.cfg.PartSuffix} {
+				if _, err := os.Stat(name); !errors.Is(err, os.ErrNotExist) {
+					t.Errorf("%v not removed: %v", name, err)
+				}
+			}
+		})
+	}
+
+}
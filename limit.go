@@ -0,0 +1,99 @@
+package gobits
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// limitChunk is the most a fragment body reads before waiting for the limiter, so concurrent
+// fragments take turns instead of one large fragment holding up the others
+const limitChunk = 32 << 10
+
+// Limiter limits the rate fragment bodies are read at. WaitN blocks until n bytes may be read,
+// or returns an error if the context is done first. It is satisfied by *rate.Limiter of
+// golang.org/x/time/rate, which must have a burst of at least 32 KiB
+type Limiter interface {
+	WaitN(ctx context.Context, n int) error
+}
+
+// tokenBucket is the Limiter of MaxTotalBytesPerSecond. Each wait reserves its bytes right away,
+// so waiting readers are served in the order they asked
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64   // bytes added per second
+	burst  float64   // most bytes that can be held
+	tokens float64   // bytes available, negative when reserved ahead
+	last   time.Time // when the tokens were last updated
+}
+
+// create a token bucket allowing rate bytes per second, starting full
+func newTokenBucket(rate uint64) *tokenBucket {
+	return &tokenBucket{rate: float64(rate), burst: limitChunk, tokens: limitChunk, last: time.Now()}
+}
+
+// WaitN implements Limiter
+func (t *tokenBucket) WaitN(ctx context.Context, n int) error {
+	t.mu.Lock()
+	now := time.Now()
+	t.tokens += now.Sub(t.last).Seconds() * t.rate
+	if t.tokens > t.burst {
+		t.tokens = t.burst
+	}
+	t.last = now
+	t.tokens -= float64(n)
+	wait := time.Duration(-t.tokens / t.rate * float64(time.Second))
+	t.mu.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		// give back the reservation
+		t.mu.Lock()
+		t.tokens += float64(n)
+		t.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// limitReader reads the body a chunk at a time, and waits for the limiter before the chunk is
+// returned. Reading whole chunks keeps readers asking for small buffers from waiting once per read
+type limitReader struct {
+	r       io.Reader
+	ctx     context.Context
+	limiter Limiter
+	chunk   []byte // what is left of the chunk that was waited for
+	err     error  // the error that ended the body
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	if len(l.chunk) == 0 {
+		if l.err != nil {
+			return 0, l.err
+		}
+		buf := make([]byte, limitChunk)
+		n, err := io.ReadFull(l.r, buf)
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		l.err = err
+		if n == 0 {
+			return 0, err
+		}
+		if err = l.limiter.WaitN(l.ctx, n); err != nil {
+			l.err = err
+			return 0, err
+		}
+		l.chunk = buf[:n]
+	}
+	n := copy(p, l.chunk)
+	l.chunk = l.chunk[n:]
+	return n, nil
+}
@@ -0,0 +1,105 @@
+package gobits
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// chunkLimiter records the chunks it is asked to wait for
+type chunkLimiter struct {
+	mu     sync.Mutex
+	chunks []int
+}
+
+func (c *chunkLimiter) WaitN(ctx context.Context, n int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.chunks = append(c.chunks, n)
+	return nil
+}
+
+func TestLimiterChunks(t *testing.T) {
+
+	limiter := &chunkLimiter{}
+	h := newTestHandler(t, Config{Limiter: limiter}, nil)
+	uuid := createSession(t, h)
+
+	// every byte of the body is waited for, in chunks
+	data := bytes.Repeat([]byte("0123456789abcdef"), 10000)
+	res := sendFragment(h, uuid, "file.bin", data, 0, uint64(len(data)))
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("fragment failed: %v", res.Status)
+	}
+	total := 0
+	for _, n := range limiter.chunks {
+		if n > limitChunk {
+			t.Errorf("chunk of %v bytes is larger than %v", n, limitChunk)
+		}
+		total += n
+	}
+	if total != len(data) {
+		t.Errorf("expected %v bytes limited, got %v", len(data), total)
+	}
+
+}
+
+func TestMaxTotalBytesPerSecond(t *testing.T) {
+
+	const rate = 256 << 10
+	h := newTestHandler(t, Config{MaxTotalBytesPerSecond: rate}, nil)
+
+	// a large fragment, and small ones sent by other sessions while it is read
+	large := bytes.Repeat([]byte("L"), 256<<10)
+	small := bytes.Repeat([]byte("s"), 8<<10)
+	sessions := []string{createSession(t, h), createSession(t, h), createSession(t, h)}
+
+	var wg sync.WaitGroup
+	var largeTook time.Duration
+	smallTook := make([]time.Duration, len(sessions)-1)
+	start := time.Now()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		res := sendFragment(h, sessions[0], "large.bin", large, 0, uint64(len(large)))
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("large fragment failed: %v", res.Status)
+		}
+		largeTook = time.Since(start)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	for i, uuid := range sessions[1:] {
+		wg.Add(1)
+		go func(i int, uuid string) {
+			defer wg.Done()
+			sent := time.Now()
+			res := sendFragment(h, uuid, "small.bin", small, 0, uint64(len(small)))
+			res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				t.Errorf("small fragment failed: %v", res.Status)
+			}
+			smallTook[i] = time.Since(sent)
+		}(i, uuid)
+	}
+	wg.Wait()
+
+	// all of it is limited together, less the burst
+	total := len(large) + len(small)*len(smallTook)
+	min := time.Duration(float64(total-limitChunk) / rate * float64(time.Second))
+	if largeTook < min*9/10 {
+		t.Errorf("expected the fragments to take at least %v, took %v", min, largeTook)
+	}
+
+	// the small fragments don't wait for the large one to be read
+	for i, took := range smallTook {
+		if took > largeTook/2 {
+			t.Errorf("small fragment %v took %v, the large one %v", i, took, largeTook)
+		}
+	}
+
+}
@@ -0,0 +1,161 @@
+package gobits
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// metadataFile is the name of the file in each session directory holding the state of the
+// session, so it survives restarts. Clients can't upload a file with this name
+const metadataFile = ".gobits-session.json"
+
+// sessionMetadata is the content of the metadata file. Paths are slash separated and relative
+// to the session directory
+type sessionMetadata struct {
+	Created   time.Time               `json:"created"`
+	Principal string                  `json:"principal,omitempty"`
+	Remote    string                  `json:"remote,omitempty"`  // address of the client that created the session
+	Headers   map[string]string       `json:"headers,omitempty"` // captured headers of Create-Session
+	Cert      *ClientCert             `json:"client_cert,omitempty"`
+	State     string                  `json:"state,omitempty"`
+	Bytes     uint64                  `json:"bytes,omitempty"` // bytes received in the session
+	Files     map[string]fileMetadata `json:"files,omitempty"`
+	Renamed   map[string]string       `json:"renamed,omitempty"` // stored paths by declared name
+}
+
+// fileMetadata is what is known about a file sent to a session
+type fileMetadata struct {
+	Length    uint64 `json:"length"`
+	Completed bool   `json:"completed,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Type      string `json:"type,omitempty"`
+}
+
+// names of the finished states in the metadata
+var stateNames = map[sessionState]string{
+	sessionClosed:   "closed",
+	sessionCanceled: "canceled",
+	sessionExpired:  "expired",
+}
+
+// load the metadata of a session. Missing or invalid metadata leaves the session as it is, the
+// error is only returned for invalid metadata
+func (s *session) load() error {
+	data, err := os.ReadFile(filepath.Join(s.dir, metadataFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var m sessionMetadata
+	if err = json.Unmarshal(data, &m); err != nil {
+		return err
+	}
+
+	s.created = m.Created
+	s.origin = origin{principal: m.Principal, remote: m.Remote, headers: m.Headers, cert: m.Cert}
+	s.received = m.Bytes
+	for state, name := range stateNames {
+		if m.State == name {
+			s.state = state
+		}
+	}
+	for name, f := range m.Files {
+		src, ok := s.path(name)
+		if !ok {
+			continue
+		}
+		s.announce(src, f.Length)
+		if f.Name != "" {
+			s.claim(src, f.Name)
+		}
+		if f.Type != "" {
+			s.setType(src, f.Type)
+		}
+		if f.Completed {
+			if s.completed == nil {
+				s.completed = make(map[string]bool)
+			}
+			s.completed[src] = true
+		}
+	}
+	for name, stored := range m.Renamed {
+		storedSrc, ok := s.path(stored)
+		if !ok {
+			continue
+		}
+		if s.renamed == nil {
+			s.renamed = make(map[string]string)
+		}
+		s.renamed[name] = storedSrc
+	}
+	return nil
+}
+
+// write the metadata of a session
+func (s *session) save() error {
+	m := sessionMetadata{
+		Created:   s.created,
+		Principal: s.origin.principal,
+		Remote:    s.origin.remote,
+		Headers:   s.origin.headers,
+		Cert:      s.origin.cert,
+		State:     stateNames[s.state],
+		Bytes:     s.received,
+		Files:     make(map[string]fileMetadata),
+		Renamed:   make(map[string]string),
+	}
+	for src, length := range s.lengths {
+		m.Files[s.relative(src)] = fileMetadata{Length: length, Completed: s.completed[src], Name: s.names[src], Type: s.types[src]}
+	}
+	for name, stored := range s.renamed {
+		m.Renamed[name] = s.relative(stored)
+	}
+
+	return writeMetadata(s.dir, m)
+}
+
+// write metadata to a temporary file, and move it in place so it is never half written
+func writeMetadata(dir string, m sessionMetadata) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, metadataFile+".*")
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err = os.Rename(f.Name(), filepath.Join(dir, metadataFile)); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+// get a path relative to the session directory
+func (s *session) relative(src string) string {
+	if rel, err := filepath.Rel(s.dir, src); err == nil {
+		return filepath.ToSlash(rel)
+	}
+	return filepath.Base(src)
+}
+
+// get the absolute path of a relative path in the metadata, false if it isn't in the session directory
+func (s *session) path(name string) (string, bool) {
+	if !validPath(name, true) {
+		return "", false
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(name)), true
+}
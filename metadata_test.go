@@ -0,0 +1,143 @@
+package gobits
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// create a handler using the same directory as another, as if the server was restarted
+func restartHandler(t *testing.T, h *Handler, cb CallbackFunc) *Handler {
+	t.Helper()
+
+	restarted, err := NewHandler(h.cfg, cb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return restarted
+}
+
+func TestSessionMetadata(t *testing.T) {
+
+	h := newTestHandler(t, Config{StrictClose: true}, nil)
+	uuid := createSession(t, h)
+
+	for _, f := range []struct {
+		filename string
+		data     string
+		length   uint64
+	}{{"done.txt", "data", 4}, {"half.txt", "da", 4}} {
+		res := sendFragment(h, uuid, f.filename, []byte(f.data), 0, f.length)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("fragment of %v failed: %v", f.filename, res.Status)
+		}
+	}
+
+	var received []string
+	var incomplete []string
+	var restarted *Handler
+	restarted = restartHandler(t, h, func(event Event, session, path string) {
+		switch event {
+		case EventRecieveFile:
+			received = append(received, filepath.Base(path))
+		case EventCloseSession:
+			incomplete, _ = restarted.IncompleteFiles(session)
+		}
+	})
+
+	// the declared length is remembered
+	res := sendFragment(restarted, uuid, "half.txt", []byte("ta"), 2, 8)
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected a changed length to be rejected, got %v", res.Status)
+	}
+
+	// and so is the completed file, so a retried final fragment is only acked
+	res = sendFragment(restarted, uuid, "done.txt", []byte("data"), 0, 4)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || len(received) != 0 {
+		t.Errorf("expected the retry to be acked without receiving the file, got %v and %v", res.Status, received)
+	}
+
+	// the half file is incomplete
+	res = doPacket(restarted, "Close-Session", uuid, "/BITS/", nil, nil)
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected strict close to fail, got %v", res.Status)
+	}
+	res = sendFragment(restarted, uuid, "half.txt", []byte("ta"), 2, 4)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("last fragment failed: %v", res.Status)
+	}
+	res = doPacket(restarted, "Close-Session", uuid, "/BITS/", nil, nil)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || len(incomplete) != 0 {
+		t.Errorf("expected close to succeed, got %v with incomplete %v", res.Status, incomplete)
+	}
+	if !reflect.DeepEqual(received, []string{"half.txt"}) {
+		t.Errorf("expected half.txt to be received, got %v", received)
+	}
+
+	// closed sessions stay closed
+	restarted = restartHandler(t, h, nil)
+	res = sendFragment(restarted, uuid, "more.txt", []byte("data"), 0, 4)
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("expected a fragment for a closed session to fail, got %v", res.Status)
+	}
+
+}
+
+func TestSessionMetadataInvalid(t *testing.T) {
+
+	testcases := []struct {
+		name     string
+		content  string
+		reported bool
+	}{
+		{name: "corrupt", content: "{not json", reported: true},
+		{name: "escaping paths", content: `{"files":{"../../outside.txt":{"length":8}},"renamed":{"a.txt":"../b.txt"}}`},
+	}
+
+	for _, tc := range testcases {
+
+		t.Run(tc.name, func(t *testing.T) {
+			h := newTestHandler(t, Config{}, nil)
+			uuid := createSession(t, h)
+
+			if err := os.WriteFile(filepath.Join(h.cfg.TempDir, uuid, metadataFile), []byte(tc.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			// the session works as if there was no metadata, invalid metadata is reported
+			var reported []error
+			h.cfg.ErrorHandler = func(err error, r *http.Request) { reported = append(reported, err) }
+			restarted := restartHandler(t, h, nil)
+			res := sendFragment(restarted, uuid, "a.txt", []byte("data"), 0, 4)
+			res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				t.Errorf("fragment failed: %v", res.Status)
+			}
+			if (len(reported) > 0) != tc.reported {
+				t.Errorf("expected the metadata to be reported %v, got %v", tc.reported, reported)
+			}
+			if _, err := os.Stat(filepath.Join(h.cfg.TempDir, uuid, "a.txt")); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+
+	// clients can't overwrite the metadata
+	h := newTestHandler(t, Config{}, nil)
+	uuid := createSession(t, h)
+	res := sendFragment(h, uuid, metadataFile, []byte("{}"), 0, 2)
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected the metadata filename to be rejected, got %v", res.Status)
+	}
+
+}
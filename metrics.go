@@ -0,0 +1,139 @@
+package gobits
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// MetricsCollector receives the metrics of a handler, e.g. to export them to Prometheus. The
+// names are the Metric constants, counters only have the labels documented with them
+type MetricsCollector interface {
+	IncCounter(name string, labels map[string]string, delta float64)
+	SetGauge(name string, value float64)
+	ObserveDuration(name string, d time.Duration)
+}
+
+// Metrics of a handler
+const (
+	MetricSessions         = "gobits_sessions_total"            // Counter of sessions by "event": created, closed, canceled or expired (terminated by the server)
+	MetricFragments        = "gobits_fragments_total"           // Counter of fragments by "result": accepted, or why they are rejected
+	MetricReceivedBytes    = "gobits_received_bytes_total"      // Counter of bytes received, not counting fragments sent again
+	MetricFilesCompleted   = "gobits_files_completed_total"     // Counter of files received completely
+	MetricActiveSessions   = "gobits_active_sessions"           // Gauge of the sessions created since the handler started that are still active and not swept as idle
+	MetricFragmentDuration = "gobits_fragment_duration_seconds" // How long accepted fragments take to read and write
+	MetricWebhooksDropped  = "gobits_webhooks_dropped_total"    // Counter of events that couldn't be delivered to the webhook
+)
+
+// Results of fragments, the "result" label of MetricFragments
+const (
+	FragmentAccepted        = "accepted"          // the fragment is written, or was already received
+	FragmentRejected        = "rejected"          // the file is rejected by a filter, sniffer, inspector or hook
+	FragmentSessionNotFound = "session_not_found" // the session doesn't exist or isn't active
+	FragmentTooLarge        = "too_large"         // the fragment or file is larger than allowed
+	FragmentTimeout         = "timeout"           // the client was too slow sending the fragment
+	FragmentNoSpace         = "no_space"          // the TempDir budget is used up
+	FragmentInvalid         = "invalid"           // the fragment is malformed or conflicts with what is received
+	FragmentError           = "error"             // the server failed to handle the fragment
+)
+
+// noMetrics is the MetricsCollector used when the config doesn't have one
+type noMetrics struct{}
+
+func (noMetrics) IncCounter(name string, labels map[string]string, delta float64) {}
+func (noMetrics) SetGauge(name string, value float64)                             {}
+func (noMetrics) ObserveDuration(name string, d time.Duration)                    {}
+
+// statusWriter records the status of a response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	reason error // why a file is rejected, for the log
+}
+
+func (s *statusWriter) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusWriter) Write(p []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(p)
+}
+
+// Unwrap returns the original ResponseWriter, for use by http.ResponseController
+func (s *statusWriter) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// count a handled fragment by its result
+func (b *Handler) fragmentHandled(w *statusWriter, took time.Duration) {
+	result := fragmentResult(w.status, w.Header().Get("BITS-Error-Code"))
+	b.metrics.IncCounter(MetricFragments, map[string]string{"result": result}, 1)
+	if result == FragmentAccepted {
+		b.metrics.ObserveDuration(MetricFragmentDuration, took)
+	}
+}
+
+// get the result of a fragment from the status and BITS error code of the response
+func fragmentResult(status int, code string) string {
+	switch {
+	case status < http.StatusBadRequest:
+		return FragmentAccepted
+	case status == http.StatusRequestTimeout:
+		return FragmentTimeout
+	case status == http.StatusRequestEntityTooLarge:
+		return FragmentTooLarge
+	case status == http.StatusInsufficientStorage:
+		return FragmentNoSpace
+	case status >= http.StatusInternalServerError:
+		return FragmentError
+	}
+	switch code {
+	case strconv.FormatInt(codeSessionNotFound, 16):
+		return FragmentSessionNotFound
+	case "", "0", strconv.FormatInt(codeInvalidData, 16):
+		return FragmentInvalid
+	}
+	return FragmentRejected
+}
+
+// count the sessions and files of an event
+func (b *Handler) countEvent(event Event, uuid string, server bool) {
+	var label string
+	switch event {
+	case EventCreateSession:
+		label = "created"
+	case EventCloseSession:
+		label = "closed"
+	case EventCancelSession:
+		label = "canceled"
+		if server {
+			label = "expired"
+		}
+	case EventRecieveFile:
+		b.metrics.IncCounter(MetricFilesCompleted, nil, 1)
+		return
+	default:
+		return
+	}
+	b.metrics.IncCounter(MetricSessions, map[string]string{"event": label}, 1)
+
+	// only sessions created since the start are known to be active
+	b.activeMu.Lock()
+	if event == EventCreateSession {
+		if b.active == nil {
+			b.active = make(map[string]bool)
+		}
+		b.active[uuid] = true
+	} else {
+		delete(b.active, uuid)
+	}
+	active := len(b.active)
+	b.activeMu.Unlock()
+	b.metrics.SetGauge(MetricActiveSessions, float64(active))
+}
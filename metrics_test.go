@@ -0,0 +1,106 @@
+package gobits
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeMetrics keeps the metrics it is given
+type fakeMetrics struct {
+	mu        sync.Mutex
+	counters  map[string]float64 // by name and labels
+	gauges    map[string]float64
+	durations map[string]int
+}
+
+func newFakeMetrics() *fakeMetrics {
+	return &fakeMetrics{counters: make(map[string]float64), gauges: make(map[string]float64), durations: make(map[string]int)}
+}
+
+func (f *fakeMetrics) IncCounter(name string, labels map[string]string, delta float64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for k, v := range labels {
+		name += " " + k + "=" + v
+	}
+	f.counters[name] += delta
+}
+
+func (f *fakeMetrics) SetGauge(name string, value float64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.gauges[name] = value
+}
+
+func (f *fakeMetrics) ObserveDuration(name string, d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.durations[name]++
+}
+
+func TestMetrics(t *testing.T) {
+
+	metrics := newFakeMetrics()
+	h := newTestHandler(t, Config{Metrics: metrics, Disallowed: []string{`.*\.exe`}}, nil)
+	uuid := createSession(t, h)
+	other := createSession(t, h)
+	if metrics.gauges[MetricActiveSessions] != 2 {
+		t.Errorf("expected 2 active sessions, got %v", metrics.gauges[MetricActiveSessions])
+	}
+
+	// a file in two fragments, one of them sent twice, and a rejected file
+	for _, f := range []struct {
+		filename string
+		data     string
+		start    uint64
+		status   int
+	}{
+		{filename: "file.txt", data: "01234", start: 0, status: http.StatusOK},
+		{filename: "file.txt", data: "01234", start: 0, status: http.StatusOK},
+		{filename: "file.txt", data: "56789", start: 5, status: http.StatusOK},
+		{filename: "virus.exe", data: "MZ", start: 0, status: http.StatusBadRequest},
+	} {
+		res := sendFragment(h, uuid, f.filename, []byte(f.data), f.start, 10)
+		res.Body.Close()
+		if res.StatusCode != f.status {
+			t.Fatalf("%v at %v: expected status %v, got %v", f.filename, f.start, f.status, res.StatusCode)
+		}
+	}
+	res := doPacket(h, "Close-Session", uuid, "/BITS/", nil, nil)
+	res.Body.Close()
+	if err := h.TerminateSession(other); err != nil {
+		t.Fatal(err)
+	}
+
+	// a fragment for a closed session
+	res = sendFragment(h, uuid, "late.txt", []byte("data"), 0, 4)
+	res.Body.Close()
+
+	expected := map[string]float64{
+		MetricSessions + " event=created":             2,
+		MetricSessions + " event=closed":              1,
+		MetricSessions + " event=expired":             1,
+		MetricFragments + " result=accepted":          3,
+		MetricFragments + " result=rejected":          1,
+		MetricFragments + " result=session_not_found": 1,
+		MetricReceivedBytes:                           10,
+		MetricFilesCompleted:                          1,
+	}
+	for name, value := range expected {
+		if metrics.counters[name] != value {
+			t.Errorf("expected %v to be %v, got %v", name, value, metrics.counters[name])
+		}
+	}
+	if len(metrics.counters) != len(expected) {
+		t.Errorf("unexpected counters: %v", metrics.counters)
+	}
+	if metrics.gauges[MetricActiveSessions] != 0 {
+		t.Errorf("expected no active sessions, got %v", metrics.gauges[MetricActiveSessions])
+	}
+	if metrics.durations[MetricFragmentDuration] != 3 {
+		t.Errorf("expected 3 fragment durations, got %v", metrics.durations[MetricFragmentDuration])
+	}
+
+}
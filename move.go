@@ -0,0 +1,126 @@
+package gobits
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// ErrFileExists is the reason a file is rejected when a file with the same name is already in
+// Config.DestDir and OnCollision is ExistingFileReject
+var ErrFileExists = errors.New("file already exists")
+
+// functions used to move files, replaced by tests to force the fallbacks
+var (
+	linkFile   = os.Link
+	renameFile = os.Rename
+)
+
+// MoveFile moves the file src to dst, replacing dst if it exists. It prefers a hard link and
+// removing src, then renaming src, and falls back to copying it, e.g. to another device
+func MoveFile(src, dst string) error {
+	fs, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if !fs.Mode().IsRegular() {
+		return fmt.Errorf("source must be a file")
+	}
+
+	if fd, err := os.Stat(dst); err == nil {
+		if !fd.Mode().IsRegular() {
+			return fmt.Errorf("destination must be a file")
+		}
+		if os.SameFile(fs, fd) {
+			// No need to move the file, they are the same
+			return nil
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	// Best solution: Create a hard link and remove the old file. Linking fails if dst exists
+	if err = linkFile(src, dst); err == nil {
+		return os.Remove(src)
+	}
+
+	// Ok, try and rename the file (move it)
+	if err = renameFile(src, dst); err == nil {
+		return nil
+	}
+
+	// Failed to move it, then copy it
+	if err = copyFile(src, dst, fs); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// copy the file src to dst, keeping its mode and modification time. The copy is written to a
+// temporary file next to dst and renamed in place, so dst is never half written
+func copyFile(src, dst string, info os.FileInfo) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			out.Close()
+			os.Remove(out.Name())
+		}
+	}()
+
+	if _, err = io.Copy(out, in); err != nil {
+		return err
+	}
+	if err = out.Sync(); err != nil {
+		return err
+	}
+	if err = out.Chmod(info.Mode().Perm()); err != nil {
+		return err
+	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+	if err = os.Chtimes(out.Name(), info.ModTime(), info.ModTime()); err != nil {
+		return err
+	}
+	return os.Rename(out.Name(), dst)
+}
+
+// move a completed file to the destination directory, following the collision policy when a
+// file with the same name is already there. Returns where the file was moved
+func (b *Handler) moveToDest(uuid, src string) (string, error) {
+	dst := filepath.Join(b.cfg.DestDir, filepath.FromSlash(b.sessionPath(uuid, src)))
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return "", err
+	}
+
+	exist, err := exists(dst)
+	if err != nil {
+		return "", err
+	}
+	if exist {
+		switch b.cfg.OnCollision {
+		case ExistingFileReject:
+			return "", ErrFileExists
+		case ExistingFileRename:
+			if dst, err = uniqueFilename(osFS{}, dst, ""); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	if err = MoveFile(src, dst); err != nil {
+		return "", err
+	}
+	return dst, nil
+}
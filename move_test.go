@@ -0,0 +1,278 @@
+package gobits
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestMoveFile(t *testing.T) {
+
+	testcases := []struct {
+		name   string
+		link   bool
+		rename bool
+	}{
+		{name: "link", link: true, rename: true},
+		{name: "rename", rename: true},
+		{name: "copy"},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			// moves to another device fail with EXDEV, and are copied
+			crossDevice := func(oldname, newname string) error {
+				return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: syscall.EXDEV}
+			}
+			if !tc.link {
+				linkFile = crossDevice
+			}
+			if !tc.rename {
+				renameFile = crossDevice
+			}
+			defer func() {
+				linkFile, renameFile = os.Link, os.Rename
+			}()
+
+			dir := t.TempDir()
+			src := filepath.Join(dir, "src.txt")
+			dst := filepath.Join(dir, "dst.txt")
+			mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+			if err := os.WriteFile(src, []byte("data"), 0640); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(src, mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := MoveFile(src, dst); err != nil {
+				t.Fatal(err)
+			}
+			if exist, _ := exists(src); exist {
+				t.Error("source is still there")
+			}
+			data, err := os.ReadFile(dst)
+			if err != nil || string(data) != "data" {
+				t.Errorf("unexpected content %q: %v", data, err)
+			}
+			info, err := os.Stat(dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().Perm() != 0640 || !info.ModTime().Equal(mtime) {
+				t.Errorf("mode %v and modification time %v not kept", info.Mode().Perm(), info.ModTime())
+			}
+
+			// an existing destination is replaced
+			os.WriteFile(src, []byte("new"), 0600)
+			if err = MoveFile(src, dst); err != nil {
+				t.Fatal(err)
+			}
+			if data, _ = os.ReadFile(dst); string(data) != "new" {
+				t.Errorf("destination not replaced, got %q", data)
+			}
+
+			if err = MoveFile(src, dst); !os.IsNotExist(err) {
+				t.Errorf("expected a missing source to fail, got %v", err)
+			}
+		})
+	}
+
+}
+
+func TestMoveFileSameFile(t *testing.T) {
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.txt")
+	link := filepath.Join(dir, "link.txt")
+	if err := os.WriteFile(src, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(src, link); err != nil {
+		t.Skip("hard links not supported:", err)
+	}
+
+	// moving a file onto itself, or a hard link of it, leaves it alone
+	for _, dst := range []string{src, link} {
+		if err := MoveFile(src, dst); err != nil {
+			t.Fatal(err)
+		}
+		if data, err := os.ReadFile(src); err != nil || string(data) != "data" {
+			t.Errorf("%v: source changed to %q: %v", filepath.Base(dst), data, err)
+		}
+	}
+
+}
+
+func TestFinalize(t *testing.T) {
+
+	var finalized []Session
+	var received, rejected []string
+	h := newTestHandler(t, Config{
+		DestDir: t.TempDir(),
+		Finalize: func(s Session) error {
+			finalized = append(finalized, s)
+			if exist, _ := exists(s.Path); !exist {
+				t.Errorf("%v isn't in the session directory", s.Path)
+			}
+			if s.Filename == "bad.txt" {
+				return &RejectError{Code: 0x80070020, Reason: "bad file"}
+			}
+			return nil
+		},
+	}, func(event Event, session, path string) {
+		switch event {
+		case EventRecieveFile:
+			received = append(received, filepath.Base(path))
+		case EventRejectFile:
+			rejected = append(rejected, path)
+		}
+	})
+	uuid := createSession(t, h)
+
+	res := sendFragment(h, uuid, "good.txt", []byte("data"), 0, 4)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("fragment failed: %v", res.Status)
+	}
+
+	// a file refused by Finalize is removed
+	res = sendFragment(h, uuid, "bad.txt", []byte("data"), 0, 4)
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status %v, got %v", http.StatusBadRequest, res.StatusCode)
+	}
+	if code := res.Header.Get("BITS-Error-Code"); code != "80070020" {
+		t.Errorf("expected error code 80070020, got %q", code)
+	}
+	if exist, _ := exists(filepath.Join(h.cfg.TempDir, uuid, "bad.txt")); exist {
+		t.Error("rejected file is still there")
+	}
+
+	if len(finalized) != 2 || finalized[0].ID != uuid || finalized[0].Bytes != 4 {
+		t.Errorf("unexpected files finalized: %+v", finalized)
+	}
+	if len(received) != 1 || received[0] != "good.txt" || len(rejected) != 1 || rejected[0] != "bad.txt" {
+		t.Errorf("expected good.txt to be received and bad.txt rejected, got %v and %v", received, rejected)
+	}
+
+}
+
+func TestDestDir(t *testing.T) {
+
+	testcases := []struct {
+		name    string
+		policy  ExistingFilePolicy
+		status  int
+		dest    string
+		content map[string]string
+	}{
+		{
+			name:    "overwrite",
+			policy:  ExistingFileOverwrite,
+			status:  http.StatusOK,
+			dest:    "file.txt",
+			content: map[string]string{"file.txt": "0123456789"},
+		},
+		{
+			name:    "reject",
+			policy:  ExistingFileReject,
+			status:  http.StatusConflict,
+			content: map[string]string{"file.txt": "existing"},
+		},
+		{
+			name:    "rename",
+			policy:  ExistingFileRename,
+			status:  http.StatusOK,
+			dest:    "file (1).txt",
+			content: map[string]string{"file.txt": "existing", "file (1).txt": "0123456789"},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			dest := t.TempDir()
+			var received []string
+			h := newTestHandler(t, Config{DestDir: dest, OnCollision: tc.policy}, func(event Event, session, path string) {
+				if event == EventRecieveFile {
+					received = append(received, path)
+				}
+			})
+			uuid := createSession(t, h)
+
+			// the first file is moved out of the session directory
+			res := sendFragment(h, uuid, "first.txt", []byte("data"), 0, 4)
+			res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("fragment failed: %v", res.Status)
+			}
+			if len(received) != 1 || received[0] != filepath.Join(dest, "first.txt") {
+				t.Fatalf("expected the file to be received in %v, got %v", dest, received)
+			}
+			if exist, _ := exists(filepath.Join(h.cfg.TempDir, uuid, "first.txt")); exist {
+				t.Error("file is still in the session directory")
+			}
+
+			// a retried final fragment is acked, without receiving the file again
+			res = sendFragment(h, uuid, "first.txt", []byte("data"), 0, 4)
+			res.Body.Close()
+			if res.StatusCode != http.StatusOK || len(received) != 1 {
+				t.Errorf("retried fragment: status %v, received %v", res.Status, received)
+			}
+
+			// a file already in the destination directory
+			if err := os.WriteFile(filepath.Join(dest, "file.txt"), []byte("existing"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			res = sendFragment(h, uuid, "file.txt", []byte("0123456789"), 0, 10)
+			res.Body.Close()
+			if res.StatusCode != tc.status {
+				t.Fatalf("expected status %v, got %v", tc.status, res.StatusCode)
+			}
+			if tc.dest != "" && received[len(received)-1] != filepath.Join(dest, tc.dest) {
+				t.Errorf("expected the file to be received as %v, got %v", tc.dest, received)
+			}
+			for name, content := range tc.content {
+				data, err := os.ReadFile(filepath.Join(dest, name))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(data) != content {
+					t.Errorf("unexpected content of %v: %q, expected %q", name, data, content)
+				}
+			}
+			if exist, _ := exists(filepath.Join(h.cfg.TempDir, uuid, "file.txt")); exist {
+				t.Error("file is still in the session directory")
+			}
+		})
+	}
+
+}
+
+func TestDestDirCreated(t *testing.T) {
+
+	// the destination doesn't have to exist
+	dest := filepath.Join(t.TempDir(), "incoming", "files")
+	var received Session
+	h := newTestHandler(t, Config{DestDir: dest, SessionCallback: func(event Event, s Session) {
+		if event == EventRecieveFile {
+			received = s
+		}
+	}}, nil)
+	uuid := createSession(t, h)
+
+	res := sendFragment(h, uuid, "file.txt", []byte("data"), 0, 4)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("fragment failed: %v", res.Status)
+	}
+	if received.Path != filepath.Join(dest, "file.txt") {
+		t.Errorf("expected the event path in %v, got %v", dest, received.Path)
+	}
+	if data, err := os.ReadFile(filepath.Join(dest, "file.txt")); err != nil || string(data) != "data" {
+		t.Errorf("unexpected file in the destination: %q, %v", data, err)
+	}
+}
@@ -0,0 +1,65 @@
+package gobits
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// errNetworkDenied is why a client outside the allowed networks, or in a denied one, is refused
+var errNetworkDenied = errors.New("client network is not allowed")
+
+// parse networks in CIDR notation. A single address is a network of only that address
+func parseNetworks(networks []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, network := range networks {
+		network = strings.TrimSpace(network)
+		if prefix, err := netip.ParsePrefix(network); err == nil {
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(network)
+		if err != nil {
+			return nil, fmt.Errorf("%w '%s', must be an address or CIDR prefix", ErrInvalidNetwork, network)
+		}
+		addr = addr.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// check if an address is in one of the networks. IPv4-mapped IPv6 addresses are in the IPv4
+// networks
+func inNetworks(addr netip.Addr, networks []netip.Prefix) bool {
+	for _, network := range networks {
+		if network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// check that the client of a request is in the AllowedNetworks and not in the DeniedNetworks.
+// Returns false if the request is refused with a 403 and EventRejectClient. Clients without a valid
+// address are only allowed if there are no AllowedNetworks
+func (b *Handler) checkNetwork(w http.ResponseWriter, r *http.Request, sessionID string) bool {
+	if len(b.allowedNetworks) == 0 && len(b.deniedNetworks) == 0 {
+		return true
+	}
+	client := b.cfg.ClientIP(r)
+	addr, err := netip.ParseAddr(client)
+	if err == nil {
+		addr = addr.Unmap()
+		if !inNetworks(addr, b.deniedNetworks) && (len(b.allowedNetworks) == 0 || inNetworks(addr, b.allowedNetworks)) {
+			return true
+		}
+	} else if len(b.allowedNetworks) == 0 {
+		return true
+	}
+
+	b.event(r, EventRejectClient, "", eventInfo{path: client, reason: errNetworkDenied})
+	bitsError(w, sessionID, http.StatusForbidden, codeAccessDenied, ErrorContextRemoteFile)
+	return false
+}
@@ -0,0 +1,94 @@
+package gobits
+
+import (
+	"net/http"
+	"net/netip"
+	"testing"
+)
+
+func TestNetworks(t *testing.T) {
+
+	testcases := []struct {
+		name    string
+		cfg     Config
+		remote  string
+		forward string
+		status  int
+	}{
+		{"no lists", Config{}, "192.0.2.1:1234", "", http.StatusOK},
+		{"allowed", Config{AllowedNetworks: []string{"10.0.0.0/8"}}, "10.1.2.3:1234", "", http.StatusOK},
+		{"not allowed", Config{AllowedNetworks: []string{"10.0.0.0/8"}}, "192.0.2.1:1234", "", http.StatusForbidden},
+		{"single address", Config{AllowedNetworks: []string{"192.0.2.1"}}, "192.0.2.1:1234", "", http.StatusOK},
+		{"denied", Config{DeniedNetworks: []string{"192.0.2.0/24"}}, "192.0.2.1:1234", "", http.StatusForbidden},
+		{"deny wins", Config{AllowedNetworks: []string{"10.0.0.0/8"}, DeniedNetworks: []string{"10.6.0.0/16"}}, "10.6.0.1:1234", "", http.StatusForbidden},
+		{"ipv6", Config{AllowedNetworks: []string{"2001:db8::/32"}}, "[2001:db8::1]:1234", "", http.StatusOK},
+		{"ipv6 not allowed", Config{AllowedNetworks: []string{"2001:db8::/32"}}, "[2001:db9::1]:1234", "", http.StatusForbidden},
+		{"ipv4-mapped", Config{AllowedNetworks: []string{"10.0.0.0/8"}}, "[::ffff:10.0.0.1]:1234", "", http.StatusOK},
+		{"ipv4-mapped denied", Config{DeniedNetworks: []string{"10.0.0.0/8"}}, "[::ffff:10.0.0.1]:1234", "", http.StatusForbidden},
+		{
+			name:    "through trusted proxy",
+			cfg:     Config{AllowedNetworks: []string{"192.0.2.0/24"}, TrustedProxies: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}},
+			remote:  "10.0.0.1:1234",
+			forward: "192.0.2.1",
+			status:  http.StatusOK,
+		},
+		{
+			name:    "proxy forwarding a denied client",
+			cfg:     Config{DeniedNetworks: []string{"198.51.100.0/24"}, TrustedProxies: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}},
+			remote:  "10.0.0.1:1234",
+			forward: "198.51.100.7",
+			status:  http.StatusForbidden,
+		},
+		{
+			name:    "spoofed header",
+			cfg:     Config{AllowedNetworks: []string{"192.0.2.0/24"}, TrustedProxies: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}},
+			remote:  "198.51.100.7:1234",
+			forward: "192.0.2.1",
+			status:  http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			var rejected []Session
+			tc.cfg.SessionCallback = func(event Event, s Session) {
+				if event == EventRejectClient {
+					rejected = append(rejected, s)
+				}
+			}
+			h := newTestHandler(t, tc.cfg, nil)
+
+			headers := map[string]string{}
+			if tc.forward != "" {
+				headers["X-Forwarded-For"] = tc.forward
+			}
+			res := doPacketFrom(h, tc.remote, "Ping", "", "/BITS/", headers, nil)
+			res.Body.Close()
+			if res.StatusCode != tc.status {
+				t.Fatalf("expected status %v, got %v", tc.status, res.StatusCode)
+			}
+			if tc.status == http.StatusOK {
+				if len(rejected) != 0 {
+					t.Errorf("unexpected rejections %+v", rejected)
+				}
+				return
+			}
+			if res.Header.Get("BITS-Error-Code") != "80070005" {
+				t.Errorf("unexpected error code %q", res.Header.Get("BITS-Error-Code"))
+			}
+			if len(rejected) != 1 || rejected[0].Path != h.cfg.ClientIP(rejected[0].Request) || rejected[0].Reason != errNetworkDenied {
+				t.Errorf("unexpected rejections %+v", rejected)
+			}
+		})
+	}
+}
+
+func TestInvalidNetworks(t *testing.T) {
+
+	for _, cfg := range []Config{{AllowedNetworks: []string{"10.0.0.0/33"}}, {DeniedNetworks: []string{"example.com"}}} {
+		cfg.TempDir = t.TempDir()
+		if _, err := NewHandler(cfg, nil); err == nil {
+			t.Errorf("expected an error for %v %v", cfg.AllowedNetworks, cfg.DeniedNetworks)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package gobits
+
+import "net/http"
+
+// origin is what is known about how a session was created, passed to the events of the session
+type origin struct {
+	principal string            // who created the session, by the Authenticator
+	remote    string            // the address of the client that created the session, by ClientIP
+	cert      *ClientCert       // the certificate of the client that created the session, if any
+	headers   map[string]string // the captured headers of Create-Session, by canonical name
+}
+
+// the values of the CaptureHeaders sent with a request, nil if there are none
+func (b *Handler) captureHeaders(r *http.Request) map[string]string {
+	var headers map[string]string
+	for _, name := range b.cfg.CaptureHeaders {
+		value := r.Header.Get(name)
+		if value == "" {
+			continue
+		}
+		if headers == nil {
+			headers = make(map[string]string)
+		}
+		headers[http.CanonicalHeaderKey(name)] = value
+	}
+	return headers
+}
+
+// remember how a session was created, so its events know it after the session is dropped
+func (b *Handler) rememberOrigin(uuid string, o origin) {
+	if o.principal == "" && o.remote == "" && o.headers == nil && o.cert == nil {
+		return
+	}
+	b.activeMu.Lock()
+	defer b.activeMu.Unlock()
+	if b.origins == nil {
+		b.origins = make(map[string]origin)
+	}
+	b.origins[uuid] = o
+}
+
+// how a session was created, empty if it isn't known. It is forgotten once the session is
+// closed or canceled
+func (b *Handler) sessionOrigin(event Event, uuid string) origin {
+	b.activeMu.Lock()
+	defer b.activeMu.Unlock()
+	o := b.origins[uuid]
+	if event == EventCloseSession || event == EventCancelSession {
+		delete(b.origins, uuid)
+	}
+	return o
+}
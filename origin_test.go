@@ -0,0 +1,43 @@
+package gobits
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCaptureHeaders(t *testing.T) {
+
+	var received Session
+	cfg := Config{
+		CaptureHeaders: []string{"x-upload-category", "X-Missing"},
+		SessionCallback: func(event Event, s Session) {
+			if event == EventRecieveFile {
+				received = s
+			}
+		},
+	}
+	h := newTestHandler(t, cfg, nil)
+
+	res := doPacket(h, "Create-Session", "", "/BITS/", map[string]string{
+		"BITS-Supported-Protocols": h.cfg.Protocol,
+		"X-Upload-Category":        "crash-dumps",
+		"X-Other":                  "ignored",
+	}, nil)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("failed to create session: %v", res.Status)
+	}
+	uuid := res.Header.Get("BITS-Session-Id")
+
+	// the headers are kept with the session
+	h = restartHandler(t, h, nil)
+	res = sendFragment(h, uuid, "file.txt", []byte("data"), 0, 4)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("failed to send fragment: %v", res.Status)
+	}
+
+	if len(received.Headers) != 1 || received.Headers["X-Upload-Category"] != "crash-dumps" {
+		t.Errorf("unexpected headers %v", received.Headers)
+	}
+}
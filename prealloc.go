@@ -0,0 +1,5 @@
+package gobits
+
+// reserve the disk space of a file before it is written. It is a variable so tests can see
+// what is preallocated
+var preallocate = fallocate
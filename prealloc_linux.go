@@ -0,0 +1,24 @@
+package gobits
+
+import (
+	"os"
+	"syscall"
+)
+
+// fallocateKeepSize is FALLOC_FL_KEEP_SIZE, the blocks are allocated without changing the size of
+// the file, which is how much of it is received
+const fallocateKeepSize = 0x01
+
+// allocate the blocks of a file on disk. Files that aren't on the OS file system, and file
+// systems without fallocate, aren't preallocated
+func fallocate(f fsFile, size uint64) error {
+	file, ok := f.(*os.File)
+	if !ok {
+		return nil
+	}
+	err := syscall.Fallocate(int(file.Fd()), fallocateKeepSize, 0, int64(size))
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,56 @@
+package gobits
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestPreallocate(t *testing.T) {
+
+	// not all file systems can allocate
+	probe, err := os.CreateTemp(t.TempDir(), "probe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = syscall.Fallocate(int(probe.Fd()), fallocateKeepSize, 0, 4096)
+	probe.Close()
+	if err != nil {
+		t.Skipf("fallocate isn't supported: %v", err)
+	}
+
+	const length = 1 << 20
+	h := newTestHandler(t, Config{Preallocate: true}, nil)
+	uuid := createSession(t, h)
+
+	res := sendFragment(h, uuid, "file.bin", []byte("data"), 0, length)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("fragment failed: %v", res.Status)
+	}
+
+	// the whole file is allocated, while its size is what is received
+	info, err := os.Stat(filepath.Join(h.cfg.TempDir, uuid, "file.bin"+h.cfg.PartSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 4 {
+		t.Errorf("expected the size to be 4, got %v", info.Size())
+	}
+	if allocated := info.Sys().(*syscall.Stat_t).Blocks * 512; allocated < length {
+		t.Errorf("expected %v bytes allocated, got %v", length, allocated)
+	}
+
+	// the rest of the file resumes where it was
+	res = sendFragment(h, uuid, "file.bin", make([]byte, length-4), 4, length)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("fragment failed: %v", res.Status)
+	}
+	if info, err = os.Stat(filepath.Join(h.cfg.TempDir, uuid, "file.bin")); err != nil || info.Size() != length {
+		t.Errorf("expected the file to be complete: %v", err)
+	}
+
+}
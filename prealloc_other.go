@@ -0,0 +1,8 @@
+//go:build !linux
+
+package gobits
+
+// files are only preallocated on Linux
+func fallocate(f fsFile, size uint64) error {
+	return nil
+}
@@ -0,0 +1,46 @@
+package gobits
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestPreallocateFull(t *testing.T) {
+
+	var sizes []uint64
+	preallocate = func(f fsFile, size uint64) error {
+		sizes = append(sizes, size)
+		return syscall.ENOSPC
+	}
+	defer func() { preallocate = fallocate }()
+
+	h := newTestHandler(t, Config{Preallocate: true}, nil)
+	uuid := createSession(t, h)
+
+	// a file that can't be allocated is refused before anything is written
+	res := sendFragment(h, uuid, "file.bin", []byte("data"), 0, 1<<20)
+	res.Body.Close()
+	if res.StatusCode != http.StatusInsufficientStorage {
+		t.Errorf("expected status %v, got %v", http.StatusInsufficientStorage, res.StatusCode)
+	}
+	if len(sizes) != 1 || sizes[0] != 1<<20 {
+		t.Errorf("expected 1 MiB to be preallocated, got %v", sizes)
+	}
+	if _, err := os.Stat(filepath.Join(h.cfg.TempDir, uuid, "file.bin"+h.cfg.PartSuffix)); !os.IsNotExist(err) {
+		t.Errorf("part file left behind: %v", err)
+	}
+
+	// files of unknown size aren't preallocated
+	res = doPacket(h, "Fragment", uuid, "/BITS/other.bin", map[string]string{
+		"Content-Range":  "bytes 0-3/*",
+		"Content-Length": "4",
+	}, []byte("data"))
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || len(sizes) != 1 {
+		t.Errorf("expected a file of unknown size to be stored without preallocation, got %v and %v", res.Status, sizes)
+	}
+
+}
@@ -0,0 +1,192 @@
+package gobits
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+)
+
+// ProxyHeader is the header the trusted proxies record the client and the URL it used in. Only
+// that header is read, a client can send the other one and the proxies pass it on
+type ProxyHeader int
+
+// Headers of proxies
+const (
+	ProxyXForwarded ProxyHeader = 0 // X-Forwarded-For, X-Forwarded-Proto and X-Forwarded-Host
+	ProxyForwarded  ProxyHeader = 1 // The Forwarded header of RFC 7239
+)
+
+// TrustedProxyIP returns a Config.ClientIP that takes the client address from the header the
+// trusted proxies set, for requests sent by them. The hops are followed from the proxy back to
+// the client, and the first address that isn't a trusted proxy is the client. Requests from
+// other peers are identified by RemoteIP, their headers are ignored since anyone can set them
+func TrustedProxyIP(trusted []netip.Prefix, header ProxyHeader) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		peer, err := netip.ParseAddr(RemoteIP(r))
+		if err != nil || !inNetworks(peer.Unmap(), trusted) {
+			return RemoteIP(r)
+		}
+		hops := forwardedHops(r.Header, header)
+		i := clientHop(hops, trusted)
+		if i < 0 {
+			return peer.Unmap().String()
+		}
+		if addr, ok := parseHop(hops[i].client); ok {
+			return addr.String()
+		}
+
+		// an obfuscated or invalid hop, the proxy it came to is the furthest known address
+		if i == len(hops)-1 {
+			return peer.Unmap().String()
+		}
+		addr, _ := parseHop(hops[i+1].client)
+		return addr.String()
+	}
+}
+
+// RequestURL returns the absolute URL of a request as the handler got it, with the scheme of the
+// connection and the Host header. The replies of gobits have no absolute URLs, it is for hooks
+// building them, like a SessionCallback linking to the files of Session.Request. Behind a proxy
+// terminating TLS, use TrustedProxyURL to get the URL the client used
+func RequestURL(r *http.Request) *url.URL {
+	u := *r.URL
+	u.Scheme, u.Host, u.User = "http", r.Host, nil
+	if r.TLS != nil {
+		u.Scheme = "https"
+	}
+	return &u
+}
+
+// TrustedProxyURL returns a function getting the absolute URL a client used for a request. For
+// requests sent by the trusted proxies, the scheme and host are taken from the header they set,
+// as the proxy the client connected to recorded them. Requests from other peers get their
+// RequestURL, their headers are ignored since anyone can set them
+func TrustedProxyURL(trusted []netip.Prefix, header ProxyHeader) func(r *http.Request) *url.URL {
+	return func(r *http.Request) *url.URL {
+		u := RequestURL(r)
+		peer, err := netip.ParseAddr(RemoteIP(r))
+		if err != nil || !inNetworks(peer.Unmap(), trusted) {
+			return u
+		}
+		hops := forwardedHops(r.Header, header)
+		i := clientHop(hops, trusted)
+		if i < 0 {
+			return u
+		}
+
+		if proto := strings.ToLower(hops[i].proto); proto == "http" || proto == "https" {
+			u.Scheme = proto
+		}
+		if validHost(hops[i].host) {
+			u.Host = hops[i].host
+		}
+		return u
+	}
+}
+
+// check that a forwarded host is a host with an optional port, and nothing that would change
+// the meaning of the URL it is put in
+func validHost(host string) bool {
+	if host == "" || strings.ContainsAny(host, "/?#@\\ ") {
+		return false
+	}
+	u, err := url.Parse("http://" + host)
+	if err != nil || u.Host != host {
+		return false
+	}
+	if _, port, err := net.SplitHostPort(host); err == nil && port == "" {
+		return false
+	}
+	return true
+}
+
+// forwardedHop is what a proxy recorded about the request it got: who sent it, and the scheme
+// and host it was sent to
+type forwardedHop struct {
+	client string
+	proto  string
+	host   string
+}
+
+// get the hops of a request from a proxy header, in the order they were added. The values of
+// X-Forwarded-Proto and X-Forwarded-Host belong to the hops of X-Forwarded-For from the right,
+// since proxies that only set them overwrite them
+func forwardedHops(header http.Header, which ProxyHeader) []forwardedHop {
+	var hops []forwardedHop
+	if which == ProxyForwarded {
+		for _, value := range header.Values("Forwarded") {
+			for _, element := range strings.Split(value, ",") {
+				var hop forwardedHop
+				for _, pair := range strings.Split(element, ";") {
+					name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+					if !ok {
+						continue
+					}
+					switch value = strings.Trim(value, `"`); strings.ToLower(name) {
+					case "for":
+						hop.client = value
+					case "proto":
+						hop.proto = value
+					case "host":
+						hop.host = value
+					}
+				}
+				hops = append(hops, hop)
+			}
+		}
+		return hops
+	}
+
+	list := func(name string) []string {
+		var values []string
+		for _, value := range header.Values(name) {
+			for _, v := range strings.Split(value, ",") {
+				values = append(values, strings.TrimSpace(v))
+			}
+		}
+		return values
+	}
+	clients, protos, hosts := list("X-Forwarded-For"), list("X-Forwarded-Proto"), list("X-Forwarded-Host")
+	hops = make([]forwardedHop, max(len(clients), len(protos), len(hosts)))
+	for i, client := range clients {
+		hops[len(hops)-len(clients)+i].client = client
+	}
+	for i, proto := range protos {
+		hops[len(hops)-len(protos)+i].proto = proto
+	}
+	for i, host := range hosts {
+		hops[len(hops)-len(hosts)+i].host = host
+	}
+	return hops
+}
+
+// get the hop recorded by the proxy the client connected to, -1 if there are none. The
+// rightmost hop was added by the peer, a trusted proxy. The hops before it are followed while
+// they came from a trusted proxy, the others can be forged by the client. The walk stops at an
+// obfuscated or invalid address, since the hops before it can't be trusted
+func clientHop(hops []forwardedHop, trusted []netip.Prefix) int {
+	i := len(hops) - 1
+	for i > 0 {
+		addr, ok := parseHop(hops[i].client)
+		if !ok || !inNetworks(addr, trusted) {
+			break
+		}
+		i--
+	}
+	return i
+}
+
+// parse the address of a hop, with or without a port. IPv6 addresses are in brackets in the
+// Forwarded header
+func parseHop(hop string) (netip.Addr, bool) {
+	if addrPort, err := netip.ParseAddrPort(hop); err == nil {
+		return addrPort.Addr().Unmap(), true
+	}
+	addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(hop, "["), "]"))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
@@ -0,0 +1,282 @@
+package gobits
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestTrustedProxyIP(t *testing.T) {
+
+	trusted := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("2001:db8:1::/48")}
+
+	testcases := []struct {
+		name    string
+		remote  string
+		header  ProxyHeader
+		headers map[string]string
+		client  string
+	}{
+		{
+			name:   "direct client",
+			remote: "192.0.2.1:1234",
+			client: "192.0.2.1",
+		},
+		{
+			name:    "spoofed forwarded for from untrusted peer",
+			remote:  "192.0.2.1:1234",
+			headers: map[string]string{"X-Forwarded-For": "198.51.100.7"},
+			client:  "192.0.2.1",
+		},
+		{
+			name:    "spoofed forwarded from untrusted peer",
+			remote:  "192.0.2.1:1234",
+			header:  ProxyForwarded,
+			headers: map[string]string{"Forwarded": "for=198.51.100.7"},
+			client:  "192.0.2.1",
+		},
+		{
+			name:    "trusted proxy",
+			remote:  "10.0.0.1:1234",
+			headers: map[string]string{"X-Forwarded-For": "192.0.2.1"},
+			client:  "192.0.2.1",
+		},
+		{
+			name:    "chain of trusted proxies",
+			remote:  "10.0.0.1:1234",
+			headers: map[string]string{"X-Forwarded-For": "192.0.2.1, 10.0.0.2, 10.0.0.3"},
+			client:  "192.0.2.1",
+		},
+		{
+			name:    "spoofed hop before the client",
+			remote:  "10.0.0.1:1234",
+			headers: map[string]string{"X-Forwarded-For": "10.0.0.9, 198.51.100.7, 192.0.2.1, 10.0.0.2"},
+			client:  "192.0.2.1",
+		},
+		{
+			name:    "forwarded",
+			remote:  "10.0.0.1:1234",
+			header:  ProxyForwarded,
+			headers: map[string]string{"Forwarded": `for=192.0.2.1;proto=https, for="[2001:db8:1::2]:4711"`, "X-Forwarded-For": "198.51.100.7"},
+			client:  "192.0.2.1",
+		},
+		{
+			name:    "forwarded injected by the client",
+			remote:  "10.0.0.1:1234",
+			headers: map[string]string{"X-Forwarded-For": "203.0.113.9", "Forwarded": "for=192.168.1.5"},
+			client:  "203.0.113.9",
+		},
+		{
+			name:    "x-forwarded-for injected by the client",
+			remote:  "10.0.0.1:1234",
+			header:  ProxyForwarded,
+			headers: map[string]string{"Forwarded": "for=203.0.113.9", "X-Forwarded-For": "192.168.1.5"},
+			client:  "203.0.113.9",
+		},
+		{
+			name:    "forwarded with port",
+			remote:  "[2001:db8:1::1]:1234",
+			header:  ProxyForwarded,
+			headers: map[string]string{"Forwarded": `For="192.0.2.1:47011"`},
+			client:  "192.0.2.1",
+		},
+		{
+			name:    "obfuscated hop",
+			remote:  "10.0.0.1:1234",
+			header:  ProxyForwarded,
+			headers: map[string]string{"Forwarded": "for=192.0.2.1, for=_hidden, for=10.0.0.2"},
+			client:  "10.0.0.2",
+		},
+		{
+			name:   "trusted proxy without header",
+			remote: "10.0.0.1:1234",
+			client: "10.0.0.1",
+		},
+		{
+			name:    "only trusted proxies",
+			remote:  "10.0.0.1:1234",
+			headers: map[string]string{"X-Forwarded-For": "10.0.0.3, 10.0.0.2"},
+			client:  "10.0.0.3",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("BITS_POST", "/", nil)
+			r.RemoteAddr = tc.remote
+			for k, v := range tc.headers {
+				r.Header.Set(k, v)
+			}
+			if ip := TrustedProxyIP(trusted, tc.header)(r); ip != tc.client {
+				t.Errorf("expected client %v, got %v", tc.client, ip)
+			}
+		})
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+
+	var created *http.Request
+	h := newTestHandler(t, Config{
+		TrustedProxies: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+		BindSessions:   true,
+		SessionCallback: func(event Event, s Session) {
+			if event == EventCreateSession {
+				created = s.Request
+			}
+		},
+	}, nil)
+
+	res := doPacketFrom(h, "10.0.0.1:1234", "Create-Session", "", "/BITS/", map[string]string{
+		"BITS-Supported-Protocols": h.cfg.Protocol,
+		"X-Forwarded-For":          "192.0.2.1",
+	}, nil)
+	res.Body.Close()
+	uuid := res.Header.Get("BITS-Session-Id")
+	if ip := h.cfg.ClientIP(created); ip != "192.0.2.1" {
+		t.Fatalf("expected client 192.0.2.1, got %v", ip)
+	}
+
+	// the session is bound to the client, not the proxy
+	testcases := []struct {
+		name    string
+		remote  string
+		forward string
+		status  int
+	}{
+		{"same client through another proxy", "10.0.0.2:1234", "192.0.2.1", http.StatusOK},
+		{"another client through the proxy", "10.0.0.1:1234", "198.51.100.7", http.StatusForbidden},
+		{"client spoofing the header", "198.51.100.7:1234", "192.0.2.1", http.StatusForbidden},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			res := doPacketFrom(h, tc.remote, "Fragment", uuid, "/BITS/file.txt", map[string]string{
+				"Content-Range":   "bytes 0-0/10",
+				"X-Forwarded-For": tc.forward,
+			}, []byte{'x'})
+			res.Body.Close()
+			if res.StatusCode != tc.status {
+				t.Errorf("expected status %v, got %v", tc.status, res.StatusCode)
+			}
+		})
+	}
+}
+
+func TestTrustedProxyURL(t *testing.T) {
+
+	trusted := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+
+	testcases := []struct {
+		name    string
+		trusted []netip.Prefix
+		remote  string
+		header  ProxyHeader
+		tls     bool
+		headers map[string]string
+		url     string
+	}{
+		{
+			name:   "direct client",
+			remote: "192.0.2.1:1234",
+			url:    "http://gobits.internal/BITS/file.txt?v=1",
+		},
+		{
+			name:   "direct client over tls",
+			remote: "192.0.2.1:1234",
+			tls:    true,
+			url:    "https://gobits.internal/BITS/file.txt?v=1",
+		},
+		{
+			name:    "spoofed headers from untrusted peer",
+			remote:  "192.0.2.1:1234",
+			headers: map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "evil.example"},
+			url:     "http://gobits.internal/BITS/file.txt?v=1",
+		},
+		{
+			name:    "proxy not trusted",
+			trusted: []netip.Prefix{},
+			remote:  "10.0.0.1:1234",
+			headers: map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "uploads.example.com"},
+			url:     "http://gobits.internal/BITS/file.txt?v=1",
+		},
+		{
+			name:    "tls terminating proxy",
+			remote:  "10.0.0.1:1234",
+			headers: map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "uploads.example.com"},
+			url:     "https://uploads.example.com/BITS/file.txt?v=1",
+		},
+		{
+			name:    "chain of proxies",
+			remote:  "10.0.0.1:1234",
+			headers: map[string]string{"X-Forwarded-For": "192.0.2.1, 10.0.0.2", "X-Forwarded-Proto": "HTTPS, http", "X-Forwarded-Host": "uploads.example.com:8443, gobits.internal"},
+			url:     "https://uploads.example.com:8443/BITS/file.txt?v=1",
+		},
+		{
+			name:    "values injected by the client",
+			remote:  "10.0.0.1:1234",
+			headers: map[string]string{"X-Forwarded-For": "192.0.2.1", "X-Forwarded-Proto": "http, https", "X-Forwarded-Host": "evil.example, uploads.example.com"},
+			url:     "https://uploads.example.com/BITS/file.txt?v=1",
+		},
+		{
+			name:    "forwarded",
+			remote:  "10.0.0.1:1234",
+			header:  ProxyForwarded,
+			headers: map[string]string{"Forwarded": `for=192.0.2.1;proto=https;host="[2001:db8::1]:8443", for=10.0.0.2;proto=http`, "X-Forwarded-Proto": "http"},
+			url:     "https://[2001:db8::1]:8443/BITS/file.txt?v=1",
+		},
+		{
+			name:   "proxy over tls without headers",
+			remote: "10.0.0.1:1234",
+			tls:    true,
+			url:    "https://gobits.internal/BITS/file.txt?v=1",
+		},
+		{
+			name:    "invalid values",
+			remote:  "10.0.0.1:1234",
+			headers: map[string]string{"X-Forwarded-Proto": "ftp", "X-Forwarded-Host": "evil.example/path"},
+			url:     "http://gobits.internal/BITS/file.txt?v=1",
+		},
+		{
+			name:    "forwarded injected by the client",
+			remote:  "10.0.0.1:1234",
+			headers: map[string]string{"Forwarded": "proto=https;host=evil.example"},
+			url:     "http://gobits.internal/BITS/file.txt?v=1",
+		},
+		{
+			name:    "host with credentials",
+			remote:  "10.0.0.1:1234",
+			header:  ProxyForwarded,
+			headers: map[string]string{"Forwarded": "host=user@evil.example"},
+			url:     "http://gobits.internal/BITS/file.txt?v=1",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("BITS_POST", "http://gobits.internal/BITS/file.txt?v=1", nil)
+			r.RemoteAddr = tc.remote
+			if tc.tls {
+				r.TLS = &tls.ConnectionState{}
+			}
+			for k, v := range tc.headers {
+				r.Header.Set(k, v)
+			}
+			proxies := trusted
+			if tc.trusted != nil {
+				proxies = tc.trusted
+			}
+			if u := TrustedProxyURL(proxies, tc.header)(r); u.String() != tc.url {
+				t.Errorf("expected %v, got %v", tc.url, u)
+			}
+		})
+	}
+
+	// the request itself is left as it is
+	r := httptest.NewRequest("BITS_POST", "/BITS/file.txt", nil)
+	r.Host = "gobits.internal:8080"
+	if u := RequestURL(r); u.String() != "http://gobits.internal:8080/BITS/file.txt" || r.URL.Host != "" {
+		t.Errorf("unexpected url %v of %v", u, r.URL)
+	}
+}
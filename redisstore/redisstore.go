@@ -0,0 +1,162 @@
+// Package redisstore keeps the sessions of gobits handlers in Redis, so servers behind a load
+// balancer can handle each other's sessions.
+//
+// Each session is a hash holding when it was created, when it last received a fragment, its
+// tenant, and how much of each file is received and if it is complete. It expires when it hasn't
+// been touched for the TTL. The files themselves are on the storage the servers share.
+package redisstore
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitlab.com/magan/gobits"
+)
+
+// Client is the part of a Redis client the store uses. Wrap go-redis, redigo or any other
+// client in it. HGetAll returns an empty map for a missing key
+type Client interface {
+	HSet(key string, values map[string]string) error
+	HGetAll(key string) (map[string]string, error)
+	Expire(key string, ttl time.Duration) error
+	Del(key string) error
+	Exists(key string) (bool, error)
+}
+
+// fields of the session hash. The fields of a file are the prefix followed by its name
+const (
+	fieldCreated   = "created"
+	fieldTouched   = "touched"
+	fieldTenant    = "tenant"
+	fieldLength    = "length:"
+	fieldReceived  = "received:"
+	fieldCompleted = "completed:"
+)
+
+// Store is a gobits.SessionStore keeping the sessions in Redis
+type Store struct {
+	client Client
+	prefix string
+	ttl    time.Duration
+}
+
+// New creates a store keeping each session under prefix+id. Sessions expire when they haven't
+// been touched for ttl, and never if it is zero
+func New(client Client, prefix string, ttl time.Duration) *Store {
+	return &Store{
+		client: client,
+		prefix: prefix,
+		ttl:    ttl,
+	}
+}
+
+// Create stores a new session
+func (s *Store) Create(id string, info gobits.SessionInfo) error {
+	key := s.prefix + id
+	if err := s.client.HSet(key, map[string]string{
+		fieldCreated: formatTime(info.Created),
+		fieldTouched: formatTime(info.Touched),
+		fieldTenant:  info.Tenant,
+	}); err != nil {
+		return err
+	}
+	return s.expire(key)
+}
+
+// Touch records that the session received a fragment, and restarts its TTL
+func (s *Store) Touch(id string) error {
+	return s.update(id, map[string]string{fieldTouched: formatTime(time.Now())})
+}
+
+// Progress records what is received of a file of the session, and restarts its TTL
+func (s *Store) Progress(id string, file gobits.FileStatus) error {
+	return s.update(id, map[string]string{
+		fieldLength + file.Name:    strconv.FormatUint(file.Length, 10),
+		fieldReceived + file.Name:  strconv.FormatUint(file.Received, 10),
+		fieldCompleted + file.Name: strconv.FormatBool(file.Completed),
+	})
+}
+
+// Get gets a session, or gobits.ErrSessionNotFound if it doesn't exist or has expired
+func (s *Store) Get(id string) (gobits.SessionInfo, error) {
+	values, err := s.client.HGetAll(s.prefix + id)
+	if err != nil {
+		return gobits.SessionInfo{}, err
+	}
+	if _, ok := values[fieldCreated]; !ok {
+		// missing, or only fields updated while the session was deleted
+		return gobits.SessionInfo{}, gobits.ErrSessionNotFound
+	}
+	info := gobits.SessionInfo{
+		Created: parseTime(values[fieldCreated]),
+		Touched: parseTime(values[fieldTouched]),
+		Tenant:  values[fieldTenant],
+	}
+	for field, value := range values {
+		name, ok := strings.CutPrefix(field, fieldReceived)
+		if !ok {
+			continue
+		}
+		f := gobits.FileStatus{Name: name, Length: gobits.UnknownLength}
+		f.Received, _ = strconv.ParseUint(value, 10, 64)
+		if length, err := strconv.ParseUint(values[fieldLength+name], 10, 64); err == nil {
+			f.Length = length
+		}
+		f.Completed, _ = strconv.ParseBool(values[fieldCompleted+name])
+		info.Files = append(info.Files, f)
+	}
+	sort.Slice(info.Files, func(i, j int) bool {
+		return info.Files[i].Name < info.Files[j].Name
+	})
+	return info, nil
+}
+
+// Delete removes a session
+func (s *Store) Delete(id string) error {
+	return s.client.Del(s.prefix + id)
+}
+
+// set fields of an existing session, and restart its TTL. A session that is deleted or expired
+// isn't created again. If it is deleted right after it is checked, the fields are left in a hash
+// without the creation time, which Get doesn't see and which expires with the TTL
+func (s *Store) update(id string, values map[string]string) error {
+	key := s.prefix + id
+	exists, err := s.client.Exists(key)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return gobits.ErrSessionNotFound
+	}
+	if err = s.client.HSet(key, values); err != nil {
+		return err
+	}
+	return s.expire(key)
+}
+
+// set the TTL of a session, if there is one
+func (s *Store) expire(key string) error {
+	if s.ttl <= 0 {
+		return nil
+	}
+	return s.client.Expire(key, s.ttl)
+}
+
+// times are stored as RFC 3339, an empty string for an unknown time
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// parse a stored time, an unknown or invalid time is zero
+func parseTime(s string) time.Time {
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
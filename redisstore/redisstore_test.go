@@ -0,0 +1,266 @@
+package redisstore
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"gitlab.com/magan/gobits"
+)
+
+// an in-memory Redis, with a clock that can be moved forward to expire keys. The module doesn't
+// depend on miniredis or a Redis server, so the fake models what the store relies on: a key is
+// gone once its TTL has passed on the clock, and a TTL is only set on a key that exists
+type fakeRedis struct {
+	mu      sync.Mutex
+	now     time.Time
+	hashes  map[string]map[string]string
+	expires map[string]time.Time
+}
+
+func newFakeRedis() *fakeRedis {
+	return &fakeRedis{
+		now:     time.Now(),
+		hashes:  make(map[string]map[string]string),
+		expires: make(map[string]time.Time),
+	}
+}
+
+// drop a key if it has expired, the caller holds the lock
+func (r *fakeRedis) expired(key string) {
+	if at, ok := r.expires[key]; ok && !r.now.Before(at) {
+		delete(r.hashes, key)
+		delete(r.expires, key)
+	}
+}
+
+func (r *fakeRedis) HSet(key string, values map[string]string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.expired(key)
+	if r.hashes[key] == nil {
+		r.hashes[key] = make(map[string]string)
+	}
+	for k, v := range values {
+		r.hashes[key][k] = v
+	}
+	return nil
+}
+
+func (r *fakeRedis) HGetAll(key string) (map[string]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.expired(key)
+	values := make(map[string]string)
+	for k, v := range r.hashes[key] {
+		values[k] = v
+	}
+	return values, nil
+}
+
+func (r *fakeRedis) Expire(key string, ttl time.Duration) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.expired(key)
+	if _, ok := r.hashes[key]; ok {
+		r.expires[key] = r.now.Add(ttl)
+	}
+	return nil
+}
+
+func (r *fakeRedis) Del(key string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.hashes, key)
+	delete(r.expires, key)
+	return nil
+}
+
+func (r *fakeRedis) Exists(key string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.expired(key)
+	_, ok := r.hashes[key]
+	return ok, nil
+}
+
+// move the clock forward
+func (r *fakeRedis) advance(d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.now = r.now.Add(d)
+}
+
+func TestStore(t *testing.T) {
+
+	redis := newFakeRedis()
+	store := New(redis, "gobits:", time.Hour)
+
+	if _, err := store.Get("session"); err != gobits.ErrSessionNotFound {
+		t.Errorf("expected %v, got %v", gobits.ErrSessionNotFound, err)
+	}
+	if err := store.Touch("session"); err != gobits.ErrSessionNotFound {
+		t.Errorf("expected %v, got %v", gobits.ErrSessionNotFound, err)
+	}
+
+	// create
+	created := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+	if err := store.Create("session", gobits.SessionInfo{Created: created, Tenant: "acme"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := redis.hashes["gobits:session"]; !ok {
+		t.Fatal("session is not stored under its prefixed key")
+	}
+	info, err := store.Get("session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Created.Equal(created) || !info.Touched.IsZero() || info.Tenant != "acme" {
+		t.Errorf("unexpected session %+v", info)
+	}
+
+	// touching keeps the session alive past its first TTL
+	redis.advance(45 * time.Minute)
+	if err = store.Touch("session"); err != nil {
+		t.Fatal(err)
+	}
+	redis.advance(45 * time.Minute)
+	if info, err = store.Get("session"); err != nil {
+		t.Fatalf("touched session expired: %v", err)
+	}
+	if info.Touched.IsZero() {
+		t.Error("touch was not recorded")
+	}
+
+	// what is received of the files is kept with the session, and keeps it alive too
+	files := []gobits.FileStatus{
+		{Name: "a.txt", Length: 10, Received: 10, Completed: true},
+		{Name: "dir/b.txt", Length: gobits.UnknownLength, Received: 4},
+	}
+	for _, f := range []gobits.FileStatus{{Name: "a.txt", Length: 10, Received: 5}, files[0], files[1]} {
+		if err = store.Progress("session", f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	redis.advance(45 * time.Minute)
+	if info, err = store.Get("session"); err != nil || !reflect.DeepEqual(info.Files, files) {
+		t.Errorf("expected the files %+v, got %+v %v", files, info.Files, err)
+	}
+
+	// expiry
+	redis.advance(time.Hour)
+	if _, err = store.Get("session"); err != gobits.ErrSessionNotFound {
+		t.Errorf("expected the session to expire, got %v", err)
+	}
+
+	// an expired session isn't brought back
+	if err = store.Touch("session"); err != gobits.ErrSessionNotFound {
+		t.Errorf("expected the touch to fail, got %v", err)
+	}
+	if err = store.Progress("session", files[0]); err != gobits.ErrSessionNotFound {
+		t.Errorf("expected the progress to fail, got %v", err)
+	}
+	if _, ok := redis.hashes["gobits:session"]; ok {
+		t.Error("expired session is stored again")
+	}
+
+	// delete
+	store.Create("session", gobits.SessionInfo{Created: created})
+	if err = store.Delete("session"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.Get("session"); err != gobits.ErrSessionNotFound {
+		t.Errorf("expected the session to be deleted, got %v", err)
+	}
+	if err = store.Touch("session"); err != gobits.ErrSessionNotFound {
+		t.Errorf("expected the touch to fail, got %v", err)
+	}
+	if _, ok := redis.hashes["gobits:session"]; ok {
+		t.Error("deleted session is stored again")
+	}
+
+	// fields updated while the session was deleted don't bring it back
+	redis.HSet("gobits:session", map[string]string{fieldTouched: formatTime(time.Now())})
+	if _, err = store.Get("session"); err != gobits.ErrSessionNotFound {
+		t.Errorf("expected the leftover fields to be ignored, got %v", err)
+	}
+
+	// sessions without a TTL don't expire
+	store = New(redis, "gobits:", 0)
+	store.Create("forever", gobits.SessionInfo{Created: created})
+	store.Touch("forever")
+	redis.advance(24 * time.Hour)
+	if _, err = store.Get("forever"); err != nil {
+		t.Errorf("expected the session to be kept, got %v", err)
+	}
+}
+
+// send a BITS packet to the handler and return the response
+func doPacket(h http.Handler, packetType, uuid, target string, headers map[string]string) *http.Response {
+	r := httptest.NewRequest("BITS_POST", target, nil)
+	r.Header.Set("BITS-Packet-Type", packetType)
+	if uuid != "" {
+		r.Header.Set("BITS-Session-Id", uuid)
+	}
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	return rec.Result()
+}
+
+func TestStoreHandler(t *testing.T) {
+
+	redis := newFakeRedis()
+	h, err := gobits.NewHandler(gobits.Config{
+		TempDir:      t.TempDir(),
+		SessionStore: New(redis, "gobits:", time.Hour),
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := doPacket(h, "Create-Session", "", "/BITS/", map[string]string{
+		"BITS-Supported-Protocols": gobits.ProtocolUpload15,
+	})
+	res.Body.Close()
+	uuid := res.Header.Get("BITS-Session-Id")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("failed to create session: %v", res.Status)
+	}
+	if _, ok := redis.hashes["gobits:"+uuid]; !ok {
+		t.Fatal("session is not in redis")
+	}
+
+	// an empty file touches the session
+	res = doPacket(h, "Fragment", uuid, "/BITS/empty.txt", map[string]string{
+		"Content-Range":  "bytes 0-0/0",
+		"Content-Length": "0",
+	})
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("fragment failed: %v", res.Status)
+	}
+	if redis.hashes["gobits:"+uuid]["touched"] == redis.hashes["gobits:"+uuid]["created"] {
+		t.Error("fragment didn't touch the session")
+	}
+	store := New(redis, "gobits:", time.Hour)
+	info, err := store.Get(uuid)
+	if want := []gobits.FileStatus{{Name: "empty.txt", Completed: true}}; err != nil || !reflect.DeepEqual(info.Files, want) {
+		t.Errorf("expected the files %+v, got %+v %v", want, info.Files, err)
+	}
+
+	// closing the session deletes it
+	res = doPacket(h, "Close-Session", uuid, "/BITS/", nil)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("close-session failed: %v", res.Status)
+	}
+	if _, ok := redis.hashes["gobits:"+uuid]; ok {
+		t.Error("closed session is still in redis")
+	}
+}
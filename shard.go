@@ -0,0 +1,35 @@
+package gobits
+
+import "path/filepath"
+
+// maxShardDepth is the max Config.ShardDepth, the number of hex character pairs before the
+// first dash of a UUID
+const maxShardDepth = 4
+
+// get the directory of a session in dir, under depth levels of shard directories named by pairs
+// of hex characters from the start of the UUID, e.g. "ab/cd/abcdef01-..." at depth 2. Sessions
+// created before sharding was enabled are still found directly in dir
+func sessionDir(dir string, depth int, uuid string) string {
+	flat := filepath.Join(dir, uuid)
+	if depth <= 0 || len(uuid) < 2*depth {
+		return flat
+	}
+
+	elems := []string{dir}
+	for i := 0; i < depth; i++ {
+		elems = append(elems, uuid[2*i:2*i+2])
+	}
+	sharded := filepath.Join(append(elems, uuid)...)
+
+	if exist, _ := exists(sharded); !exist {
+		if exist, _ = exists(flat); exist {
+			return flat
+		}
+	}
+	return sharded
+}
+
+// get the directory of a session in the TempDir, in the directory of its tenant if it has one
+func (b *Handler) sessionDir(uuid string) string {
+	return sessionDir(filepath.Join(b.cfg.TempDir, b.tenantOf(uuid)), b.cfg.ShardDepth, uuid)
+}
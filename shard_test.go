@@ -0,0 +1,89 @@
+package gobits
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestShardDepth(t *testing.T) {
+
+	var dirs []string
+	h := newTestHandler(t, Config{ShardDepth: 2}, func(event Event, session, path string) {
+		if event == EventCreateSession {
+			dirs = append(dirs, path)
+		}
+	})
+
+	// sessions are created under the first characters of their UUID
+	uuid := createSession(t, h)
+	sharded := filepath.Join(h.cfg.TempDir, uuid[0:2], uuid[2:4], uuid)
+	if len(dirs) != 1 || dirs[0] != sharded {
+		t.Fatalf("expected the session in %v, got %v", sharded, dirs)
+	}
+	if exist, _ := exists(filepath.Join(h.cfg.TempDir, uuid)); exist {
+		t.Error("session created directly in the TempDir")
+	}
+
+	// and found there by the fragments
+	res := sendFragment(h, uuid, "file.txt", []byte("data"), 0, 4)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("fragment failed: %v", res.Status)
+	}
+	if data, err := os.ReadFile(filepath.Join(sharded, "file.txt")); err != nil || string(data) != "data" {
+		t.Errorf("unexpected content %q: %v", data, err)
+	}
+	res = doPacket(h, "Close-Session", uuid, "/BITS/", nil, nil)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("close failed: %v", res.Status)
+	}
+
+	// terminated sessions are removed from their shard
+	uuid = createSession(t, h)
+	if err := h.TerminateSession(uuid); err != nil {
+		t.Fatal(err)
+	}
+	if exist, _ := exists(filepath.Join(h.cfg.TempDir, uuid[0:2], uuid[2:4], uuid)); exist {
+		t.Error("terminated session is still there")
+	}
+	res = sendFragment(h, uuid, "file.txt", []byte("data"), 0, 4)
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("expected fragments to a terminated session to fail, got %v", res.Status)
+	}
+
+}
+
+func TestShardDepthTransition(t *testing.T) {
+
+	// a session created before sharding was enabled
+	h := newTestHandler(t, Config{}, nil)
+	uuid := createSession(t, h)
+	sharded, err := NewHandler(Config{TempDir: h.cfg.TempDir, ShardDepth: 2}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// is still found in the TempDir
+	res := sendFragment(sharded, uuid, "file.txt", []byte("data"), 0, 4)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("fragment failed: %v", res.Status)
+	}
+	if exist, _ := exists(filepath.Join(h.cfg.TempDir, uuid, "file.txt")); !exist {
+		t.Error("file not stored in the unsharded session directory")
+	}
+	res = doPacket(sharded, "Cancel-Session", uuid, "/BITS/", nil, nil)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("cancel failed: %v", res.Status)
+	}
+
+	if _, err = NewHandler(Config{ShardDepth: maxShardDepth + 1}, nil); err == nil {
+		t.Error("expected a shard depth beyond the UUID prefix to fail")
+	}
+
+}
@@ -0,0 +1,146 @@
+package gobits
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Keys of the attributes logged to Config.Logger. Every record has the session and filename,
+// empty if the packet isn't about one
+const (
+	LogKeySession   = "session"         // the session id
+	LogKeyFilename  = "filename"        // the requested filename of a fragment, or the path of a received file in the session
+	LogKeyPacket    = "packet"          // the BITS packet type of the request
+	LogKeyStatus    = "status"          // the status of the response
+	LogKeyErrorCode = "bits_error_code" // the BITS error code of a refused request, in hex
+	LogKeyReason    = "reason"          // why a request is refused
+	LogKeyRange     = "range"           // the Content-Range of a fragment
+	LogKeyBytes     = "bytes"           // the bytes of a fragment, a received file or a closed session
+	LogKeyPath      = "path"            // where a session or file is stored
+	LogKeyError     = "error"           // an internal error
+)
+
+// statusKey is the context key of the statusWriter of a request
+type statusKey struct{}
+
+// keep the statusWriter in the context of a request, so the reason of a rejection reaches the log
+func (b *Handler) withStatus(r *http.Request, sw *statusWriter) *http.Request {
+	if b.cfg.Logger == nil {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), statusKey{}, sw))
+}
+
+// keep why a request is refused, for the log
+func refusedBecause(r *http.Request, reason error) {
+	if sw, ok := r.Context().Value(statusKey{}).(*statusWriter); ok {
+		sw.reason = reason
+	}
+}
+
+// log a handled request. Fragments are logged at debug level, and refused requests as warnings.
+// Internal errors are logged when they are reported
+func (b *Handler) logRequest(r *http.Request, sw *statusWriter, packetType, sessionID string) {
+	if b.cfg.Logger == nil {
+		return
+	}
+	var filename string
+	if packetType == "fragment" {
+		filename = path.Base(r.URL.Path)
+	}
+	attrs := []slog.Attr{
+		slog.String(LogKeySession, sessionID),
+		slog.String(LogKeyFilename, filename),
+		slog.String(LogKeyPacket, packetType),
+		slog.Int(LogKeyStatus, sw.status),
+	}
+	switch {
+	case sw.status >= http.StatusBadRequest && sw.status != http.StatusInternalServerError:
+		reason := http.StatusText(sw.status)
+		if sw.reason != nil {
+			reason = sw.reason.Error()
+		}
+		attrs = append(attrs, slog.String(LogKeyErrorCode, sw.Header().Get("BITS-Error-Code")), slog.String(LogKeyReason, reason))
+		b.cfg.Logger.LogAttrs(r.Context(), slog.LevelWarn, "request refused", attrs...)
+	case sw.status < http.StatusBadRequest && packetType == "fragment":
+		attrs = append(attrs, slog.String(LogKeyRange, r.Header.Get("Content-Range")), slog.Int64(LogKeyBytes, r.ContentLength))
+		b.cfg.Logger.LogAttrs(r.Context(), slog.LevelDebug, "fragment received", attrs...)
+	}
+}
+
+// log an event of a session
+func (b *Handler) logEvent(r *http.Request, event Event, uuid string, info eventInfo) {
+	if b.cfg.Logger == nil {
+		return
+	}
+	var msg string
+	switch event {
+	case EventCreateSession:
+		msg = "session created"
+	case EventRecieveFile:
+		msg = "file received"
+	case EventCloseSession:
+		msg = "session closed"
+	case EventCancelSession:
+		msg = "session canceled"
+		if r == nil {
+			msg = "session terminated"
+		}
+	case EventRejectFile, EventRejectClient:
+		// logged with the request
+		if r != nil {
+			refusedBecause(r, info.reason)
+		}
+		return
+	}
+	ctx := context.Background()
+	if r != nil {
+		ctx = r.Context()
+	}
+	b.cfg.Logger.LogAttrs(ctx, slog.LevelInfo, msg,
+		slog.String(LogKeySession, uuid),
+		slog.String(LogKeyFilename, info.filename),
+		slog.String(LogKeyPath, info.path),
+		slog.Uint64(LogKeyBytes, info.bytes),
+	)
+}
+
+// log something wrong with a request that is still handled, e.g. a header that is ignored
+func (b *Handler) logWarning(r *http.Request, msg string, reason error) {
+	if b.cfg.Logger == nil {
+		return
+	}
+	var filename string
+	if strings.EqualFold(r.Header.Get("BITS-Packet-Type"), "fragment") {
+		filename = path.Base(r.URL.Path)
+	}
+	b.cfg.Logger.LogAttrs(r.Context(), slog.LevelWarn, msg,
+		slog.String(LogKeySession, r.Header.Get("BITS-Session-Id")),
+		slog.String(LogKeyFilename, filename),
+		slog.String(LogKeyReason, reason.Error()),
+	)
+}
+
+// log an internal error
+func (b *Handler) logError(err error, r *http.Request) {
+	if b.cfg.Logger == nil {
+		return
+	}
+	ctx := context.Background()
+	var sessionID, filename string
+	if r != nil {
+		ctx = r.Context()
+		sessionID = r.Header.Get("BITS-Session-Id")
+		if strings.EqualFold(r.Header.Get("BITS-Packet-Type"), "fragment") {
+			filename = path.Base(r.URL.Path)
+		}
+	}
+	b.cfg.Logger.LogAttrs(ctx, slog.LevelError, "internal error",
+		slog.String(LogKeySession, sessionID),
+		slog.String(LogKeyFilename, filename),
+		slog.String(LogKeyError, err.Error()),
+	)
+}
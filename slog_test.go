@@ -0,0 +1,100 @@
+package gobits
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+// captureHandler is a slog.Handler keeping the records it gets
+type captureHandler struct {
+	mu      sync.Mutex
+	records []slog.Record
+}
+
+func (c *captureHandler) Enabled(ctx context.Context, level slog.Level) bool { return true }
+func (c *captureHandler) WithAttrs(attrs []slog.Attr) slog.Handler           { return c }
+func (c *captureHandler) WithGroup(name string) slog.Handler                 { return c }
+
+func (c *captureHandler) Handle(ctx context.Context, r slog.Record) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.records = append(c.records, r)
+	return nil
+}
+
+// get the attributes of a record
+func recordAttrs(r slog.Record) map[string]string {
+	attrs := make(map[string]string)
+	r.Attrs(func(a slog.Attr) bool {
+		attrs[a.Key] = a.Value.String()
+		return true
+	})
+	return attrs
+}
+
+func TestLogger(t *testing.T) {
+
+	capture := &captureHandler{}
+	fs := &memFS{}
+	h := newTestHandler(t, Config{Logger: slog.New(capture), Disallowed: []string{`.*\.exe`}}, nil).WithFileSystem(fs)
+	uuid := createSession(t, h)
+
+	res := doPacket(h, "Fragment", uuid, "/BITS/file.txt", map[string]string{
+		"Content-Range":    "bytes 0-3/4",
+		"Content-Length":   "4",
+		"X-Original-Mtime": "yesterday",
+	}, []byte("data"))
+	res.Body.Close()
+	res = sendFragment(h, uuid, "virus.exe", []byte("MZ"), 0, 2)
+	res.Body.Close()
+	fs.writeErr = syscall.EIO
+	res = sendFragment(h, uuid, "other.txt", []byte("data"), 0, 4)
+	res.Body.Close()
+	res = doPacket(h, "Close-Session", uuid, "/BITS/", nil, nil)
+	res.Body.Close()
+
+	expected := []struct {
+		level    slog.Level
+		msg      string
+		filename string
+		attrs    map[string]string
+	}{
+		{level: slog.LevelInfo, msg: "session created"},
+		{level: slog.LevelWarn, msg: "invalid X-Original-Mtime ignored", filename: "file.txt", attrs: map[string]string{LogKeyReason: "invalid timestamp syntax"}},
+		{level: slog.LevelInfo, msg: "file received", filename: "file.txt", attrs: map[string]string{LogKeyBytes: "4"}},
+		{level: slog.LevelDebug, msg: "fragment received", filename: "file.txt", attrs: map[string]string{LogKeyRange: "bytes 0-3/4", LogKeyStatus: "200"}},
+		{level: slog.LevelWarn, msg: "request refused", filename: "virus.exe", attrs: map[string]string{LogKeyReason: ErrFileDisallowed.Error(), LogKeyErrorCode: "80070005"}},
+		{level: slog.LevelError, msg: "internal error", filename: "other.txt"},
+		{level: slog.LevelInfo, msg: "session closed", attrs: map[string]string{LogKeyBytes: "4"}},
+	}
+	if len(capture.records) != len(expected) {
+		for _, r := range capture.records {
+			t.Log(r.Level, r.Message, recordAttrs(r))
+		}
+		t.Fatalf("expected %v records, got %v", len(expected), len(capture.records))
+	}
+	for i, e := range expected {
+		r := capture.records[i]
+		attrs := recordAttrs(r)
+		if r.Level != e.level || r.Message != e.msg {
+			t.Errorf("record %v: expected %v %q, got %v %q", i, e.level, e.msg, r.Level, r.Message)
+		}
+
+		// every record is about a session and maybe a file
+		if attrs[LogKeySession] != uuid {
+			t.Errorf("record %v: expected session %v, got %q", i, uuid, attrs[LogKeySession])
+		}
+		if filename, ok := attrs[LogKeyFilename]; !ok || filename != e.filename {
+			t.Errorf("record %v: expected filename %q, got %q", i, e.filename, filename)
+		}
+		for k, v := range e.attrs {
+			if attrs[k] != v {
+				t.Errorf("record %v: expected %v to be %q, got %q", i, k, v, attrs[k])
+			}
+		}
+	}
+
+}
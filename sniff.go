@@ -0,0 +1,71 @@
+package gobits
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+)
+
+// sniffLength is the max number of bytes passed to the content sniffer
+const sniffLength = 512
+
+// ErrExecutable is returned by SniffExecutable when a file is an executable
+var ErrExecutable = &RejectError{Code: codeAccessDenied, Reason: "executable content is not allowed"}
+
+// executableMagic are the magic numbers of PE, ELF and Mach-O executables
+var executableMagic = [][]byte{
+	[]byte("MZ"),             // PE
+	[]byte("\x7fELF"),        // ELF
+	{0xfe, 0xed, 0xfa, 0xce}, // Mach-O 32-bit
+	{0xfe, 0xed, 0xfa, 0xcf}, // Mach-O 64-bit
+	{0xce, 0xfa, 0xed, 0xfe}, // Mach-O 32-bit, little endian
+	{0xcf, 0xfa, 0xed, 0xfe}, // Mach-O 64-bit, little endian
+	{0xca, 0xfe, 0xba, 0xbe}, // Mach-O universal binary
+}
+
+// SniffExecutable is a content sniffer rejecting PE, ELF and Mach-O executables. A head that is
+// too short to tell is allowed, the sniffer is called again when more of the file is received
+func SniffExecutable(filename string, head []byte) error {
+	for _, magic := range executableMagic {
+		if bytes.HasPrefix(head, magic) {
+			return ErrExecutable
+		}
+	}
+	return nil
+}
+
+// get the MIME type of a file from the headers of its first fragment, or detect it from the data
+func detectContentType(r *http.Request, data []byte) string {
+	if contentType := r.Header.Get("X-Original-Content-Type"); contentType != "" {
+		return contentType
+	}
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		return contentType
+	}
+	if len(data) > sniffLength {
+		data = data[:sniffLength]
+	}
+	return http.DetectContentType(data)
+}
+
+// get the first sniffLength bytes of a file, from the size bytes already written to the part file
+// followed by data
+func fileHead(fs fileSystem, part string, size uint64, data []byte) ([]byte, error) {
+	head := make([]byte, 0, sniffLength)
+	if size > 0 {
+		f, err := fs.OpenFile(part, os.O_RDONLY, 0)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if _, err = io.ReadFull(f, head[:size]); err != nil {
+			return nil, err
+		}
+		head = head[:size]
+	}
+	if n := sniffLength - len(head); len(data) > n {
+		data = data[:n]
+	}
+	return append(head, data...), nil
+}
@@ -0,0 +1,124 @@
+package gobits
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSniffExecutable(t *testing.T) {
+
+	testcases := []struct {
+		name string
+		head []byte
+		err  error
+	}{
+		{name: "pe", head: []byte("MZ\x90\x00"), err: ErrExecutable},
+		{name: "elf", head: []byte("\x7fELF\x02\x01"), err: ErrExecutable},
+		{name: "mach-o", head: []byte{0xcf, 0xfa, 0xed, 0xfe, 0x07}, err: ErrExecutable},
+		{name: "universal", head: []byte{0xca, 0xfe, 0xba, 0xbe, 0x00}, err: ErrExecutable},
+		{name: "text", head: []byte("hello world")},
+		{name: "too short", head: []byte("\x7fE")},
+		{name: "empty", head: nil},
+	}
+
+	for _, tc := range testcases {
+		if err := SniffExecutable("file", tc.head); err != tc.err {
+			t.Errorf("%v: expected %v, got %v", tc.name, tc.err, err)
+		}
+	}
+
+}
+
+func TestFileHead(t *testing.T) {
+
+	part := filepath.Join(t.TempDir(), "file.part")
+	if err := os.WriteFile(part, []byte("0123"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	head, err := fileHead(osFS{}, part, 4, []byte("4567"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(head) != "01234567" {
+		t.Errorf("expected head %q, got %q", "01234567", head)
+	}
+
+	// nothing staged, and more data than is sniffed
+	head, err = fileHead(osFS{}, part, 0, bytes.Repeat([]byte("x"), sniffLength+10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(head) != sniffLength {
+		t.Errorf("expected %v bytes, got %v", sniffLength, len(head))
+	}
+
+}
+
+func TestFragmentContentType(t *testing.T) {
+
+	png := append([]byte("\x89PNG\x0d\x0a\x1a\x0a"), bytes.Repeat([]byte{0}, 24)...)
+
+	testcases := []struct {
+		name        string
+		headers     map[string]string
+		contentType string
+	}{
+		{name: "detected", contentType: "image/png"},
+		{name: "content type", headers: map[string]string{"Content-Type": "image/x-custom"}, contentType: "image/x-custom"},
+		{
+			name:        "original content type",
+			headers:     map[string]string{"Content-Type": "application/octet-stream", "X-Original-Content-Type": "image/x-original"},
+			contentType: "image/x-original",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			var received []Session
+			h := newTestHandler(t, Config{
+				SessionCallback: func(event Event, s Session) {
+					if event == EventRecieveFile {
+						received = append(received, s)
+					}
+				},
+			}, nil)
+			uuid := createSession(t, h)
+
+			// the type is taken from the first fragment
+			length := uint64(len(png))
+			for _, start := range []uint64{0, 16} {
+				headers := map[string]string{
+					"Content-Range":  fmt.Sprintf("bytes %d-%d/%d", start, start+15, length),
+					"Content-Length": "16",
+				}
+				if start == 0 {
+					for k, v := range tc.headers {
+						headers[k] = v
+					}
+				}
+				res := doPacket(h, "Fragment", uuid, "/BITS/image.png", headers, png[start:start+16])
+				res.Body.Close()
+				if res.StatusCode != http.StatusOK {
+					t.Fatalf("fragment %v failed: %v", start, res.Status)
+				}
+			}
+
+			if len(received) != 1 {
+				t.Fatalf("expected the file to be received once, got %v", received)
+			}
+			s := received[0]
+			if s.ID != uuid || s.Filename != "image.png" || s.Bytes != length {
+				t.Errorf("unexpected session %+v", s)
+			}
+			if s.ContentType != tc.contentType {
+				t.Errorf("expected content type %q, got %q", tc.contentType, s.ContentType)
+			}
+		})
+	}
+
+}
@@ -0,0 +1,70 @@
+package gobits
+
+import (
+	"os"
+	"time"
+)
+
+// SessionStore keeps track of the sessions that exist. The default store uses the session
+// directories in Config.TempDir. A store shared between servers behind a load balancer lets
+// them handle packets of sessions created by each other, but the uploaded files still need to
+// be on storage shared by the servers, e.g. NFS, since each fragment is written at its offset
+// in the file in the TempDir of the server receiving it.
+type SessionStore interface {
+	Create(id string, info SessionInfo) error // A new session is created
+	Touch(id string) error                    // A fragment is received for the session
+	Get(id string) (SessionInfo, error)       // Get a session, or ErrSessionNotFound
+	Delete(id string) error                   // The session is closed, canceled or terminated
+}
+
+// ProgressStore is a SessionStore that also keeps what is received of the files of a session,
+// so other servers and tools can see it. The handler records a file after each fragment written
+// to it. The files on the storage stay what the handler goes by
+type ProgressStore interface {
+	SessionStore
+	Progress(id string, file FileStatus) error // A fragment is written to the file
+}
+
+// SessionInfo is what a SessionStore keeps about a session
+type SessionInfo struct {
+	Created time.Time    // When the session was created, zero if unknown
+	Touched time.Time    // When the last fragment was received, zero if unknown
+	Tenant  string       // The tenant of the session, by Config.TenantResolver
+	Files   []FileStatus // What is received of the files, if the store is a ProgressStore
+}
+
+// dirStore is the default SessionStore, where a session exists as long as its directory does.
+// The directories are created and removed by the handler and the callback, so the store only
+// looks at them
+type dirStore struct {
+	dir     string
+	depth   int  // Config.ShardDepth
+	tenants bool // sessions can be in tenant directories, with Config.TenantResolver
+}
+
+func (s dirStore) Create(id string, info SessionInfo) error {
+	return nil
+}
+
+func (s dirStore) Touch(id string) error {
+	return nil
+}
+
+func (s dirStore) Get(id string) (SessionInfo, error) {
+	info, err := os.Stat(sessionDir(s.dir, s.depth, id))
+	if os.IsNotExist(err) && s.tenants {
+		if tenant, info, ok := findTenantSession(s.dir, s.depth, id); ok {
+			return SessionInfo{Touched: info.ModTime(), Tenant: tenant}, nil
+		}
+	}
+	if os.IsNotExist(err) || (err == nil && !info.IsDir()) {
+		return SessionInfo{}, ErrSessionNotFound
+	} else if err != nil {
+		return SessionInfo{}, err
+	}
+	return SessionInfo{Touched: info.ModTime()}, nil
+}
+
+func (s dirStore) Delete(id string) error {
+	return nil
+}
@@ -0,0 +1,162 @@
+package gobits
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// a SessionStore shared between handlers, as a database would be
+type memoryStore struct {
+	mu       sync.Mutex
+	sessions map[string]SessionInfo
+	touched  int
+	deleted  func(id string) // called before a session is deleted, if set
+	failing  error           // returned by Delete, if set
+}
+
+func (s *memoryStore) Create(id string, info SessionInfo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sessions == nil {
+		s.sessions = make(map[string]SessionInfo)
+	}
+	s.sessions[id] = info
+	return nil
+}
+
+func (s *memoryStore) Touch(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info, ok := s.sessions[id]
+	if !ok {
+		return ErrSessionNotFound
+	}
+	info.Touched = time.Now()
+	s.sessions[id] = info
+	s.touched++
+	return nil
+}
+
+func (s *memoryStore) Get(id string) (SessionInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info, ok := s.sessions[id]
+	if !ok {
+		return SessionInfo{}, ErrSessionNotFound
+	}
+	return info, nil
+}
+
+func (s *memoryStore) Delete(id string) error {
+	if s.deleted != nil {
+		s.deleted(id)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failing != nil {
+		return s.failing
+	}
+	delete(s.sessions, id)
+	return nil
+}
+
+func TestSessionStore(t *testing.T) {
+
+	// without a shared store, a server doesn't know the sessions of another
+	a := newTestHandler(t, Config{}, nil)
+	b := newTestHandler(t, Config{}, nil)
+	uuid := createSession(t, a)
+	res := sendFragment(b, uuid, "file.txt", []byte("data"), 0, 4)
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("expected status %v, got %v", http.StatusNotFound, res.StatusCode)
+	}
+
+	store := &memoryStore{}
+	var received, closed string
+	a = newTestHandler(t, Config{SessionStore: store}, nil)
+	b = newTestHandler(t, Config{SessionStore: store}, func(event Event, session, path string) {
+		switch event {
+		case EventRecieveFile:
+			received = session
+		case EventCloseSession:
+			closed = session
+		}
+	})
+
+	// a session created on one server is handled by the other
+	uuid = createSession(t, a)
+	if _, err := store.Get(uuid); err != nil {
+		t.Fatalf("session is not in the store: %v", err)
+	}
+	res = sendFragment(b, uuid, "file.txt", []byte("data"), 0, 4)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("fragment failed: %v", res.Status)
+	}
+	if received != uuid {
+		t.Errorf("file was never received")
+	}
+	if info, err := os.Stat(b.sessionDir(uuid)); err != nil || info.Mode().Perm() != 0700 {
+		t.Errorf("expected the session directory to be private, got %v %v", info, err)
+	}
+	if store.touched != 1 {
+		t.Errorf("expected the session to be touched once, got %v", store.touched)
+	}
+
+	res = doPacket(b, "Close-Session", uuid, "/BITS/", nil, nil)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("close-session failed: %v", res.Status)
+	}
+	if closed != uuid {
+		t.Errorf("session was never closed")
+	}
+	if _, err := store.Get(uuid); err != ErrSessionNotFound {
+		t.Errorf("expected the closed session to be deleted from the store, got %v", err)
+	}
+
+	// a terminated session leaves the store before its directory is removed
+	uuid = createSession(t, a)
+	store.deleted = func(id string) {
+		if _, err := os.Stat(a.sessionDir(id)); err != nil {
+			t.Errorf("expected the session directory while the session is deleted, got %v", err)
+		}
+	}
+	if err := a.TerminateSession(uuid); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(uuid); err != ErrSessionNotFound {
+		t.Errorf("expected the terminated session to be deleted from the store, got %v", err)
+	}
+	store.deleted = nil
+
+	// a session deleted from the store is gone on every server
+	uuid = createSession(t, a)
+	store.Delete(uuid)
+	res = sendFragment(a, uuid, "file.txt", []byte("data"), 0, 4)
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("expected status %v, got %v", http.StatusNotFound, res.StatusCode)
+	}
+
+	// a session that can't be deleted from the store is reported, and finished anyway
+	var reported error
+	c := newTestHandler(t, Config{SessionStore: store, ErrorHandler: func(err error, r *http.Request) {
+		reported = err
+	}}, nil)
+	uuid = createSession(t, c)
+	store.failing = errors.New("store is down")
+	res = doPacket(c, "Close-Session", uuid, "/BITS/", nil, nil)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("close-session failed: %v", res.Status)
+	}
+	if reported != store.failing {
+		t.Errorf("expected the store error to be reported, got %v", reported)
+	}
+}
@@ -0,0 +1,99 @@
+package gobits
+
+import "time"
+
+// How long sessions are tracked after they are done with. Finished sessions whose directory is
+// kept by the callback are tracked for a while, so late packets for them are rejected without
+// loading their metadata. Active sessions that never expire are only tracked while they are in
+// use, and are loaded from their metadata again by their next packet
+const (
+	sweepInterval     = time.Minute
+	finishedRetention = 10 * time.Minute
+	idleRetention     = time.Hour
+)
+
+// sweep the sessions regularly until the handler is closed
+func (b *Handler) sweepSessions(closed <-chan struct{}) {
+	defer b.workers.Done()
+	interval := sweepInterval
+	if b.cfg.SessionTimeout > 0 {
+		interval = min(interval, b.cfg.SessionTimeout/2)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-closed:
+			return
+		case now := <-ticker.C:
+			b.sweep(now)
+		}
+	}
+}
+
+// expire the active sessions that got no fragment for the SessionTimeout, and stop tracking the
+// sessions that are finished or idle, so the handler doesn't grow with every session it has seen
+func (b *Handler) sweep(now time.Time) {
+	b.mu.Lock()
+	sessions := make(map[string]*session, len(b.sessions))
+	for uuid, s := range b.sessions {
+		sessions[uuid] = s
+	}
+	b.mu.Unlock()
+
+	for uuid, s := range sessions {
+		s.mu.Lock()
+		expire := b.expired(s, now)
+		evict := !expire && b.evictable(s, now)
+		if evict {
+			s.evicted = true
+			b.mu.Lock()
+			if b.sessions[uuid] == s {
+				delete(b.sessions, uuid)
+			}
+			b.mu.Unlock()
+		}
+		s.mu.Unlock()
+
+		// the session is checked again, it may have got a fragment since
+		if expire {
+			b.terminate(uuid, sessionExpired, func(s *session) bool { return b.expired(s, now) })
+		}
+		if evict {
+			b.forgetSession(uuid)
+			b.forgetActive(uuid)
+			b.forgetTenant(uuid)
+		}
+	}
+}
+
+// check if a locked session is active, but got no fragment for the SessionTimeout
+func (b *Handler) expired(s *session, now time.Time) bool {
+	return b.cfg.SessionTimeout > 0 && s.state == sessionActive && now.Sub(s.touched) >= b.cfg.SessionTimeout
+}
+
+// check if a locked session can stop being tracked
+func (b *Handler) evictable(s *session, now time.Time) bool {
+	switch s.state {
+	case sessionClosed, sessionCanceled, sessionExpired:
+		return now.Sub(s.touched) >= finishedRetention
+	case sessionActive:
+		// sessions that expire are tracked until they do
+		return b.cfg.SessionTimeout == 0 && now.Sub(s.touched) >= idleRetention &&
+			len(s.watchdogs) == 0 && len(s.inspectors) == 0
+	}
+	return false
+}
+
+// stop counting a session that is no longer tracked as active, and forget how it was created
+func (b *Handler) forgetActive(uuid string) {
+	b.activeMu.Lock()
+	delete(b.origins, uuid)
+	_, ok := b.active[uuid]
+	delete(b.active, uuid)
+	active := len(b.active)
+	b.activeMu.Unlock()
+	if ok {
+		b.metrics.SetGauge(MetricActiveSessions, float64(active))
+	}
+}
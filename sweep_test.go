@@ -0,0 +1,160 @@
+package gobits
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// move the last activity of a session back in time
+func backdate(h *Handler, uuid string, d time.Duration) {
+	s := h.lockSession(uuid)
+	s.touched = s.touched.Add(-d)
+	s.mu.Unlock()
+}
+
+// check how many sessions are tracked, and in the maps kept by session
+func checkTracked(t *testing.T, h *Handler, sessions, created, active, tenants int) {
+	t.Helper()
+
+	h.mu.Lock()
+	gotSessions, gotCreated := len(h.sessions), len(h.created)
+	h.mu.Unlock()
+	h.activeMu.Lock()
+	gotActive, gotOrigins := len(h.active), len(h.origins)
+	h.activeMu.Unlock()
+	h.tenantMu.Lock()
+	gotTenants := len(h.tenants)
+	h.tenantMu.Unlock()
+	if gotSessions != sessions || gotCreated != created || gotActive != active || gotOrigins != active || gotTenants != tenants {
+		t.Errorf("expected %v sessions, %v keys, %v active and %v tenants, got %v, %v, %v (%v origins) and %v",
+			sessions, created, active, tenants, gotSessions, gotCreated, gotActive, gotOrigins, gotTenants)
+	}
+}
+
+func TestSessionTimeout(t *testing.T) {
+
+	canceled := make(chan string, 2)
+	metrics := newFakeMetrics()
+	h := newTestHandler(t, Config{SessionTimeout: time.Hour, Metrics: metrics}, func(event Event, session, path string) {
+		if event == EventCancelSession {
+			canceled <- session
+		}
+	})
+
+	// a session without fragments expires, one getting them doesn't
+	idle := createSession(t, h)
+	busy := createSession(t, h)
+	res := sendFragment(h, busy, "file.txt", []byte("01234"), 0, 10)
+	res.Body.Close()
+	h.sweep(time.Now())
+	checkTracked(t, h, 2, 0, 2, 0)
+
+	backdate(h, idle, time.Hour)
+	h.sweep(time.Now())
+	select {
+	case session := <-canceled:
+		if session != idle {
+			t.Errorf("expected session %v to expire, got %v", idle, session)
+		}
+	default:
+		t.Fatal("session not expired")
+	}
+	if _, err := os.Stat(h.sessionDir(idle)); !os.IsNotExist(err) {
+		t.Errorf("expected the directory of the session to be removed, got %v", err)
+	}
+	res = sendFragment(h, idle, "file.txt", []byte("01234"), 0, 10)
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("expected the expired session to be gone, got %v", res.Status)
+	}
+	metrics.mu.Lock()
+	if got := metrics.counters[MetricSessions+" event=expired"]; got != 1 {
+		t.Errorf("expected an expired session, got %v", got)
+	}
+	if got := metrics.gauges[MetricActiveSessions]; got != 1 {
+		t.Errorf("expected an active session, got %v", got)
+	}
+	metrics.mu.Unlock()
+	checkTracked(t, h, 1, 0, 1, 0)
+
+	// the busy session is still there
+	res = sendFragment(h, busy, "file.txt", []byte("56789"), 5, 10)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("expected the busy session to take the fragment, got %v", res.Status)
+	}
+
+	// sessions expire without a sweep by hand
+	h = newTestHandler(t, Config{SessionTimeout: 50 * time.Millisecond}, func(event Event, session, path string) {
+		if event == EventCancelSession {
+			canceled <- session
+		}
+	})
+	uuid := createSession(t, h)
+	select {
+	case session := <-canceled:
+		if session != uuid {
+			t.Errorf("expected session %v to expire, got %v", uuid, session)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("session not expired")
+	}
+}
+
+func TestSweepSessions(t *testing.T) {
+
+	h := newTestHandler(t, Config{
+		DeduplicateCreate: true,
+		TenantResolver:    func(r *http.Request) (string, error) { return "acme", nil },
+	}, nil)
+
+	// a closed session whose directory is kept, and a session that is abandoned
+	closed := createSession(t, h)
+	res := doPacket(h, "Close-Session", closed, "/BITS/", nil, nil)
+	res.Body.Close()
+	res = doPacket(h, "Create-Session", "", "/BITS/", map[string]string{
+		"BITS-Supported-Protocols": h.cfg.Protocol,
+		"Idempotency-Key":          "abandoned",
+	}, nil)
+	res.Body.Close()
+	idle := res.Header.Get("BITS-Session-Id")
+	res = sendFragment(h, idle, "file.txt", []byte("01234"), 0, 10)
+	res.Body.Close()
+	h.sweep(time.Now())
+	checkTracked(t, h, 2, 1, 1, 2)
+
+	// finished sessions are forgotten first, and still rejected from their metadata
+	h.sweep(time.Now().Add(finishedRetention))
+	checkTracked(t, h, 1, 1, 1, 1)
+	res = sendFragment(h, closed, "file.txt", []byte("01234"), 0, 10)
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("expected the closed session to reject fragments, got %v", res.Status)
+	}
+
+	// idle sessions are forgotten later, and restored by their next packet
+	h.sweep(time.Now().Add(idleRetention))
+	checkTracked(t, h, 0, 0, 0, 0)
+	res = sendFragment(h, idle, "file.txt", []byte("56789"), 5, 10)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected the idle session to take the fragment, got %v", res.Status)
+	}
+	res = doPacket(h, "Close-Session", idle, "/BITS/", nil, nil)
+	res.Body.Close()
+	if data, err := os.ReadFile(filepath.Join(h.sessionDir(idle), "file.txt")); err != nil || string(data) != "0123456789" {
+		t.Errorf("expected the file to be complete, got %q %v", data, err)
+	}
+
+	// the handler can be closed more than once
+	if err := h.Close(context.Background()); err != nil {
+		t.Error(err)
+	}
+	if err := h.Close(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,31 @@
+package gobits
+
+import "os"
+
+// SyncPolicy decides when received data is flushed to disk, so files that are reported as
+// received survive a power loss
+type SyncPolicy int
+
+// Policies for flushing received data
+const (
+	SyncNone          SyncPolicy = 0 // Leave it to the operating system
+	SyncOnComplete    SyncPolicy = 1 // Sync a completed file and its directory before it is received
+	SyncEveryFragment SyncPolicy = 2 // Sync the file after every fragment too, and the directory when it is created
+)
+
+// functions used to sync files and directories, replaced by tests to see that they are called.
+// Directories are always on the OS file system
+var (
+	syncFile = fsFile.Sync
+	syncDir  = syncDirectory
+)
+
+// sync a directory, so the files created or renamed in it are kept
+func syncDirectory(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
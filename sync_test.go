@@ -0,0 +1,145 @@
+package gobits
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// count the files and directories synced, until the returned function is called
+func countSyncs() (files, dirs *int, restore func()) {
+	files, dirs = new(int), new(int)
+	syncFile = func(f fsFile) error {
+		*files++
+		return f.Sync()
+	}
+	syncDir = func(dir string) error {
+		*dirs++
+		return syncDirectory(dir)
+	}
+	return files, dirs, func() {
+		syncFile, syncDir = fsFile.Sync, syncDirectory
+	}
+}
+
+func TestSyncPolicy(t *testing.T) {
+
+	testcases := []struct {
+		name   string
+		policy SyncPolicy
+		dest   bool
+		files  int
+		dirs   int
+	}{
+		{name: "none", policy: SyncNone},
+		{name: "on complete", policy: SyncOnComplete, files: 1, dirs: 1},
+		{name: "on complete with dest dir", policy: SyncOnComplete, dest: true, files: 1, dirs: 1},
+		{name: "every fragment", policy: SyncEveryFragment, files: 2, dirs: 2},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			files, dirs, restore := countSyncs()
+			defer restore()
+
+			cfg := Config{SyncPolicy: tc.policy}
+			if tc.dest {
+				cfg.DestDir = t.TempDir()
+			}
+
+			// the file and its directory are synced before the file is received
+			var synced [2]int
+			h := newTestHandler(t, cfg, func(event Event, session, path string) {
+				if event == EventRecieveFile {
+					synced = [2]int{*files, *dirs}
+				}
+			})
+			uuid := createSession(t, h)
+
+			res := sendFragment(h, uuid, "file.txt", []byte("01234"), 0, 10)
+			res.Body.Close()
+			res = sendFragment(h, uuid, "file.txt", []byte("56789"), 5, 10)
+			res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("fragment failed: %v", res.Status)
+			}
+			if *files != tc.files || *dirs != tc.dirs {
+				t.Errorf("expected %v files and %v directories synced, got %v and %v", tc.files, tc.dirs, *files, *dirs)
+			}
+			if synced != [2]int{tc.files, tc.dirs} {
+				t.Errorf("file received before it was synced, %v files and %v directories", synced[0], synced[1])
+			}
+		})
+	}
+
+}
+
+func TestSyncPolicyError(t *testing.T) {
+
+	_, _, restore := countSyncs()
+	defer restore()
+	syncFile = func(f fsFile) error {
+		return errors.New("sync failed")
+	}
+
+	var received bool
+	h := newTestHandler(t, Config{SyncPolicy: SyncOnComplete}, func(event Event, session, path string) {
+		received = received || event == EventRecieveFile
+	})
+	uuid := createSession(t, h)
+
+	// a file that can't be synced isn't received
+	res := sendFragment(h, uuid, "file.txt", []byte("data"), 0, 4)
+	res.Body.Close()
+	if res.StatusCode != http.StatusInternalServerError {
+		t.Errorf("expected status %v, got %v", http.StatusInternalServerError, res.StatusCode)
+	}
+	if received {
+		t.Error("file received without being synced")
+	}
+
+}
+
+// The cost of each policy when a 1 MiB file is sent in 64 KiB fragments
+func BenchmarkSyncPolicy(b *testing.B) {
+
+	const fragmentSize = 64 << 10
+	data := bytes.Repeat([]byte("0123456789abcdef"), (1<<20)/16)
+
+	policies := []struct {
+		name   string
+		policy SyncPolicy
+	}{
+		{name: "none", policy: SyncNone},
+		{name: "on-complete", policy: SyncOnComplete},
+		{name: "every-fragment", policy: SyncEveryFragment},
+	}
+
+	for _, p := range policies {
+		b.Run(p.name, func(b *testing.B) {
+			h, err := NewHandler(Config{TempDir: b.TempDir(), SyncPolicy: p.policy}, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			res := doPacket(h, "Create-Session", "", "/BITS/", map[string]string{
+				"BITS-Supported-Protocols": h.cfg.Protocol,
+			}, nil)
+			uuid := res.Header.Get("BITS-Session-Id")
+
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				name := fmt.Sprintf("file%d.bin", i)
+				for start := 0; start < len(data); start += fragmentSize {
+					res := sendFragment(h, uuid, name, data[start:start+fragmentSize], uint64(start), uint64(len(data)))
+					if res.StatusCode != http.StatusOK {
+						b.Fatalf("fragment failed: %v", res.Status)
+					}
+				}
+			}
+		})
+	}
+
+}
@@ -0,0 +1,170 @@
+package gobits
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// maxTenantLength is the max length in bytes of a tenant
+const maxTenantLength = 64
+
+// errInvalidTenant is returned for tenants that can't be used as a directory name
+var errInvalidTenant = errors.New("invalid tenant")
+
+// TenantStats are the statistics of a tenant since the handler was created
+type TenantStats struct {
+	Sessions int    // Sessions created since the start that aren't closed or canceled
+	Bytes    uint64 // Bytes received, not counting fragments sent again
+}
+
+// check that a tenant is a single directory name. Only letters, digits, dashes, underscores and
+// dots are allowed, and it can't start with a dot
+func validTenant(tenant string) bool {
+	if tenant == "" || len(tenant) > maxTenantLength || tenant[0] == '.' {
+		return false
+	}
+	for _, c := range tenant {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// get the tenant of a new session, empty without a TenantResolver
+func (b *Handler) resolveTenant(r *http.Request) (string, error) {
+	if b.cfg.TenantResolver == nil {
+		return "", nil
+	}
+	tenant, err := b.cfg.TenantResolver(r)
+	if err != nil {
+		return "", err
+	}
+	if !validTenant(tenant) {
+		return "", errInvalidTenant
+	}
+	return tenant, nil
+}
+
+// remember the tenant of a session, so its directory is found without the session store
+func (b *Handler) rememberTenant(uuid, tenant string) {
+	if tenant == "" {
+		return
+	}
+	b.tenantMu.Lock()
+	defer b.tenantMu.Unlock()
+	if b.tenants == nil {
+		b.tenants = make(map[string]string)
+	}
+	b.tenants[uuid] = tenant
+}
+
+// forget the tenant of a session that is no longer tracked
+func (b *Handler) forgetTenant(uuid string) {
+	if b.cfg.TenantResolver == nil {
+		return
+	}
+	b.tenantMu.Lock()
+	defer b.tenantMu.Unlock()
+	delete(b.tenants, uuid)
+}
+
+// get the tenant of a session, recorded in the session store when it was created. Empty for
+// sessions without a tenant, or that don't exist
+func (b *Handler) tenantOf(uuid string) string {
+	if b.cfg.TenantResolver == nil {
+		return ""
+	}
+	b.tenantMu.Lock()
+	tenant, ok := b.tenants[uuid]
+	b.tenantMu.Unlock()
+	if ok {
+		return tenant
+	}
+	info, err := b.cfg.SessionStore.Get(uuid)
+	if err != nil {
+		return ""
+	}
+	b.rememberTenant(uuid, info.Tenant)
+	return info.Tenant
+}
+
+// count the sessions of a tenant. Only sessions created since the start are counted
+func (b *Handler) countTenant(event Event, uuid string) {
+	if event != EventCreateSession && event != EventCloseSession && event != EventCancelSession {
+		return
+	}
+	tenant := b.tenantOf(uuid)
+	if tenant == "" {
+		return
+	}
+	b.tenantMu.Lock()
+	defer b.tenantMu.Unlock()
+	stats := b.statsOf(tenant)
+	if event == EventCreateSession {
+		stats.Sessions++
+	} else if stats.Sessions > 0 {
+		stats.Sessions--
+	}
+}
+
+// count the bytes received by a tenant
+func (b *Handler) tenantReceived(uuid string, n uint64) {
+	tenant := b.tenantOf(uuid)
+	if tenant == "" || n == 0 {
+		return
+	}
+	b.tenantMu.Lock()
+	defer b.tenantMu.Unlock()
+	b.statsOf(tenant).Bytes += n
+}
+
+// get the statistics of a tenant, tenantMu must be held
+func (b *Handler) statsOf(tenant string) *TenantStats {
+	if b.tenantStats == nil {
+		b.tenantStats = make(map[string]*TenantStats)
+	}
+	stats, ok := b.tenantStats[tenant]
+	if !ok {
+		stats = &TenantStats{}
+		b.tenantStats[tenant] = stats
+	}
+	return stats
+}
+
+// copy the statistics of the tenants, nil if there are none
+func (b *Handler) tenantsStats() map[string]TenantStats {
+	b.tenantMu.Lock()
+	defer b.tenantMu.Unlock()
+	if len(b.tenantStats) == 0 {
+		return nil
+	}
+	stats := make(map[string]TenantStats, len(b.tenantStats))
+	for tenant, s := range b.tenantStats {
+		stats[tenant] = *s
+	}
+	return stats
+}
+
+// find the directory of a session in the tenant directories of dir, for dirStore. Returns the
+// tenant, or false if the session isn't found
+func findTenantSession(dir string, depth int, uuid string) (string, os.FileInfo, bool) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", nil, false
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || !validTenant(entry.Name()) {
+			continue
+		}
+		info, err := os.Stat(sessionDir(filepath.Join(dir, entry.Name()), depth, uuid))
+		if err == nil && info.IsDir() {
+			return entry.Name(), info, true
+		}
+	}
+	return "", nil, false
+}
@@ -0,0 +1,117 @@
+package gobits
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// resolve the tenant from a header
+func headerTenant(r *http.Request) (string, error) {
+	tenant := r.Header.Get("X-Tenant")
+	if tenant == "" {
+		return "", errors.New("no tenant")
+	}
+	return tenant, nil
+}
+
+func TestTenantResolver(t *testing.T) {
+
+	h := newTestHandler(t, Config{TenantResolver: headerTenant, ShardDepth: 1}, nil)
+
+	res := doPacket(h, "Create-Session", "", "/BITS/", map[string]string{
+		"BITS-Supported-Protocols": h.cfg.Protocol,
+		"X-Tenant":                 "acme",
+	}, nil)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("failed to create session: %v", res.Status)
+	}
+	uuid := res.Header.Get("BITS-Session-Id")
+
+	dir := filepath.Join(h.cfg.TempDir, "acme", uuid[:2], uuid)
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		t.Fatalf("expected the session directory %v: %v", dir, err)
+	}
+
+	// the tenant isn't resolved again, even after a restart
+	h = restartHandler(t, h, nil)
+	res = doPacket(h, "Fragment", uuid, "/BITS/file.txt", map[string]string{
+		"Content-Range": "bytes 0-3/4",
+		"X-Tenant":      "other",
+	}, []byte("data"))
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("failed to send fragment: %v", res.Status)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "file.txt")); err != nil {
+		t.Errorf("expected the file in the tenant directory: %v", err)
+	}
+
+	// the restarted handler only counts what it received
+	stats := h.Stats().Tenants["acme"]
+	if stats.Sessions != 0 || stats.Bytes != 4 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	res = doPacket(h, "Close-Session", uuid, "/BITS/", nil, nil)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("failed to close session: %v", res.Status)
+	}
+}
+
+func TestTenantStats(t *testing.T) {
+
+	h := newTestHandler(t, Config{TenantResolver: headerTenant}, nil)
+
+	create := func(tenant string) string {
+		t.Helper()
+		res := doPacket(h, "Create-Session", "", "/BITS/", map[string]string{
+			"BITS-Supported-Protocols": h.cfg.Protocol,
+			"X-Tenant":                 tenant,
+		}, nil)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("failed to create session: %v", res.Status)
+		}
+		return res.Header.Get("BITS-Session-Id")
+	}
+	a1, a2, b := create("a"), create("a"), create("b")
+	sendFragment(h, a1, "one.txt", []byte("12345"), 0, 5).Body.Close()
+	sendFragment(h, a2, "two.txt", []byte("123"), 0, 3).Body.Close()
+	sendFragment(h, b, "one.txt", []byte("1"), 0, 1).Body.Close()
+	doPacket(h, "Cancel-Session", a2, "/BITS/", nil, nil).Body.Close()
+
+	stats := h.Stats().Tenants
+	expected := map[string]TenantStats{"a": {Sessions: 1, Bytes: 8}, "b": {Sessions: 1, Bytes: 1}}
+	if len(stats) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, stats)
+	}
+	for tenant, s := range expected {
+		if stats[tenant] != s {
+			t.Errorf("%v: expected %+v, got %+v", tenant, s, stats[tenant])
+		}
+	}
+}
+
+func TestTenantRefused(t *testing.T) {
+
+	h := newTestHandler(t, Config{TenantResolver: headerTenant}, nil)
+
+	for _, tenant := range []string{"", "..", "a/b", ".hidden"} {
+		res := doPacket(h, "Create-Session", "", "/BITS/", map[string]string{
+			"BITS-Supported-Protocols": h.cfg.Protocol,
+			"X-Tenant":                 tenant,
+		}, nil)
+		res.Body.Close()
+		if res.StatusCode != http.StatusForbidden {
+			t.Errorf("%q: expected status %v, got %v", tenant, http.StatusForbidden, res.StatusCode)
+		}
+	}
+	if entries, _ := os.ReadDir(h.cfg.TempDir); len(entries) != 0 {
+		t.Errorf("expected no directories, got %v", entries)
+	}
+}
@@ -0,0 +1,44 @@
+package gobits
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+)
+
+// ClientCert identifies a client by the TLS certificate it authenticated with
+type ClientCert struct {
+	Subject     string   `json:"subject"`        // common name of the subject
+	SANs        []string `json:"sans,omitempty"` // DNS names, email addresses, IP addresses and URIs of the certificate
+	Fingerprint string   `json:"fingerprint"`    // hex SHA-256 digest of the certificate
+}
+
+// CertFileFilter is a FileFilter that also decides by the certificate the session was created
+// with. AllowCert is called instead of Allow, the certificate is nil for clients without one
+type CertFileFilter interface {
+	FileFilter
+	AllowCert(cert *ClientCert, session, filename string, declaredSize uint64) error
+}
+
+// ClientCertificate returns the verified certificate of the client of a request, nil for plain
+// HTTP or if the client didn't send a certificate that was verified. Authenticators can use it
+// to authenticate clients by their certificates
+func ClientCertificate(r *http.Request) *ClientCert {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+
+	c := &ClientCert{Subject: cert.Subject.CommonName}
+	c.SANs = append(c.SANs, cert.DNSNames...)
+	c.SANs = append(c.SANs, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		c.SANs = append(c.SANs, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		c.SANs = append(c.SANs, uri.String())
+	}
+	sum := sha256.Sum256(cert.Raw)
+	c.Fingerprint = hex.EncodeToString(sum[:])
+	return c
+}
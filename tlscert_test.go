@@ -0,0 +1,160 @@
+package gobits
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// create a certificate signed by parent, or a self-signed CA if parent is nil
+func newCert(t *testing.T, template *x509.Certificate, parent *tls.Certificate) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	signer, signerKey := template, any(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// certFilter records the certificates it is asked about
+type certFilter struct {
+	mu    sync.Mutex
+	certs []*ClientCert
+}
+
+func (f *certFilter) Allow(session, filename string, declaredSize uint64) error {
+	return nil
+}
+
+func (f *certFilter) AllowCert(cert *ClientCert, session, filename string, declaredSize uint64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.certs = append(f.certs, cert)
+	return nil
+}
+
+func TestClientCert(t *testing.T) {
+
+	ca := newCert(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "devices"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	device := newCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "device-1"},
+		DNSNames:     []string{"device-1.example.com"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, &ca)
+
+	var mu sync.Mutex
+	var created Session
+	filter := &certFilter{}
+	cfg := Config{
+		FileFilter: filter,
+		SessionCallback: func(event Event, s Session) {
+			mu.Lock()
+			defer mu.Unlock()
+			if event == EventCreateSession {
+				created = s
+			}
+		},
+	}
+	h := newTestHandler(t, cfg, nil)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	server := httptest.NewUnstartedServer(h)
+	server.TLS = &tls.Config{ClientAuth: tls.VerifyClientCertIfGiven, ClientCAs: pool}
+	server.StartTLS()
+	defer server.Close()
+
+	client := server.Client()
+	client.Transport.(*http.Transport).TLSClientConfig.Certificates = []tls.Certificate{device}
+
+	send := func(packetType, sessionID, path string, headers map[string]string, body string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(h.cfg.AllowedMethod, server.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("BITS-Packet-Type", packetType)
+		if sessionID != "" {
+			req.Header.Set("BITS-Session-Id", sessionID)
+		}
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	res := send("Create-Session", "", "/BITS/", map[string]string{"BITS-Supported-Protocols": h.cfg.Protocol}, "")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("failed to create session: %v", res.Status)
+	}
+	res = send("Fragment", res.Header.Get("BITS-Session-Id"), "/BITS/file.txt", map[string]string{"Content-Range": "bytes 0-0/1"}, "x")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("failed to send fragment: %v", res.Status)
+	}
+
+	sum := sha256.Sum256(device.Leaf.Raw)
+	expected := ClientCert{Subject: "device-1", SANs: []string{"device-1.example.com"}, Fingerprint: hex.EncodeToString(sum[:])}
+
+	mu.Lock()
+	defer mu.Unlock()
+	cert := created.ClientCert
+	if cert == nil {
+		t.Fatal("expected a client certificate in the create-session event")
+	}
+	if cert.Subject != expected.Subject || len(cert.SANs) != 1 || cert.SANs[0] != expected.SANs[0] || cert.Fingerprint != expected.Fingerprint {
+		t.Errorf("expected certificate %+v, got %+v", expected, *cert)
+	}
+
+	filter.mu.Lock()
+	defer filter.mu.Unlock()
+	if len(filter.certs) != 1 || filter.certs[0] == nil || filter.certs[0].Fingerprint != expected.Fingerprint {
+		t.Errorf("expected the filter to get the certificate, got %v", filter.certs)
+	}
+}
+
+func TestClientCertPlainHTTP(t *testing.T) {
+
+	r := httptest.NewRequest("BITS_POST", "/BITS/", nil)
+	if cert := ClientCertificate(r); cert != nil {
+		t.Errorf("expected no certificate, got %+v", *cert)
+	}
+}
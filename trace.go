@@ -0,0 +1,86 @@
+package gobits
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+)
+
+// Tracer traces the packets of a handler, e.g. with OpenTelemetry. Extract returns the context
+// with the trace context of the request headers, and StartSpan starts a span in it
+type Tracer interface {
+	Extract(ctx context.Context, header http.Header) context.Context
+	StartSpan(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer. SetError marks the span as failed
+type Span interface {
+	SetAttributes(attrs ...Attribute)
+	SetError(err error)
+	End()
+}
+
+// Attribute is a key and value describing a span
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// Attributes of the spans
+const (
+	AttributeSessionID    = "bits.session_id"    // the session id of the packet, or of the created session
+	AttributeFilename     = "bits.filename"      // the filename of a fragment
+	AttributeRange        = "bits.range"         // the Content-Range of a fragment
+	AttributeBytesWritten = "bits.bytes_written" // the bytes of a fragment written to the file
+	AttributeStatusCode   = "http.status_code"   // the status of the response
+)
+
+// names of the spans of the traced packets
+var spanNames = map[string]string{
+	"create-session": "gobits.create-session",
+	"fragment":       "gobits.fragment",
+	"close-session":  "gobits.close-session",
+	"cancel-session": "gobits.cancel-session",
+}
+
+// spanKey is the context key of the span of a request
+type spanKey struct{}
+
+// start the span of a packet, and return the request with the span in its context. The span is
+// nil if the packet isn't traced
+func (b *Handler) startSpan(r *http.Request, packetType, sessionID string) (*http.Request, Span) {
+	name, ok := spanNames[packetType]
+	if b.cfg.Tracer == nil || !ok {
+		return r, nil
+	}
+	var attrs []Attribute
+	if sessionID != "" {
+		attrs = append(attrs, Attribute{Key: AttributeSessionID, Value: sessionID})
+	}
+	if packetType == "fragment" {
+		attrs = append(attrs,
+			Attribute{Key: AttributeFilename, Value: path.Base(r.URL.Path)},
+			Attribute{Key: AttributeRange, Value: r.Header.Get("Content-Range")},
+		)
+	}
+	ctx := b.cfg.Tracer.Extract(r.Context(), r.Header)
+	ctx, span := b.cfg.Tracer.StartSpan(ctx, name, attrs...)
+	return r.WithContext(context.WithValue(ctx, spanKey{}, span)), span
+}
+
+// end the span of a packet with the status of the response
+func endSpan(span Span, w *statusWriter) {
+	span.SetAttributes(Attribute{Key: AttributeStatusCode, Value: w.status})
+	if w.status >= http.StatusBadRequest {
+		span.SetError(fmt.Errorf("%d %s, BITS error code %s", w.status, http.StatusText(w.status), w.Header().Get("BITS-Error-Code")))
+	}
+	span.End()
+}
+
+// add attributes to the span of a request, if it is traced
+func spanAttributes(r *http.Request, attrs ...Attribute) {
+	if span, ok := r.Context().Value(spanKey{}).(Span); ok {
+		span.SetAttributes(attrs...)
+	}
+}
@@ -0,0 +1,132 @@
+package gobits
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+// recordedSpan is a span kept by a spanRecorder
+type recordedSpan struct {
+	name   string
+	parent string // the trace of the request headers
+	attrs  map[string]interface{}
+	err    error
+	ended  bool
+}
+
+func (s *recordedSpan) SetAttributes(attrs ...Attribute) {
+	for _, a := range attrs {
+		s.attrs[a.Key] = a.Value
+	}
+}
+
+func (s *recordedSpan) SetError(err error) {
+	s.err = err
+}
+
+func (s *recordedSpan) End() {
+	s.ended = true
+}
+
+// traceKey is the context key of the trace extracted by a spanRecorder
+type traceKey struct{}
+
+// spanRecorder is a Tracer keeping its spans in memory. The trace context is the traceparent header
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []*recordedSpan
+}
+
+func (t *spanRecorder) Extract(ctx context.Context, header http.Header) context.Context {
+	return context.WithValue(ctx, traceKey{}, header.Get("traceparent"))
+}
+
+func (t *spanRecorder) StartSpan(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span) {
+	parent, _ := ctx.Value(traceKey{}).(string)
+	span := &recordedSpan{name: name, parent: parent, attrs: make(map[string]interface{})}
+	span.SetAttributes(attrs...)
+	t.mu.Lock()
+	t.spans = append(t.spans, span)
+	t.mu.Unlock()
+	return ctx, span
+}
+
+func TestTracer(t *testing.T) {
+
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	tracer := &spanRecorder{}
+	h := newTestHandler(t, Config{Tracer: tracer}, nil)
+
+	res := doPacket(h, "Create-Session", "", "/BITS/", map[string]string{
+		"BITS-Supported-Protocols": h.cfg.Protocol,
+		"traceparent":              traceparent,
+	}, nil)
+	res.Body.Close()
+	uuid := res.Header.Get("BITS-Session-Id")
+	res = doPacket(h, "Ping", "", "/BITS/", nil, nil)
+	res.Body.Close()
+	res = sendFragment(h, uuid, "file.txt", []byte("data"), 0, 4)
+	res.Body.Close()
+	res = sendFragment(h, "unknown", "file.txt", []byte("data"), 0, 4)
+	res.Body.Close()
+	res = doPacket(h, "Close-Session", uuid, "/BITS/", nil, nil)
+	res.Body.Close()
+
+	expected := []struct {
+		name  string
+		attrs map[string]interface{}
+		err   bool
+	}{
+		{name: "gobits.create-session", attrs: map[string]interface{}{
+			AttributeSessionID:  uuid,
+			AttributeStatusCode: http.StatusOK,
+		}},
+		{name: "gobits.fragment", attrs: map[string]interface{}{
+			AttributeSessionID:    uuid,
+			AttributeFilename:     "file.txt",
+			AttributeRange:        "bytes 0-3/4",
+			AttributeBytesWritten: 4,
+			AttributeStatusCode:   http.StatusOK,
+		}},
+		{name: "gobits.fragment", err: true, attrs: map[string]interface{}{
+			AttributeSessionID:  "unknown",
+			AttributeFilename:   "file.txt",
+			AttributeRange:      "bytes 0-3/4",
+			AttributeStatusCode: http.StatusBadRequest,
+		}},
+		{name: "gobits.close-session", attrs: map[string]interface{}{
+			AttributeSessionID:  uuid,
+			AttributeStatusCode: http.StatusOK,
+		}},
+	}
+
+	// pings aren't traced
+	if len(tracer.spans) != len(expected) {
+		t.Fatalf("expected %v spans, got %v", len(expected), len(tracer.spans))
+	}
+	for i, e := range expected {
+		span := tracer.spans[i]
+		if span.name != e.name || !span.ended {
+			t.Errorf("span %v: expected %v to be ended, got %v ended %v", i, e.name, span.name, span.ended)
+		}
+		if (span.err != nil) != e.err {
+			t.Errorf("span %v: unexpected error %v", i, span.err)
+		}
+		if len(span.attrs) != len(e.attrs) {
+			t.Errorf("span %v: expected attributes %v, got %v", i, e.attrs, span.attrs)
+		}
+		for k, v := range e.attrs {
+			if span.attrs[k] != v {
+				t.Errorf("span %v: expected %v to be %v, got %v", i, k, v, span.attrs[k])
+			}
+		}
+	}
+
+	// the trace context of the request is the parent
+	if tracer.spans[0].parent != traceparent {
+		t.Errorf("expected the span to continue %v, got %q", traceparent, tracer.spans[0].parent)
+	}
+
+}
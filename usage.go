@@ -0,0 +1,93 @@
+package gobits
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Stats are statistics of a handler, for monitoring
+type Stats struct {
+	TempDirSize  uint64 // Bytes held in TempDir, only tracked when Config.MaxTempDirSize is set
+	Fragments    int    // Fragments being handled
+	AuditErrors  uint64 // Audit records the AuditWriter failed to write
+	AuditDropped uint64 // Audit records dropped because the AuditWriter couldn't keep up
+
+	// Tenants are the statistics of each tenant since the start, with Config.TenantResolver
+	Tenants map[string]TenantStats
+}
+
+// Stats returns the current statistics of the handler
+func (b *Handler) Stats() Stats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return Stats{
+		TempDirSize:  b.usage,
+		Fragments:    b.inflight,
+		AuditErrors:  b.auditErrors.Load(),
+		AuditDropped: b.auditDropped.Load(),
+		Tenants:      b.tenantsStats(),
+	}
+}
+
+// add n bytes to the TempDir usage, unless it would exceed the budget. The bytes are held by
+// the session until they are released
+func (b *Handler) reserve(s *session, n uint64) bool {
+	if b.cfg.MaxTempDirSize == 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.usage+n > b.cfg.MaxTempDirSize {
+		return false
+	}
+	b.usage += n
+	s.size += n
+	return true
+}
+
+// remove n bytes held by a session from the TempDir usage
+func (b *Handler) release(s *session, n uint64) {
+	if b.cfg.MaxTempDirSize == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if n > s.size {
+		n = s.size
+	}
+	s.size -= n
+	if n > b.usage {
+		n = b.usage
+	}
+	b.usage -= n
+}
+
+// release the bytes of a file that is about to be replaced or removed, if it exists
+func (b *Handler) releaseFile(s *session, path string) {
+	if b.cfg.MaxTempDirSize == 0 {
+		return
+	}
+	if info, err := b.fs.Stat(path); err == nil {
+		b.release(s, uint64(info.Size()))
+	}
+}
+
+// get the total size of the files in a directory and its subdirectories, zero if it doesn't exist.
+// The session metadata isn't counted
+func dirSize(dir string) (uint64, error) {
+	var size uint64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() && !strings.HasPrefix(info.Name(), metadataFile) {
+			size += uint64(info.Size())
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	return size, err
+}
@@ -0,0 +1,119 @@
+package gobits
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMaxTempDirSize(t *testing.T) {
+
+	h := newTestHandler(t, Config{MaxTempDirSize: 10}, nil)
+	uuid := createSession(t, h)
+
+	expectUsage := func(size uint64) {
+		t.Helper()
+		if usage := h.Stats().TempDirSize; usage != size {
+			t.Errorf("expected %v bytes in the TempDir, got %v", size, usage)
+		}
+	}
+
+	res := sendFragment(h, uuid, "first.txt", []byte("0123"), 0, 8)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("fragment failed: %v", res.Status)
+	}
+	expectUsage(4)
+
+	// a retried fragment doesn't count twice
+	res = sendFragment(h, uuid, "first.txt", []byte("0123"), 0, 8)
+	res.Body.Close()
+	expectUsage(4)
+
+	// a fragment beyond the budget is rejected
+	res = sendFragment(h, uuid, "second.txt", []byte("0123456789"), 0, 10)
+	res.Body.Close()
+	if res.StatusCode != http.StatusInsufficientStorage {
+		t.Errorf("expected status %v, got %v", http.StatusInsufficientStorage, res.StatusCode)
+	}
+	if context := res.Header.Get("BITS-Error-Context"); context != "4" {
+		t.Errorf("expected error context 4, got %q", context)
+	}
+	expectUsage(4)
+
+	// up to the budget is fine
+	res = sendFragment(h, uuid, "second.txt", []byte("012345"), 0, 6)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("fragment failed: %v", res.Status)
+	}
+	expectUsage(10)
+
+	// the unfinished file is removed when the session is closed, but the completed file is kept
+	res = doPacket(h, "Close-Session", uuid, "/BITS/", nil, nil)
+	res.Body.Close()
+	expectUsage(6)
+
+	// until the session is terminated
+	uuid = createSession(t, h)
+	res = sendFragment(h, uuid, "third.txt", []byte("0123"), 0, 4)
+	res.Body.Close()
+	expectUsage(10)
+	if err := h.TerminateSession(uuid); err != nil {
+		t.Fatal(err)
+	}
+	expectUsage(6)
+
+}
+
+func TestMaxTempDirSizeDestDir(t *testing.T) {
+
+	h := newTestHandler(t, Config{MaxTempDirSize: 10, DestDir: t.TempDir()}, nil)
+	uuid := createSession(t, h)
+
+	// files moved out of the TempDir don't count
+	for i := 0; i < 3; i++ {
+		res := sendFragment(h, uuid, "file.txt", []byte("01234567"), 0, 8)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("fragment %v failed: %v", i, res.Status)
+		}
+		if usage := h.Stats().TempDirSize; usage != 0 {
+			t.Errorf("expected an empty TempDir, got %v bytes", usage)
+		}
+	}
+
+}
+
+func TestMaxTempDirSizeScan(t *testing.T) {
+
+	// what is in the TempDir at startup counts
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "session"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "session", "file.txt"), []byte("012345"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "session", metadataFile), []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := NewHandler(Config{TempDir: dir, MaxTempDirSize: 10}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage := h.Stats().TempDirSize; usage != 6 {
+		t.Errorf("expected 6 bytes in the TempDir, got %v", usage)
+	}
+
+	// and the usage isn't tracked without a budget
+	if h, err = NewHandler(Config{TempDir: dir}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if usage := h.Stats().TempDirSize; usage != 0 {
+		t.Errorf("expected the usage not to be tracked, got %v", usage)
+	}
+
+}
@@ -0,0 +1,48 @@
+package gobits
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// codeDescriptions explain the BITS error codes in the bodies written with VerboseErrors
+var codeDescriptions = map[int]string{
+	codeAccessDenied:    "the file is rejected",
+	codeInvalidData:     "the declared length of the file changed",
+	codeNotSupported:    "none of the offered protocols are supported",
+	codeInvalidArgument: "no protocols are offered",
+	codeMoreData:        "the session is closed before all files are complete",
+	codeSessionNotFound: "the session doesn't exist or is closed or canceled",
+	codeInvalidOwner:    "the session was created by another client",
+}
+
+// verboseWriter writes a plain text description of BITS errors in the body of the reply, for
+// debugging with tools like curl. The headers are still what clients go by
+type verboseWriter struct {
+	http.ResponseWriter
+}
+
+func (v *verboseWriter) WriteHeader(status int) {
+	code := v.Header().Get("BITS-Error-Code")
+	if status < http.StatusBadRequest || code == "" {
+		v.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	description := fmt.Sprintf("%d %s", status, http.StatusText(status))
+	if n, err := strconv.ParseUint(code, 16, 32); err == nil && codeDescriptions[int(n)] != "" {
+		description += ": " + codeDescriptions[int(n)]
+	}
+	description += fmt.Sprintf(" (BITS-Error-Code 0x%s, BITS-Error-Context 0x%s)\n", code, v.Header().Get("BITS-Error-Context"))
+
+	v.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	v.Header().Set("X-Content-Type-Options", "nosniff")
+	v.ResponseWriter.WriteHeader(status)
+	v.ResponseWriter.Write([]byte(description))
+}
+
+// Unwrap returns the original ResponseWriter, for use by http.ResponseController
+func (v *verboseWriter) Unwrap() http.ResponseWriter {
+	return v.ResponseWriter
+}
@@ -0,0 +1,49 @@
+package gobits
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestVerboseErrors(t *testing.T) {
+
+	testcases := []struct {
+		name    string
+		verbose bool
+		body    string
+	}{
+		{"verbose", true, "404 Not Found: the session doesn't exist or is closed or canceled (BITS-Error-Code 0x80070490, BITS-Error-Context 0x5)\n"},
+		{"quiet", false, ""},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newTestHandler(t, Config{VerboseErrors: tc.verbose}, nil)
+
+			res := doPacket(h, "Close-Session", "00000000-0000-4000-8000-000000000000", "/BITS/", nil, nil)
+			defer res.Body.Close()
+			if res.StatusCode != http.StatusNotFound {
+				t.Fatalf("expected status %v, got %v", http.StatusNotFound, res.StatusCode)
+			}
+			if res.Header.Get("BITS-Error-Code") != "80070490" {
+				t.Errorf("unexpected error code %q", res.Header.Get("BITS-Error-Code"))
+			}
+			body, _ := io.ReadAll(res.Body)
+			if string(body) != tc.body {
+				t.Errorf("expected body %q, got %q", tc.body, body)
+			}
+			if tc.verbose && !strings.HasPrefix(res.Header.Get("Content-Type"), "text/plain") {
+				t.Errorf("unexpected content type %q", res.Header.Get("Content-Type"))
+			}
+		})
+	}
+
+	// successful replies are left alone
+	h := newTestHandler(t, Config{VerboseErrors: true}, nil)
+	res := doPacket(h, "Ping", "", "/BITS/", nil, nil)
+	defer res.Body.Close()
+	if body, _ := io.ReadAll(res.Body); len(body) != 0 {
+		t.Errorf("expected an empty body, got %q", body)
+	}
+}
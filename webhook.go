@@ -0,0 +1,102 @@
+package gobits
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// webhookQueueSize is the number of events waiting for delivery before new ones are dropped
+const webhookQueueSize = 1024
+
+// webhookAttempts is the number of times an event is sent before it is dropped
+const webhookAttempts = 5
+
+// webhookBackoff is the wait before the first retry, it doubles with each retry. It is a
+// variable so tests don't have to wait
+var webhookBackoff = time.Second
+
+// webhookEvent is an event waiting for delivery, the same JSON object as in the audit log
+type webhookEvent struct {
+	session string
+	event   string
+	payload []byte
+}
+
+// queue an event for the webhook, dropping it if the queue is full
+func (b *Handler) notify(record auditRecord, payload []byte) {
+	select {
+	case b.webhooks <- webhookEvent{session: record.Session, event: record.Event, payload: payload}:
+	default:
+		b.webhookDropped(webhookEvent{session: record.Session, event: record.Event}, "queue full")
+	}
+}
+
+// deliver the queued events to the webhook one at a time. Once ctx is done, the events left are
+// dropped
+func (b *Handler) deliverWebhooks(ctx context.Context) {
+	defer b.workers.Done()
+	for e := range b.webhooks {
+		var err error
+		for attempt := 0; attempt < webhookAttempts; attempt++ {
+			if attempt > 0 {
+				select {
+				case <-time.After(webhookBackoff << (attempt - 1)):
+				case <-ctx.Done():
+				}
+			}
+			if err = b.postWebhook(ctx, e); err == nil || ctx.Err() != nil {
+				break
+			}
+		}
+		if err != nil {
+			b.webhookDropped(e, err.Error())
+		}
+	}
+}
+
+// post an event to the webhook, signed with the secret
+func (b *Handler) postWebhook(ctx context.Context, e webhookEvent) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.cfg.WebhookURL, bytes.NewReader(e.payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-GoBITS-Event", e.event)
+	if b.cfg.WebhookSecret != nil {
+		req.Header.Set("X-GoBITS-Signature", "sha256="+signPayload(b.cfg.WebhookSecret, e.payload))
+	}
+	res, err := b.cfg.WebhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("webhook replied %v", res.Status)
+	}
+	return nil
+}
+
+// count and log an event that couldn't be delivered
+func (b *Handler) webhookDropped(e webhookEvent, reason string) {
+	b.metrics.IncCounter(MetricWebhooksDropped, nil, 1)
+	if b.cfg.Logger != nil {
+		b.cfg.Logger.LogAttrs(context.Background(), slog.LevelWarn, "webhook dropped",
+			slog.String(LogKeySession, e.session),
+			slog.String(LogKeyReason, reason),
+		)
+	}
+}
+
+// sign a payload with HMAC-SHA256, as hex
+func signPayload(secret, payload []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
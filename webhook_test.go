@@ -0,0 +1,207 @@
+package gobits
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver fails the first attempts of each event, and keeps the events it accepts
+type webhookReceiver struct {
+	mu       sync.Mutex
+	failures int            // attempts to fail for each event
+	attempts map[string]int // by body
+	events   []auditRecord
+	headers  []http.Header
+}
+
+func (wr *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	wr.attempts[string(body)]++
+	if wr.attempts[string(body)] <= wr.failures {
+		http.Error(w, "try again", http.StatusServiceUnavailable)
+		return
+	}
+	var record auditRecord
+	if err := json.Unmarshal(body, &record); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	wr.events = append(wr.events, record)
+	wr.headers = append(wr.headers, r.Header.Clone())
+}
+
+// wait until the receiver has n events
+func (wr *webhookReceiver) wait(n int) []auditRecord {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		wr.mu.Lock()
+		events := wr.events
+		wr.mu.Unlock()
+		if len(events) >= n {
+			return events
+		}
+		time.Sleep(time.Millisecond)
+	}
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	return wr.events
+}
+
+func TestWebhook(t *testing.T) {
+
+	webhookBackoff = time.Millisecond
+	defer func() { webhookBackoff = time.Second }()
+
+	receiver := &webhookReceiver{failures: 2, attempts: make(map[string]int)}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	secret := []byte("shared secret")
+	h := newTestHandler(t, Config{WebhookURL: server.URL, WebhookSecret: secret, HashFiles: true}, nil)
+	uuid := createSession(t, h)
+	res := sendFragment(h, uuid, "file.txt", []byte("data"), 0, 4)
+	res.Body.Close()
+	res = doPacket(h, "Close-Session", uuid, "/BITS/", nil, nil)
+	res.Body.Close()
+
+	// every event is delivered after the failed attempts
+	events := receiver.wait(3)
+	if len(events) != 3 {
+		t.Fatalf("expected 3 events, got %v", events)
+	}
+	for i, event := range []string{"create-session", "receive-file", "close-session"} {
+		if events[i].Event != event || events[i].Session != uuid {
+			t.Errorf("event %v: expected %v of %v, got %+v", i, event, uuid, events[i])
+		}
+		if got := receiver.headers[i].Get("X-GoBITS-Event"); got != event {
+			t.Errorf("event %v: expected the event header %v, got %v", i, event, got)
+		}
+	}
+	file := events[1]
+	if file.Filename != "file.txt" || file.Bytes != 4 || file.Hash == "" {
+		t.Errorf("unexpected file event %+v", file)
+	}
+	for body, attempts := range receiver.attempts {
+		if attempts != 3 {
+			t.Errorf("expected 3 attempts of %v, got %v", body, attempts)
+		}
+	}
+
+	// the signature is the HMAC of the body
+	payload, _ := json.Marshal(file)
+	if got := receiver.headers[1].Get("X-GoBITS-Signature"); got != "sha256="+signPayload(secret, payload) {
+		t.Errorf("invalid signature %v", got)
+	}
+
+}
+
+func TestWebhookDropped(t *testing.T) {
+
+	webhookBackoff = time.Millisecond
+	defer func() { webhookBackoff = time.Second }()
+
+	receiver := &webhookReceiver{failures: webhookAttempts, attempts: make(map[string]int)}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	metrics := newFakeMetrics()
+	h := newTestHandler(t, Config{WebhookURL: server.URL, Metrics: metrics}, nil)
+
+	// the fragment isn't held up by the failing webhook
+	start := time.Now()
+	uuid := createSession(t, h)
+	res := sendFragment(h, uuid, "file.txt", []byte("data"), 0, 4)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || time.Since(start) > 100*time.Millisecond {
+		t.Errorf("fragment held up by the webhook: %v in %v", res.Status, time.Since(start))
+	}
+
+	// the events are dropped after the last attempt
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		metrics.mu.Lock()
+		dropped := metrics.counters[MetricWebhooksDropped]
+		metrics.mu.Unlock()
+		if dropped == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	if metrics.counters[MetricWebhooksDropped] != 2 {
+		t.Errorf("expected 2 events dropped, got %v", metrics.counters[MetricWebhooksDropped])
+	}
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	if len(receiver.events) != 0 {
+		t.Errorf("unexpected events delivered: %v", receiver.events)
+	}
+
+}
+
+func TestWebhookClose(t *testing.T) {
+
+	webhookBackoff = time.Millisecond
+	defer func() { webhookBackoff = time.Second }()
+
+	// the queued events are delivered before Close returns
+	receiver := &webhookReceiver{failures: 1, attempts: make(map[string]int)}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	audit := &syncBuffer{}
+	h, err := NewHandler(Config{TempDir: t.TempDir(), WebhookURL: server.URL, AuditWriter: audit}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uuid := createSession(t, h)
+	res := doPacket(h, "Close-Session", uuid, "/BITS/", nil, nil)
+	res.Body.Close()
+	if err = h.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	receiver.mu.Lock()
+	if len(receiver.events) != 2 {
+		t.Errorf("expected 2 events delivered, got %v", receiver.events)
+	}
+	receiver.mu.Unlock()
+	if lines := strings.Count(audit.String(), "\n"); lines != 2 {
+		t.Errorf("expected 2 audit records, got %v", lines)
+	}
+
+	// events after Close only go to the callbacks
+	createSession(t, h)
+
+	// the events left are dropped when Close gives up
+	webhookBackoff = time.Hour
+	receiver = &webhookReceiver{failures: webhookAttempts, attempts: make(map[string]int)}
+	server = httptest.NewServer(receiver)
+	defer server.Close()
+	metrics := newFakeMetrics()
+	h, err = NewHandler(Config{TempDir: t.TempDir(), WebhookURL: server.URL, Metrics: metrics}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	createSession(t, h)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err = h.Close(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected Close to give up, got %v", err)
+	}
+	h.workers.Wait()
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	if metrics.counters[MetricWebhooksDropped] != 1 {
+		t.Errorf("expected the event to be dropped, got %v", metrics.counters[MetricWebhooksDropped])
+	}
+}